@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditEvent is an entry of the audit log
+type auditEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Bucket   string    `json:"bucket"`
+	Key      string    `json:"key"`
+	Share    string    `json:"share,omitempty"`    // Key of the share concerned
+	Provider int       `json:"provider,omitempty"` // Suspect provider, starting at 1 like client1
+	Reason   string    `json:"reason"`
+}
+
+// Audit events
+const (
+	auditShareTampered    = "share-tampered"
+	auditManifestTampered = "manifest-tampered"
+)
+
+// auditLog records security relevant events, such as data of an untrusted
+// provider failing its integrity check, as JSON lines. A nil *auditLog only
+// writes to the standard log.
+type auditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// openAuditLog opens the audit log at path for appending
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{w: f}, nil
+}
+
+// record writes event to the audit log
+func (a *auditLog) record(event auditEvent) {
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	log.Printf("AUDIT %s: bucket=%s key=%s share=%s provider=%d: %s",
+		event.Event, event.Bucket, event.Key, event.Share, event.Provider, event.Reason)
+	if a == nil {
+		return
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode audit event: %v", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+	}
+}
@@ -87,10 +87,12 @@ func CreateS3Client(cfg S3ClientConfig, localMinio bool) *s3.Client {
 		MaxIdleConns:        100,
 		IdleConnTimeout:     90 * time.Second,
 		TLSHandshakeTimeout: 10 * time.Second,
+		// Bodies of shares take as long as the client sending or
+		// receiving the object, only the response must start in time
+		ResponseHeaderTimeout: 30 * time.Second,
 	}
 	httpClient := &http.Client{
 		Transport: tr,
-		Timeout:   30 * time.Second,
 	}
 
 	// Create custom endpoint resolver
@@ -5,6 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"maps"
+	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,41 +22,39 @@ import (
 func (self *MyBackend) ListBuckets(ctx context.Context, input s3response.ListBucketsInput) (s3response.ListAllMyBucketsResult, error) {
 	log.Printf("MyBackend.ListBuckets(%v, %v)", ctx, input)
 
-	// Get buckets from both storage systems
-	output1, err := self.client1.ListBuckets(ctx, &s3.ListBucketsInput{})
+	// Get buckets from all storage systems
+	listed, err := self.listProviderBuckets(ctx)
 	if err != nil {
 		return s3response.ListAllMyBucketsResult{}, handleError(err)
 	}
 
-	output2, err := self.client2.ListBuckets(ctx, &s3.ListBucketsInput{})
-	if err != nil {
-		return s3response.ListAllMyBucketsResult{}, handleError(err)
+	// Track the earliest creation date and the number of storage systems
+	// of every bucket
+	creationDates := make(map[string]time.Time)
+	counts := make(map[string]int)
+	for _, buckets := range listed {
+		for _, b := range buckets {
+			date, exists := creationDates[*b.Name]
+			if !exists || b.CreationDate.Before(date) {
+				creationDates[*b.Name] = *b.CreationDate
+			}
+			counts[*b.Name]++
+		}
 	}
 
-	// Create maps to track buckets in each system
-	buckets1 := make(map[string]time.Time)
-	buckets2 := make(map[string]time.Time)
-
-	// Populate maps with bucket names and creation dates
-	for _, b := range output1.Buckets {
-		buckets1[*b.Name] = *b.CreationDate
-	}
-	for _, b := range output2.Buckets {
-		buckets2[*b.Name] = *b.CreationDate
+	// Buckets missing on some storage systems cannot be used until they
+	// are reconciled
+	for _, b := range asymmetricBuckets(listed) {
+		log.Printf("Warning: bucket '%s' exists in storage systems %v only, see --reconcile-buckets", b.Bucket, b.Present)
 	}
 
-	// Find buckets that exist in both systems
+	// Find buckets that exist in all systems
 	var commonBuckets []s3response.ListAllMyBucketsEntry
-	for name, date1 := range buckets1 {
-		if date2, exists := buckets2[name]; exists {
-			// Use the earlier creation date
-			creationDate := date1
-			if date2.Before(date1) {
-				creationDate = date2
-			}
+	for _, b := range listed[0] {
+		if counts[*b.Name] == len(self.clients) {
 			commonBuckets = append(commonBuckets, s3response.ListAllMyBucketsEntry{
-				Name:         name,
-				CreationDate: creationDate,
+				Name:         *b.Name,
+				CreationDate: creationDates[*b.Name],
 			})
 		}
 	}
@@ -71,58 +72,97 @@ func (self *MyBackend) ListBuckets(ctx context.Context, input s3response.ListBuc
 func (self *MyBackend) CreateBucket(
 	ctx context.Context, input *s3.CreateBucketInput, data []byte,
 ) error {
-	// Check if bucket already exists in either storage system
-	_, err1 := self.client1.HeadBucket(ctx, &s3.HeadBucketInput{
-		Bucket: input.Bucket,
-	})
-	if err1 == nil {
-		return fmt.Errorf("bucket '%s' already exists in first storage system", *input.Bucket)
+	// Check if bucket already exists in any storage system. A bucket that
+	// exists in some of them only, e.g. because its creation was
+	// interrupted, is adopted if it is empty there.
+	existing := make([]bool, len(self.clients))
+	adopted := 0
+	for i, client := range self.clients {
+		_, err := client.HeadBucket(ctx, &s3.HeadBucketInput{
+			Bucket: input.Bucket,
+		})
+		if err == nil {
+			existing[i] = true
+			adopted++
+		}
+	}
+	for i, client := range self.clients {
+		if !existing[i] {
+			continue
+		}
+		empty := false
+		if adopted < len(self.clients) {
+			var err error
+			if empty, err = bucketEmpty(ctx, client, *input.Bucket); err != nil {
+				return handleError(err)
+			}
+		}
+		if !empty {
+			return fmt.Errorf("bucket '%s' already exists in storage system %d", *input.Bucket, i+1)
+		}
 	}
 
-	_, err2 := self.client2.HeadBucket(ctx, &s3.HeadBucketInput{
-		Bucket: input.Bucket,
-	})
-	if err2 == nil {
-		return fmt.Errorf("bucket '%s' already exists in second storage system", *input.Bucket)
+	// The bucket is removed again at startup if the gateway stops before
+	// it exists in all storage systems
+	intent, err := self.journal.begin(journalEntry{Op: intentCreateBucket, Bucket: *input.Bucket})
+	if err != nil {
+		return err
 	}
 
-	// Create bucket in both storage systems
-	_, err1 = self.client1.CreateBucket(ctx, input)
-	if err1 != nil {
-		return fmt.Errorf("failed to create bucket '%s' in first storage system: %v", *input.Bucket, err1)
+	// Create bucket in all storage systems
+	for i, client := range self.clients {
+		if existing[i] {
+			continue
+		}
+		_, err := client.CreateBucket(ctx, input)
+		if err != nil {
+			// If a creation fails, try to clean up the buckets created so far
+			cleaned := true
+			for j, created := range self.clients[:i] {
+				if existing[j] {
+					continue
+				}
+				_, delErr := created.DeleteBucket(context.WithoutCancel(ctx), &s3.DeleteBucketInput{
+					Bucket: input.Bucket,
+				})
+				cleaned = cleaned && delErr == nil
+			}
+			if cleaned {
+				self.journal.end(intent)
+			}
+			return fmt.Errorf("failed to create bucket '%s' in storage system %d: %v", *input.Bucket, i+1, err)
+		}
 	}
 
-	_, err2 = self.client2.CreateBucket(ctx, input)
-	if err2 != nil {
-		// If second creation fails, try to clean up the first bucket
-		_, _ = self.client1.DeleteBucket(ctx, &s3.DeleteBucketInput{
-			Bucket: input.Bucket,
-		})
-		return fmt.Errorf("failed to create bucket '%s' in second storage system: %v", *input.Bucket, err2)
+	// Adopted buckets start without the tags they had, so that the new
+	// bucket uses the default settings in all storage systems
+	if adopted > 0 {
+		log.Printf("Adopted the empty bucket '%s' in %d storage systems", *input.Bucket, adopted)
+		defer self.buckets.Delete(*input.Bucket)
+		if err := self.putBucketTags(ctx, *input.Bucket, nil); err != nil {
+			return err
+		}
 	}
 
+	self.journal.end(intent)
 	return nil
 }
 
 func (self *MyBackend) DeleteBucket(ctx context.Context, bucket string) error {
-	// Check if bucket exists in both storage systems
+	// Check if bucket exists in the storage systems
 	if err := self.checkBucketAccess(ctx, bucket); err != nil {
 		return err
 	}
 
-	// Delete bucket from both storage systems
-	_, err1 := self.client1.DeleteBucket(ctx, &s3.DeleteBucketInput{
-		Bucket: aws.String(bucket),
-	})
-	if err1 != nil {
-		return fmt.Errorf("failed to delete bucket '%s' from first storage system: %v", bucket, err1)
-	}
-
-	_, err2 := self.client2.DeleteBucket(ctx, &s3.DeleteBucketInput{
-		Bucket: aws.String(bucket),
-	})
-	if err2 != nil {
-		return fmt.Errorf("failed to delete bucket '%s' from second storage system: %v", bucket, err2)
+	// Delete bucket from all storage systems
+	defer self.buckets.Delete(bucket)
+	for i, client := range self.clients {
+		_, err := client.DeleteBucket(ctx, &s3.DeleteBucketInput{
+			Bucket: aws.String(bucket),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to delete bucket '%s' from storage system %d: %v", bucket, i+1, err)
+		}
 	}
 
 	return nil
@@ -137,8 +177,27 @@ func (self *MyBackend) GetBucketAcl(
 		input.ExpectedBucketOwner = nil
 	}
 
-	tagout, err := self.client1.GetBucketTagging(ctx, &s3.GetBucketTaggingInput{
-		Bucket: input.Bucket,
+	tags, err := self.bucketTags(ctx, *input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	if value, ok := tags[aclKey]; ok {
+		acl, err := Base64Decode(value)
+		if err != nil {
+			return nil, handleError(err)
+		}
+		return acl, nil
+	}
+
+	return []byte{}, nil
+}
+
+// bucketTags returns the tags of a bucket as stored on the first storage
+// system, a bucket without tags has an empty map
+func (self *MyBackend) bucketTags(ctx context.Context, bucket string) (map[string]string, error) {
+	tagout, err := self.clients[0].GetBucketTagging(ctx, &s3.GetBucketTaggingInput{
+		Bucket: aws.String(bucket),
 	})
 	if err != nil {
 		var ae smithy.APIError
@@ -146,26 +205,119 @@ func (self *MyBackend) GetBucketAcl(
 			// sdk issue workaround for missing NoSuchTagSet error type
 			// https://github.com/aws/aws-sdk-go-v2/issues/2878
 			if strings.Contains(ae.ErrorCode(), "NoSuchTagSet") {
-				return []byte{}, nil
+				return map[string]string{}, nil
 			}
 			if strings.Contains(ae.ErrorCode(), "NotImplemented") {
-				return []byte{}, nil
+				return map[string]string{}, nil
 			}
 		}
 		return nil, handleError(err)
 	}
 
+	tags := make(map[string]string, len(tagout.TagSet))
 	for _, tag := range tagout.TagSet {
-		if *tag.Key == aclKey {
-			acl, err := Base64Decode(*tag.Value)
-			if err != nil {
-				return nil, handleError(err)
+		tags[*tag.Key] = *tag.Value
+	}
+	return tags, nil
+}
+
+// putBucketTags replaces the tags of a bucket on all storage systems
+func (self *MyBackend) putBucketTags(ctx context.Context, bucket string, tags map[string]string) error {
+	for i, client := range self.clients {
+		var err error
+		if len(tags) == 0 {
+			_, err = client.DeleteBucketTagging(ctx, &s3.DeleteBucketTaggingInput{
+				Bucket: aws.String(bucket),
+			})
+		} else {
+			tagSet := make([]types.Tag, 0, len(tags))
+			for k, v := range tags {
+				tagSet = append(tagSet, types.Tag{Key: aws.String(k), Value: aws.String(v)})
 			}
-			return acl, nil
+			_, err = client.PutBucketTagging(ctx, &s3.PutBucketTaggingInput{
+				Bucket:  aws.String(bucket),
+				Tagging: &types.Tagging{TagSet: tagSet},
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to tag bucket '%s' in storage system %d: %w", bucket, i+1, err)
 		}
 	}
+	return nil
+}
 
-	return []byte{}, nil
+// bucketSettings holds how the objects of a bucket are stored
+type bucketSettings struct {
+	scheme ShareScheme
+	names  *keyNames // nil if the keys are not hidden
+}
+
+// parseBucketSettings returns the settings of a bucket with the given tags:
+// the share scheme selected by its schemeKey tag, or the default scheme if
+// it has none, and whether its keys are hidden according to hideKeysKey.
+func (self *MyBackend) parseBucketSettings(bucket string, tags map[string]string) (*bucketSettings, error) {
+	settings := &bucketSettings{scheme: self.scheme}
+	if name, ok := tags[schemeKey]; ok {
+		scheme, err := parseScheme(name, len(self.clients))
+		if err == nil {
+			err = checkProviders(scheme, len(self.clients))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s tag: %v", schemeKey, err)
+		}
+		settings.scheme = scheme
+	}
+	if value, ok := tags[hideKeysKey]; ok {
+		hide, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s tag: %q is not a boolean", hideKeysKey, value)
+		}
+		if hide {
+			if len(self.namesKey) == 0 {
+				return nil, fmt.Errorf("invalid %s tag: hiding keys requires a key encryption key or MAC key", hideKeysKey)
+			}
+			settings.names = newKeyNames(self.namesKey, bucket)
+		}
+	}
+	return settings, nil
+}
+
+// settings returns the settings of a bucket as selected by its tags
+func (self *MyBackend) settings(ctx context.Context, bucket string) (*bucketSettings, error) {
+	if settings, ok := self.buckets.Load(bucket); ok {
+		return settings.(*bucketSettings), nil
+	}
+
+	tags, err := self.bucketTags(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := self.parseBucketSettings(bucket, tags)
+	if err != nil {
+		return nil, fmt.Errorf("bucket '%s' has an %v", bucket, err)
+	}
+	if err := checkPlacement(settings.scheme); err != nil {
+		log.Printf("Warning: bucket '%s' loses objects with a single storage system: %v", bucket, err)
+	}
+	self.buckets.Store(bucket, settings)
+	return settings, nil
+}
+
+// bucketEmpty reports whether no storage system holds an object in the bucket
+func (self *MyBackend) bucketEmpty(ctx context.Context, bucket string) (bool, error) {
+	for _, client := range self.clients {
+		output, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:  aws.String(bucket),
+			MaxKeys: aws.Int32(1),
+		})
+		if err != nil {
+			return false, handleError(err)
+		}
+		if len(output.Contents) > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
 }
 
 func (MyBackend) ChangeBucketOwner(ctx context.Context, bucket string, acl []byte) error {
@@ -183,9 +335,11 @@ func (MyBackend) DeleteBucketPolicy(ctx context.Context, bucket string) error {
 	return s3err.GetAPIError(s3err.ErrNotImplemented)
 }
 
-func (MyBackend) DeleteBucketTagging(ctx context.Context, bucket string) error {
+// DeleteBucketTagging removes the tags set by users, the tags holding the
+// ACL and the settings of the bucket are kept
+func (self *MyBackend) DeleteBucketTagging(ctx context.Context, bucket string) error {
 	log.Printf("MyBackend.DeleteBucketTagging(%v, %v)", ctx, bucket)
-	return s3err.GetAPIError(s3err.ErrNotImplemented)
+	return self.PutBucketTagging(ctx, bucket, map[string]string{})
 }
 
 func (MyBackend) GetBucketPolicy(ctx context.Context, bucket string) ([]byte, error) {
@@ -193,9 +347,9 @@ func (MyBackend) GetBucketPolicy(ctx context.Context, bucket string) ([]byte, er
 	return nil, s3err.GetAPIError(s3err.ErrNotImplemented)
 }
 
-func (MyBackend) GetBucketTagging(ctx context.Context, bucket string) (map[string]string, error) {
+func (self *MyBackend) GetBucketTagging(ctx context.Context, bucket string) (map[string]string, error) {
 	log.Printf("MyBackend.GetBucketTagging(%v, %v)", ctx, bucket)
-	return nil, s3err.GetAPIError(s3err.ErrNotImplemented)
+	return self.bucketTags(ctx, bucket)
 }
 
 func (MyBackend) GetBucketVersioning(ctx context.Context, bucket string) (s3response.GetBucketVersioningOutput, error) {
@@ -236,7 +390,7 @@ func (MyBackend) HeadBucket(ctx context.Context, input *s3.HeadBucketInput) (*s3
 
 func (self *MyBackend) checkBucketAccess(ctx context.Context, bucket string) error {
 	// Check first storage system
-	_, err1 := self.client1.HeadBucket(ctx, &s3.HeadBucketInput{
+	_, err1 := self.clients[0].HeadBucket(ctx, &s3.HeadBucketInput{
 		Bucket: aws.String(bucket),
 	})
 	if err1 != nil {
@@ -255,9 +409,65 @@ func (self *MyBackend) checkBucketAccess(ctx context.Context, bucket string) err
 	return nil
 }
 
-func (MyBackend) PutBucketTagging(ctx context.Context, bucket string, tags map[string]string) error {
+// PutBucketTagging replaces the tags of a bucket. The schemeKey tag selects
+// the share scheme and the hideKeysKey tag hides the keys from the
+// providers, they can only be changed while the bucket is empty as the
+// shares of existing objects would no longer be found. The tags holding
+// the ACL and the bucket settings are kept unless they are given.
+func (self *MyBackend) PutBucketTagging(ctx context.Context, bucket string, tags map[string]string) error {
 	log.Printf("MyBackend.PutBucketTagging(%v, %v)", ctx, bucket)
-	return s3err.GetAPIError(s3err.ErrNotImplemented)
+
+	current, err := self.bucketTags(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	tags = maps.Clone(tags)
+	if tags == nil {
+		tags = make(map[string]string)
+	}
+	for _, key := range []string{aclKey, schemeKey, hideKeysKey} {
+		if _, ok := tags[key]; !ok {
+			if value, ok := current[key]; ok {
+				tags[key] = value
+			}
+		}
+	}
+
+	settings, err := self.parseBucketSettings(bucket, tags)
+	if err == nil {
+		err = checkPlacement(settings.scheme)
+	}
+	if err != nil {
+		return s3err.APIError{
+			Code:           "InvalidTag",
+			Description:    fmt.Sprintf("Invalid bucket settings: %v", err),
+			HTTPStatusCode: http.StatusBadRequest,
+		}
+	}
+	currentSettings, err := self.settings(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	if settings.scheme.name() != currentSettings.scheme.name() ||
+		settings.names.hidden() != currentSettings.names.hidden() {
+		empty, err := self.bucketEmpty(ctx, bucket)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return s3err.APIError{
+				Code:           "InvalidRequest",
+				Description:    "The share scheme and key hiding of a bucket can only be changed while it is empty",
+				HTTPStatusCode: http.StatusConflict,
+			}
+		}
+	}
+
+	defer self.buckets.Delete(bucket)
+	if err := self.putBucketTags(ctx, bucket, tags); err != nil {
+		return handleError(err)
+	}
+	return nil
 }
 
 func (MyBackend) ListBucketsAndOwners(ctx context.Context) ([]s3response.Bucket, error) {
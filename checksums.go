@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"math/bits"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/valyala/fasthttp"
+	"github.com/versity/versitygw/s3err"
+)
+
+var (
+	crc32cTable    = crc32.MakeTable(crc32.Castagnoli)
+	crc64NVMETable = crc64.MakeTable(bits.Reverse64(0xad93d23594c93659))
+)
+
+// checksumHashes create the hashes of the additional checksums clients
+// can request for an object
+var checksumHashes = map[types.ChecksumAlgorithm]func() hash.Hash{
+	types.ChecksumAlgorithmCrc32:     func() hash.Hash { return crc32.NewIEEE() },
+	types.ChecksumAlgorithmCrc32c:    func() hash.Hash { return crc32.New(crc32cTable) },
+	types.ChecksumAlgorithmCrc64nvme: func() hash.Hash { return crc64.New(crc64NVMETable) },
+	types.ChecksumAlgorithmSha1:      sha1.New,
+	types.ChecksumAlgorithmSha256:    sha256.New,
+}
+
+// errBadDigest is returned if the data of an upload does not match its
+// Content-MD5
+var errBadDigest = s3err.APIError{
+	Code:           "BadDigest",
+	Description:    "The Content-MD5 you specified did not match what we received.",
+	HTTPStatusCode: http.StatusBadRequest,
+}
+
+// uploadDigests are the digests a client sent with an upload
+type uploadDigests struct {
+	contentMD5 []byte                  // nil if not sent
+	algorithm  types.ChecksumAlgorithm // Of the additional checksum, "" if none is requested
+	checksum   string                  // Expected base64 encoded value, "" to only compute it
+	etag       string                  // ETag kept for the object if not the MD5 of its data, e.g. of one uploaded in parts
+}
+
+// requestContentMD5 returns the decoded Content-MD5 of an upload, nil if
+// it was not sent. versitygw does not pass the header on to the backend,
+// so it is taken from the request if the context is the request.
+func requestContentMD5(ctx context.Context, value *string) ([]byte, error) {
+	encoded := aws.ToString(value)
+	if req, ok := ctx.(*fasthttp.RequestCtx); ok && encoded == "" {
+		encoded = string(req.Request.Header.Peek("Content-MD5"))
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+	sum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sum) != md5.Size {
+		return nil, s3err.GetAPIError(s3err.ErrInvalidDigest)
+	}
+	return sum, nil
+}
+
+// putObjectDigests returns the digests sent with a PutObject request. A
+// checksum value also selects its algorithm.
+func putObjectDigests(ctx context.Context, input *s3.PutObjectInput) (uploadDigests, error) {
+	contentMD5, err := requestContentMD5(ctx, input.ContentMD5)
+	if err != nil {
+		return uploadDigests{}, err
+	}
+	d := uploadDigests{contentMD5: contentMD5, algorithm: input.ChecksumAlgorithm}
+	for _, c := range []struct {
+		algorithm types.ChecksumAlgorithm
+		value     *string
+	}{
+		{types.ChecksumAlgorithmCrc32, input.ChecksumCRC32},
+		{types.ChecksumAlgorithmCrc32c, input.ChecksumCRC32C},
+		{types.ChecksumAlgorithmCrc64nvme, input.ChecksumCRC64NVME},
+		{types.ChecksumAlgorithmSha1, input.ChecksumSHA1},
+		{types.ChecksumAlgorithmSha256, input.ChecksumSHA256},
+	} {
+		if aws.ToString(c.value) != "" {
+			d.algorithm, d.checksum = c.algorithm, *c.value
+			break
+		}
+	}
+	if d.algorithm != "" && checksumHashes[d.algorithm] == nil {
+		return uploadDigests{}, s3err.GetAPIError(s3err.ErrInvalidChecksumAlgorithm)
+	}
+	return d, nil
+}
+
+// objectHasher computes the checksums of an original file while it is
+// written through it: the MD5 of its ETag and the additional checksum the
+// client requested, if any
+type objectHasher struct {
+	digests  uploadDigests
+	md5      hash.Hash
+	checksum hash.Hash // Additional checksum, nil if none is requested
+	w        io.Writer
+}
+
+func newObjectHasher(digests uploadDigests) *objectHasher {
+	h := &objectHasher{digests: digests, md5: md5.New()}
+	h.w = h.md5
+	if newHash := checksumHashes[digests.algorithm]; newHash != nil {
+		h.checksum = newHash()
+		h.w = io.MultiWriter(h.md5, h.checksum)
+	}
+	return h
+}
+
+func (h *objectHasher) Write(p []byte) (int, error) {
+	return h.w.Write(p)
+}
+
+func (h *objectHasher) checksums() manifestChecksums {
+	c := manifestChecksums{MD5: hex.EncodeToString(h.md5.Sum(nil))}
+	if h.checksum != nil {
+		c.Algorithm = h.digests.algorithm
+		c.Checksum = base64.StdEncoding.EncodeToString(h.checksum.Sum(nil))
+	}
+	return c
+}
+
+// verify checks the original file written through the hasher against the
+// digests sent by the client
+func (h *objectHasher) verify() error {
+	if h.digests.contentMD5 != nil && !bytes.Equal(h.digests.contentMD5, h.md5.Sum(nil)) {
+		return errBadDigest
+	}
+	if h.digests.checksum != "" && h.digests.checksum != h.checksums().Checksum {
+		return s3err.GetChecksumBadDigestErr(h.digests.algorithm)
+	}
+	return nil
+}
+
+// value returns the additional checksum for the response field of the
+// given algorithm, nil if the object has no checksum of that algorithm
+func (c manifestChecksums) value(algorithm types.ChecksumAlgorithm) *string {
+	if c.Checksum == "" || c.Algorithm != algorithm {
+		return nil
+	}
+	return aws.String(c.Checksum)
+}
+
+// checksumType returns the type of the additional checksum, which covers
+// the whole object
+func (c manifestChecksums) checksumType() types.ChecksumType {
+	if c.Checksum == "" {
+		return ""
+	}
+	return types.ChecksumTypeFullObject
+}
+
+// etag returns the ETag of an object uploaded at once, the MD5 of its data
+func (c manifestChecksums) etag() string {
+	if c.MD5 == "" {
+		return ""
+	}
+	return `"` + c.MD5 + `"`
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/versity/versitygw/s3err"
+)
+
+func TestChecksumAlgorithms(t *testing.T) {
+	// Check values of the algorithms over "123456789"
+	tests := map[types.ChecksumAlgorithm]string{
+		types.ChecksumAlgorithmCrc32:     "y/Q5Jg==",
+		types.ChecksumAlgorithmCrc32c:    "4waSgw==",
+		types.ChecksumAlgorithmCrc64nvme: "rosUhgp5mIg=",
+		types.ChecksumAlgorithmSha1:      "98O8HYCOBHMq32eZZczDTKeuNEE=",
+		types.ChecksumAlgorithmSha256:    "FeKw08M4keuw8e9gnsQZQgwg4yDOlMZfvIwzEkSOsiU=",
+	}
+	for algorithm, want := range tests {
+		h := newObjectHasher(uploadDigests{algorithm: algorithm, checksum: want})
+		h.Write([]byte("1234"))
+		h.Write([]byte("56789"))
+		c := h.checksums()
+		if c.Algorithm != algorithm || c.Checksum != want {
+			t.Errorf("%s: checksums() = %+v, want %s", algorithm, c, want)
+		}
+		if c.MD5 != "25f9e794323b453885f5181f1b624d0b" {
+			t.Errorf("%s: MD5 = %s", algorithm, c.MD5)
+		}
+		if err := h.verify(); err != nil {
+			t.Errorf("%s: verify() = %v", algorithm, err)
+		}
+	}
+}
+
+func TestChecksumVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		digests uploadDigests
+		want    string // Error code, "" if the data matches
+	}{
+		{"none", uploadDigests{}, ""},
+		{"content md5", uploadDigests{contentMD5: []byte{0x25, 0xf9, 0xe7, 0x94, 0x32, 0x3b, 0x45, 0x38,
+			0x85, 0xf5, 0x18, 0x1f, 0x1b, 0x62, 0x4d, 0x0b}}, ""},
+		{"content md5 mismatch", uploadDigests{contentMD5: make([]byte, 16)}, "BadDigest"},
+		{"computed only", uploadDigests{algorithm: types.ChecksumAlgorithmCrc32}, ""},
+		{"checksum mismatch", uploadDigests{algorithm: types.ChecksumAlgorithmCrc32, checksum: "AAAAAA=="}, "BadDigest"},
+	}
+	for _, tt := range tests {
+		h := newObjectHasher(tt.digests)
+		h.Write([]byte("123456789"))
+		err := h.verify()
+		var apiErr s3err.APIError
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s: verify() = %v", tt.name, err)
+		case tt.want != "" && (!errors.As(err, &apiErr) || apiErr.Code != tt.want):
+			t.Errorf("%s: verify() = %v, want %s", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestPutObjectDigests(t *testing.T) {
+	d, err := putObjectDigests(context.Background(), &s3.PutObjectInput{
+		ContentMD5:    aws.String("JfnnlDI7RTiF9RgfG2JNCw=="),
+		ChecksumCRC32: aws.String("y/Q5Jg=="),
+	})
+	if err != nil || len(d.contentMD5) != 16 || d.algorithm != types.ChecksumAlgorithmCrc32 || d.checksum != "y/Q5Jg==" {
+		t.Errorf("putObjectDigests() = %+v, %v", d, err)
+	}
+
+	d, err = putObjectDigests(context.Background(), &s3.PutObjectInput{ChecksumAlgorithm: types.ChecksumAlgorithmSha1})
+	if err != nil || d.contentMD5 != nil || d.algorithm != types.ChecksumAlgorithmSha1 || d.checksum != "" {
+		t.Errorf("putObjectDigests() = %+v, %v", d, err)
+	}
+
+	for _, input := range []*s3.PutObjectInput{
+		{ContentMD5: aws.String("not base64")},
+		{ContentMD5: aws.String("AAAA")},
+		{ChecksumAlgorithm: "MD5"},
+	} {
+		if d, err := putObjectDigests(context.Background(), input); err == nil {
+			t.Errorf("putObjectDigests(%+v) = %+v, want an error", input, d)
+		}
+	}
+}
+
+func TestManifestChecksumOutput(t *testing.T) {
+	m := testManifest(xorScheme{providers: 2})
+	h := newObjectHasher(uploadDigests{algorithm: types.ChecksumAlgorithmCrc32c})
+	h.Write([]byte("123456789"))
+	m.Checksums = h.checksums()
+
+	head := m.headOutput("")
+	if aws.ToString(head.ETag) != `"25f9e794323b453885f5181f1b624d0b"` || head.ChecksumCRC32C != nil || head.ChecksumType != "" {
+		t.Errorf("unexpected HeadObject output %+v", head)
+	}
+	head = m.headOutput(types.ChecksumModeEnabled)
+	if aws.ToString(head.ChecksumCRC32C) != "4waSgw==" || head.ChecksumCRC32 != nil ||
+		head.ChecksumType != types.ChecksumTypeFullObject {
+		t.Errorf("unexpected HeadObject output with checksums %+v", head)
+	}
+
+	entry := manifestEntry("dir/a.txt", m)
+	if len(entry.ChecksumAlgorithm) != 1 || entry.ChecksumAlgorithm[0] != types.ChecksumAlgorithmCrc32c {
+		t.Errorf("unexpected list entry %+v", entry)
+	}
+
+	// Objects uploaded in parts keep their own ETag
+	m.ETag = `"abc-2"`
+	if head := m.headOutput(""); aws.ToString(head.ETag) != `"abc-2"` {
+		t.Errorf("ETag = %s", aws.ToString(head.ETag))
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/valyala/fasthttp"
+	"github.com/versity/versitygw/s3err"
+)
+
+// errNotModified is returned for reads of which the If-None-Match or
+// If-Modified-Since condition fails
+var errNotModified = s3err.APIError{
+	Code:           "NotModified",
+	Description:    "Not Modified",
+	HTTPStatusCode: http.StatusNotModified,
+}
+
+// etagMatches reports whether etag is in the comma separated list of
+// ETags of a conditional header, "*" matches any ETag
+func etagMatches(list, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		candidate = strings.TrimPrefix(candidate, "W/")
+		if candidate == "*" || strings.Trim(candidate, `"`) == strings.Trim(etag, `"`) {
+			return true
+		}
+	}
+	return false
+}
+
+// modifiedSince reports whether an object last modified at modified was
+// modified after since, at the precision of HTTP dates
+func modifiedSince(modified, since time.Time) bool {
+	return modified.Truncate(time.Second).After(since)
+}
+
+// objectConditions are the conditional headers of a request on an object.
+// Empty conditions and nil times are not evaluated.
+type objectConditions struct {
+	ifMatch, ifNoneMatch               string
+	ifModifiedSince, ifUnmodifiedSince *time.Time
+	// Only for deletes
+	ifMatchLastModified *time.Time
+	ifMatchSize         *int64
+}
+
+// requestConditions returns the conditions of a request on an object.
+// versitygw does not pass them on to the backend, so they are taken from
+// the request if the context is the request. Invalid dates are ignored
+// like by S3.
+func requestConditions(ctx context.Context) objectConditions {
+	req, ok := ctx.(*fasthttp.RequestCtx)
+	if !ok {
+		return objectConditions{}
+	}
+	header := func(name string) string {
+		return string(req.Request.Header.Peek(name))
+	}
+	date := func(name string) *time.Time {
+		t, err := http.ParseTime(header(name))
+		if err != nil {
+			return nil
+		}
+		return &t
+	}
+	c := objectConditions{
+		ifMatch:             header("If-Match"),
+		ifNoneMatch:         header("If-None-Match"),
+		ifModifiedSince:     date("If-Modified-Since"),
+		ifUnmodifiedSince:   date("If-Unmodified-Since"),
+		ifMatchLastModified: date("X-Amz-If-Match-Last-Modified-Time"),
+	}
+	if size, err := strconv.ParseInt(header("X-Amz-If-Match-Size"), 10, 64); err == nil {
+		c.ifMatchSize = &size
+	}
+	return c
+}
+
+// check evaluates the conditions of a read on an object with the given
+// ETag and modification time. Like S3 a matching If-Match overrides
+// If-Unmodified-Since and a failing If-None-Match overrides
+// If-Modified-Since. If the latter fail, reads return errNotModified,
+// other requests fail their precondition.
+func (c objectConditions) check(etag string, modified time.Time, read bool) error {
+	switch {
+	case c.ifMatch != "" && !etagMatches(c.ifMatch, etag),
+		c.ifMatch == "" && c.ifUnmodifiedSince != nil && modifiedSince(modified, *c.ifUnmodifiedSince):
+		return s3err.GetAPIError(s3err.ErrPreconditionFailed)
+	}
+	switch {
+	case c.ifNoneMatch != "" && etagMatches(c.ifNoneMatch, etag),
+		c.ifNoneMatch == "" && c.ifModifiedSince != nil && !modifiedSince(modified, *c.ifModifiedSince):
+		if read {
+			return errNotModified
+		}
+		return s3err.GetAPIError(s3err.ErrPreconditionFailed)
+	}
+	return nil
+}
+
+// conditionalWrite reports whether a write depends on the object it
+// replaces or deletes
+func (c objectConditions) conditionalWrite() bool {
+	return c.ifMatch != "" || c.ifNoneMatch != "" || c.ifMatchLastModified != nil || c.ifMatchSize != nil
+}
+
+// createOnly reports whether a write may only create the object
+func (c objectConditions) createOnly() bool {
+	return strings.TrimSpace(c.ifNoneMatch) == "*"
+}
+
+// checkWrite evaluates the conditions of a PUT or DELETE on the current
+// object, head is nil if there is none. Conditions on an object that does
+// not exist fail with NoSuchKey like on S3.
+func (c objectConditions) checkWrite(head *s3.HeadObjectOutput) error {
+	if head == nil {
+		if c.ifMatch != "" || c.ifMatchLastModified != nil || c.ifMatchSize != nil {
+			return s3err.GetAPIError(s3err.ErrNoSuchKey)
+		}
+		return nil
+	}
+	etag := aws.ToString(head.ETag)
+	modified := aws.ToTime(head.LastModified).Truncate(time.Second)
+	switch {
+	case c.ifNoneMatch != "" && etagMatches(c.ifNoneMatch, etag),
+		c.ifMatch != "" && !etagMatches(c.ifMatch, etag),
+		c.ifMatchLastModified != nil && !modified.Equal(c.ifMatchLastModified.Truncate(time.Second)),
+		c.ifMatchSize != nil && aws.ToInt64(head.ContentLength) != *c.ifMatchSize:
+		return s3err.GetAPIError(s3err.ErrPreconditionFailed)
+	}
+	return nil
+}
+
+// checkCopySource evaluates the conditions of a copy request on its source
+// with the given ETag and modification time, see objectConditions.check
+func checkCopySource(etag string, modified time.Time, ifMatch, ifNoneMatch string,
+	ifModifiedSince, ifUnmodifiedSince *time.Time,
+) error {
+	return objectConditions{
+		ifMatch:           ifMatch,
+		ifNoneMatch:       ifNoneMatch,
+		ifModifiedSince:   ifModifiedSince,
+		ifUnmodifiedSince: ifUnmodifiedSince,
+	}.check(etag, modified, false)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/valyala/fasthttp"
+	"github.com/versity/versitygw/s3err"
+)
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		list, etag string
+		want       bool
+	}{
+		{`"abc"`, `"abc"`, true},
+		{`abc`, `"abc"`, true},
+		{`"x", "abc"`, `"abc"`, true},
+		{`W/"abc"`, `"abc"`, true},
+		{`*`, `"abc"`, true},
+		{`"abd"`, `"abc"`, false},
+		{`"abc-2"`, `"abc"`, false},
+	}
+	for _, tt := range tests {
+		if got := etagMatches(tt.list, tt.etag); got != tt.want {
+			t.Errorf("etagMatches(%q, %q) = %v, want %v", tt.list, tt.etag, got, tt.want)
+		}
+	}
+}
+
+func TestCheckCopySource(t *testing.T) {
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)
+	before := modified.Add(-time.Hour)
+	after := modified.Add(time.Hour)
+	same := modified.Truncate(time.Second)
+	etag := `"abc"`
+
+	tests := []struct {
+		name                 string
+		ifMatch, ifNoneMatch string
+		ifModifiedSince      *time.Time
+		ifUnmodifiedSince    *time.Time
+		fail                 bool
+	}{
+		{name: "no conditions"},
+		{name: "if-match", ifMatch: etag},
+		{name: "if-match fails", ifMatch: `"other"`, fail: true},
+		{name: "if-none-match", ifNoneMatch: `"other"`},
+		{name: "if-none-match fails", ifNoneMatch: "*", fail: true},
+		{name: "modified since", ifModifiedSince: &before},
+		{name: "not modified since", ifModifiedSince: &after, fail: true},
+		{name: "modified at the same second", ifModifiedSince: &same, fail: true},
+		{name: "unmodified since", ifUnmodifiedSince: &after},
+		{name: "modified after", ifUnmodifiedSince: &before, fail: true},
+		{name: "if-match overrides unmodified since", ifMatch: etag, ifUnmodifiedSince: &before},
+		{name: "if-none-match overrides modified since", ifNoneMatch: `"other"`, ifModifiedSince: &after},
+		{name: "if-match and failing if-none-match", ifMatch: etag, ifNoneMatch: etag, fail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkCopySource(etag, modified, tt.ifMatch, tt.ifNoneMatch, tt.ifModifiedSince, tt.ifUnmodifiedSince)
+			if tt.fail {
+				if !errors.Is(err, s3err.GetAPIError(s3err.ErrPreconditionFailed)) {
+					t.Fatalf("expected PreconditionFailed, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckRead(t *testing.T) {
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	after := modified.Add(time.Hour)
+	etag := `"abc"`
+
+	tests := []struct {
+		name  string
+		conds objectConditions
+		want  error
+	}{
+		{"no conditions", objectConditions{}, nil},
+		{"if-match fails", objectConditions{ifMatch: `"other"`}, s3err.GetAPIError(s3err.ErrPreconditionFailed)},
+		{"if-none-match fails", objectConditions{ifNoneMatch: etag}, errNotModified},
+		{"not modified since", objectConditions{ifModifiedSince: &after}, errNotModified},
+		{"if-match and not modified since", objectConditions{ifMatch: etag, ifModifiedSince: &after}, errNotModified},
+	}
+	for _, tt := range tests {
+		if err := tt.conds.check(etag, modified, true); !errors.Is(err, tt.want) {
+			t.Errorf("%s: check() = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestCheckWrite(t *testing.T) {
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	head := &s3.HeadObjectOutput{
+		ETag:          aws.String(`"abc"`),
+		LastModified:  aws.Time(modified.Add(500 * time.Millisecond)),
+		ContentLength: aws.Int64(42),
+	}
+	failed := s3err.GetAPIError(s3err.ErrPreconditionFailed)
+	missing := s3err.GetAPIError(s3err.ErrNoSuchKey)
+
+	tests := []struct {
+		name  string
+		conds objectConditions
+		head  *s3.HeadObjectOutput
+		want  error
+	}{
+		{"create", objectConditions{ifNoneMatch: "*"}, nil, nil},
+		{"create existing", objectConditions{ifNoneMatch: "*"}, head, failed},
+		{"replace", objectConditions{ifMatch: `"abc"`}, head, nil},
+		{"replace changed", objectConditions{ifMatch: `"other"`}, head, failed},
+		{"replace missing", objectConditions{ifMatch: `"abc"`}, nil, missing},
+		{"delete at time", objectConditions{ifMatchLastModified: &modified}, head, nil},
+		{"delete modified", objectConditions{ifMatchLastModified: aws.Time(modified.Add(time.Second))}, head, failed},
+		{"delete size", objectConditions{ifMatchSize: aws.Int64(42)}, head, nil},
+		{"delete other size", objectConditions{ifMatchSize: aws.Int64(41)}, head, failed},
+		{"delete missing", objectConditions{ifMatchSize: aws.Int64(42)}, nil, missing},
+	}
+	for _, tt := range tests {
+		if err := tt.conds.checkWrite(tt.head); !errors.Is(err, tt.want) {
+			t.Errorf("%s: checkWrite() = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestRequestConditions(t *testing.T) {
+	if c := requestConditions(context.Background()); c.conditionalWrite() || c.ifModifiedSince != nil {
+		t.Errorf("conditions without a request = %+v", c)
+	}
+
+	var req fasthttp.RequestCtx
+	req.Request.Header.Set("If-None-Match", "*")
+	req.Request.Header.Set("If-Modified-Since", "Wed, 01 May 2024 12:00:00 GMT")
+	req.Request.Header.Set("If-Unmodified-Since", "yesterday")
+	req.Request.Header.Set("X-Amz-If-Match-Size", "42")
+	c := requestConditions(&req)
+	want := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if !c.createOnly() || c.ifModifiedSince == nil || !c.ifModifiedSince.Equal(want) ||
+		c.ifUnmodifiedSince != nil || aws.ToInt64(c.ifMatchSize) != 42 {
+		t.Errorf("requestConditions() = %+v", c)
+	}
+}
+
+func TestPutObjectIfMatchRace(t *testing.T) {
+	backend, stubs := newStubBackend(t, 2, &bucketSettings{scheme: xor2x2Scheme{}})
+	existing := putTestObject(t, backend, "a.txt", "first", nil)
+	manifest := bytes.Clone(stubs[0].objects["bucket/a.txt.manifest"].data)
+	stored := stubs[0].keys()
+
+	put := func(body string) error {
+		var req fasthttp.Request
+		req.Header.Set("If-Match", existing.ETag)
+		var ctx fasthttp.RequestCtx
+		ctx.Init(&req, nil, nil)
+		_, err := backend.PutObject(&ctx, &s3.PutObjectInput{
+			Bucket:        aws.String("bucket"),
+			Key:           aws.String("a.txt"),
+			Body:          strings.NewReader(body),
+			ContentLength: aws.Int64(int64(len(body))),
+		})
+		return err
+	}
+
+	// Another write replaces the manifest on the second provider after the
+	// condition was evaluated
+	stubs[1].fail = func(r *http.Request) bool {
+		if r.Method == http.MethodPut && r.Header.Get("If-Match") != "" {
+			stubs[1].objects["bucket/a.txt.manifest"] = &stubObject{data: []byte(`{"concurrent":true}`)}
+			stubs[1].fail = nil
+		}
+		return false
+	}
+	if err := put("second"); errorCode(err) != "PreconditionFailed" {
+		t.Fatalf("PutObject() racing another write = %v, want PreconditionFailed", err)
+	}
+	if got := stubs[0].objects["bucket/a.txt.manifest"].data; !bytes.Equal(got, manifest) {
+		t.Error("manifest written to the first provider was not rolled back")
+	}
+	if keys := stubs[0].keys(); !slices.Equal(keys, stored) {
+		t.Errorf("first provider stores %v after the failed put, want %v", keys, stored)
+	}
+	if got := getTestObject(t, backend, "a.txt"); got != "first" {
+		t.Errorf("object is %q after the failed put, want %q", got, "first")
+	}
+
+	// Without a concurrent write the object is replaced
+	stubs[1].objects["bucket/a.txt.manifest"] = &stubObject{data: manifest}
+	if err := put("second"); err != nil {
+		t.Fatalf("PutObject() with a matching ETag failed: %v", err)
+	}
+	if got := getTestObject(t, backend, "a.txt"); got != "second" {
+		t.Errorf("object is %q after the put, want %q", got, "second")
+	}
+}
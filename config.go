@@ -3,6 +3,9 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
+	"path/filepath"
+	"time"
 )
 
 // S3ClientConfig holds configuration for an S3 client.
@@ -13,77 +16,219 @@ type S3ClientConfig struct {
 	Endpoint  string
 }
 
+// maxProviders is the number of storage providers command line flags are
+// defined for
+const maxProviders = 8
+
+// providerFlags holds the command line flags of one storage provider
+type providerFlags struct {
+	endpoint *string
+	region   *string
+	access   *string
+	secret   *string
+}
+
+// defineProviderFlags defines the flags --s3-<kind>-<i>-endpoint etc. for
+// the providers 1 to maxProviders
+func defineProviderFlags(kind, description string) []providerFlags {
+	result := make([]providerFlags, maxProviders)
+	for i := range result {
+		name := fmt.Sprintf("s3-%s-%d-", kind, i+1)
+		desc := fmt.Sprintf("%s %d", description, i+1)
+		result[i] = providerFlags{
+			endpoint: flag.String(name+"endpoint", "", "Endpoint for "+desc),
+			region:   flag.String(name+"region", "", "Region for "+desc),
+			access:   flag.String(name+"access", "", "Access key for "+desc),
+			secret:   flag.String(name+"secret", "", "Secret key for "+desc),
+		}
+	}
+	return result
+}
+
 // Define command line flags for all storage configurations
 var (
-	// Local MinIO configurations
-	local1Endpoint = flag.String("s3-local-1-endpoint", "", "Endpoint for first local MinIO server")
-	local1Region   = flag.String("s3-local-1-region", "", "Region for first local MinIO server")
-	local1Access   = flag.String("s3-local-1-access", "", "Access key for first local MinIO server")
-	local1Secret   = flag.String("s3-local-1-secret", "", "Secret key for first local MinIO server")
+	providerCount = flag.Int("providers", 2, "Number of storage providers the shares are spread over")
+	shareScheme   = flag.String("scheme", "",
+		"Share scheme of buckets without a pcsScheme tag: replication, xor2x2, xor or shamir:<k> (default xor2x2 for 2 providers, xor otherwise)")
 
-	local2Endpoint = flag.String("s3-local-2-endpoint", "", "Endpoint for second local MinIO server")
-	local2Region   = flag.String("s3-local-2-region", "", "Region for second local MinIO server")
-	local2Access   = flag.String("s3-local-2-access", "", "Access key for second local MinIO server")
-	local2Secret   = flag.String("s3-local-2-secret", "", "Secret key for second local MinIO server")
+	macKey = flag.String("mac-key", "",
+		"Secret key of the MACs protecting shares and manifests against tampering, at least 16 bytes (no integrity checks if empty)")
+	// Changing the key hiding the object keys makes the objects of buckets
+	// with hidden keys unreachable, the gateway refuses to start then
+	keyEncryptionKey = flag.String("key-encryption-key", "",
+		"Secret key hiding the object keys of buckets tagged pcsHideKeys=true, at least 16 bytes (default --mac-key, which then cannot be changed)")
+
+	uploadThreshold = flag.Int64("multipart-threshold", defaultUploadThreshold,
+		"Size in bytes above which shares are uploaded to the storages in parts")
+	uploadPartSize = flag.Int64("multipart-part-size", defaultUploadPartSize,
+		"Size in bytes of the parts of shares uploaded in parts, at least 5 MiB")
+
+	fsckBucket = flag.String("fsck", "",
+		"Check the consistency of the shares of the given bucket, print the problems found as JSON lines and exit")
+	fsckRepair = flag.Bool("fsck-repair", false, "Remove the orphaned shares found by --fsck")
+	fsckGrace  = flag.Duration("fsck-grace", defaultFsckGrace,
+		"Minimum age of the orphaned shares removed by --fsck-repair, younger ones may belong to running uploads")
+
+	reconcileMode = flag.String("reconcile-buckets", "",
+		"Find the buckets that exist on some storages only, report, complete or remove them, print them as JSON lines and exit")
+
+	refreshTarget = flag.String("refresh", "",
+		"Split the objects of <bucket>[/<prefix>] again with fresh randomness, print the result of every object as JSON lines and exit")
+	refreshRate     = flag.Int64("refresh-rate", 0, "Maximum bytes per second read and written by refreshes, unlimited if 0")
+	refreshInterval = flag.Duration("refresh-interval", 0,
+		"Refresh the objects of all buckets last modified more than this long ago, every this long while the server runs (disabled if 0)")
+
+	journalPath = flag.String("journal", defaultJournalPath,
+		"File recording the operations in progress, which are completed or undone at startup (disabled if empty)")
+
+	// Local MinIO configurations
+	localProviders = defineProviderFlags("local", "local MinIO server")
 
 	// Remote storage configurations
-	remote1Endpoint = flag.String("s3-remote-1-endpoint", "", "Endpoint for first remote storage")
-	remote1Region   = flag.String("s3-remote-1-region", "", "Region for first remote storage")
-	remote1Access   = flag.String("s3-remote-1-access", "", "Access key for first remote storage")
-	remote1Secret   = flag.String("s3-remote-1-secret", "", "Secret key for first remote storage")
-
-	remote2Endpoint = flag.String("s3-remote-2-endpoint", "", "Endpoint for second remote storage")
-	remote2Region   = flag.String("s3-remote-2-region", "", "Region for second remote storage")
-	remote2Access   = flag.String("s3-remote-2-access", "", "Access key for second remote storage")
-	remote2Secret   = flag.String("s3-remote-2-secret", "", "Secret key for second remote storage")
+	remoteProviders = defineProviderFlags("remote", "remote storage")
 )
 
-// LoadDefaultConfigs returns the configs for client1 and client2 based on localMinio flag
-func LoadDefaultConfigs(localMinio bool) (client1, client2 S3ClientConfig, err error) {
+// LoadDefaultConfigs returns the configs for the first --providers clients
+// based on localMinio flag
+func LoadDefaultConfigs(localMinio bool) ([]S3ClientConfig, error) {
+	if *providerCount < 2 || *providerCount > maxProviders {
+		return nil, fmt.Errorf("number of providers must be between 2 and %d, got %d",
+			maxProviders, *providerCount)
+	}
+
+	kind, providers := "remote", remoteProviders
 	if localMinio {
-		// Validate local MinIO configurations
-		if err := validateConfig(*local1Endpoint, *local1Region, *local1Access, *local1Secret); err != nil {
-			return S3ClientConfig{}, S3ClientConfig{}, fmt.Errorf("invalid local1 configuration: %v", err)
-		}
-		if err := validateConfig(*local2Endpoint, *local2Region, *local2Access, *local2Secret); err != nil {
-			return S3ClientConfig{}, S3ClientConfig{}, fmt.Errorf("invalid local2 configuration: %v", err)
-		}
+		kind, providers = "local", localProviders
+	}
 
-		client1 = S3ClientConfig{
-			AccessKey: *local1Access,
-			SecretKey: *local1Secret,
-			Region:    *local1Region,
-			Endpoint:  *local1Endpoint,
-		}
-		client2 = S3ClientConfig{
-			AccessKey: *local2Access,
-			SecretKey: *local2Secret,
-			Region:    *local2Region,
-			Endpoint:  *local2Endpoint,
-		}
-	} else {
-		// Validate remote storage configurations
-		if err := validateConfig(*remote1Endpoint, *remote1Region, *remote1Access, *remote1Secret); err != nil {
-			return S3ClientConfig{}, S3ClientConfig{}, fmt.Errorf("invalid remote1 configuration: %v", err)
+	configs := make([]S3ClientConfig, *providerCount)
+	for i := range configs {
+		p := providers[i]
+		if err := validateConfig(*p.endpoint, *p.region, *p.access, *p.secret); err != nil {
+			return nil, fmt.Errorf("invalid %s%d configuration: %v", kind, i+1, err)
 		}
-		if err := validateConfig(*remote2Endpoint, *remote2Region, *remote2Access, *remote2Secret); err != nil {
-			return S3ClientConfig{}, S3ClientConfig{}, fmt.Errorf("invalid remote2 configuration: %v", err)
+		configs[i] = S3ClientConfig{
+			AccessKey: *p.access,
+			SecretKey: *p.secret,
+			Region:    *p.region,
+			Endpoint:  *p.endpoint,
 		}
+	}
+	return configs, nil
+}
 
-		client1 = S3ClientConfig{
-			AccessKey: *remote1Access,
-			SecretKey: *remote1Secret,
-			Region:    *remote1Region,
-			Endpoint:  *remote1Endpoint,
-		}
-		client2 = S3ClientConfig{
-			AccessKey: *remote2Access,
-			SecretKey: *remote2Secret,
-			Region:    *remote2Region,
-			Endpoint:  *remote2Endpoint,
-		}
+// LoadScheme returns the default share scheme for the given number of
+// providers based on the scheme flag
+func LoadScheme(providers int) (ShareScheme, error) {
+	if *shareScheme == "" {
+		return defaultScheme(providers), nil
+	}
+	scheme, err := parseScheme(*shareScheme, providers)
+	if err == nil {
+		err = checkProviders(scheme, providers)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return scheme, checkPlacement(scheme)
+}
+
+// LoadMACKey returns the key of the share and manifest MACs based on the
+// mac-key flag, or nil if integrity checks are disabled
+func LoadMACKey() ([]byte, error) {
+	if *macKey == "" {
+		return nil, nil
+	}
+	if len(*macKey) < minMACKeyLength {
+		return nil, fmt.Errorf("MAC key must have at least %d bytes, got %d", minMACKeyLength, len(*macKey))
+	}
+	return []byte(*macKey), nil
+}
+
+// LoadNamesKey returns the key hiding object keys based on the
+// key-encryption-key flag, or the MAC key if the flag is not set
+func LoadNamesKey(macKey []byte) ([]byte, error) {
+	if *keyEncryptionKey == "" {
+		return macKey, nil
+	}
+	if len(*keyEncryptionKey) < minMACKeyLength {
+		return nil, fmt.Errorf("key encryption key must have at least %d bytes, got %d",
+			minMACKeyLength, len(*keyEncryptionKey))
+	}
+	return []byte(*keyEncryptionKey), nil
+}
+
+// LoadUploadLimits returns when shares are uploaded in parts based on the
+// multipart-threshold and multipart-part-size flags
+func LoadUploadLimits() (uploadLimits, error) {
+	if *uploadPartSize < minPartSize {
+		return uploadLimits{}, fmt.Errorf("part size must be at least %d bytes, got %d", minPartSize, *uploadPartSize)
+	}
+	if *uploadThreshold < 0 || *uploadThreshold > maxSinglePutSize {
+		return uploadLimits{}, fmt.Errorf("multipart threshold must be between 0 and %d bytes, got %d",
+			int64(maxSinglePutSize), *uploadThreshold)
+	}
+	return uploadLimits{threshold: *uploadThreshold, partSize: *uploadPartSize}, nil
+}
+
+// LoadFsckOptions returns the bucket to check for consistency and the
+// options of the check based on the fsck flags. The bucket is empty if no
+// check is requested.
+func LoadFsckOptions() (string, fsckOptions, error) {
+	if *fsckRepair && *fsckBucket == "" {
+		return "", fsckOptions{}, fmt.Errorf("--fsck-repair requires --fsck")
+	}
+	if *fsckGrace < 0 {
+		return "", fsckOptions{}, fmt.Errorf("fsck grace period must not be negative, got %s", *fsckGrace)
+	}
+	return *fsckBucket, fsckOptions{repair: *fsckRepair, grace: *fsckGrace, now: time.Now()}, nil
+}
+
+// LoadReconcileMode returns how buckets that exist on some providers only
+// are reconciled based on the reconcile-buckets flag, empty if they are not
+func LoadReconcileMode() (string, error) {
+	switch *reconcileMode {
+	case "", reconcileReport, reconcileComplete, reconcileRemove:
+	default:
+		return "", fmt.Errorf("reconcile mode must be %s, %s or %s, got %q",
+			reconcileReport, reconcileComplete, reconcileRemove, *reconcileMode)
+	}
+	if *reconcileMode != "" && *fsckBucket != "" {
+		return "", fmt.Errorf("--reconcile-buckets cannot be combined with --fsck")
+	}
+	return *reconcileMode, nil
+}
+
+// LoadRefreshOptions returns the bucket whose shares are refreshed, the
+// options of the refresh and the interval of the background refresh based
+// on the refresh flags. The bucket is empty if no refresh is requested.
+func LoadRefreshOptions() (string, refreshOptions, time.Duration, error) {
+	if *refreshRate < 0 {
+		return "", refreshOptions{}, 0, fmt.Errorf("refresh rate must not be negative, got %d", *refreshRate)
+	}
+	if *refreshInterval < 0 {
+		return "", refreshOptions{}, 0, fmt.Errorf("refresh interval must not be negative, got %s", *refreshInterval)
+	}
+	bucket, prefix := parseRefreshTarget(*refreshTarget)
+	if *refreshTarget != "" && bucket == "" {
+		return "", refreshOptions{}, 0, fmt.Errorf("--refresh needs a bucket, got %q", *refreshTarget)
+	}
+	if bucket != "" && (*fsckBucket != "" || *reconcileMode != "") {
+		return "", refreshOptions{}, 0, fmt.Errorf("--refresh cannot be combined with --fsck or --reconcile-buckets")
+	}
+	return bucket, refreshOptions{prefix: prefix, rate: *refreshRate}, *refreshInterval, nil
+}
+
+// LoadJournal opens the intent journal based on the journal flag, or
+// returns nil if it is disabled
+func LoadJournal() (*intentJournal, error) {
+	if *journalPath == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(*journalPath), 0750); err != nil {
+		return nil, err
 	}
-	return client1, client2, nil
+	return openIntentJournal(*journalPath)
 }
 
 // validateConfig checks if all required configuration values are provided
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/versity/versitygw/s3err"
+	"github.com/versity/versitygw/s3response"
+)
+
+// metaRerandomize is the user metadata of a copy request asking for the
+// object to be split again with fresh randomness instead of copying its
+// shares, e.g. after a storage may have been compromised
+const metaRerandomize = "pcs-rerandomize"
+
+// Limits of the providers for copying share objects, larger ones are
+// copied in parts
+const (
+	maxCopyObjectSize = 5 << 30
+	copyPartSize      = 1 << 30
+)
+
+// copySource is the source of a copy request
+type copySource struct {
+	bucket, key string
+	settings    *bucketSettings
+	stored      string          // Key of the source on the providers
+	manifest    *objectManifest // nil for objects without a manifest
+	head        *s3.HeadObjectOutput
+}
+
+// parseCopySource returns the bucket and key of the x-amz-copy-source of a
+// request. Versions are not supported, a version ID is ignored.
+func parseCopySource(source string) (bucket, key string, err error) {
+	source, _, _ = strings.Cut(strings.TrimPrefix(source, "/"), "?versionId=")
+	bucket, key, found := strings.Cut(source, "/")
+	if !found || bucket == "" || key == "" {
+		return "", "", s3err.GetAPIError(s3err.ErrInvalidCopySource)
+	}
+	return bucket, key, nil
+}
+
+// openCopySource looks up the source of a copy request
+func (self *MyBackend) openCopySource(ctx context.Context, source string) (*copySource, error) {
+	bucket, key, err := parseCopySource(source)
+	if err != nil {
+		return nil, err
+	}
+	return self.openSource(ctx, bucket, key)
+}
+
+// openSource looks up the object bucket/key to be read and stored again
+func (self *MyBackend) openSource(ctx context.Context, bucket, key string) (*copySource, error) {
+	if err := self.checkBucketAccess(ctx, bucket); err != nil {
+		return nil, handleError(err)
+	}
+	settings, err := self.settings(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	src := &copySource{bucket: bucket, key: key, settings: settings}
+	if src.stored, err = settings.names.hide(key); err != nil {
+		return nil, err
+	}
+
+	src.manifest, err = self.readManifest(ctx, bucket, src.stored)
+	if err == nil {
+		src.head = src.manifest.headOutput("")
+		return src, nil
+	}
+	if !errors.Is(err, errNoManifest) {
+		return nil, handleError(err)
+	}
+	src.manifest = nil
+	if src.head, err = self.headOriginal(ctx, settings.scheme, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(src.stored),
+	}); err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// openCopyRange returns the GetObject response for the given Range header of the
+// source, an empty header reads the whole object
+func (self *MyBackend) openCopyRange(ctx context.Context, src *copySource, header string) (*s3.GetObjectOutput, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(src.bucket),
+		Key:    aws.String(src.key),
+	}
+	if header != "" {
+		input.Range = aws.String(header)
+	}
+	return self.getObject(ctx, input, objectConditions{})
+}
+
+func (self *MyBackend) CopyObject(ctx context.Context, input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	log.Printf("MyBackend.CopyObject(%v, %v)", ctx, input)
+	if err := self.checkBucketAccess(ctx, *input.Bucket); err != nil {
+		return nil, handleError(err)
+	}
+	settings, err := self.settings(ctx, *input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := settings.names.hide(*input.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := self.openCopySource(ctx, aws.ToString(input.CopySource))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCopySource(aws.ToString(src.head.ETag), aws.ToTime(src.head.LastModified),
+		aws.ToString(input.CopySourceIfMatch), aws.ToString(input.CopySourceIfNoneMatch),
+		input.CopySourceIfModifiedSince, input.CopySourceIfUnmodifiedSince); err != nil {
+		return nil, err
+	}
+
+	// The metadata of the copy is the one of the source unless replaced,
+	// the gateway's own metadata is never stored
+	rerandomize, _ := strconv.ParseBool(input.Metadata[metaRerandomize])
+	replace := input.MetadataDirective == types.MetadataDirectiveReplace
+	headers := headObjectHeaders(src.head)
+	metadata := stripShareMetadata(src.head.Metadata)
+	if replace {
+		headers = newObjectHeaders(input.ContentType, input.CacheControl, input.ContentDisposition,
+			input.ContentEncoding, input.ContentLanguage, input.Expires)
+		metadata = stripShareMetadata(input.Metadata)
+	}
+	if len(metadata) == 0 {
+		metadata = nil
+	}
+
+	selfCopy := src.bucket == *input.Bucket && src.stored == stored
+	if selfCopy && !replace && !rerandomize {
+		return nil, s3err.GetAPIError(s3err.ErrInvalidCopyDest)
+	}
+
+	// The copy keeps the additional checksum of the source unless another
+	// one is requested
+	var checksums manifestChecksums
+	if src.manifest != nil {
+		checksums = src.manifest.Checksums
+	}
+	algorithm := checksums.Algorithm
+	if input.ChecksumAlgorithm != "" {
+		algorithm = input.ChecksumAlgorithm
+	}
+
+	// Shares are copied by the providers if the copy keeps the layout and
+	// checksum of the source, otherwise the object is joined and split again
+	sameScheme := false
+	if src.manifest != nil {
+		scheme, err := src.manifest.scheme(len(self.clients))
+		sameScheme = err == nil && scheme == settings.scheme
+	}
+	var manifest *objectManifest
+	if sameScheme && !rerandomize && algorithm == checksums.Algorithm {
+		var intent string
+		manifest, intent, err = self.copyShares(ctx, src, *input.Bucket, stored, selfCopy)
+		if err != nil {
+			return nil, err
+		}
+		manifest.objectHeaders = headers
+		manifest.Metadata = metadata
+		// Shares copied for the manifest are removed again if it cannot be
+		// published, those of a copy to itself are the ones of the object
+		rollback := func() {
+			if !selfCopy && self.deleteShares(context.WithoutCancel(ctx), *input.Bucket, manifest.Shares) == nil {
+				self.journal.end(intent)
+			}
+		}
+		if err := self.signManifest(*input.Bucket, stored, manifest); err != nil {
+			rollback()
+			return nil, handleError(err)
+		}
+		if err := self.replaceManifest(ctx, *input.Bucket, stored, settings.scheme, manifest); err != nil {
+			log.Printf("Failed to write manifest of %s: %v", *input.Key, err)
+			rollback()
+			return nil, handleError(err)
+		}
+		self.journal.end(intent)
+		return &s3.CopyObjectOutput{
+			CopyObjectResult: &types.CopyObjectResult{
+				ETag:         aws.String(manifest.ETag),
+				LastModified: aws.Time(manifest.Created),
+			},
+		}, nil
+	}
+
+	manifest, err = self.splitAgain(ctx, src, *input.Bucket, *input.Key, headers, metadata,
+		uploadDigests{algorithm: algorithm}, objectConditions{})
+	if err != nil {
+		return nil, err
+	}
+	return &s3.CopyObjectOutput{
+		CopyObjectResult: &types.CopyObjectResult{
+			ETag:         aws.String(manifest.Checksums.etag()),
+			LastModified: aws.Time(manifest.Created),
+		},
+	}, nil
+}
+
+// splitAgain reads the source object and stores it as bucket/key with the
+// given headers, metadata and digests, split with fresh randomness. The
+// object is written like an upload with the given conditions, its data is
+// checked against the MD5 of the source if it is known. It returns the
+// manifest of the object.
+func (self *MyBackend) splitAgain(ctx context.Context, src *copySource, bucket, key string, headers objectHeaders,
+	metadata map[string]string, digests uploadDigests, conds objectConditions,
+) (*objectManifest, error) {
+	source, err := self.openCopyRange(ctx, src, "")
+	if err != nil {
+		return nil, err
+	}
+	defer source.Body.Close()
+	if src.manifest != nil {
+		if sum, err := hex.DecodeString(src.manifest.Checksums.MD5); err == nil && len(sum) == md5.Size {
+			digests.contentMD5 = sum
+		}
+	}
+	return self.putObject(ctx, &s3.PutObjectInput{
+		Bucket:             aws.String(bucket),
+		Key:                aws.String(key),
+		Body:               source.Body,
+		CacheControl:       optional(headers.CacheControl),
+		ContentDisposition: optional(headers.ContentDisposition),
+		ContentEncoding:    optional(headers.ContentEncoding),
+		ContentLanguage:    optional(headers.ContentLanguage),
+		ContentLength:      source.ContentLength,
+		ContentType:        optional(headers.ContentType),
+		Expires:            headers.Expires,
+		Metadata:           metadata,
+	}, digests, conds)
+}
+
+// copyShares copies the shares of a source object with a manifest to the
+// object stored as bucket/key and returns the manifest of the copy. The
+// share MACs stay bound to the object they were computed for. Copying an
+// object to itself only replaces its manifest. The copies are recorded in
+// the journal like an upload, the returned intent is to be ended once the
+// manifest is published or the copies are removed.
+func (self *MyBackend) copyShares(ctx context.Context, src *copySource, bucket, key string, selfCopy bool) (*objectManifest, string, error) {
+	scheme, err := src.manifest.scheme(len(self.clients))
+	if err != nil {
+		return nil, "", handleError(err)
+	}
+	manifest := *src.manifest
+	manifest.Shares = append([]manifestShare(nil), src.manifest.Shares...)
+	manifest.Created = time.Now().UTC()
+	manifest.ETag = aws.ToString(src.head.ETag)
+	manifest.MAC = ""
+	if selfCopy {
+		return &manifest, "", nil
+	}
+	origin := src.manifest.macOrigin(src.bucket, src.stored)
+	manifest.Origin = &origin
+
+	// Like uploads the copies are staged under keys of their own until the
+	// manifest publishes them
+	id, err := newUploadID()
+	if err != nil {
+		return nil, "", err
+	}
+	shares := scheme.shares()
+	for i, share := range shares {
+		manifest.Shares[i].Key = key + share.suffix + "." + id
+	}
+	intent, err := self.journal.begin(journalEntry{
+		Op:     intentPutObject,
+		Bucket: bucket,
+		Key:    key,
+		Shares: manifest.Shares,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	errs := make([]error, len(shares))
+	var wg sync.WaitGroup
+	for i := range shares {
+		wg.Add(1)
+		go func(i int, from, to manifestShare) {
+			defer wg.Done()
+			etag, err := copyShareObject(ctx, self.clients[from.Provider], src.bucket, from.Key, bucket, to.Key, from.Size)
+			if err != nil {
+				log.Printf("Failed to copy %s to %s on client%d: %v", from.Key, to.Key, from.Provider+1, err)
+				errs[i] = err
+				return
+			}
+			manifest.Shares[i].ETag = etag
+		}(i, src.manifest.Shares[i], manifest.Shares[i])
+	}
+	wg.Wait()
+	if err := firstError(errs); err != nil {
+		if self.deleteShares(context.WithoutCancel(ctx), bucket, manifest.Shares) == nil {
+			self.journal.end(intent)
+		}
+		return nil, "", handleError(err)
+	}
+	return &manifest, intent, nil
+}
+
+// copyShareObject copies a share object of the given size on a provider
+// and returns the ETag of the copy. Objects too large for CopyObject are
+// copied in parts.
+func copyShareObject(ctx context.Context, client *s3.Client, srcBucket, srcKey, bucket, key string, size int64) (string, error) {
+	source := aws.String(srcBucket + "/" + url.PathEscape(srcKey))
+	if size <= maxCopyObjectSize {
+		output, err := client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:     aws.String(bucket),
+			Key:        aws.String(key),
+			CopySource: source,
+		})
+		if err != nil {
+			return "", err
+		}
+		return aws.ToString(output.CopyObjectResult.ETag), nil
+	}
+
+	upload, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", err
+	}
+	abort := func(err error) (string, error) {
+		client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(key),
+			UploadId: upload.UploadId,
+		})
+		return "", err
+	}
+	var parts []types.CompletedPart
+	for offset := int64(0); offset < size; offset += copyPartSize {
+		number := aws.Int32(int32(len(parts) + 1))
+		output, err := client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:     aws.String(bucket),
+			Key:        aws.String(key),
+			UploadId:   upload.UploadId,
+			PartNumber: number,
+			CopySource: source,
+			CopySourceRange: aws.String(byteRange{
+				Start: offset,
+				End:   min(offset+copyPartSize, size) - 1,
+			}.Header()),
+		})
+		if err != nil {
+			return abort(err)
+		}
+		parts = append(parts, types.CompletedPart{PartNumber: number, ETag: output.CopyPartResult.ETag})
+	}
+	output, err := client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(bucket),
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return abort(err)
+	}
+	return aws.ToString(output.ETag), nil
+}
+
+func (self *MyBackend) UploadPartCopy(ctx context.Context, input *s3.UploadPartCopyInput) (s3response.CopyPartResult, error) {
+	log.Printf("MyBackend.UploadPartCopy(%v, %v)", ctx, input)
+	src, err := self.openCopySource(ctx, aws.ToString(input.CopySource))
+	if err != nil {
+		return s3response.CopyPartResult{}, err
+	}
+	if err := checkCopySource(aws.ToString(src.head.ETag), aws.ToTime(src.head.LastModified),
+		aws.ToString(input.CopySourceIfMatch), aws.ToString(input.CopySourceIfNoneMatch),
+		input.CopySourceIfModifiedSince, input.CopySourceIfUnmodifiedSince); err != nil {
+		return s3response.CopyPartResult{}, err
+	}
+
+	// The layout of a part never matches the source, the range is joined
+	// and split again as part of the upload
+	header := aws.ToString(input.CopySourceRange)
+	if header != "" {
+		r, ok, err := parseRange(header, aws.ToInt64(src.head.ContentLength))
+		if err != nil || !ok {
+			return s3response.CopyPartResult{}, s3err.GetAPIError(s3err.ErrInvalidCopySourceRange)
+		}
+		header = r.Header()
+	}
+	source, err := self.openCopyRange(ctx, src, header)
+	if err != nil {
+		return s3response.CopyPartResult{}, err
+	}
+	defer source.Body.Close()
+	part, err := self.uploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        input.Bucket,
+		Key:           input.Key,
+		UploadId:      input.UploadId,
+		PartNumber:    input.PartNumber,
+		Body:          source.Body,
+		ContentLength: source.ContentLength,
+	})
+	if err != nil {
+		return s3response.CopyPartResult{}, err
+	}
+	return s3response.CopyPartResult{
+		LastModified: *part.Created,
+		ETag:         &part.ETag,
+	}, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/versity/versitygw/s3err"
+)
+
+func TestParseCopySource(t *testing.T) {
+	tests := []struct {
+		source, bucket, key string
+		invalid             bool
+	}{
+		{source: "bucket/key", bucket: "bucket", key: "key"},
+		{source: "/bucket/dir/a b", bucket: "bucket", key: "dir/a b"},
+		{source: "bucket/key?versionId=123", bucket: "bucket", key: "key"},
+		{source: "bucket", invalid: true},
+		{source: "bucket/", invalid: true},
+		{source: "/key", invalid: true},
+	}
+	for _, tt := range tests {
+		bucket, key, err := parseCopySource(tt.source)
+		if tt.invalid {
+			if !errors.Is(err, s3err.GetAPIError(s3err.ErrInvalidCopySource)) {
+				t.Errorf("parseCopySource(%q): expected InvalidCopySource, got %v", tt.source, err)
+			}
+			continue
+		}
+		if err != nil || bucket != tt.bucket || key != tt.key {
+			t.Errorf("parseCopySource(%q) = %q, %q, %v", tt.source, bucket, key, err)
+		}
+	}
+}
+
+func TestCopyObjectMetadataDirective(t *testing.T) {
+	ctx := context.Background()
+	backend, _ := newStubBackend(t, 2, &bucketSettings{scheme: xor2x2Scheme{}})
+	putTestObject(t, backend, "src", "content", map[string]string{"color": "red"})
+
+	tests := []struct {
+		directive types.MetadataDirective
+		metadata  map[string]string
+		want      map[string]string
+	}{
+		{directive: "", metadata: map[string]string{"color": "blue"}, want: map[string]string{"color": "red"}},
+		{directive: types.MetadataDirectiveCopy, metadata: map[string]string{"color": "blue"}, want: map[string]string{"color": "red"}},
+		{directive: types.MetadataDirectiveReplace, metadata: map[string]string{"shape": "round"}, want: map[string]string{"shape": "round"}},
+		{directive: types.MetadataDirectiveReplace, want: nil},
+	}
+	for _, tt := range tests {
+		output, err := backend.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:            aws.String("bucket"),
+			Key:               aws.String("dst"),
+			CopySource:        aws.String("bucket/src"),
+			MetadataDirective: tt.directive,
+			Metadata:          tt.metadata,
+		})
+		if err != nil {
+			t.Fatalf("CopyObject() with directive %q failed: %v", tt.directive, err)
+		}
+		head, err := backend.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("dst")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (len(head.Metadata) > 0 || len(tt.want) > 0) && !reflect.DeepEqual(head.Metadata, tt.want) {
+			t.Errorf("directive %q: copy has metadata %v, want %v", tt.directive, head.Metadata, tt.want)
+		}
+		if got, want := aws.ToTime(output.CopyObjectResult.LastModified), aws.ToTime(head.LastModified); !got.Equal(want) {
+			t.Errorf("directive %q: CopyObject() reported last modified %v, the copy has %v", tt.directive, got, want)
+		}
+		if got := getTestObject(t, backend, "dst"); got != "content" {
+			t.Errorf("directive %q: copy is %q", tt.directive, got)
+		}
+	}
+}
+
+func TestCopyObjectLayout(t *testing.T) {
+	ctx := context.Background()
+	backend, _ := newStubBackend(t, 2, &bucketSettings{scheme: xor2x2Scheme{}})
+	backend.buckets.Store("replicated", &bucketSettings{scheme: replicationScheme{providers: 2}})
+	putTestObject(t, backend, "src", "content", nil)
+
+	// Shares are copied by the providers only if the copy keeps the layout
+	// and checksum of the source
+	tests := []struct {
+		name       string
+		bucket     string
+		algorithm  types.ChecksumAlgorithm
+		metadata   map[string]string
+		wantCopied bool
+	}{
+		{name: "same layout", bucket: "bucket", wantCopied: true},
+		{name: "other scheme", bucket: "replicated"},
+		{name: "other checksum", bucket: "bucket", algorithm: types.ChecksumAlgorithmCrc32},
+		{name: "rerandomized", bucket: "bucket", metadata: map[string]string{metaRerandomize: "true"}},
+	}
+	for _, tt := range tests {
+		output, err := backend.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:            aws.String(tt.bucket),
+			Key:               aws.String("dst"),
+			CopySource:        aws.String("bucket/src"),
+			ChecksumAlgorithm: tt.algorithm,
+			Metadata:          tt.metadata,
+		})
+		if err != nil {
+			t.Fatalf("%s: CopyObject() failed: %v", tt.name, err)
+		}
+		m, err := backend.readManifest(ctx, tt.bucket, "dst")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if copied := m.Origin != nil; copied != tt.wantCopied {
+			t.Errorf("%s: shares copied = %v, want %v", tt.name, copied, tt.wantCopied)
+		}
+		if got, want := aws.ToTime(output.CopyObjectResult.LastModified), m.Created; !got.Equal(want) {
+			t.Errorf("%s: CopyObject() reported last modified %v, the manifest has %v", tt.name, got, want)
+		}
+		head, err := backend.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String(tt.bucket), Key: aws.String("dst")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if aws.ToString(head.ETag) != aws.ToString(output.CopyObjectResult.ETag) {
+			t.Errorf("%s: CopyObject() reported ETag %s, the copy has %s", tt.name, aws.ToString(output.CopyObjectResult.ETag), aws.ToString(head.ETag))
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// defaultFsckGrace is the default minimum age of orphaned shares removed
+// by a repair. Younger ones may belong to uploads that are still running.
+const defaultFsckGrace = 24 * time.Hour
+
+// fsckSkew is the largest time between the writes of the shares of an
+// object that is not reported. The shares of an upload are written at the
+// same time, larger differences hint at shares of different versions.
+const fsckSkew = 15 * time.Minute
+
+// Kinds of problems found by a consistency check
+const (
+	fsckOrphan             = "orphan-share"        // Share object that belongs to no object
+	fsckIncomplete         = "incomplete"          // Share of an object is missing
+	fsckSizeMismatch       = "size-mismatch"       // Share has the wrong length
+	fsckWriteSkew          = "write-skew"          // Shares of an object were written at different times
+	fsckPartialManifest    = "partial-manifest"    // Manifest is missing on a provider
+	fsckUnreadableManifest = "unreadable-manifest" // Manifest is invalid or cannot be read
+)
+
+// fsckOptions configure a consistency check of a bucket
+type fsckOptions struct {
+	repair bool          // Whether orphaned shares are removed
+	grace  time.Duration // Minimum age of the orphaned shares removed
+	now    time.Time     // Time the ages are computed at
+}
+
+// fsckProblem is an inconsistency of the share objects of a bucket
+type fsckProblem struct {
+	Kind     string `json:"kind"`
+	Key      string `json:"key"`                // Logical key, the stored one if it cannot be revealed
+	Share    string `json:"share,omitempty"`    // Stored key of the share concerned
+	Provider int    `json:"provider,omitempty"` // Starting at 1 like client1
+	Detail   string `json:"detail"`
+	Repaired bool   `json:"repaired,omitempty"`
+
+	base     string    // Stored key of the logical object
+	modified time.Time // Of the share object
+}
+
+// removable reports whether the problem is an orphaned share object that
+// is old enough to be removed by a repair with the given options
+func (p fsckProblem) removable(opts fsckOptions) bool {
+	return p.Kind == fsckOrphan && !p.modified.After(opts.now.Add(-opts.grace))
+}
+
+// parseStagedShareKey returns the stored key of the object and the ID of
+// a share stored under a key unique to an upload, that is a share key of
+// the scheme followed by "." and the ID. ok is false for other keys.
+func parseStagedShareKey(scheme ShareScheme, key string) (base, id string, ok bool) {
+	i := strings.LastIndex(key, ".")
+	if i < 0 || !validUploadID(key[i+1:]) {
+		return "", "", false
+	}
+	base, _, ok = parseShareKey(scheme, key[:i])
+	return base, key[i+1:], ok && base != ""
+}
+
+// parseRecordKey returns the stored key and the upload ID of an upload or
+// part record, stored under its prefix or, by older gateways, under its
+// name alone. ok is false for other keys.
+func parseRecordKey(key string) (stored, id string, ok bool) {
+	if name, found := strings.CutPrefix(key, uploadRecordPrefix); found {
+		return parseUploadKey(name)
+	}
+	if name, found := strings.CutPrefix(key, partRecordPrefix); found {
+		key = name
+	}
+	if i := strings.LastIndex(key, suffixPart); i >= 0 {
+		if stored, id, ok := parseUploadKey(key[:i]); ok {
+			return stored, id, true
+		}
+	}
+	return parseUploadKey(key)
+}
+
+// fsckProblems returns the problems of the objects of a bucket stored
+// with the given scheme, sorted by key. listed[i] holds the objects listed
+// on client i, manifests the manifests read of the listed ones and
+// unreadable the errors of those that could not be read. The shares of
+// objects with an unreadable manifest are never reported as orphans.
+//
+// Shares are orphans if no manifest references them, unless they are the
+// shares of an object without a manifest that can be read from them or
+// belong to a multipart upload in progress.
+func fsckProblems(scheme ShareScheme, listed [][]types.Object, manifests map[string]*objectManifest,
+	unreadable map[string]error,
+) []fsckProblem {
+	shares := scheme.shares()
+	stored := make(map[manifestShare]types.Object)
+	manifestOn := make(map[string][]bool)
+	uploads := make(map[string]bool)
+	inferred := make(map[string][]*types.Object) // Shares of the scheme on their provider
+	type candidate struct {
+		base   string
+		share  manifestShare
+		upload string // Key of the upload record of a share stored for an upload
+		about  string // Why it is not one of the shares of base given by the scheme
+	}
+	var candidates []candidate
+	for i, contents := range listed {
+		for j, obj := range contents {
+			key := *obj.Key
+			stored[manifestShare{Key: key, Provider: i}] = obj
+			if base, ok := strings.CutSuffix(key, suffixManifest); ok {
+				if manifestOn[base] == nil {
+					manifestOn[base] = make([]bool, len(listed))
+				}
+				manifestOn[base][i] = true
+			} else if base, id, ok := parseRecordKey(key); ok {
+				uploads[uploadKey(base, id)] = true
+			} else if base, index, ok := parseShareKey(scheme, key); ok && base != "" {
+				if shares[index].provider != i {
+					candidates = append(candidates, candidate{base, manifestShare{Key: key, Provider: i},
+						"", "stored on the wrong provider"})
+					continue
+				}
+				if inferred[base] == nil {
+					inferred[base] = make([]*types.Object, len(shares))
+				}
+				inferred[base][index] = &contents[j]
+				candidates = append(candidates, candidate{base, manifestShare{Key: key, Provider: i}, "", ""})
+			} else if base, id, ok := parseStagedShareKey(scheme, key); ok {
+				candidates = append(candidates, candidate{base, manifestShare{Key: key, Provider: i},
+					uploadKey(base, id), "stored for an upload that no longer exists"})
+			}
+		}
+	}
+
+	var problems []fsckProblem
+	add := func(kind, base string, share *manifestShare, format string, args ...any) {
+		p := fsckProblem{Kind: kind, Key: base, Detail: fmt.Sprintf(format, args...), base: base}
+		if share != nil {
+			p.Share, p.Provider = share.Key, share.Provider+1
+			p.modified = aws.ToTime(stored[*share].LastModified)
+		}
+		problems = append(problems, p)
+	}
+
+	// Objects with a manifest
+	referenced := make(map[manifestShare]bool)
+	for base, on := range manifestOn {
+		if err, found := unreadable[base]; found {
+			add(fsckUnreadableManifest, base, nil, "%v", err)
+			continue
+		}
+		m := manifests[base]
+		if m == nil {
+			// Deleted since it was listed
+			delete(manifestOn, base)
+			continue
+		}
+		for i, found := range on {
+			if !found {
+				add(fsckPartialManifest, base, &manifestShare{Key: base + suffixManifest, Provider: i},
+					"the manifest is missing on client%d", i+1)
+			}
+		}
+		var present []*types.Object
+		for _, share := range m.Shares {
+			location := manifestShare{Key: share.Key, Provider: share.Provider}
+			referenced[location] = true
+			obj, found := stored[location]
+			if !found {
+				add(fsckIncomplete, base, &location, "share of the manifest is missing")
+				continue
+			}
+			if aws.ToInt64(obj.Size) != share.Size {
+				add(fsckSizeMismatch, base, &location, "share has %d bytes, the manifest records %d",
+					aws.ToInt64(obj.Size), share.Size)
+			}
+			present = append(present, &obj)
+		}
+		if skew := writeSkew(present); skew > fsckSkew {
+			add(fsckWriteSkew, base, nil, "shares were written %s apart", skew)
+		}
+	}
+
+	// Objects inferred from their shares
+	for base, found := range inferred {
+		if manifestOn[base] != nil {
+			continue
+		}
+		streams := availableStreams(scheme, func(i int) bool { return found[i] != nil })
+		if len(streams) < scheme.threshold() {
+			// Reported as orphans below
+			continue
+		}
+		var present []*types.Object
+		for i, obj := range found {
+			location := manifestShare{Key: base + shares[i].suffix, Provider: shares[i].provider}
+			if obj == nil {
+				add(fsckIncomplete, base, &location, "share is missing, the object is still readable")
+				continue
+			}
+			present = append(present, obj)
+			if want := inferredShareLength(scheme, found, streams[0], i); want >= 0 && aws.ToInt64(obj.Size) != want {
+				add(fsckSizeMismatch, base, &location, "share has %d bytes, the other shares need %d",
+					aws.ToInt64(obj.Size), want)
+			}
+		}
+		if skew := writeSkew(present); skew > fsckSkew {
+			add(fsckWriteSkew, base, nil, "shares were written %s apart", skew)
+		}
+	}
+
+	// Shares no object references
+	for _, c := range candidates {
+		if referenced[c.share] || unreadable[c.base] != nil || uploads[c.upload] {
+			continue
+		}
+		about := c.about
+		if about == "" {
+			if manifestOn[c.base] != nil {
+				about = "not referenced by the manifest"
+			} else if found := inferred[c.base]; len(availableStreams(scheme, func(i int) bool {
+				return found[i] != nil
+			})) < scheme.threshold() {
+				about = "incomplete share set, the object cannot be read"
+			} else {
+				continue
+			}
+		}
+		add(fsckOrphan, c.base, &c.share, "%s", about)
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].base != problems[j].base {
+			return problems[i].base < problems[j].base
+		}
+		if problems[i].Share != problems[j].Share {
+			return problems[i].Share < problems[j].Share
+		}
+		return problems[i].Kind < problems[j].Kind
+	})
+	return problems
+}
+
+// inferredShareLength returns the length share index of an object without
+// a manifest must have according to the shares of the given available
+// stream, -1 if it cannot be told from the lengths alone
+func inferredShareLength(scheme ShareScheme, found []*types.Object, stream, index int) int64 {
+	length := func(i int) int64 { return aws.ToInt64(found[i].Size) }
+	part := scheme.shares()[index].part
+	if scheme.width() == 1 {
+		_, n := scheme.segment(part, streamSize(scheme, stream, length))
+		return n
+	}
+	// Striped shares are padded, only shares of the same part must agree
+	for _, i := range streamShares(scheme, stream) {
+		if scheme.shares()[i].part == part {
+			return length(i)
+		}
+	}
+	return -1
+}
+
+// writeSkew returns the time between the first and the last write of the
+// given objects
+func writeSkew(objects []*types.Object) time.Duration {
+	var first, last time.Time
+	for i, obj := range objects {
+		t := aws.ToTime(obj.LastModified)
+		if i == 0 || t.Before(first) {
+			first = t
+		}
+		if i == 0 || t.After(last) {
+			last = t
+		}
+	}
+	return last.Sub(first)
+}
+
+// fsck checks the consistency of the share objects of a bucket on all
+// providers and returns the problems found. A repair removes the orphaned
+// shares older than the grace period, the other problems are only
+// reported.
+func (self *MyBackend) fsck(ctx context.Context, bucket string, opts fsckOptions) ([]fsckProblem, error) {
+	settings, err := self.settings(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	listed, err := self.listStored(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]bool)
+	var keys []string
+	for _, contents := range listed {
+		for _, obj := range contents {
+			if base, ok := strings.CutSuffix(*obj.Key, suffixManifest); ok && !found[base] {
+				found[base] = true
+				keys = append(keys, base)
+			}
+		}
+	}
+	manifests := make(map[string]*objectManifest, len(keys))
+	unreadable := make(map[string]error)
+	var mu sync.Mutex
+	limit := make(chan struct{}, 16) // Concurrent reads
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(key string) {
+			defer func() { <-limit; wg.Done() }()
+			m, err := self.readManifest(ctx, bucket, key)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				manifests[key] = m
+			case !errors.Is(err, errNoManifest):
+				unreadable[key] = err
+			}
+		}(key)
+	}
+	wg.Wait()
+
+	problems := fsckProblems(settings.scheme, listed, manifests, unreadable)
+	for i := range problems {
+		p := &problems[i]
+		if settings.names.hidden() {
+			if key, err := settings.names.reveal(p.base); err == nil {
+				p.Key = key
+			}
+		}
+		if !opts.repair || !p.removable(opts) {
+			continue
+		}
+		_, err := self.clients[p.Provider-1].DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(p.Share),
+		})
+		if err != nil && !isNotFound(err) {
+			log.Printf("Failed to delete orphaned share %s from client%d: %v", p.Share, p.Provider, err)
+			continue
+		}
+		p.Repaired = true
+	}
+	return problems, nil
+}
+
+// runFsck checks the consistency of bucket, writes the problems found to w
+// as JSON lines and returns the number of problems that were not repaired
+func (self *MyBackend) runFsck(ctx context.Context, bucket string, opts fsckOptions, w io.Writer) (int, error) {
+	problems, err := self.fsck(ctx, bucket, opts)
+	if err != nil {
+		return 0, err
+	}
+	enc := json.NewEncoder(w)
+	remaining := 0
+	for _, p := range problems {
+		if err := enc.Encode(p); err != nil {
+			return 0, err
+		}
+		if !p.Repaired {
+			remaining++
+		}
+	}
+	log.Printf("Checked bucket %s: %d problems found, %d repaired", bucket, len(problems), len(problems)-remaining)
+	return remaining, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestFsckProblems(t *testing.T) {
+	scheme := xor2x2Scheme{}
+	written := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	listed := make([][]types.Object, 2)
+	store := func(provider int, key string, size int64, modified time.Time) {
+		listed[provider] = append(listed[provider], types.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(size),
+			LastModified: aws.Time(modified),
+		})
+	}
+	storeShares := func(key string, sizes ...int64) {
+		for i, share := range scheme.shares() {
+			if sizes[i] >= 0 {
+				store(share.provider, key+share.suffix, sizes[i], written)
+			}
+		}
+	}
+	const staged, upload = "0123456789abcdef0123456789abcdef", "fedcba9876543210fedcba9876543210"
+
+	// Readable objects without a manifest
+	storeShares("ok.txt", 5, 5, 5, 5)
+	storeShares("odd.txt", 6, 5, 6, 5)
+	storeShares("size.txt", 5, 5, 4, 5)
+	storeShares("skew.txt", 5, 5, 5, -1)
+	store(0, "skew.txt.rand.second", 5, written.Add(time.Hour))
+	// Unreadable object without a manifest
+	storeShares("broken.txt", 5, -1, -1, 5)
+	// Object with a manifest on one provider and a missing share, next to
+	// the shares of an upload in progress and of a failed one
+	m := testManifest(scheme)
+	m.Shares = shareLocations("m.txt", scheme, nil)
+	for i := range m.Shares {
+		m.Shares[i].Size = 21
+	}
+	store(0, "m.txt.manifest", 100, written)
+	storeShares("m.txt", 21, 21, 21, -1)
+	store(1, "m.txt.cypher.second."+staged, 21, written)
+	store(0, "m.txt.cypher.first."+upload, 21, written)
+	store(0, "m.txt.upload."+upload, 100, written)
+	store(1, "m.txt.upload."+upload, 100, written)
+	store(0, "m.txt.upload."+upload+".part.00001", 100, written)
+	// Object with a manifest that cannot be read
+	store(0, "bad.txt.manifest", 100, written)
+	store(1, "bad.txt.manifest", 100, written)
+	storeShares("bad.txt", 5, -1, -1, -1)
+	// Share on the wrong provider and objects not written by the gateway
+	store(1, "ok.txt.rand.second", 5, written)
+	store(0, "other.txt", 10, written)
+
+	got := fsckProblems(scheme, listed, map[string]*objectManifest{"m.txt": m},
+		map[string]error{"bad.txt": errors.New("manifest tampered")})
+	type problem struct {
+		kind, key, share string
+		provider         int
+	}
+	want := []problem{
+		{fsckUnreadableManifest, "bad.txt", "", 0},
+		{fsckOrphan, "broken.txt", "broken.txt.cypher.first", 1},
+		{fsckOrphan, "broken.txt", "broken.txt.rand.second", 1},
+		{fsckOrphan, "m.txt", "m.txt.cypher.second." + staged, 2},
+		{fsckPartialManifest, "m.txt", "m.txt.manifest", 2},
+		{fsckIncomplete, "m.txt", "m.txt.rand.second", 1},
+		{fsckOrphan, "ok.txt", "ok.txt.rand.second", 2},
+		{fsckSizeMismatch, "size.txt", "size.txt.rand.first", 2},
+		{fsckWriteSkew, "skew.txt", "", 0},
+	}
+	var problems []problem
+	for _, p := range got {
+		problems = append(problems, problem{p.Kind, p.Key, p.Share, p.Provider})
+	}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("fsckProblems() = %v, want %v", problems, want)
+	}
+}
+
+func TestFsckRemovable(t *testing.T) {
+	now := time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC)
+	opts := fsckOptions{repair: true, grace: time.Hour, now: now}
+	for _, tt := range []struct {
+		problem fsckProblem
+		want    bool
+	}{
+		{fsckProblem{Kind: fsckOrphan, modified: now.Add(-2 * time.Hour)}, true},
+		{fsckProblem{Kind: fsckOrphan, modified: now.Add(-time.Minute)}, false},
+		{fsckProblem{Kind: fsckIncomplete, modified: now.Add(-2 * time.Hour)}, false},
+	} {
+		if got := tt.problem.removable(opts); got != tt.want {
+			t.Errorf("removable(%+v) = %v, want %v", tt.problem, got, tt.want)
+		}
+	}
+}
+
+func TestParseStagedShareKey(t *testing.T) {
+	const id = "0123456789abcdef0123456789abcdef"
+	if base, got, ok := parseStagedShareKey(xor2x2Scheme{}, "a.txt.rand.first."+id); !ok || base != "a.txt" || got != id {
+		t.Errorf("parseStagedShareKey() = %q, %q, %v", base, got, ok)
+	}
+	for _, key := range []string{"a.txt.rand.first", "a.txt.rand.first.123", "a.txt.upload." + id, ".rand.first." + id} {
+		if _, _, ok := parseStagedShareKey(xor2x2Scheme{}, key); ok {
+			t.Errorf("parseStagedShareKey(%q) accepted", key)
+		}
+	}
+	for _, key := range []string{
+		"a.txt.upload." + id + ".part.00002",
+		uploadRecordKey("a.txt", id),
+		partRecordKey("a.txt", id, 2),
+	} {
+		if stored, got, ok := parseRecordKey(key); !ok || stored != "a.txt" || got != id {
+			t.Errorf("parseRecordKey(%q) = %q, %q, %v", key, stored, got, ok)
+		}
+	}
+	if _, _, ok := parseRecordKey(uploadRecordPrefix + partKey("a.txt", id, 2)); ok {
+		t.Errorf("parseRecordKey() accepted a part record under the prefix of upload records")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import "errors"
+
+// Arithmetic in GF(2^8) with the reducing polynomial x^8 + x^4 + x^3 + x + 1
+// (0x11b, as used by AES) and the generator 3. Addition and subtraction
+// are XOR.
+
+var (
+	gfExp [510]byte // gfExp[i] = 3^i, doubled to avoid a modulo in gfMul
+	gfLog [256]byte // gfLog[3^i] = i, gfLog[0] is unused
+)
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfExp[i+255] = x
+		gfLog[x] = byte(i)
+		// x *= 3, i.e. x*2 + x
+		hi := x & 0x80
+		x2 := x << 1
+		if hi != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+}
+
+// gfMul returns a * b
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+// gfDiv returns a / b, b must not be 0
+func gfDiv(a, b byte) byte {
+	if b == 0 {
+		panic("division by zero in GF(256)")
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// gfInv returns 1 / a, a must not be 0
+func gfInv(a byte) byte {
+	return gfDiv(1, a)
+}
+
+// gfMulAddSlice sets dst[i] ^= c * src[i] for all i
+func gfMulAddSlice(dst []byte, c byte, src []byte) {
+	if c == 0 {
+		return
+	}
+	logC := int(gfLog[c])
+	for i, s := range src {
+		if s != 0 {
+			dst[i] ^= gfExp[logC+int(gfLog[s])]
+		}
+	}
+}
+
+// gfInvertMatrix returns the inverse of the square matrix m using
+// Gauss-Jordan elimination. m is not modified.
+func gfInvertMatrix(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	// Augment m with the identity matrix
+	a := make([][]byte, n)
+	for i := range a {
+		a[i] = make([]byte, 2*n)
+		copy(a[i], m[i])
+		a[i][n+i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		// Find a pivot and move it to the diagonal
+		pivot := -1
+		for row := col; row < n; row++ {
+			if a[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, errors.New("matrix is singular")
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+
+		// Scale the pivot row to 1 and eliminate the column elsewhere
+		inv := gfInv(a[col][col])
+		for j := range a[col] {
+			a[col][j] = gfMul(a[col][j], inv)
+		}
+		for row := 0; row < n; row++ {
+			if row != col && a[row][col] != 0 {
+				gfMulAddSlice(a[row], a[row][col], a[col])
+			}
+		}
+	}
+
+	result := make([][]byte, n)
+	for i := range result {
+		result[i] = a[i][n:]
+	}
+	return result, nil
+}
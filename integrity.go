@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+
+	"github.com/versity/versitygw/s3err"
+)
+
+// minMACKeyLength is the minimum length of the key of the share MACs
+const minMACKeyLength = 16
+
+// maxVerifiedUpfront is the size up to which objects and ranges are read
+// and checked against their MACs before the response is sent, so that a
+// mismatch is reported as an S3 error. Larger responses are checked chunk
+// by chunk while they are sent and aborted at the first mismatch.
+const maxVerifiedUpfront = 1 << 20
+
+// macChunkSize is the number of share bytes covered by one chunk MAC, see
+// newChunkMAC
+const macChunkSize = 1 << 20
+
+// chunkMACLength is the length chunk MACs are truncated to
+const chunkMACLength = 16
+
+// Domains of the MACs, a MAC of one kind is never valid for the other
+const (
+	macDomainShare     = "pcs-share-mac-v1"
+	macDomainSharePart = "pcs-share-part-mac-v1"
+	macDomainChunk     = "pcs-share-chunk-mac-v1"
+	macDomainManifest  = "pcs-manifest-mac-v1"
+	macDomainUpload    = "pcs-upload-mac-v1"
+	macDomainPart      = "pcs-part-mac-v1"
+)
+
+// sealDomain is the domain of the key encrypting the sealed fields of
+// records, see seal
+const sealDomain = "pcs-seal-key-v1"
+
+// integrityError returns the S3 error for data of a provider failing its
+// integrity check
+func integrityError(format string, args ...any) s3err.APIError {
+	return s3err.APIError{
+		Code:           "IntegrityCheckFailed",
+		Description:    fmt.Sprintf(format, args...),
+		HTTPStatusCode: http.StatusBadGateway,
+	}
+}
+
+// newMAC returns an HMAC-SHA256 keyed with key over the given fields
+// followed by the data written to it. The fields are length prefixed, so
+// that no two field lists produce the same input.
+func newMAC(key []byte, domain string, fields ...string) hash.Hash {
+	mac := hmac.New(sha256.New, key)
+	for _, field := range append([]string{domain}, fields...) {
+		binary.Write(mac, binary.BigEndian, uint64(len(field)))
+		io.WriteString(mac, field)
+	}
+	return mac
+}
+
+// newShareMAC returns the MAC of share index of bucket/key with the given
+// size. It binds the share content to the object and its position in the
+// scheme, so that shares cannot be swapped.
+func newShareMAC(key []byte, bucket, object string, index int, size int64) hash.Hash {
+	return newMAC(key, macDomainShare, bucket, object,
+		fmt.Sprint(index), fmt.Sprint(size))
+}
+
+// newPartMAC returns the MAC of share index of part number part of
+// bucket/key, the part of the share having the given size. Parts of
+// multipart uploads are split and authenticated one by one.
+func newPartMAC(key []byte, bucket, object string, index, part int, size int64) hash.Hash {
+	return newMAC(key, macDomainSharePart, bucket, object,
+		fmt.Sprint(index), fmt.Sprint(part), fmt.Sprint(size))
+}
+
+// newChunkMAC returns the MAC of chunk number chunk of share index of part
+// number part of bucket/key, 0 if the object was not uploaded in parts,
+// the share of the part having the given size. Every macChunkSize bytes of
+// a share have their own MAC, so that ranges can be checked before any of
+// their bytes are sent.
+func newChunkMAC(key []byte, bucket, object string, index, part int, size, chunk int64) hash.Hash {
+	return newMAC(key, macDomainChunk, bucket, object,
+		fmt.Sprint(index), fmt.Sprint(part), fmt.Sprint(size), fmt.Sprint(chunk))
+}
+
+// chunkMACWriter computes the chunk MACs of the share written to it
+type chunkMACWriter struct {
+	newMAC func(chunk int64) hash.Hash
+	mac    hash.Hash // Of the current chunk, nil before its first byte
+	n      int64     // Bytes of the current chunk
+	chunk  int64
+	sums   []byte // Truncated MACs of the completed chunks
+}
+
+func newChunkMACWriter(newMAC func(chunk int64) hash.Hash) *chunkMACWriter {
+	return &chunkMACWriter{newMAC: newMAC}
+}
+
+func (w *chunkMACWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		if w.mac == nil {
+			w.mac = w.newMAC(w.chunk)
+		}
+		n := min(int64(len(p)), macChunkSize-w.n)
+		w.mac.Write(p[:n])
+		w.n += n
+		p = p[n:]
+		if w.n == macChunkSize {
+			w.finish()
+		}
+	}
+	return written, nil
+}
+
+// finish completes the current chunk
+func (w *chunkMACWriter) finish() {
+	w.sums = append(w.sums, w.mac.Sum(nil)[:chunkMACLength]...)
+	w.mac, w.n = nil, 0
+	w.chunk++
+}
+
+// encode returns the base64 encoded chunk MACs of the share written
+func (w *chunkMACWriter) encode() string {
+	if w.mac != nil {
+		w.finish()
+	}
+	return base64.StdEncoding.EncodeToString(w.sums)
+}
+
+// decodeChunkMACs returns the chunk MACs of a share of the given size as
+// encoded by chunkMACWriter.encode, or ok=false if they do not cover it
+func decodeChunkMACs(encoded string, size int64) (sums []byte, ok bool) {
+	sums, err := base64.StdEncoding.DecodeString(encoded)
+	chunks := (size + macChunkSize - 1) / macChunkSize
+	return sums, err == nil && int64(len(sums)) == chunks*chunkMACLength
+}
+
+// chunkAlign returns the range of a share of the given size that covers
+// the chunks holding the bytes rng
+func chunkAlign(rng byteRange, size int64) byteRange {
+	return byteRange{
+		Start: rng.Start / macChunkSize * macChunkSize,
+		End:   min((rng.End/macChunkSize+1)*macChunkSize, size) - 1,
+	}
+}
+
+// chunkMACReader reads the chunks of a share range as aligned by
+// chunkAlign and passes a chunk on only once it matches its MAC, dropping
+// the bytes before and after the requested range. On a mismatch Read
+// returns the error of onMismatch.
+type chunkMACReader struct {
+	r          io.ReadCloser
+	newMAC     func(chunk int64) hash.Hash
+	sums       []byte // Of all chunks of the share
+	size       int64  // Of the share
+	chunk      int64  // Next chunk to read
+	skip       int64  // Bytes to drop before the range
+	remaining  int64  // Bytes of the range not passed on yet
+	buf        []byte
+	pending    []byte // Checked bytes not passed on yet
+	onMismatch func() error
+	err        error
+}
+
+// newChunkMACReader returns a reader of the bytes rng of a share of the
+// given size from r, which reads the range chunkAlign(rng, size)
+func newChunkMACReader(r io.ReadCloser, newMAC func(chunk int64) hash.Hash, sums []byte, size int64,
+	rng byteRange, onMismatch func() error,
+) *chunkMACReader {
+	aligned := chunkAlign(rng, size)
+	return &chunkMACReader{
+		r:          r,
+		newMAC:     newMAC,
+		sums:       sums,
+		size:       size,
+		chunk:      aligned.Start / macChunkSize,
+		skip:       rng.Start - aligned.Start,
+		remaining:  rng.Length(),
+		onMismatch: onMismatch,
+	}
+}
+
+func (c *chunkMACReader) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.remaining == 0 {
+			return 0, io.EOF
+		}
+		c.err = c.next()
+	}
+	n := copy(p, c.pending[:min(int64(len(c.pending)), c.remaining)])
+	c.pending = c.pending[n:]
+	c.remaining -= int64(n)
+	if c.remaining == 0 {
+		c.pending = nil
+	}
+	return n, nil
+}
+
+// next reads and checks the next chunk
+func (c *chunkMACReader) next() error {
+	length := min(macChunkSize, c.size-c.chunk*macChunkSize)
+	if cap(c.buf) < int(length) {
+		c.buf = make([]byte, length)
+	}
+	chunk := c.buf[:length]
+	if _, err := io.ReadFull(c.r, chunk); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	mac := c.newMAC(c.chunk)
+	mac.Write(chunk)
+	want := c.sums[c.chunk*chunkMACLength : (c.chunk+1)*chunkMACLength]
+	if !hmac.Equal(mac.Sum(nil)[:chunkMACLength], want) {
+		return c.onMismatch()
+	}
+	c.chunk++
+	drop := min(c.skip, length)
+	c.skip -= drop
+	c.pending = chunk[drop:]
+	return nil
+}
+
+func (c *chunkMACReader) Close() error {
+	return c.r.Close()
+}
+
+// signedRecord is a record replicated on all providers, such as a
+// manifest, that carries a MAC over its own JSON encoding
+type signedRecord interface {
+	macField() *string
+}
+
+// recordMAC returns the hex encoded MAC of record r of bucket/key in the
+// given domain, computed over its JSON encoding without the MAC
+func recordMAC(key []byte, domain, bucket, object string, r signedRecord) (string, error) {
+	field := r.macField()
+	saved := *field
+	*field = ""
+	data, err := json.Marshal(r)
+	*field = saved
+	if err != nil {
+		return "", err
+	}
+	mac := newMAC(key, domain, bucket, object)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// manifestMAC returns the hex encoded MAC of manifest m of bucket/key
+func manifestMAC(key []byte, bucket, object string, m *objectManifest) (string, error) {
+	return recordMAC(key, macDomainManifest, bucket, object, m)
+}
+
+// signRecord sets the MAC of record r if a MAC key is configured
+func (self *MyBackend) signRecord(domain, bucket, key string, r signedRecord) error {
+	if len(self.macKey) == 0 {
+		return nil
+	}
+	mac, err := recordMAC(self.macKey, domain, bucket, key, r)
+	if err != nil {
+		return err
+	}
+	*r.macField() = mac
+	return nil
+}
+
+// verifyRecord checks the MAC of record r, described as what in errors, if
+// a MAC key is configured. Records must then carry a MAC, otherwise a
+// provider could strip the share MACs from them.
+func (self *MyBackend) verifyRecord(domain, what, bucket, key string, r signedRecord) error {
+	if len(self.macKey) == 0 {
+		return nil
+	}
+	if *r.macField() == "" {
+		return integrityError("The %s of %s has no MAC", what, key)
+	}
+	want, err := recordMAC(self.macKey, domain, bucket, key, r)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(*r.macField()), []byte(want)) {
+		return integrityError("The %s of %s has an invalid MAC", what, key)
+	}
+	return nil
+}
+
+// signManifest sets the MAC of manifest m if a MAC key is configured
+func (self *MyBackend) signManifest(bucket, key string, m *objectManifest) error {
+	return self.signRecord(macDomainManifest, bucket, key, m)
+}
+
+// verifyManifest checks the MAC of manifest m if a MAC key is configured
+func (self *MyBackend) verifyManifest(bucket, key string, m *objectManifest) error {
+	return self.verifyRecord(macDomainManifest, "manifest", bucket, key, m)
+}
+
+// isIntegrityError reports whether err is a failed integrity check
+func isIntegrityError(err error) bool {
+	var apiErr s3err.APIError
+	return errors.As(err, &apiErr) && apiErr.Code == "IntegrityCheckFailed"
+}
+
+// macReader computes the MAC of the data read through it and checks it
+// against the expected MAC once the underlying reader is exhausted. On a
+// mismatch Read returns the error of onMismatch instead of io.EOF, so the
+// data of the last chunk is never joined.
+type macReader struct {
+	r          io.ReadCloser
+	mac        hash.Hash
+	want       []byte
+	onMismatch func() error
+	err        error
+}
+
+func newMACReader(r io.ReadCloser, mac hash.Hash, want []byte, onMismatch func() error) *macReader {
+	return &macReader{r: r, mac: mac, want: want, onMismatch: onMismatch}
+}
+
+func (m *macReader) Read(p []byte) (int, error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+	n, err := m.r.Read(p)
+	m.mac.Write(p[:n])
+	if err == io.EOF && !hmac.Equal(m.mac.Sum(nil), m.want) {
+		err = m.onMismatch()
+	}
+	if err != nil {
+		m.err = err
+	}
+	return n, err
+}
+
+func (m *macReader) Close() error {
+	return m.r.Close()
+}
+
+// sealAAD returns the additional data binding a sealed value to the
+// record stored as bucket/key
+func sealAAD(bucket, key string) []byte {
+	var aad bytes.Buffer
+	for _, field := range []string{bucket, key} {
+		binary.Write(&aad, binary.BigEndian, uint64(len(field)))
+		aad.WriteString(field)
+	}
+	return aad.Bytes()
+}
+
+// sealCipher returns the AES-256-GCM cipher of sealed values, keyed with a
+// key derived from macKey
+func sealCipher(macKey []byte) cipher.AEAD {
+	block, err := aes.NewCipher(newMAC(macKey, sealDomain).Sum(nil))
+	if err != nil {
+		// The key of a SHA-256 sum is always valid for AES-256
+		panic(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return gcm
+}
+
+// seal returns the JSON encoding of v encrypted for the record stored as
+// bucket/key, as base64 of a random nonce followed by the ciphertext, or
+// "" if no MAC key is configured and v is stored as it is
+func (self *MyBackend) seal(bucket, key string, v any) (string, error) {
+	if len(self.macKey) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	gcm := sealCipher(self.macKey)
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(data)+gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, data, sealAAD(bucket, key))), nil
+}
+
+// unseal decrypts a value sealed for the record stored as bucket/key, of
+// which what is the description in errors, into v
+func (self *MyBackend) unseal(what, bucket, key, sealed string, v any) error {
+	if len(self.macKey) == 0 {
+		return fmt.Errorf("the %s of %s is sealed, reading it requires the MAC key", what, key)
+	}
+	gcm := sealCipher(self.macKey)
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(data) < gcm.NonceSize() {
+		return integrityError("The %s of %s has invalid sealed fields", what, key)
+	}
+	data, err = gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], sealAAD(bucket, key))
+	if err != nil {
+		return integrityError("The sealed fields of the %s of %s cannot be decrypted", what, key)
+	}
+	return json.Unmarshal(data, v)
+}
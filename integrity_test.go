@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/versity/versitygw/s3err"
+)
+
+var testMACKey = []byte("0123456789abcdef")
+
+// shareMACOf returns the MAC of data as share index of bucket/key
+func shareMACOf(data []byte, index int) []byte {
+	mac := newShareMAC(testMACKey, "bucket", "a.txt", index, int64(len(data)))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func TestMACReader(t *testing.T) {
+	data := []byte(strings.Repeat("share data ", 100))
+	want := shareMACOf(data, 1)
+
+	for _, tt := range []struct {
+		name     string
+		data     []byte
+		mismatch bool
+	}{
+		{"intact", data, false},
+		{"flipped bit", append([]byte{data[0] ^ 1}, data[1:]...), true},
+		{"truncated", data[:len(data)-1], true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mismatches := 0
+			r := newMACReader(io.NopCloser(bytes.NewReader(tt.data)),
+				newShareMAC(testMACKey, "bucket", "a.txt", 1, int64(len(data))), want,
+				func() error {
+					mismatches++
+					return integrityError("mismatch")
+				})
+			got, err := io.ReadAll(r)
+			if tt.mismatch {
+				var apiErr s3err.APIError
+				if !errors.As(err, &apiErr) || apiErr.Code != "IntegrityCheckFailed" {
+					t.Errorf("got error %v, want an integrity error", err)
+				}
+				if _, err := r.Read(make([]byte, 1)); err == nil {
+					t.Errorf("error is not sticky")
+				}
+				if mismatches != 1 {
+					t.Errorf("onMismatch called %d times, want 1", mismatches)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("got %d bytes, %v, want the data", len(got), err)
+			}
+		})
+	}
+
+	// MACs are bound to the position of the share
+	if bytes.Equal(shareMACOf(data, 0), want) {
+		t.Errorf("shares 0 and 1 have the same MAC")
+	}
+}
+
+func TestChunkMACReader(t *testing.T) {
+	data := make([]byte, 2*macChunkSize+1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	size := int64(len(data))
+	newMAC := func(chunk int64) hash.Hash {
+		return newChunkMAC(testMACKey, "bucket", "a.txt", 1, 0, size, chunk)
+	}
+	w := newChunkMACWriter(newMAC)
+	// Writes need not be aligned to chunks
+	for rest := data; len(rest) > 0; rest = rest[min(len(rest), 300000):] {
+		w.Write(rest[:min(len(rest), 300000)])
+	}
+	sums, ok := decodeChunkMACs(w.encode(), size)
+	if !ok || len(sums) != 3*chunkMACLength {
+		t.Fatalf("got %d bytes of chunk MACs, ok=%v, want 3 chunks", len(sums), ok)
+	}
+	if _, ok := decodeChunkMACs(w.encode(), macChunkSize); ok {
+		t.Errorf("chunk MACs of 3 chunks accepted for a share of 1 chunk")
+	}
+
+	tampered := bytes.Clone(data)
+	tampered[macChunkSize+10] ^= 1
+	for _, tt := range []struct {
+		name     string
+		data     []byte
+		rng      byteRange
+		mismatch bool
+	}{
+		{"whole", data, byteRange{Start: 0, End: size - 1}, false},
+		{"within a chunk", data, byteRange{Start: 10, End: 20}, false},
+		{"across chunks", data, byteRange{Start: macChunkSize - 5, End: 2*macChunkSize + 5}, false},
+		{"last chunk", data, byteRange{Start: size - 1, End: size - 1}, false},
+		{"tampered chunk", tampered, byteRange{Start: macChunkSize + 20, End: macChunkSize + 30}, true},
+		{"range after the tampered byte", tampered, byteRange{Start: macChunkSize + 11, End: macChunkSize + 11}, true},
+		{"other chunk", tampered, byteRange{Start: 0, End: macChunkSize - 1}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			aligned := chunkAlign(tt.rng, size)
+			body := io.NopCloser(bytes.NewReader(tt.data[aligned.Start : aligned.End+1]))
+			r := newChunkMACReader(body, newMAC, sums, size, tt.rng, func() error {
+				return integrityError("mismatch")
+			})
+			got, err := io.ReadAll(r)
+			if tt.mismatch {
+				if errorCode(err) != "IntegrityCheckFailed" {
+					t.Errorf("got error %v, want an integrity error", err)
+				}
+				// Nothing of the tampered chunk is passed on
+				if int64(len(got)) > max(0, macChunkSize-tt.rng.Start) {
+					t.Errorf("got %d bytes before the mismatch", len(got))
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(got, data[tt.rng.Start:tt.rng.End+1]) {
+				t.Errorf("got %d bytes, %v, want %d bytes of the data", len(got), err, tt.rng.Length())
+			}
+		})
+	}
+
+	// Chunk MACs are bound to the position of the chunk
+	if bytes.Equal(newMAC(0).Sum(nil), newMAC(1).Sum(nil)) {
+		t.Errorf("chunks 0 and 1 have the same MAC")
+	}
+}
+
+// TestGetObjectChunkMACs reads ranges of an object whose share was
+// tampered with and checks that only bytes of intact chunks are returned
+func TestGetObjectChunkMACs(t *testing.T) {
+	ctx := context.Background()
+	backend, stubs := newStubBackend(t, 2, &bucketSettings{scheme: replicationScheme{providers: 2}})
+	data := make([]byte, 3*macChunkSize+100)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	putTestObject(t, backend, "a.txt", string(data), nil)
+	m, err := backend.readManifest(ctx, "bucket", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getRange := func(first, last int64) ([]byte, error) {
+		output, err := backend.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String("bucket"),
+			Key:    aws.String("a.txt"),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-%d", first, last)),
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer output.Body.Close()
+		return io.ReadAll(output.Body)
+	}
+	for _, rng := range [][2]int64{{5, 50}, {macChunkSize - 1, 2*macChunkSize + 1}, {3 * macChunkSize, 3*macChunkSize + 99}} {
+		got, err := getRange(rng[0], rng[1])
+		if err != nil || !bytes.Equal(got, data[rng[0]:rng[1]+1]) {
+			t.Errorf("range %v: got %d bytes, %v, want the data", rng, len(got), err)
+		}
+	}
+
+	// Tamper with the second chunk of every replica
+	for i, stub := range stubs {
+		stub.mu.Lock()
+		stub.objects["bucket/"+m.Shares[i].Key].data[macChunkSize+1] ^= 1
+		stub.mu.Unlock()
+	}
+	if got, err := getRange(0, 99); err != nil || !bytes.Equal(got, data[:100]) {
+		t.Errorf("range in an intact chunk: got %d bytes, %v, want the data", len(got), err)
+	}
+	// Small ranges are checked before responding
+	if _, err := getRange(macChunkSize+50, macChunkSize+60); errorCode(err) != "IntegrityCheckFailed" {
+		t.Errorf("range in the tampered chunk: got error %v, want an integrity error", err)
+	}
+	// Larger ones fail at the tampered chunk
+	got, err := getRange(macChunkSize-10, 3*macChunkSize)
+	if errorCode(err) != "IntegrityCheckFailed" {
+		t.Errorf("range across the tampered chunk: got error %v, want an integrity error", err)
+	}
+	if len(got) > 10 {
+		t.Errorf("range across the tampered chunk: got %d bytes, want at most the 10 before it", len(got))
+	}
+
+	// Manifests of older gateways only have MACs over whole shares, which
+	// ranges cannot be checked against
+	for i := range m.Shares {
+		m.Shares[i].Chunks = ""
+	}
+	if err := backend.signManifest("bucket", "a.txt", m); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.writeManifest(ctx, "bucket", "a.txt", m); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getRange(0, 99); errorCode(err) != "IntegrityCheckFailed" {
+		t.Errorf("range without chunk MACs: got error %v, want an integrity error", err)
+	}
+}
+
+// TestGetObjectWithoutManifest checks that shares without a manifest,
+// which have no MACs, are not served with a MAC key
+func TestGetObjectWithoutManifest(t *testing.T) {
+	ctx := context.Background()
+	scheme := replicationScheme{providers: 2}
+	backend, stubs := newStubBackend(t, 2, &bucketSettings{scheme: scheme})
+	for _, share := range scheme.shares() {
+		stubs[share.provider].objects["bucket/a.txt"+share.suffix] = &stubObject{data: []byte("unchecked")}
+	}
+
+	for _, tt := range []struct {
+		key, want string
+	}{
+		{"a.txt", "IntegrityCheckFailed"},
+		{"missing.txt", "NoSuchKey"},
+	} {
+		_, err := backend.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String(tt.key)})
+		if errorCode(err) != tt.want {
+			t.Errorf("GetObject(%s) = %v, want %s", tt.key, err, tt.want)
+		}
+		_, err = backend.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String("bucket"),
+			Key:    aws.String(tt.key),
+			Range:  aws.String("bytes=0-3"),
+		})
+		if errorCode(err) != tt.want {
+			t.Errorf("GetObject(%s) of a range = %v, want %s", tt.key, err, tt.want)
+		}
+	}
+	if _, err := backend.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("a.txt")}); errorCode(err) != "IntegrityCheckFailed" {
+		t.Errorf("HeadObject() = %v, want an integrity error", err)
+	}
+}
+
+func TestManifestMAC(t *testing.T) {
+	backend := &MyBackend{macKey: testMACKey}
+	m := testManifest(xorScheme{providers: 2})
+	if err := backend.signManifest("bucket", "dir/a.txt", m); err != nil {
+		t.Fatalf("Failed to sign manifest: %v", err)
+	}
+	if err := backend.verifyManifest("bucket", "dir/a.txt", m); err != nil {
+		t.Errorf("valid manifest failed verification: %v", err)
+	}
+
+	// The MAC survives the JSON round trip through the providers
+	data, _ := json.Marshal(m)
+	var decoded objectManifest
+	json.Unmarshal(data, &decoded)
+	if err := backend.verifyManifest("bucket", "dir/a.txt", &decoded); err != nil {
+		t.Errorf("decoded manifest failed verification: %v", err)
+	}
+
+	for name, tamper := range map[string]func(m *objectManifest) (bucket, key string){
+		"size":      func(m *objectManifest) (string, string) { m.Size++; return "bucket", "dir/a.txt" },
+		"share mac": func(m *objectManifest) (string, string) { m.Shares[1].MAC = "00"; return "bucket", "dir/a.txt" },
+		"no mac":    func(m *objectManifest) (string, string) { m.MAC = ""; return "bucket", "dir/a.txt" },
+		"key":       func(m *objectManifest) (string, string) { return "bucket", "dir/b.txt" },
+		"bucket":    func(m *objectManifest) (string, string) { return "other", "dir/a.txt" },
+	} {
+		tampered := decoded
+		tampered.Shares = append([]manifestShare(nil), decoded.Shares...)
+		bucket, key := tamper(&tampered)
+		if err := backend.verifyManifest(bucket, key, &tampered); err == nil {
+			t.Errorf("%s: tampered manifest passed verification", name)
+		}
+	}
+
+	// Without a key nothing is signed or verified
+	unkeyed := &MyBackend{}
+	m = testManifest(xorScheme{providers: 2})
+	if err := unkeyed.signManifest("bucket", "dir/a.txt", m); err != nil || m.MAC != "" {
+		t.Errorf("signManifest without key = %v, MAC %q", err, m.MAC)
+	}
+	if err := unkeyed.verifyManifest("bucket", "dir/a.txt", m); err != nil {
+		t.Errorf("verifyManifest without key = %v", err)
+	}
+}
+
+func TestSealManifest(t *testing.T) {
+	backend := &MyBackend{macKey: testMACKey}
+	m := testManifest(xorScheme{providers: 2})
+	h := newObjectHasher(uploadDigests{})
+	h.Write([]byte("hello world"))
+	m.Checksums = h.checksums()
+	if err := backend.signManifest("bucket", "dir/a.txt", m); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := backend.sealManifest("bucket", "dir/a.txt", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Origin = &manifestOrigin{Bucket: "bucket", Key: "dir/source.txt"}
+	if err := backend.signManifest("bucket", "dir/a.txt", m); err != nil {
+		t.Fatal(err)
+	}
+	stored, err = backend.sealManifest("bucket", "dir/a.txt", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(stored)
+	for _, secret := range []string{m.Checksums.MD5, "text/plain", "alice", "source.txt"} {
+		if stored.Sealed == "" || bytes.Contains(data, []byte(secret)) {
+			t.Errorf("sealed manifest %s shows %s", data, secret)
+		}
+	}
+	if m.Sealed != "" || m.Checksums.MD5 == "" {
+		t.Errorf("sealing changed the manifest in memory: %+v", m)
+	}
+
+	var decoded objectManifest
+	json.Unmarshal(data, &decoded)
+	if err := backend.unsealManifest("bucket", "dir/a.txt", &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.verifyManifest("bucket", "dir/a.txt", &decoded); err != nil {
+		t.Errorf("unsealed manifest failed verification: %v", err)
+	}
+	if !reflect.DeepEqual(&decoded, m) {
+		t.Errorf("unsealed manifest = %+v, want %+v", decoded, *m)
+	}
+
+	// Sealed fields are bound to the manifest they were sealed for
+	json.Unmarshal(data, &decoded)
+	if err := backend.unsealManifest("bucket", "dir/b.txt", &decoded); !isIntegrityError(err) {
+		t.Errorf("unsealing the fields of another manifest: got %v, want an integrity error", err)
+	}
+
+	// Without a key nothing is sealed
+	unkeyed := &MyBackend{}
+	if got, err := unkeyed.sealManifest("bucket", "dir/a.txt", m); err != nil || got != m {
+		t.Errorf("sealManifest without key = %+v, %v", got, err)
+	}
+}
+
+func TestLimitReadCloserDrains(t *testing.T) {
+	failing := integrityError("mismatch")
+	body := io.NopCloser(io.MultiReader(strings.NewReader("payload+padding"), iotest.ErrReader(failing)))
+	got, err := io.ReadAll(NewLimitReadCloser(body, 7))
+	if string(got) != "payload" {
+		t.Errorf("got %q, want %q", got, "payload")
+	}
+	if !errors.Is(err, failing) {
+		t.Errorf("got error %v, want %v", err, failing)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	var buf bytes.Buffer
+	audit := &auditLog{w: &buf}
+	audit.record(auditEvent{
+		Event:    auditShareTampered,
+		Bucket:   "bucket",
+		Key:      "a.txt",
+		Share:    "a.txt.share.1",
+		Provider: 2,
+		Reason:   "share does not match its MAC",
+	})
+
+	var event auditEvent
+	if err := json.Unmarshal(buf.Bytes(), &event); err != nil {
+		t.Fatalf("audit log is not a JSON line: %q", buf.String())
+	}
+	if event.Provider != 2 || event.Share != "a.txt.share.1" || event.Time.IsZero() {
+		t.Errorf("unexpected audit event %+v", event)
+	}
+
+	// A nil audit log only writes to the standard log
+	var nilLog *auditLog
+	nilLog.record(event)
+}
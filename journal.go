@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// Operations recorded in the intent journal
+const (
+	intentCreateBucket   = "create-bucket"   // Rolled back
+	intentDeleteObject   = "delete-object"   // Rolled forward, also after the request failed
+	intentPutObject      = "put-object"      // Rolled forward if the manifest was written, back otherwise
+	intentCompleteUpload = "complete-upload" // Rolled forward if the manifest was written, the upload stays otherwise
+)
+
+// Default location of the intent journal, next to the log files whose
+// directory is created at startup anyway
+const defaultJournalPath = "/var/log/go-s3/intents.journal"
+
+// maxJournalSize is the size above which the journal is emptied once no
+// intents are open
+const maxJournalSize = 1 << 20
+
+// journalEntry is a line of the intent journal: an intent recorded before
+// an operation changes the providers, or the completion of the intent with
+// the same ID once all providers are changed
+type journalEntry struct {
+	ID     string          `json:"id"`
+	Time   time.Time       `json:"time"`
+	Op     string          `json:"op,omitempty"` // Empty for completions
+	Bucket string          `json:"bucket,omitempty"`
+	Key    string          `json:"key,omitempty"`    // Stored key of the object
+	Shares []manifestShare `json:"shares,omitempty"` // Written by a put, removed by a delete
+	Done   bool            `json:"done,omitempty"`
+}
+
+// intentJournal is an append-only file of JSON lines recording the
+// operations that change several providers, so that operations cut short
+// by a crash can be completed or undone when the gateway starts again.
+// Every entry is synced to disk before the operation continues. A nil
+// *intentJournal records nothing.
+type intentJournal struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	size int64
+	open map[string]journalEntry // Intents not completed, by ID
+	seq  []string                // IDs of the open intents in the order they were recorded
+}
+
+// openIntentJournal opens the journal at path and loads the intents left
+// open by earlier runs. A line cut short by a crash is ignored.
+func openIntentJournal(path string) (*intentJournal, error) {
+	j := &intentJournal{path: path, open: make(map[string]journalEntry)}
+	f, err := os.Open(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, maxJournalSize)
+		for scanner.Scan() {
+			var entry journalEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.ID == "" {
+				log.Printf("Skipping invalid line of the intent journal %s: %q", path, scanner.Text())
+				continue
+			}
+			j.add(entry)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read the intent journal %s: %v", path, err)
+		}
+	}
+	// Only the open intents are kept
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// add applies an entry to the open intents
+func (j *intentJournal) add(entry journalEntry) {
+	if entry.Done {
+		delete(j.open, entry.ID)
+		j.seq = slices.DeleteFunc(j.seq, func(id string) bool { return id == entry.ID })
+		return
+	}
+	if _, found := j.open[entry.ID]; !found {
+		j.seq = append(j.seq, entry.ID)
+	}
+	j.open[entry.ID] = entry
+}
+
+// compact replaces the journal file by one holding only the open intents
+func (j *intentJournal) compact() error {
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, id := range j.seq {
+		line, err := json.Marshal(j.open[id])
+		if err == nil {
+			var n int
+			n, err = f.Write(append(line, '\n'))
+			size += int64(n)
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(j.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	f, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	if j.f != nil {
+		j.f.Close()
+	}
+	j.f, j.size = f, size
+	return nil
+}
+
+// write appends an entry to the journal and syncs it to disk
+func (j *intentJournal) write(entry journalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	n, err := j.f.Write(append(line, '\n'))
+	j.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// begin records the intent of an operation and returns its ID. The
+// operation must not change the providers if it fails.
+func (j *intentJournal) begin(intent journalEntry) (string, error) {
+	if j == nil {
+		return "", nil
+	}
+	id, err := newUploadID()
+	if err != nil {
+		return "", err
+	}
+	intent.ID, intent.Time, intent.Done = id, time.Now().UTC(), false
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.write(intent); err != nil {
+		log.Printf("Failed to record %s of %s/%s in the intent journal: %v", intent.Op, intent.Bucket, intent.Key, err)
+		return "", err
+	}
+	j.add(intent)
+	return id, nil
+}
+
+// end records the completion of the intent with the given ID. Failures are
+// only logged, the intent is then completed again by the next replay.
+func (j *intentJournal) end(id string) {
+	if j == nil || id == "" {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entry := journalEntry{ID: id, Time: time.Now().UTC(), Done: true}
+	if err := j.write(entry); err != nil {
+		log.Printf("Failed to record the completion of intent %s: %v", id, err)
+		return
+	}
+	j.add(entry)
+	if len(j.open) == 0 && j.size > maxJournalSize {
+		if err := j.compact(); err != nil {
+			log.Printf("Failed to compact the intent journal: %v", err)
+		}
+	}
+}
+
+// pending returns the open intents in the order they were recorded
+func (j *intentJournal) pending() []journalEntry {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	intents := make([]journalEntry, len(j.seq))
+	for i, id := range j.seq {
+		intents[i] = j.open[id]
+	}
+	return intents
+}
+
+// replayJournal completes or undoes the operations left open by an earlier
+// run, it must be called before requests are served. Intents that cannot
+// be resolved, e.g. because a provider is unavailable, stay in the journal
+// for the next start.
+func (self *MyBackend) replayJournal(ctx context.Context) {
+	intents := self.journal.pending()
+	if len(intents) == 0 {
+		return
+	}
+	log.Printf("Replaying %d open intents of the journal", len(intents))
+	for _, intent := range intents {
+		var err error
+		switch intent.Op {
+		case intentCreateBucket:
+			err = self.undoCreateBucket(ctx, intent.Bucket)
+		case intentDeleteObject:
+			err = self.redoDeleteObject(ctx, intent)
+		case intentPutObject, intentCompleteUpload:
+			err = self.resolvePutObject(ctx, intent)
+		default:
+			err = fmt.Errorf("unknown operation %q", intent.Op)
+		}
+		if err != nil {
+			log.Printf("Failed to replay %s of %s/%s: %v", intent.Op, intent.Bucket, intent.Key, err)
+			continue
+		}
+		log.Printf("Replayed %s of %s/%s", intent.Op, intent.Bucket, intent.Key)
+		self.journal.end(intent.ID)
+	}
+}
+
+// undoCreateBucket removes a bucket whose creation did not complete from
+// the providers that store it
+func (self *MyBackend) undoCreateBucket(ctx context.Context, bucket string) error {
+	var errs []error
+	for _, client := range self.clients {
+		_, err := client.DeleteBucket(ctx, &s3.DeleteBucketInput{Bucket: aws.String(bucket)})
+		var ae smithy.APIError
+		if err != nil && !(errors.As(err, &ae) && ae.ErrorCode() == "NoSuchBucket") {
+			errs = append(errs, err)
+		}
+	}
+	self.buckets.Delete(bucket)
+	return firstError(errs)
+}
+
+// redoDeleteObject completes the deletion of an object: its manifest, if it
+// is still stored, and the shares it had. A delete that fails to remove
+// the manifest from every provider leaves its intent open, as the object
+// may already be unreadable on the providers without it, so the deletion
+// the client saw fail is completed here.
+func (self *MyBackend) redoDeleteObject(ctx context.Context, intent journalEntry) error {
+	if err := self.deleteManifest(ctx, intent.Bucket, intent.Key); err != nil {
+		return err
+	}
+	return self.deleteShares(ctx, intent.Bucket, intent.Shares)
+}
+
+// resolvePutObject completes an upload whose manifest was written to any
+// provider and otherwise removes its shares. The manifest is then written
+// to all providers, and the shares of the replaced object that providers
+// still have the manifest of are removed. The shares of a multipart upload
+// that was not published are kept, its completion can be retried or the
+// upload aborted.
+func (self *MyBackend) resolvePutObject(ctx context.Context, intent journalEntry) error {
+	var copies []*objectManifest
+	for i, client := range self.clients {
+		var m objectManifest
+		err := readRecordFrom(ctx, client, intent.Bucket, intent.Key+suffixManifest, &m)
+		if isNotFound(err) {
+			continue
+		}
+		if err == nil {
+			err = self.unsealManifest(intent.Bucket, intent.Key, &m)
+		}
+		if err == nil {
+			err = self.verifyManifest(intent.Bucket, intent.Key, &m)
+		}
+		if err != nil {
+			log.Printf("Ignoring the manifest of %s on client%d: %v", intent.Key, i+1, err)
+			continue
+		}
+		copies = append(copies, &m)
+	}
+
+	committed := committedManifest(copies, intent.Shares)
+	if committed == nil && intent.Op == intentCompleteUpload {
+		return nil
+	}
+	if committed == nil {
+		return self.deleteShares(ctx, intent.Bucket, intent.Shares)
+	}
+	settings, err := self.settings(ctx, intent.Bucket)
+	if err != nil {
+		return err
+	}
+	if err := self.writeManifest(ctx, intent.Bucket, intent.Key, committed); err != nil {
+		return err
+	}
+	current := make(map[manifestShare]bool, len(committed.Shares))
+	for _, share := range committed.Shares {
+		current[manifestShare{Key: share.Key, Provider: share.Provider}] = true
+	}
+	var replaced []manifestShare
+	for _, m := range append(copies, nil) {
+		if m == committed {
+			continue
+		}
+		for _, share := range shareLocations(intent.Key, settings.scheme, m) {
+			if !current[manifestShare{Key: share.Key, Provider: share.Provider}] {
+				replaced = append(replaced, share)
+			}
+		}
+	}
+	return self.deleteShares(ctx, intent.Bucket, replaced)
+}
+
+// committedManifest returns the manifest among copies that publishes the
+// given shares of an upload, nil if the upload was not committed
+func committedManifest(copies []*objectManifest, shares []manifestShare) *objectManifest {
+	if len(shares) == 0 {
+		return nil
+	}
+	for _, m := range copies {
+		for _, share := range m.Shares {
+			if share.Key == shares[0].Key && share.Provider == shares[0].Provider {
+				return m
+			}
+		}
+	}
+	return nil
+}
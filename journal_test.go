@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestJournalReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "intents.journal")
+	j, err := openIntentJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares := []manifestShare{{Key: "a.txt.share.0.0123", Provider: 1}}
+	done, err := j.begin(journalEntry{Op: intentDeleteObject, Bucket: "bucket", Key: "b.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, err := j.begin(journalEntry{Op: intentPutObject, Bucket: "bucket", Key: "a.txt", Shares: shares})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.end(done)
+
+	// A crash in the middle of a write leaves a torn line
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":"x","op":"put-`)
+	f.Close()
+
+	j, err = openIntentJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := j.pending()
+	if len(pending) != 1 || pending[0].ID != open || pending[0].Op != intentPutObject ||
+		pending[0].Key != "a.txt" || len(pending[0].Shares) != 1 || pending[0].Shares[0] != shares[0] {
+		t.Fatalf("pending() = %+v, want the put of a.txt", pending)
+	}
+
+	// Reopening keeps only the open intent
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 1 {
+		t.Errorf("journal has %d lines after reopening, want 1:\n%s", lines, data)
+	}
+
+	j.end(open)
+	if pending := j.pending(); len(pending) != 0 {
+		t.Errorf("pending() = %+v after end, want none", pending)
+	}
+	if j, err = openIntentJournal(path); err != nil || len(j.pending()) != 0 {
+		t.Errorf("reopened journal has %+v, %v, want no intents", j.pending(), err)
+	}
+}
+
+func TestJournalCompaction(t *testing.T) {
+	j, err := openIntentJournal(filepath.Join(t.TempDir(), "intents.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := j.begin(journalEntry{Op: intentCreateBucket, Bucket: "bucket"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The journal is only compacted once it is large
+	j.size += maxJournalSize
+	j.end(id)
+	if j.size != 0 {
+		t.Errorf("journal has %d bytes once no intents are open, want 0", j.size)
+	}
+}
+
+func TestJournalDisabled(t *testing.T) {
+	var j *intentJournal
+	if id, err := j.begin(journalEntry{Op: intentCreateBucket, Bucket: "bucket"}); id != "" || err != nil {
+		t.Errorf("begin() = %q, %v on a disabled journal", id, err)
+	}
+	j.end("")
+	if pending := j.pending(); pending != nil {
+		t.Errorf("pending() = %+v on a disabled journal", pending)
+	}
+}
+
+func TestCommittedManifest(t *testing.T) {
+	staged := []manifestShare{{Key: "a.txt.share.0.new", Provider: 0}, {Key: "a.txt.share.1.new", Provider: 1}}
+	old := &objectManifest{Shares: []manifestShare{{Key: "a.txt.share.0.old", Provider: 0}, {Key: "a.txt.share.1.old", Provider: 1}}}
+	published := &objectManifest{Shares: []manifestShare{{Key: "a.txt.share.0.new", Provider: 0, Size: 3}, {Key: "a.txt.share.1.new", Provider: 1, Size: 3}}}
+
+	if got := committedManifest([]*objectManifest{old, published}, staged); got != published {
+		t.Errorf("committedManifest() = %+v, want the published manifest", got)
+	}
+	if got := committedManifest([]*objectManifest{old}, staged); got != nil {
+		t.Errorf("committedManifest() = %+v, want nil before the upload is published", got)
+	}
+	if got := committedManifest(nil, staged); got != nil {
+		t.Errorf("committedManifest() = %+v, want nil without manifests", got)
+	}
+}
+
+func TestJournalResolvePutObject(t *testing.T) {
+	ctx := context.Background()
+	backend, stubs := newStubBackend(t, 2, &bucketSettings{scheme: xor2x2Scheme{}})
+	putTestObject(t, backend, "a.txt", "first", nil)
+	old, err := backend.readManifest(ctx, "bucket", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldManifest := stubs[0].objects["bucket/a.txt.manifest"]
+	putTestObject(t, backend, "a.txt", "second", nil)
+	published, err := backend.readManifest(ctx, "bucket", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The gateway stopped after writing the manifest to the second
+	// provider only, the old shares are still stored
+	stubs[0].objects["bucket/a.txt.manifest"] = oldManifest
+	for _, share := range old.Shares {
+		stubs[share.Provider].objects["bucket/"+share.Key] = &stubObject{data: []byte("old")}
+	}
+	err = backend.resolvePutObject(ctx, journalEntry{Op: intentPutObject, Bucket: "bucket", Key: "a.txt", Shares: published.Shares})
+	if err != nil {
+		t.Fatalf("resolvePutObject() failed: %v", err)
+	}
+	if a, b := stubs[0].objects["bucket/a.txt.manifest"].data, stubs[1].objects["bucket/a.txt.manifest"].data; !bytes.Equal(a, b) {
+		t.Errorf("providers store different manifests after the upload was completed")
+	}
+	for _, share := range old.Shares {
+		if _, ok := stubs[share.Provider].objects["bucket/"+share.Key]; ok {
+			t.Errorf("replaced share %s was not removed", share.Key)
+		}
+	}
+	if got := getTestObject(t, backend, "a.txt"); got != "second" {
+		t.Errorf("object is %q after the upload was completed, want %q", got, "second")
+	}
+
+	// Shares staged before any manifest was written are removed
+	staged := manifestShare{Key: "a.txt.cypher.first.0123456789abcdef0123456789abcdef", Provider: 0}
+	stubs[0].objects["bucket/"+staged.Key] = &stubObject{data: []byte("staged")}
+	err = backend.resolvePutObject(ctx, journalEntry{Op: intentPutObject, Bucket: "bucket", Key: "a.txt", Shares: []manifestShare{staged}})
+	if err != nil {
+		t.Fatalf("resolvePutObject() failed: %v", err)
+	}
+	if _, ok := stubs[0].objects["bucket/"+staged.Key]; ok {
+		t.Errorf("staged share of an uncommitted upload was not removed")
+	}
+
+	// The completed shares of a multipart upload stay for another attempt
+	stubs[0].objects["bucket/"+staged.Key] = &stubObject{data: []byte("completed")}
+	err = backend.resolvePutObject(ctx, journalEntry{Op: intentCompleteUpload, Bucket: "bucket", Key: "a.txt", Shares: []manifestShare{staged}})
+	if err != nil {
+		t.Fatalf("resolvePutObject() failed: %v", err)
+	}
+	if _, ok := stubs[0].objects["bucket/"+staged.Key]; !ok {
+		t.Errorf("share of an unpublished multipart upload was removed")
+	}
+	if got := getTestObject(t, backend, "a.txt"); got != "second" {
+		t.Errorf("object is %q after the upload was undone, want %q", got, "second")
+	}
+}
+
+func TestJournalRedoDeleteObject(t *testing.T) {
+	ctx := context.Background()
+	backend, stubs := newStubBackend(t, 2, &bucketSettings{scheme: xor2x2Scheme{}})
+	putTestObject(t, backend, "a.txt", "content", nil)
+	m, err := backend.readManifest(ctx, "bucket", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The gateway stopped after deleting the manifest from one provider
+	delete(stubs[1].objects, "bucket/a.txt.manifest")
+	err = backend.redoDeleteObject(ctx, journalEntry{Op: intentDeleteObject, Bucket: "bucket", Key: "a.txt", Shares: m.Shares})
+	if err != nil {
+		t.Fatalf("redoDeleteObject() failed: %v", err)
+	}
+	for i, stub := range stubs {
+		if keys := stub.keys(); len(keys) != 0 {
+			t.Errorf("provider %d stores %v after the delete was completed", i, keys)
+		}
+	}
+}
+
+func TestJournalDeleteManifestFailure(t *testing.T) {
+	ctx := context.Background()
+	backend, stubs := newStubBackend(t, 2, &bucketSettings{scheme: xor2x2Scheme{}})
+	j, err := openIntentJournal(filepath.Join(t.TempDir(), "intents.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.journal = j
+	putTestObject(t, backend, "a.txt", "first", nil)
+	putTestObject(t, backend, "b.txt", "second", nil)
+	shares := len(stubs[0].keys())
+
+	// The second provider fails to delete the manifests
+	stubs[1].fail = func(r *http.Request) bool {
+		return r.Method == http.MethodDelete && strings.HasSuffix(r.URL.Path, suffixManifest)
+	}
+	_, err = backend.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String("bucket"), Key: aws.String("a.txt")})
+	if err == nil {
+		t.Error("DeleteObject() succeeded without removing the manifest")
+	}
+	result, err := backend.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: aws.String("bucket"),
+		Delete: &types.Delete{Objects: []types.ObjectIdentifier{{Key: aws.String("b.txt")}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Error) != 1 || aws.ToString(result.Error[0].Key) != "b.txt" || len(result.Deleted) != 0 {
+		t.Errorf("DeleteObjects() = %+v, want an error for b.txt", result)
+	}
+
+	// The shares stay and the deletions are completed at the next start
+	if keys := stubs[1].keys(); len(keys) != shares {
+		t.Errorf("provider 1 stores %v after the failed deletes", keys)
+	}
+	if pending := j.pending(); len(pending) != 2 {
+		t.Fatalf("%d intents are open after the failed deletes, want 2", len(pending))
+	}
+	stubs[1].fail = nil
+	backend.replayJournal(ctx)
+	for i, stub := range stubs {
+		if keys := stub.keys(); len(keys) != 0 {
+			t.Errorf("provider %d stores %v after the deletes were completed", i, keys)
+		}
+	}
+	if pending := j.pending(); len(pending) != 0 {
+		t.Errorf("%d intents are open after the replay", len(pending))
+	}
+}
+
+func TestJournalUndoCreateBucket(t *testing.T) {
+	backend, stubs := newStubBackend(t, 2, &bucketSettings{scheme: xor2x2Scheme{}})
+	stubs[0].buckets = map[string]map[string]string{"new": {}, "other": {}}
+	stubs[1].buckets = map[string]map[string]string{"other": {}}
+
+	if err := backend.undoCreateBucket(context.Background(), "new"); err != nil {
+		t.Fatalf("undoCreateBucket() failed: %v", err)
+	}
+	for i, stub := range stubs {
+		if _, ok := stub.buckets["new"]; ok {
+			t.Errorf("provider %d still stores the bucket", i)
+		}
+		if _, ok := stub.buckets["other"]; !ok {
+			t.Errorf("provider %d lost another bucket", i)
+		}
+	}
+}
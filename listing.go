@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/valyala/fasthttp"
+	"github.com/versity/versitygw/s3err"
+)
+
+// maxListKeys is the largest page of a listing
+const maxListKeys = 1000
+
+// listToken is the position of a paginated listing. All keys stored for an
+// object sort after its logical key, so the last key or common prefix
+// returned is also where the listing resumes on every provider.
+type listToken struct {
+	After string `json:"after"`
+}
+
+// encodeListToken returns the opaque continuation token of a listing
+// resuming after the given key
+func encodeListToken(after string) string {
+	data, _ := json.Marshal(listToken{After: after})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeListToken returns the key a listing resumes after
+func decodeListToken(token string) (string, error) {
+	var t listToken
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		err = json.Unmarshal(data, &t)
+	}
+	if err != nil || t.After == "" {
+		return "", s3err.APIError{
+			Code:           "InvalidArgument",
+			Description:    "The continuation token provided is incorrect",
+			HTTPStatusCode: http.StatusBadRequest,
+		}
+	}
+	return t.After, nil
+}
+
+// listEncoding returns the encoding of the keys in the response to a
+// listing. versitygw does not pass the encoding-type parameter on to the
+// backend, so it is taken from the request if the context is the request.
+func listEncoding(ctx context.Context, requested types.EncodingType) (types.EncodingType, error) {
+	encoding := requested
+	if req, ok := ctx.(*fasthttp.RequestCtx); ok && encoding == "" {
+		encoding = types.EncodingType(req.QueryArgs().Peek("encoding-type"))
+	}
+	if encoding != "" && encoding != types.EncodingTypeUrl {
+		return "", s3err.APIError{
+			Code:           "InvalidArgument",
+			Description:    "Invalid Encoding Method specified in Request",
+			HTTPStatusCode: http.StatusBadRequest,
+		}
+	}
+	return encoding, nil
+}
+
+// encodeListValue returns a key, prefix or delimiter of a listing in the
+// given encoding. Keys are URL encoded like query parameters except for
+// "/", with spaces encoded as "%20".
+func encodeListValue(encoding types.EncodingType, value *string) *string {
+	if value == nil || encoding != types.EncodingTypeUrl {
+		return value
+	}
+	encoded := strings.ReplaceAll(url.QueryEscape(*value), "+", "%20")
+	return aws.String(strings.ReplaceAll(encoded, "%2F", "/"))
+}
+
+// encodeListEntries encodes the keys and common prefixes of a listing
+func encodeListEntries(encoding types.EncodingType, contents []types.Object, prefixes []types.CommonPrefix) {
+	for i := range contents {
+		contents[i].Key = encodeListValue(encoding, contents[i].Key)
+	}
+	for i := range prefixes {
+		prefixes[i].Prefix = encodeListValue(encoding, prefixes[i].Prefix)
+	}
+}
+
+// objectIterator returns the logical objects of a listing in key order
+type objectIterator interface {
+	// next returns the next object, nil at the end
+	next(ctx context.Context) (*types.Object, error)
+	// skip skips the objects with the given prefix, which are rolled up
+	// into a common prefix
+	skip(prefix string)
+}
+
+// listPage returns the next page of a listing with at most max entries
+// after the key after, the key or common prefix to continue after and
+// whether there are more entries. With a delimiter, keys containing it
+// after the prefix are rolled up into common prefixes.
+func listPage(ctx context.Context, it objectIterator, prefix, delimiter, after string, max int32) (
+	contents []types.Object, prefixes []types.CommonPrefix, last string, truncated bool, err error,
+) {
+	count := int32(0)
+	for max > 0 {
+		obj, err := it.next(ctx)
+		if err != nil {
+			return nil, nil, "", false, err
+		}
+		if obj == nil {
+			break
+		}
+		key := *obj.Key
+		if !strings.HasPrefix(key, prefix) || key <= after {
+			continue
+		}
+		common := ""
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				common = key[:len(prefix)+i+len(delimiter)]
+				if common <= after || common == last {
+					continue
+				}
+			}
+		}
+		if count == max {
+			truncated = true
+			break
+		}
+		count++
+		if common != "" {
+			prefixes = append(prefixes, types.CommonPrefix{Prefix: aws.String(common)})
+			last = common
+			it.skip(common)
+		} else {
+			contents = append(contents, *obj)
+			last = key
+		}
+	}
+	return contents, prefixes, last, truncated, nil
+}
+
+// storedListing is the paginated listing of a bucket on one provider
+type storedListing struct {
+	client  *s3.Client
+	after   string         // Key the listing starts after
+	token   *string        // Of the next page
+	last    string         // Last key listed so far
+	done    bool           // Whether all pages are listed
+	objects []types.Object // Listed objects of unresolved logical objects
+}
+
+// logicalLister merges the paginated listings of all providers into the
+// logical objects of a bucket without hidden keys. The stored keys of an
+// object sort after its key and before the key followed by "/", so it is
+// resolved once every provider is listed past that point.
+type logicalLister struct {
+	backend               *MyBackend
+	scheme                ShareScheme
+	bucket, prefix, after string
+	providers             []*storedListing
+	pending               []types.Object // Resolved objects in key order
+}
+
+// newLogicalLister returns an iterator over the logical objects of a bucket
+// with the given prefix after the key after
+func (self *MyBackend) newLogicalLister(scheme ShareScheme, bucket, prefix, after string) *logicalLister {
+	l := &logicalLister{backend: self, scheme: scheme, bucket: bucket, prefix: prefix, after: after}
+	for _, client := range self.clients {
+		l.providers = append(l.providers, &storedListing{client: client, after: after})
+	}
+	return l
+}
+
+// storedBase returns the logical key of an object listed on a provider if
+// it is a share or manifest
+func storedBase(scheme ShareScheme, key string) (string, bool) {
+	base, ok := strings.CutSuffix(key, suffixManifest)
+	if !ok {
+		base, _, ok = parseShareKey(scheme, key)
+	}
+	return base, ok && base != ""
+}
+
+// resolvedAfter returns the stored key all providers must be listed past
+// before the object with the given key can be returned: objects with keys
+// that are prefixes of it followed by a character before "/" have stored
+// keys sorting after its own ones.
+func resolvedAfter(key string) string {
+	for i := 1; i < len(key); i++ {
+		if key[i] <= '.' {
+			return key[:i] + "/"
+		}
+	}
+	return key + "/"
+}
+
+// bound returns the key up to which every provider is listed, and whether
+// all providers are listed completely
+func (l *logicalLister) bound() (string, bool) {
+	bound, all := "", true
+	for _, p := range l.providers {
+		if p.done {
+			continue
+		}
+		if all || p.last < bound {
+			bound = p.last
+		}
+		all = false
+	}
+	return bound, all
+}
+
+// fetch lists the next page on the providers listed the least far
+func (l *logicalLister) fetch(ctx context.Context, bound string) error {
+	for i, p := range l.providers {
+		if p.done || p.last != bound {
+			continue
+		}
+		input := &s3.ListObjectsV2Input{
+			Bucket:            aws.String(l.bucket),
+			ContinuationToken: p.token,
+		}
+		if l.prefix != "" {
+			input.Prefix = aws.String(l.prefix)
+		}
+		if p.token == nil && p.after != "" {
+			input.StartAfter = aws.String(p.after)
+		}
+		output, err := p.client.ListObjectsV2(ctx, input)
+		if err != nil {
+			return err
+		}
+		for _, obj := range output.Contents {
+			p.last = *obj.Key
+			if base, ok := storedBase(l.scheme, *obj.Key); ok && base > l.after {
+				p.objects = append(p.objects, obj)
+			}
+		}
+		p.token = output.NextContinuationToken
+		p.done = !aws.ToBool(output.IsTruncated) || p.token == nil
+		log.Printf("Listed %d objects in client%d up to %q", len(output.Contents), i+1, p.last)
+	}
+	return nil
+}
+
+// resolve turns the listed objects of which all stored keys are listed
+// into logical objects
+func (l *logicalLister) resolve(ctx context.Context, bound string, all bool) error {
+	listed := make([][]types.Object, len(l.providers))
+	found := false
+	for i, p := range l.providers {
+		var rest []types.Object
+		for _, obj := range p.objects {
+			base, _ := storedBase(l.scheme, *obj.Key)
+			if all || base+"/" <= bound {
+				listed[i] = append(listed[i], obj)
+				found = true
+			} else {
+				rest = append(rest, obj)
+			}
+		}
+		p.objects = rest
+	}
+	if !found {
+		return nil
+	}
+	objects, err := l.backend.logicalObjects(ctx, l.scheme, l.bucket, listed)
+	if err != nil {
+		return err
+	}
+	l.pending = append(l.pending, objects...)
+	sort.Slice(l.pending, func(i, j int) bool {
+		return *l.pending[i].Key < *l.pending[j].Key
+	})
+	return nil
+}
+
+// skip skips the objects with the given prefix by restarting the listings
+// after the largest key with the prefix. Stored keys with the prefix can
+// only belong to objects with the prefix or to objects before it, which
+// are already returned.
+func (l *logicalLister) skip(prefix string) {
+	end := prefix + string(utf8.MaxRune)
+	for _, p := range l.providers {
+		var rest []types.Object
+		for _, obj := range p.objects {
+			if base, _ := storedBase(l.scheme, *obj.Key); !strings.HasPrefix(base, prefix) {
+				rest = append(rest, obj)
+			}
+		}
+		p.objects = rest
+		if !p.done && p.last < end {
+			p.after, p.token, p.last = end, nil, end
+		}
+	}
+	var pending []types.Object
+	for _, obj := range l.pending {
+		if !strings.HasPrefix(*obj.Key, prefix) {
+			pending = append(pending, obj)
+		}
+	}
+	l.pending = pending
+}
+
+func (l *logicalLister) next(ctx context.Context) (*types.Object, error) {
+	for {
+		bound, all := l.bound()
+		if err := l.resolve(ctx, bound, all); err != nil {
+			return nil, err
+		}
+		if len(l.pending) > 0 && (all || resolvedAfter(*l.pending[0].Key) <= bound) {
+			obj := l.pending[0]
+			l.pending = l.pending[1:]
+			return &obj, nil
+		}
+		if all {
+			return nil, nil
+		}
+		if err := l.fetch(ctx, bound); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// hiddenResolveBatch is the number of objects of a bucket with hidden keys
+// resolved at once
+const hiddenResolveBatch = 100
+
+// hiddenObject is an object of a bucket with hidden keys that is listed but
+// not resolved yet
+type hiddenObject struct {
+	key    string           // Logical key
+	base   string           // Hidden key
+	listed [][]types.Object // Stored objects on each provider
+}
+
+// hiddenLister returns the logical objects of a bucket with hidden keys in
+// key order. The providers cannot filter hidden keys by prefix or sort them
+// by the logical keys, so the lister lists all stored keys of the bucket,
+// decrypts and sorts them, and only resolves the objects it returns.
+type hiddenLister struct {
+	backend *MyBackend
+	scheme  ShareScheme
+	bucket  string
+	objects []hiddenObject // Unresolved objects in key order
+	pending []types.Object // Resolved objects in key order
+}
+
+// newHiddenLister returns an iterator over the logical objects of a bucket
+// with hidden keys with the given prefix after the key after
+func (self *MyBackend) newHiddenLister(ctx context.Context, scheme ShareScheme, names *keyNames,
+	bucket, prefix, after string,
+) (*hiddenLister, error) {
+	listed, err := self.listStored(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	byBase := make(map[string]*hiddenObject)
+	for i, objects := range listed {
+		for _, obj := range objects {
+			base, ok := storedBase(scheme, *obj.Key)
+			if !ok {
+				continue
+			}
+			h, seen := byBase[base]
+			if !seen {
+				key, err := names.reveal(base)
+				if err != nil {
+					log.Printf("Skipping %s in bucket %s with hidden keys: %v", base, bucket, err)
+				} else if strings.HasPrefix(key, prefix) && key > after {
+					h = &hiddenObject{key: key, base: base, listed: make([][]types.Object, len(listed))}
+				}
+				byBase[base] = h
+			}
+			if h != nil {
+				h.listed[i] = append(h.listed[i], obj)
+			}
+		}
+	}
+
+	l := &hiddenLister{backend: self, scheme: scheme, bucket: bucket}
+	for _, h := range byBase {
+		if h != nil {
+			l.objects = append(l.objects, *h)
+		}
+	}
+	sort.Slice(l.objects, func(i, j int) bool {
+		return l.objects[i].key < l.objects[j].key
+	})
+	return l, nil
+}
+
+// resolve turns the next batch of listed objects into logical objects
+func (l *hiddenLister) resolve(ctx context.Context) error {
+	batch := l.objects[:min(len(l.objects), hiddenResolveBatch)]
+	l.objects = l.objects[len(batch):]
+
+	listed := make([][]types.Object, len(l.backend.clients))
+	keys := make(map[string]string, len(batch))
+	for _, h := range batch {
+		for i, objects := range h.listed {
+			listed[i] = append(listed[i], objects...)
+		}
+		keys[h.base] = h.key
+	}
+	objects, err := l.backend.logicalObjects(ctx, l.scheme, l.bucket, listed)
+	if err != nil {
+		return err
+	}
+	for _, obj := range objects {
+		obj.Key = aws.String(keys[*obj.Key])
+		l.pending = append(l.pending, obj)
+	}
+	sort.Slice(l.pending, func(i, j int) bool {
+		return *l.pending[i].Key < *l.pending[j].Key
+	})
+	return nil
+}
+
+func (l *hiddenLister) next(ctx context.Context) (*types.Object, error) {
+	for len(l.pending) == 0 {
+		if len(l.objects) == 0 {
+			return nil, nil
+		}
+		if err := l.resolve(ctx); err != nil {
+			return nil, err
+		}
+	}
+	obj := l.pending[0]
+	l.pending = l.pending[1:]
+	return &obj, nil
+}
+
+// skip drops the objects with the given prefix, which follow in key order
+func (l *hiddenLister) skip(prefix string) {
+	for len(l.pending) > 0 && strings.HasPrefix(*l.pending[0].Key, prefix) {
+		l.pending = l.pending[1:]
+	}
+	if len(l.pending) == 0 {
+		for len(l.objects) > 0 && strings.HasPrefix(l.objects[0].key, prefix) {
+			l.objects = l.objects[1:]
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/versity/versitygw/s3err"
+)
+
+// sliceIterator iterates over sorted objects
+type sliceIterator []types.Object
+
+func (it *sliceIterator) next(ctx context.Context) (*types.Object, error) {
+	if len(*it) == 0 {
+		return nil, nil
+	}
+	obj := (*it)[0]
+	*it = (*it)[1:]
+	return &obj, nil
+}
+
+func (it *sliceIterator) skip(prefix string) {
+	for len(*it) > 0 && strings.HasPrefix(*(*it)[0].Key, prefix) {
+		*it = (*it)[1:]
+	}
+}
+
+func TestListToken(t *testing.T) {
+	for _, key := range []string{"a", "dir/sub/", "key with spaces & ümlauts"} {
+		got, err := decodeListToken(encodeListToken(key))
+		if err != nil || got != key {
+			t.Errorf("round trip of %q = %q, %v", key, got, err)
+		}
+	}
+	for _, token := range []string{"not base64!", "bm90IGpzb24", encodeListToken("")} {
+		_, err := decodeListToken(token)
+		var apiErr s3err.APIError
+		if !errors.As(err, &apiErr) || apiErr.Code != "InvalidArgument" {
+			t.Errorf("decodeListToken(%q) = %v, want InvalidArgument", token, err)
+		}
+	}
+}
+
+func TestStoredBase(t *testing.T) {
+	scheme := xor2x2Scheme{}
+	tests := []struct {
+		key, base string
+		ok        bool
+	}{
+		{key: "dir/a.txt.manifest", base: "dir/a.txt", ok: true},
+		{key: "dir/a.txt.cypher.first", base: "dir/a.txt", ok: true},
+		{key: "dir/a.txt.rand.second", base: "dir/a.txt", ok: true},
+		{key: "dir/a.txt"},
+		{key: ".manifest"},
+		{key: "dir/a.txt.upload.0123456789abcdef0123456789abcdef"},
+	}
+	for _, tt := range tests {
+		base, ok := storedBase(scheme, tt.key)
+		if base != tt.base || ok != tt.ok {
+			t.Errorf("storedBase(%q) = %q, %v, want %q, %v", tt.key, base, ok, tt.base, tt.ok)
+		}
+	}
+}
+
+func TestResolvedAfter(t *testing.T) {
+	tests := map[string]string{
+		"a":     "a/",
+		"abc":   "abc/",
+		"a.b":   "a/",
+		"a-1":   "a/",
+		"ab c":  "ab/",
+		"a/b.c": "a/b/",
+		".a":    ".a/",
+	}
+	for key, want := range tests {
+		got := resolvedAfter(key)
+		if got != want {
+			t.Errorf("resolvedAfter(%q) = %q, want %q", key, got, want)
+		}
+		// The stored keys of the object come before the bound
+		if key+suffixManifest >= got {
+			t.Errorf("manifest of %q sorts after %q", key, got)
+		}
+	}
+}
+
+func TestListPage(t *testing.T) {
+	var objects []types.Object
+	for _, key := range []string{"a", "b/1", "b/2", "c", "d/x/1", "d/y", "e"} {
+		objects = append(objects, types.Object{Key: aws.String(key)})
+	}
+	tests := []struct {
+		name              string
+		prefix, delimiter string
+		after             string
+		max               int32
+		want              []string
+		last              string
+		truncated         bool
+	}{
+		{name: "all", max: 1000, want: []string{"a", "b/1", "b/2", "c", "d/x/1", "d/y", "e"}, last: "e"},
+		{name: "first page", max: 3, want: []string{"a", "b/1", "b/2"}, last: "b/2", truncated: true},
+		{name: "exact page", after: "d/x/1", max: 2, want: []string{"d/y", "e"}, last: "e"},
+		{name: "delimiter", delimiter: "/", max: 1000, want: []string{"a", "b/", "c", "d/", "e"}, last: "e"},
+		{name: "delimiter page", delimiter: "/", max: 2, want: []string{"a", "b/"}, last: "b/", truncated: true},
+		{name: "after prefix", delimiter: "/", after: "b/", max: 2, want: []string{"c", "d/"}, last: "d/", truncated: true},
+		{name: "prefix and delimiter", prefix: "d/", delimiter: "/", max: 1000, want: []string{"d/x/", "d/y"}, last: "d/y"},
+		{name: "no keys", max: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			it := sliceIterator(objects)
+			contents, prefixes, last, truncated, err := listPage(context.Background(), &it,
+				tt.prefix, tt.delimiter, tt.after, tt.max)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, obj := range contents {
+				got = append(got, *obj.Key)
+			}
+			for _, p := range prefixes {
+				got = append(got, *p.Prefix)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) || last != tt.last || truncated != tt.truncated {
+				t.Errorf("got %q, last %q, truncated %v, want %q, %q, %v", got, last, truncated, tt.want, tt.last, tt.truncated)
+			}
+		})
+	}
+}
+
+func TestListObjectsHiddenKeys(t *testing.T) {
+	ctx := context.Background()
+	backend, _ := newStubBackend(t, 2, &bucketSettings{scheme: xor2x2Scheme{}, names: newKeyNames(testMACKey, "bucket")})
+	keys := []string{"a.txt", "dir/b.txt", "dir/c.txt", "dir2/d.txt", "dir2/e.txt", "e.txt", "f/g/h.txt"}
+	for _, key := range keys {
+		putTestObject(t, backend, key, "content of "+key, nil)
+	}
+
+	tests := []struct {
+		name, prefix, delimiter, after string
+		want                           []string
+	}{
+		{name: "all", want: keys},
+		{name: "prefix", prefix: "dir", want: []string{"dir/b.txt", "dir/c.txt", "dir2/d.txt", "dir2/e.txt"}},
+		{name: "start after", after: "dir/b", want: []string{"dir/b.txt", "dir/c.txt", "dir2/d.txt", "dir2/e.txt", "e.txt", "f/g/h.txt"}},
+		{name: "delimiter", delimiter: "/", want: []string{"a.txt", "dir/", "dir2/", "e.txt", "f/"}},
+		{name: "prefix and delimiter", prefix: "f/", delimiter: "/", want: []string{"f/g/"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Pages of two entries resume after the last one of the previous page
+			var listed []string
+			input := &s3.ListObjectsV2Input{
+				Bucket:     aws.String("bucket"),
+				Prefix:     aws.String(tt.prefix),
+				Delimiter:  aws.String(tt.delimiter),
+				StartAfter: aws.String(tt.after),
+				MaxKeys:    aws.Int32(2),
+			}
+			for pages := 0; ; pages++ {
+				if pages > len(keys) {
+					t.Fatal("listing does not end")
+				}
+				result, err := backend.ListObjectsV2(ctx, input)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var page []string
+				for _, obj := range result.Contents {
+					page = append(page, *obj.Key)
+				}
+				for _, p := range result.CommonPrefixes {
+					page = append(page, *p.Prefix)
+				}
+				sort.Strings(page)
+				listed = append(listed, page...)
+				if !aws.ToBool(result.IsTruncated) {
+					break
+				}
+				input.ContinuationToken = result.NextContinuationToken
+			}
+			// In key order, without repeated common prefixes
+			if !reflect.DeepEqual(listed, tt.want) {
+				t.Errorf("listing = %v, want %v", listed, tt.want)
+			}
+		})
+	}
+}
+
+func TestListObjectsPages(t *testing.T) {
+	ctx := context.Background()
+	keys := []string{"a.txt", "b/1", "b/2", "b/3", "c.txt", "d/x/1", "d/y", "e.txt", "f/1"}
+	want := []string{"a.txt", "b/", "c.txt", "d/", "e.txt", "f/"}
+	for _, names := range []*keyNames{nil, newKeyNames(testMACKey, "bucket")} {
+		t.Run(fmt.Sprintf("hidden=%v", names.hidden()), func(t *testing.T) {
+			backend, _ := newStubBackend(t, 2, &bucketSettings{scheme: xor2x2Scheme{}, names: names})
+			for _, key := range keys {
+				putTestObject(t, backend, key, "content of "+key, nil)
+			}
+
+			var listed []string
+			input := &s3.ListObjectsInput{Bucket: aws.String("bucket"), Delimiter: aws.String("/"), MaxKeys: aws.Int32(2)}
+			for pages := 0; ; pages++ {
+				if pages > len(keys) {
+					t.Fatal("listing does not end")
+				}
+				result, err := backend.ListObjects(ctx, input)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var page []string
+				for _, obj := range result.Contents {
+					page = append(page, *obj.Key)
+				}
+				for _, p := range result.CommonPrefixes {
+					page = append(page, *p.Prefix)
+				}
+				sort.Strings(page)
+				listed = append(listed, page...)
+
+				// Truncated pages are full and continue after their last entry
+				truncated := aws.ToBool(result.IsTruncated)
+				if more := len(listed) < len(want); truncated != more {
+					t.Fatalf("page %d %v is truncated %v, want %v", pages, page, truncated, more)
+				}
+				if !truncated {
+					if result.NextMarker != nil {
+						t.Errorf("last page has next marker %q", *result.NextMarker)
+					}
+					break
+				}
+				if len(page) != 2 || aws.ToString(result.NextMarker) != page[len(page)-1] {
+					t.Fatalf("page %d %v has next marker %v", pages, page, aws.ToString(result.NextMarker))
+				}
+				input.Marker = result.NextMarker
+			}
+			if !reflect.DeepEqual(listed, want) {
+				t.Errorf("listing = %v, want %v", listed, want)
+			}
+		})
+	}
+}
+
+func TestListEncoding(t *testing.T) {
+	ctx := context.Background()
+	if encoding, err := listEncoding(ctx, ""); encoding != "" || err != nil {
+		t.Errorf("default encoding = %q, %v", encoding, err)
+	}
+	if encoding, err := listEncoding(ctx, types.EncodingTypeUrl); encoding != types.EncodingTypeUrl || err != nil {
+		t.Errorf("url encoding = %q, %v", encoding, err)
+	}
+	if _, err := listEncoding(ctx, "base64"); err == nil {
+		t.Error("unknown encoding accepted")
+	}
+
+	tests := map[string]string{
+		"dir/a b.txt": "dir/a%20b.txt",
+		"a+b&c=d":     "a%2Bb%26c%3Dd",
+		"ümlaut":      "%C3%BCmlaut",
+		"\x01ctrl":    "%01ctrl",
+	}
+	for value, want := range tests {
+		if got := *encodeListValue(types.EncodingTypeUrl, aws.String(value)); got != want {
+			t.Errorf("encodeListValue(%q) = %q, want %q", value, got, want)
+		}
+		if got := *encodeListValue("", aws.String(value)); got != value {
+			t.Errorf("encodeListValue(%q) without encoding = %q", value, got)
+		}
+	}
+	if encodeListValue(types.EncodingTypeUrl, nil) != nil {
+		t.Error("encoded nil value")
+	}
+}
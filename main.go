@@ -10,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -24,7 +25,6 @@ import (
 	"github.com/versity/versitygw/s3api/middlewares"
 	"github.com/versity/versitygw/s3err"
 	"github.com/versity/versitygw/s3log"
-	"github.com/versity/versitygw/s3response"
 
 	"crypto/tls"
 	"crypto/x509"
@@ -39,12 +39,26 @@ var localMinio = flag.Bool("local-minio", false, "Use local MinIO server")
 // $HOME/go/pkg/mod/github.com/versity/versitygw@v1.0.11/backend/s3proxy/s3.go
 type MyBackend struct {
 	name    string
-	client1 *s3.Client // First S3 client for .cypher.first and .rand.second
-	client2 *s3.Client // Second S3 client for .cypher.second and .rand.first
+	clients []*s3.Client // One S3 client per provider, see ShareScheme for the share placement
+	scheme  ShareScheme  // Used for buckets without a schemeKey tag
+	buckets *sync.Map    // Cache of the settings of every bucket, see settings
+	macKey  []byte       // Key of the share and manifest MACs, nil disables integrity checks
+	// Key hiding the object keys of buckets tagged hideKeysKey, see
+	// keyNames, nil if keys cannot be hidden
+	namesKey []byte
+	audit    *auditLog
+	journal  *intentJournal // Operations in progress, nil if disabled
+	upload   uploadLimits   // When shares are uploaded in parts
 }
 
 const aclKey string = "pcsAclKey"
 
+// Bucket tag selecting the share scheme of the objects in the bucket
+const schemeKey string = "pcsScheme"
+
+// Bucket tag hiding the keys of the objects in the bucket from the providers
+const hideKeysKey string = "pcsHideKeys"
+
 var defTime = time.Time{}
 
 func (MyBackend) Shutdown() {
@@ -75,46 +89,11 @@ func (self *MyBackend) String() string {
 	return self.name
 }
 
-func (MyBackend) CreateMultipartUpload(ctx context.Context, input *s3.CreateMultipartUploadInput) (s3response.InitiateMultipartUploadResult, error) {
-	log.Printf("MyBackend.CreateMultipartUpload(%v, %v)", ctx, input)
-	return s3response.InitiateMultipartUploadResult{}, s3err.GetAPIError(s3err.ErrNotImplemented)
-}
-
-func (MyBackend) CompleteMultipartUpload(ctx context.Context, input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
-	log.Printf("MyBackend.CompleteMultipartUpload(%v, %v)", ctx, input)
-	return nil, s3err.GetAPIError(s3err.ErrNotImplemented)
-}
-
-func (MyBackend) AbortMultipartUpload(ctx context.Context, input *s3.AbortMultipartUploadInput) error {
-	log.Printf("MyBackend.AbortMultipartUpload(%v, %v)", ctx, input)
-	return s3err.GetAPIError(s3err.ErrNotImplemented)
-}
-
-func (MyBackend) ListMultipartUploads(ctx context.Context, input *s3.ListMultipartUploadsInput) (s3response.ListMultipartUploadsResult, error) {
-	log.Printf("MyBackend.ListMultipartUploads(%v, %v)", ctx, input)
-	return s3response.ListMultipartUploadsResult{}, s3err.GetAPIError(s3err.ErrNotImplemented)
-}
-
-func (MyBackend) ListParts(ctx context.Context, input *s3.ListPartsInput) (s3response.ListPartsResult, error) {
-	log.Printf("MyBackend.ListParts(%v, %v)", ctx, input)
-	return s3response.ListPartsResult{}, s3err.GetAPIError(s3err.ErrNotImplemented)
-}
-
-func (MyBackend) UploadPart(ctx context.Context, input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
-	log.Printf("MyBackend.UploadPart(%v, %v)", ctx, input)
-	return nil, s3err.GetAPIError(s3err.ErrNotImplemented)
-}
-
-func (MyBackend) UploadPartCopy(ctx context.Context, input *s3.UploadPartCopyInput) (s3response.CopyPartResult, error) {
-	log.Printf("MyBackend.UploadPartCopy(%v, %v)", ctx, input)
-	return s3response.CopyPartResult{}, s3err.GetAPIError(s3err.ErrNotImplemented)
-}
-
-// createS3Client creates two AWS S3 clients with different endpoints and credentials
-func createS3Client(client1Config, client2Config S3ClientConfig) (*s3.Client, *s3.Client, error) {
+// createS3Clients creates one AWS S3 client per provider config
+func createS3Clients(configs []S3ClientConfig) ([]*s3.Client, error) {
 	// Create custom HTTP client with TLS config
 	var tlsConfig *tls.Config
-	if strings.HasPrefix(client1Config.Endpoint, "https://") {
+	if strings.HasPrefix(configs[0].Endpoint, "https://") {
 		// Get the system's root certificate pool
 		systemRoots, err := x509.SystemCertPool()
 		if err != nil {
@@ -125,12 +104,12 @@ func createS3Client(client1Config, client2Config S3ClientConfig) (*s3.Client, *s
 		certFile := filepath.Join("certs", "cert.pem")
 		cert, err := os.ReadFile(certFile)
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to read certificate file: %v", err)
+			return nil, fmt.Errorf("failed to read certificate file: %v", err)
 		}
 
 		// Add our certificate to the system's root pool
 		if !systemRoots.AppendCertsFromPEM(cert) {
-			return nil, nil, fmt.Errorf("failed to append certificate to pool")
+			return nil, fmt.Errorf("failed to append certificate to pool")
 		}
 
 		tlsConfig = &tls.Config{
@@ -151,63 +130,43 @@ func createS3Client(client1Config, client2Config S3ClientConfig) (*s3.Client, *s
 		MaxIdleConns:        100,
 		IdleConnTimeout:     90 * time.Second,
 		TLSHandshakeTimeout: 10 * time.Second,
+		// Bodies of shares take as long as the client sending or
+		// receiving the object, only the response must start in time
+		ResponseHeaderTimeout: 30 * time.Second,
 	}
 	httpClient := &http.Client{
 		Transport: tr,
-		Timeout:   30 * time.Second,
-	}
-
-	// Create custom endpoint resolver
-	customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-		return aws.Endpoint{
-			URL:               client1Config.Endpoint,
-			HostnameImmutable: true,
-			SigningRegion:     client1Config.Region,
-		}, nil
-	})
-
-	// Load AWS config for client1
-	cfg1, err := configAws.LoadDefaultConfig(context.TODO(),
-		configAws.WithRegion(client1Config.Region),
-		configAws.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(client1Config.AccessKey, client1Config.SecretKey, "")),
-		configAws.WithHTTPClient(httpClient),
-		configAws.WithEndpointResolverWithOptions(customResolver),
-	)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to load AWS config for client1: %v", err)
 	}
 
-	// Create client1 with custom options
-	client1 := s3.NewFromConfig(cfg1, func(o *s3.Options) {
-		o.UsePathStyle = true
-	})
-
-	// Create custom endpoint resolver for client2
-	customResolver2 := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-		return aws.Endpoint{
-			URL:               client2Config.Endpoint,
-			HostnameImmutable: true,
-			SigningRegion:     client2Config.Region,
-		}, nil
-	})
+	clients := make([]*s3.Client, len(configs))
+	for i, clientConfig := range configs {
+		// Create custom endpoint resolver
+		customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+			return aws.Endpoint{
+				URL:               clientConfig.Endpoint,
+				HostnameImmutable: true,
+				SigningRegion:     clientConfig.Region,
+			}, nil
+		})
+
+		// Load AWS config for the client
+		cfg, err := configAws.LoadDefaultConfig(context.TODO(),
+			configAws.WithRegion(clientConfig.Region),
+			configAws.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(clientConfig.AccessKey, clientConfig.SecretKey, "")),
+			configAws.WithHTTPClient(httpClient),
+			configAws.WithEndpointResolverWithOptions(customResolver),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS config for client%d: %v", i+1, err)
+		}
 
-	// Load AWS config for client2
-	cfg2, err := configAws.LoadDefaultConfig(context.TODO(),
-		configAws.WithRegion(client2Config.Region),
-		configAws.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(client2Config.AccessKey, client2Config.SecretKey, "")),
-		configAws.WithHTTPClient(httpClient),
-		configAws.WithEndpointResolverWithOptions(customResolver2),
-	)
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to load AWS config for client2: %v", err)
+		// Create the client with custom options
+		clients[i] = s3.NewFromConfig(cfg, func(o *s3.Options) {
+			o.UsePathStyle = true
+		})
 	}
 
-	// Create client2 with custom options
-	client2 := s3.NewFromConfig(cfg2, func(o *s3.Options) {
-		o.UsePathStyle = true
-	})
-
-	return client1, client2, nil
+	return clients, nil
 }
 
 func main() {
@@ -230,45 +189,38 @@ func main() {
 	})
 
 	// Load S3 client configs
-	client1Config, client2Config, err := LoadDefaultConfigs(*localMinio)
+	configs, err := LoadDefaultConfigs(*localMinio)
 	if err != nil {
 		log.Fatalf("Failed to load configurations: %v", err)
 	}
 
-	log.Printf("Initializing S3 clients...")
-	log.Printf("Client1 config - Endpoint: %s, Region: %s", client1Config.Endpoint, client1Config.Region)
-	log.Printf("Client2 config - Endpoint: %s, Region: %s", client2Config.Endpoint, client2Config.Region)
+	log.Printf("Initializing %d S3 clients...", len(configs))
+	for i, clientConfig := range configs {
+		log.Printf("Client%d config - Endpoint: %s, Region: %s", i+1, clientConfig.Endpoint, clientConfig.Region)
+	}
 
 	// Create the S3 clients with different endpoints
-	client1, client2, err := createS3Client(client1Config, client2Config)
+	clients, err := createS3Clients(configs)
 	if err != nil {
 		log.Fatalf("Failed to create S3 clients: %v", err)
 	}
 
-	// Test both clients with a simple operation
+	// Test all clients with a simple operation
 	ctx := context.Background()
 
-	// Test client1
-	log.Printf("Testing client1 connection...")
-	_, err = client1.ListBuckets(ctx, &s3.ListBucketsInput{})
-	if err != nil {
-		log.Printf("Warning: client1 test failed: %v", err)
-	} else {
-		log.Printf("client1 test successful")
-	}
-
-	// Test client2 with more detailed logging
-	log.Printf("Testing client2 connection...")
-	_, err = client2.ListBuckets(ctx, &s3.ListBucketsInput{})
-	if err != nil {
-		log.Printf("Warning: client2 test failed: %v", err)
-	} else {
-		log.Printf("client2 test successful")
+	for i, client := range clients {
+		log.Printf("Testing client%d connection...", i+1)
+		_, err = client.ListBuckets(ctx, &s3.ListBucketsInput{})
+		if err != nil {
+			log.Printf("Warning: client%d test failed: %v", i+1, err)
+		} else {
+			log.Printf("client%d test successful", i+1)
+		}
 	}
 
 	// Additional test for client2 - try to list objects in the bucket
 	log.Printf("Testing client2 bucket access...")
-	_, err = client2.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+	_, err = clients[1].ListObjectsV2(ctx, &s3.ListObjectsV2Input{
 		Bucket: aws.String("freiburg-bucket"),
 	})
 	if err != nil {
@@ -277,11 +229,108 @@ func main() {
 		log.Printf("client2 bucket test successful")
 	}
 
+	scheme, err := LoadScheme(len(clients))
+	if err != nil {
+		log.Fatalf("Failed to configure share scheme: %v", err)
+	}
+
+	key, err := LoadMACKey()
+	if err != nil {
+		log.Fatalf("Failed to configure integrity checks: %v", err)
+	}
+	if key == nil {
+		log.Printf("Warning: no --mac-key given, shares are not protected against tampering")
+	}
+	namesKey, err := LoadNamesKey(key)
+	if err != nil {
+		log.Fatalf("Failed to configure hidden keys: %v", err)
+	}
+
+	upload, err := LoadUploadLimits()
+	if err != nil {
+		log.Fatalf("Failed to configure uploads: %v", err)
+	}
+
+	audit, err := openAuditLog(filepath.Join(logDir, "audit.log"))
+	if err != nil {
+		log.Fatalf("Failed to open audit log: %v", err)
+	}
+
 	// Initialize backend with the S3 clients
 	backend := &MyBackend{
-		name:    "aws-s3-backend",
-		client1: client1,
-		client2: client2,
+		name:     "aws-s3-backend",
+		clients:  clients,
+		scheme:   scheme,
+		buckets:  &sync.Map{},
+		macKey:   key,
+		namesKey: namesKey,
+		audit:    audit,
+		upload:   upload,
+	}
+
+	// Hidden keys cannot be read with another key, buckets with objects
+	// stored under them would appear empty
+	if err := backend.checkHiddenBuckets(ctx); err != nil {
+		log.Fatalf("Failed to check the buckets with hidden keys: %v", err)
+	}
+
+	checkBucket, checkOpts, err := LoadFsckOptions()
+	if err != nil {
+		log.Fatalf("Failed to configure the consistency check: %v", err)
+	}
+	reconcile, err := LoadReconcileMode()
+	if err != nil {
+		log.Fatalf("Failed to configure the bucket reconciliation: %v", err)
+	}
+	refreshBucket, refreshOpts, refreshEvery, err := LoadRefreshOptions()
+	if err != nil {
+		log.Fatalf("Failed to configure the share refresh: %v", err)
+	}
+
+	// Complete or undo the operations interrupted by the last run before
+	// checking buckets or serving requests that could see their effects
+	journal, err := LoadJournal()
+	if err != nil {
+		log.Fatalf("Failed to open the intent journal: %v", err)
+	}
+	backend.journal = journal
+	backend.replayJournal(ctx)
+
+	if checkBucket != "" {
+		remaining, err := backend.runFsck(ctx, checkBucket, checkOpts, os.Stdout)
+		if err != nil {
+			log.Fatalf("Failed to check bucket %s: %v", checkBucket, err)
+		}
+		if remaining > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if reconcile != "" {
+		remaining, err := backend.runReconcile(ctx, reconcile, os.Stdout)
+		if err != nil {
+			log.Fatalf("Failed to reconcile buckets: %v", err)
+		}
+		if remaining > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if refreshBucket != "" {
+		failed, err := backend.runRefresh(ctx, refreshBucket, refreshOpts, os.Stdout)
+		if err != nil {
+			log.Fatalf("Failed to refresh bucket %s: %v", refreshBucket, err)
+		}
+		if failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if refreshEvery > 0 {
+		go backend.refreshPeriodically(ctx, refreshEvery, refreshOpts.rate)
 	}
 
 	iam, err := auth.New(&auth.Opts{
@@ -0,0 +1,830 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/versity/versitygw/s3err"
+)
+
+// suffixManifest is the suffix of the manifest of a logical object
+const suffixManifest = ".manifest"
+
+// manifestVersion is the format version of the manifests written
+const manifestVersion = 1
+
+// errNoRecord is returned for records, such as manifests, that are not
+// stored on the providers
+var errNoRecord = errors.New("record not found")
+
+var errNoManifest = fmt.Errorf("object has no manifest: %w", errNoRecord)
+
+// objectManifest describes a logical object. It is written to every
+// provider as <key>.manifest once all shares are stored and is the source
+// of truth for the existence, size and metadata of the object. Objects
+// without a manifest are inferred from their shares.
+//
+// With a MAC key the headers, metadata, digests and origin of the object
+// are sealed, see manifestSecrets. The providers still read the version,
+// the scheme, the keys, placement, sizes, ETags and MACs of the shares,
+// the size and parts of the object and when it was created, which they
+// mostly learn from the shares anyway. Without a MAC key the whole
+// manifest is stored in the clear.
+type objectManifest struct {
+	Version int             `json:"version"`
+	Scheme  string          `json:"scheme"` // ShareScheme.name()
+	Shares  []manifestShare `json:"shares"` // In the order of ShareScheme.shares()
+	Size    int64           `json:"size"`
+	objectHeaders
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Checksums manifestChecksums `json:"checksums"`
+	Created   time.Time         `json:"created"`
+	ETag      string            `json:"etag,omitempty"`   // If not the MD5 of the object
+	Parts     []manifestPart    `json:"parts,omitempty"`  // Only for objects uploaded in parts
+	Origin    *manifestOrigin   `json:"origin,omitempty"` // Only for objects copied share by share
+	// Encryption of manifestSecrets, which are then left empty, as stored
+	// on the providers. Manifests in memory are never sealed.
+	Sealed string `json:"sealed,omitempty"`
+	MAC    string `json:"mac,omitempty"` // See manifestMAC
+}
+
+// manifestSecrets are the fields of a manifest that are sealed, see
+// MyBackend.seal: the headers and metadata describe the original file and
+// its digests tell the providers whether it is one they know
+type manifestSecrets struct {
+	objectHeaders
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Checksums manifestChecksums `json:"checksums"`
+	ETag      string            `json:"etag,omitempty"`
+	Origin    *manifestOrigin   `json:"origin,omitempty"`
+}
+
+func (m *objectManifest) macField() *string {
+	return &m.MAC
+}
+
+// objectHeaders are the HTTP headers of a logical object as uploaded. The
+// shares do not carry them, so they are kept with the metadata.
+type objectHeaders struct {
+	ContentType        string     `json:"contentType,omitempty"`
+	CacheControl       string     `json:"cacheControl,omitempty"`
+	ContentDisposition string     `json:"contentDisposition,omitempty"`
+	ContentEncoding    string     `json:"contentEncoding,omitempty"`
+	ContentLanguage    string     `json:"contentLanguage,omitempty"`
+	Expires            *time.Time `json:"expires,omitempty"`
+}
+
+// newObjectHeaders returns the headers given with an upload
+func newObjectHeaders(contentType, cacheControl, contentDisposition, contentEncoding, contentLanguage *string,
+	expires *time.Time,
+) objectHeaders {
+	h := objectHeaders{
+		ContentType:        aws.ToString(contentType),
+		CacheControl:       aws.ToString(cacheControl),
+		ContentDisposition: aws.ToString(contentDisposition),
+		ContentEncoding:    aws.ToString(contentEncoding),
+		ContentLanguage:    aws.ToString(contentLanguage),
+	}
+	if expires != nil && !expires.IsZero() {
+		h.Expires = aws.Time(expires.UTC())
+	}
+	return h
+}
+
+// headObjectHeaders returns the headers of a HeadObject response
+func headObjectHeaders(head *s3.HeadObjectOutput) objectHeaders {
+	return newObjectHeaders(head.ContentType, head.CacheControl, head.ContentDisposition,
+		head.ContentEncoding, head.ContentLanguage, head.Expires)
+}
+
+// optional returns a header for a response, nil if it was not set
+func optional(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return aws.String(value)
+}
+
+// manifestShare records where a share is stored
+type manifestShare struct {
+	Key      string `json:"key"`
+	Provider int    `json:"provider"`
+	Size     int64  `json:"size"`
+	ETag     string `json:"etag,omitempty"` // As returned by the provider
+	MAC      string `json:"mac,omitempty"`  // Hex encoded, see newShareMAC
+	// Base64 encoded MACs of the chunks of the share, see newChunkMAC.
+	// Missing in manifests of older gateways.
+	Chunks string `json:"chunks,omitempty"`
+}
+
+// manifestOrigin names the object the share MACs are bound to, the object
+// the shares were copied from. The manifest itself is bound to the copy.
+type manifestOrigin struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+// macOrigin returns the object the share MACs of the object stored as
+// bucket/key are bound to
+func (m *objectManifest) macOrigin(bucket, key string) manifestOrigin {
+	if m.Origin != nil {
+		return *m.Origin
+	}
+	return manifestOrigin{Bucket: bucket, Key: key}
+}
+
+// manifestPart describes a part of an object uploaded in parts. Every part
+// is split on its own, the share objects are the concatenation of the
+// shares of the parts, see storedPartLength.
+type manifestPart struct {
+	Number int      `json:"number"`
+	Size   int64    `json:"size"`
+	MACs   []string `json:"macs,omitempty"` // Hex encoded per share, see newPartMAC
+	// Base64 encoded chunk MACs per share, see newChunkMAC
+	Chunks []string `json:"chunks,omitempty"`
+}
+
+// manifestChecksums holds hex encoded digests of the original file and
+// the additional checksum requested when it was uploaded
+type manifestChecksums struct {
+	MD5       string                  `json:"md5"`
+	SHA256    string                  `json:"sha256"` // Only in manifests of older gateways`
+	Algorithm types.ChecksumAlgorithm `json:"algorithm,omitempty"`
+	Checksum  string                  `json:"checksum,omitempty"` // Base64 encoded like x-amz-checksum-*
+}
+
+// scheme returns the share scheme of the object after checking that the
+// shares match it
+func (m *objectManifest) scheme(providers int) (ShareScheme, error) {
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	scheme, err := parseScheme(m.Scheme, providers)
+	if err == nil {
+		err = checkProviders(scheme, providers)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Shares) != len(scheme.shares()) {
+		return nil, fmt.Errorf("manifest lists %d shares, scheme %s has %d",
+			len(m.Shares), m.Scheme, len(scheme.shares()))
+	}
+	for i, share := range m.Shares {
+		if share.Provider < 0 || share.Provider >= providers {
+			return nil, fmt.Errorf("share %d is stored on unknown provider %d", i, share.Provider)
+		}
+	}
+	if len(m.Parts) > 0 {
+		if err := m.checkParts(scheme); err != nil {
+			return nil, err
+		}
+	}
+	return scheme, nil
+}
+
+// checkParts checks that the parts of the object add up to its size and
+// to the sizes of its share objects
+func (m *objectManifest) checkParts(scheme ShareScheme) error {
+	shares := scheme.shares()
+	var size int64
+	stored := make([]int64, len(shares))
+	for _, part := range m.Parts {
+		if part.Size < 0 || (len(part.MACs) != 0 && len(part.MACs) != len(shares)) ||
+			(len(part.Chunks) != 0 && len(part.Chunks) != len(shares)) {
+			return fmt.Errorf("invalid part %d", part.Number)
+		}
+		size += part.Size
+		for i, share := range shares {
+			stored[i] += storedPartLength(scheme, share, part.Size)
+		}
+	}
+	if size != m.Size {
+		return fmt.Errorf("parts add up to %d bytes, manifest records %d", size, m.Size)
+	}
+	for i, share := range m.Shares {
+		if share.Size != stored[i] {
+			return fmt.Errorf("share %d has %d bytes, its parts %d", i, share.Size, stored[i])
+		}
+	}
+	return nil
+}
+
+// partLayout locates a part of a logical object in its share objects
+type partLayout struct {
+	number int      // Part number, 0 if the object was not uploaded in parts
+	offset int64    // Offset of the part in the logical object
+	size   int64    // Length of the part
+	shares []int64  // Offset of the part in every share object
+	macs   []string // Hex encoded MAC of every share of the part
+	chunks []string // Base64 encoded chunk MACs of every share of the part
+}
+
+// layout returns the parts of the object in order. An object not uploaded
+// in parts consists of one part spanning the share objects.
+func (m *objectManifest) layout(scheme ShareScheme) []partLayout {
+	if len(m.Parts) == 0 {
+		macs := make([]string, len(m.Shares))
+		chunks := make([]string, len(m.Shares))
+		for i, share := range m.Shares {
+			macs[i] = share.MAC
+			chunks[i] = share.Chunks
+		}
+		return []partLayout{{size: m.Size, shares: make([]int64, len(m.Shares)), macs: macs, chunks: chunks}}
+	}
+
+	shares := scheme.shares()
+	layout := make([]partLayout, len(m.Parts))
+	offsets := make([]int64, len(shares))
+	var offset int64
+	for p, part := range m.Parts {
+		layout[p] = partLayout{
+			number: part.Number,
+			offset: offset,
+			size:   part.Size,
+			shares: slices.Clone(offsets),
+			macs:   part.MACs,
+			chunks: part.Chunks,
+		}
+		for i, share := range shares {
+			offsets[i] += storedPartLength(scheme, share, part.Size)
+		}
+		offset += part.Size
+	}
+	return layout
+}
+
+// shareMAC returns the MAC of share index of the part, which has the given
+// length, of the object the MACs are bound to
+func (p partLayout) shareMAC(macKey []byte, origin manifestOrigin, index int, length int64) hash.Hash {
+	if p.number == 0 {
+		return newShareMAC(macKey, origin.Bucket, origin.Key, index, length)
+	}
+	return newPartMAC(macKey, origin.Bucket, origin.Key, index, p.number, length)
+}
+
+// chunkMAC returns the MAC of chunk number chunk of share index of the
+// part, which has the given length, of the object the MACs are bound to
+func (p partLayout) chunkMAC(macKey []byte, origin manifestOrigin, index int, length, chunk int64) hash.Hash {
+	return newChunkMAC(macKey, origin.Bucket, origin.Key, index, p.number, length, chunk)
+}
+
+// isNotFound reports whether err means that an object does not exist
+func isNotFound(err error) bool {
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		return ae.ErrorCode() == "NoSuchKey" || ae.ErrorCode() == "NotFound"
+	}
+	return false
+}
+
+// isPreconditionFailed reports whether err means that a conditional write
+// was refused because of the object stored by the provider
+func isPreconditionFailed(err error) bool {
+	var ae smithy.APIError
+	if errors.As(err, &ae) {
+		return ae.ErrorCode() == "PreconditionFailed" || ae.ErrorCode() == "ConditionalRequestConflict"
+	}
+	return false
+}
+
+// writeReplicated stores the JSON encoding of record v as key on all
+// providers
+func (self *MyBackend) writeReplicated(ctx context.Context, bucket, key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return firstError(self.putReplicated(ctx, bucket, key, data, nil))
+}
+
+// createReplicated stores the JSON encoding of record v as key on all
+// providers if none of them has one yet. Each provider only creates the
+// key if it does not exist, and the copies already written are removed
+// again if any provider refuses, so either all providers or none store the
+// record. Providers ignoring conditional writes are overwritten.
+func (self *MyBackend) createReplicated(ctx context.Context, bucket, key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	conds := make([]writeCondition, len(self.clients))
+	for i := range conds {
+		conds[i].ifNoneMatch = aws.String("*")
+	}
+	errs := self.putReplicated(ctx, bucket, key, data, conds)
+	if firstError(errs) == nil {
+		return nil
+	}
+	return self.rollbackReplicated(context.WithoutCancel(ctx), bucket, key, errs, nil)
+}
+
+// storedCopy is the copy of a record stored by one provider
+type storedCopy struct {
+	etag string
+	data []byte
+}
+
+// readCopies returns the copy of the record stored as key on every
+// provider, nil for the providers that do not have one
+func (self *MyBackend) readCopies(ctx context.Context, bucket, key string) ([]*storedCopy, error) {
+	copies := make([]*storedCopy, len(self.clients))
+	for i, client := range self.clients {
+		output, err := client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(output.Body)
+		output.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		copies[i] = &storedCopy{etag: aws.ToString(output.ETag), data: data}
+	}
+	return copies, nil
+}
+
+// rollbackReplicated undoes a conditional write of the record stored as
+// key that failed on some providers: the providers that accepted it get
+// their copy from copies back, or lose the record if they had none. It
+// returns the error of the write, a failed precondition if any provider
+// refused it because of the copy it stores. Failures of the rollback are
+// only logged.
+func (self *MyBackend) rollbackReplicated(ctx context.Context, bucket, key string, errs []error, copies []*storedCopy) error {
+	err := firstError(errs)
+	for i, client := range self.clients {
+		if errs[i] != nil {
+			// S3 answers If-Match on a missing key with NoSuchKey
+			if isPreconditionFailed(errs[i]) || isNotFound(errs[i]) {
+				err = s3err.GetAPIError(s3err.ErrPreconditionFailed)
+			}
+			continue
+		}
+		var rollbackErr error
+		if copies != nil && copies[i] != nil {
+			_, rollbackErr = client.PutObject(ctx, &s3.PutObjectInput{
+				Bucket:        aws.String(bucket),
+				Key:           aws.String(key),
+				Body:          bytes.NewReader(copies[i].data),
+				ContentLength: aws.Int64(int64(len(copies[i].data))),
+				ContentType:   aws.String("application/json"),
+			})
+		} else {
+			_, rollbackErr = client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(key),
+			})
+		}
+		if rollbackErr != nil && !isNotFound(rollbackErr) {
+			log.Printf("Failed to roll back %s on client%d: %v", key, i+1, rollbackErr)
+		}
+	}
+	return err
+}
+
+// writeCondition is the condition of a write of a record to one provider
+type writeCondition struct {
+	ifMatch, ifNoneMatch *string
+}
+
+// putReplicated stores data as key on all providers, with the condition
+// of each provider if conds is not nil, and returns the error of every
+// provider
+func (self *MyBackend) putReplicated(ctx context.Context, bucket, key string, data []byte, conds []writeCondition) []error {
+	errs := make([]error, len(self.clients))
+	var wg sync.WaitGroup
+	for i, client := range self.clients {
+		wg.Add(1)
+		go func(i int, client *s3.Client) {
+			defer wg.Done()
+			input := &s3.PutObjectInput{
+				Bucket:        aws.String(bucket),
+				Key:           aws.String(key),
+				Body:          bytes.NewReader(data),
+				ContentLength: aws.Int64(int64(len(data))),
+				ContentType:   aws.String("application/json"),
+			}
+			if conds != nil {
+				input.IfMatch, input.IfNoneMatch = conds[i].ifMatch, conds[i].ifNoneMatch
+			}
+			_, errs[i] = client.PutObject(ctx, input)
+		}(i, client)
+	}
+	wg.Wait()
+	return errs
+}
+
+// readReplicated returns the record stored as key from the first provider
+// that has a valid copy, check validates the decoded records. Copies
+// failing their integrity check are recorded in the audit log as
+// belonging to object. As records are written to all providers, it
+// returns errNoRecord if any provider does not have one and none has a
+// valid one, unless a copy failed its integrity check.
+func readReplicated[T any](ctx context.Context, self *MyBackend, bucket, key, object string, check func(*T) error) (*T, error) {
+	var firstErr, tampered error
+	notFound := false
+	for i, client := range self.clients {
+		var v T
+		err := readRecordFrom(ctx, client, bucket, key, &v)
+		if err == nil {
+			if err = check(&v); err == nil {
+				return &v, nil
+			}
+			if isIntegrityError(err) {
+				self.audit.record(auditEvent{
+					Event:    auditManifestTampered,
+					Bucket:   bucket,
+					Key:      object,
+					Share:    key,
+					Provider: i + 1,
+					Reason:   err.Error(),
+				})
+				if tampered == nil {
+					tampered = err
+				}
+				continue
+			}
+		}
+		if isNotFound(err) {
+			notFound = true
+			continue
+		}
+		log.Printf("Failed to read %s from client%d: %v", key, i+1, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if tampered != nil {
+		return nil, tampered
+	}
+	if notFound || firstErr == nil {
+		return nil, errNoRecord
+	}
+	return nil, firstErr
+}
+
+// readRecordFrom reads and decodes the record with the given key into v
+func readRecordFrom(ctx context.Context, client *s3.Client, bucket, key string, v any) error {
+	output, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	defer output.Body.Close()
+
+	if err := json.NewDecoder(output.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid record %s: %w", key, err)
+	}
+	return nil
+}
+
+// deleteReplicated removes the record stored as key from all providers
+func (self *MyBackend) deleteReplicated(ctx context.Context, bucket, key string) error {
+	var errs []error
+	for _, client := range self.clients {
+		_, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil && !isNotFound(err) {
+			errs = append(errs, err)
+		}
+	}
+	return firstError(errs)
+}
+
+// sealManifest returns manifest m of key as stored on the providers, with
+// its secrets sealed if a MAC key is configured. The MAC of m covers the
+// secrets in the clear.
+func (self *MyBackend) sealManifest(bucket, key string, m *objectManifest) (*objectManifest, error) {
+	sealed, err := self.seal(bucket, key+suffixManifest, manifestSecrets{
+		objectHeaders: m.objectHeaders,
+		Metadata:      m.Metadata,
+		Checksums:     m.Checksums,
+		ETag:          m.ETag,
+		Origin:        m.Origin,
+	})
+	if err != nil || sealed == "" {
+		return m, err
+	}
+	stored := *m
+	stored.objectHeaders, stored.Metadata = objectHeaders{}, nil
+	stored.Checksums, stored.ETag, stored.Origin = manifestChecksums{}, "", nil
+	stored.Sealed = sealed
+	return &stored, nil
+}
+
+// unsealManifest restores the sealed secrets of manifest m of key as read
+// from a provider
+func (self *MyBackend) unsealManifest(bucket, key string, m *objectManifest) error {
+	if m.Sealed == "" {
+		return nil
+	}
+	var secrets manifestSecrets
+	if err := self.unseal("manifest", bucket, key+suffixManifest, m.Sealed, &secrets); err != nil {
+		return err
+	}
+	m.objectHeaders, m.Metadata = secrets.objectHeaders, secrets.Metadata
+	m.Checksums, m.ETag, m.Origin = secrets.Checksums, secrets.ETag, secrets.Origin
+	m.Sealed = ""
+	return nil
+}
+
+// writeManifest stores the manifest of key on all providers
+func (self *MyBackend) writeManifest(ctx context.Context, bucket, key string, m *objectManifest) error {
+	stored, err := self.sealManifest(bucket, key, m)
+	if err != nil {
+		return err
+	}
+	return self.writeReplicated(ctx, bucket, key+suffixManifest, stored)
+}
+
+// createManifest publishes the manifest of key unless another manifest of
+// key is stored, see createReplicated
+func (self *MyBackend) createManifest(ctx context.Context, bucket, key string, m *objectManifest) error {
+	stored, err := self.sealManifest(bucket, key, m)
+	if err != nil {
+		return err
+	}
+	return self.createReplicated(ctx, bucket, key+suffixManifest, stored)
+}
+
+// readManifest returns the manifest of key from the first provider that
+// has a valid copy, or errNoManifest
+func (self *MyBackend) readManifest(ctx context.Context, bucket, key string) (*objectManifest, error) {
+	m, err := readReplicated(ctx, self, bucket, key+suffixManifest, key, func(m *objectManifest) error {
+		if err := self.unsealManifest(bucket, key, m); err != nil {
+			return err
+		}
+		if err := self.verifyManifest(bucket, key, m); err != nil {
+			return err
+		}
+		_, err := m.scheme(len(self.clients))
+		return err
+	})
+	if errors.Is(err, errNoRecord) {
+		return nil, errNoManifest
+	}
+	return m, err
+}
+
+// deleteManifest removes the manifest of key from all providers, which
+// unpublishes the object
+func (self *MyBackend) deleteManifest(ctx context.Context, bucket, key string) error {
+	return self.deleteReplicated(ctx, bucket, key+suffixManifest)
+}
+
+// replaceManifest publishes manifest m of key, replacing the object
+// published before, and removes the share objects of the replaced object
+// that m does not reference. The shares of objects without a manifest are
+// those given by the scheme. If m cannot be written to every provider, the
+// replaced object is restored on the providers that already store m.
+func (self *MyBackend) replaceManifest(ctx context.Context, bucket, key string, scheme ShareScheme, m *objectManifest) error {
+	old, err := self.readManifest(ctx, bucket, key)
+	known := err == nil || errors.Is(err, errNoManifest)
+	if !known {
+		log.Printf("Failed to read the replaced manifest of %s: %v", key, err)
+	}
+	if err := self.writeManifest(ctx, bucket, key, m); err != nil {
+		if known {
+			self.restoreManifest(context.WithoutCancel(ctx), bucket, key, old)
+		}
+		return err
+	}
+	self.deleteShares(ctx, bucket, replacedShares(key, scheme, old, m))
+	return nil
+}
+
+// replaceManifestIf is replaceManifest for conditional writes: check
+// evaluates the conditions on the object published once the copies of its
+// manifest are read, and each provider then only replaces the copy it
+// stored, with If-Match on its ETag, or creates one if it had none. If the
+// manifest changed on any provider in between, the providers that already
+// store m get their copy back and the write fails its precondition, so of
+// concurrent conditional writes at most one succeeds. This relies on the
+// providers supporting conditional writes.
+func (self *MyBackend) replaceManifestIf(ctx context.Context, bucket, key string, scheme ShareScheme,
+	m *objectManifest, check func() error,
+) error {
+	copies, err := self.readCopies(ctx, bucket, key+suffixManifest)
+	if err != nil {
+		return err
+	}
+	old, err := self.readManifest(ctx, bucket, key)
+	if err != nil && !errors.Is(err, errNoManifest) {
+		return err
+	}
+	if err := check(); err != nil {
+		return err
+	}
+
+	stored, err := self.sealManifest(bucket, key, m)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	conds := make([]writeCondition, len(copies))
+	for i, c := range copies {
+		if c != nil {
+			conds[i].ifMatch = aws.String(c.etag)
+		} else {
+			conds[i].ifNoneMatch = aws.String("*")
+		}
+	}
+	errs := self.putReplicated(ctx, bucket, key+suffixManifest, data, conds)
+	if firstError(errs) != nil {
+		return self.rollbackReplicated(context.WithoutCancel(ctx), bucket, key+suffixManifest, errs, copies)
+	}
+	self.deleteShares(ctx, bucket, replacedShares(key, scheme, old, m))
+	return nil
+}
+
+// replacedShares returns the share objects of manifest old of key that
+// manifest m does not reference
+func replacedShares(key string, scheme ShareScheme, old, m *objectManifest) []manifestShare {
+	current := make(map[manifestShare]bool, len(m.Shares))
+	for _, share := range m.Shares {
+		current[manifestShare{Key: share.Key, Provider: share.Provider}] = true
+	}
+	var replaced []manifestShare
+	for _, share := range shareLocations(key, scheme, old) {
+		if !current[manifestShare{Key: share.Key, Provider: share.Provider}] {
+			replaced = append(replaced, share)
+		}
+	}
+	return replaced
+}
+
+// restoreManifest publishes manifest old of key again after a failed
+// replacement, or unpublishes key if it had no manifest. Failures are only
+// logged.
+func (self *MyBackend) restoreManifest(ctx context.Context, bucket, key string, old *objectManifest) {
+	var err error
+	if old != nil {
+		err = self.writeManifest(ctx, bucket, key, old)
+	} else {
+		err = self.deleteManifest(ctx, bucket, key)
+	}
+	if err != nil {
+		log.Printf("Failed to restore the manifest of %s: %v", key, err)
+	}
+}
+
+// deleteShares removes share objects. Failures are logged and the first
+// one is returned, callers that cannot act on it may ignore it.
+func (self *MyBackend) deleteShares(ctx context.Context, bucket string, shares []manifestShare) error {
+	var errs []error
+	for _, share := range shares {
+		_, err := self.clients[share.Provider].DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(share.Key),
+		})
+		if err != nil && !isNotFound(err) {
+			log.Printf("Failed to delete share %s from client%d: %v", share.Key, share.Provider+1, err)
+			errs = append(errs, err)
+		}
+	}
+	return firstError(errs)
+}
+
+// manifestObjects returns the list entries of the logical objects of which
+// a manifest is listed. listed[i] holds the objects listed on client i.
+func (self *MyBackend) manifestObjects(ctx context.Context, bucket string, listed [][]types.Object) ([]types.Object, error) {
+	found := make(map[string]bool)
+	var keys []string
+	for _, contents := range listed {
+		for _, obj := range contents {
+			if base, ok := strings.CutSuffix(*obj.Key, suffixManifest); ok && !found[base] {
+				found[base] = true
+				keys = append(keys, base)
+			}
+		}
+	}
+
+	objects := make([]*types.Object, len(keys))
+	errs := make([]error, len(keys))
+	limit := make(chan struct{}, 16) // Concurrent reads
+	var wg sync.WaitGroup
+	for j, key := range keys {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(j int, key string) {
+			defer func() { <-limit; wg.Done() }()
+			m, err := self.readManifest(ctx, bucket, key)
+			if err != nil {
+				// The object may have been deleted since it was listed
+				if !errors.Is(err, errNoManifest) {
+					errs[j] = err
+				}
+				return
+			}
+			entry := manifestEntry(key, m)
+			objects[j] = &entry
+		}(j, key)
+	}
+	wg.Wait()
+	if err := firstError(errs); err != nil {
+		return nil, err
+	}
+
+	var result []types.Object
+	for _, obj := range objects {
+		if obj != nil {
+			result = append(result, *obj)
+		}
+	}
+	return result, nil
+}
+
+// manifestEntry returns the list entry of a logical object
+func manifestEntry(key string, m *objectManifest) types.Object {
+	head := m.headOutput("")
+	entry := types.Object{
+		Key:          aws.String(key),
+		Size:         head.ContentLength,
+		LastModified: head.LastModified,
+		ETag:         head.ETag,
+		StorageClass: types.ObjectStorageClassStandard,
+	}
+	if m.Checksums.Algorithm != "" {
+		entry.ChecksumAlgorithm = []types.ChecksumAlgorithm{m.Checksums.Algorithm}
+		entry.ChecksumType = m.Checksums.checksumType()
+	}
+	return entry
+}
+
+// headOutput returns the HeadObject response for the logical object, with
+// its additional checksum if the checksum mode is enabled
+func (m *objectManifest) headOutput(mode types.ChecksumMode) *s3.HeadObjectOutput {
+	output := &s3.HeadObjectOutput{
+		AcceptRanges:       aws.String("bytes"),
+		CacheControl:       optional(m.CacheControl),
+		ContentDisposition: optional(m.ContentDisposition),
+		ContentEncoding:    optional(m.ContentEncoding),
+		ContentLanguage:    optional(m.ContentLanguage),
+		ContentLength:      aws.Int64(m.Size),
+		ContentType:        optional(m.ContentType),
+		Expires:            m.Expires,
+		LastModified:       aws.Time(m.Created),
+		Metadata:           m.Metadata,
+	}
+	// Manifests written before the ETag was the MD5 of the object have no
+	// checksums
+	switch {
+	case m.ETag != "":
+		output.ETag = aws.String(m.ETag)
+	case m.Checksums.MD5 != "":
+		output.ETag = aws.String(m.Checksums.etag())
+	case len(m.Shares) > 0 && m.Shares[0].ETag != "":
+		output.ETag = aws.String(m.Shares[0].ETag)
+	}
+	if mode == types.ChecksumModeEnabled {
+		output.ChecksumCRC32 = m.Checksums.value(types.ChecksumAlgorithmCrc32)
+		output.ChecksumCRC32C = m.Checksums.value(types.ChecksumAlgorithmCrc32c)
+		output.ChecksumCRC64NVME = m.Checksums.value(types.ChecksumAlgorithmCrc64nvme)
+		output.ChecksumSHA1 = m.Checksums.value(types.ChecksumAlgorithmSha1)
+		output.ChecksumSHA256 = m.Checksums.value(types.ChecksumAlgorithmSha256)
+		output.ChecksumType = m.Checksums.checksumType()
+	}
+	return output
+}
+
+// shareLocations returns the keys and placement of the shares of the
+// logical object key as recorded in its manifest m, or as given by the
+// scheme if there is no manifest
+func shareLocations(key string, scheme ShareScheme, m *objectManifest) []manifestShare {
+	if m != nil {
+		return m.Shares
+	}
+	shares := scheme.shares()
+	locations := make([]manifestShare, len(shares))
+	for i, share := range shares {
+		locations[i] = manifestShare{Key: key + share.suffix, Provider: share.provider}
+	}
+	return locations
+}
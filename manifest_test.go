@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+// testManifest returns the manifest of a 42 byte object stored with the
+// given scheme on the providers of the scheme
+func testManifest(scheme ShareScheme) *objectManifest {
+	m := &objectManifest{
+		Version:       manifestVersion,
+		Scheme:        scheme.name(),
+		Size:          42,
+		objectHeaders: objectHeaders{ContentType: "text/plain"},
+		Metadata:      map[string]string{"owner": "alice"},
+		Created:       time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+	for i, share := range shareLocations("dir/a.txt", scheme, nil) {
+		share.Size = 42
+		share.ETag = `"etag` + string(rune('0'+i)) + `"`
+		m.Shares = append(m.Shares, share)
+	}
+	return m
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	m := testManifest(shamirScheme{providers: 3, k: 2})
+	h := newObjectHasher(uploadDigests{})
+	h.Write([]byte("hello world"))
+	m.Checksums = h.checksums()
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("Failed to marshal manifest: %v", err)
+	}
+	var got objectManifest
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Failed to unmarshal manifest: %v", err)
+	}
+	if !reflect.DeepEqual(&got, m) {
+		t.Errorf("got %+v, want %+v", got, *m)
+	}
+
+	if got.Checksums.MD5 != "5eb63bbbe01eeed093cb22bb8f5acdc3" {
+		t.Errorf("MD5 = %s", got.Checksums.MD5)
+	}
+	// SHA-256 is only computed if requested
+	if got.Checksums.SHA256 != "" || got.Checksums.Checksum != "" {
+		t.Errorf("checksums %+v without a requested algorithm", got.Checksums)
+	}
+}
+
+func TestManifestScheme(t *testing.T) {
+	want := rsScheme{providers: 3, k: 4, m: 2}
+	if got, err := testManifest(want).scheme(3); err != nil || got != want {
+		t.Errorf("scheme() = %v, %v, want %v", got, err, want)
+	}
+
+	for name, modify := range map[string]func(m *objectManifest){
+		"version":  func(m *objectManifest) { m.Version = manifestVersion + 1 },
+		"scheme":   func(m *objectManifest) { m.Scheme = "rot13" },
+		"shares":   func(m *objectManifest) { m.Shares = m.Shares[1:] },
+		"provider": func(m *objectManifest) { m.Shares[0].Provider = 3 },
+	} {
+		m := testManifest(want)
+		modify(m)
+		if got, err := m.scheme(3); err == nil {
+			t.Errorf("%s: scheme() = %v, want an error", name, got)
+		}
+	}
+}
+
+func TestManifestEntry(t *testing.T) {
+	m := testManifest(xorScheme{providers: 2})
+	head := m.headOutput("")
+	if aws.ToInt64(head.ContentLength) != 42 || aws.ToString(head.ContentType) != "text/plain" ||
+		aws.ToString(head.ETag) != `"etag0"` || !aws.ToTime(head.LastModified).Equal(m.Created) ||
+		head.Metadata["owner"] != "alice" {
+		t.Errorf("unexpected HeadObject output %+v", head)
+	}
+
+	entry := manifestEntry("dir/a.txt", m)
+	if aws.ToString(entry.Key) != "dir/a.txt" || aws.ToInt64(entry.Size) != 42 || aws.ToString(entry.ETag) != `"etag0"` {
+		t.Errorf("unexpected list entry %+v", entry)
+	}
+}
+
+func TestShareLocations(t *testing.T) {
+	want := []manifestShare{
+		{Key: "a.txt.cypher.first", Provider: 0},
+		{Key: "a.txt.cypher.second", Provider: 1},
+		{Key: "a.txt.rand.first", Provider: 1},
+		{Key: "a.txt.rand.second", Provider: 0},
+	}
+	if got := shareLocations("a.txt", xor2x2Scheme{}, nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("shareLocations() = %v, want %v", got, want)
+	}
+
+	// The manifest takes precedence over the scheme of the bucket
+	m := testManifest(shamirScheme{providers: 3, k: 2})
+	if got := shareLocations("a.txt", xor2x2Scheme{}, m); !reflect.DeepEqual(got, m.Shares) {
+		t.Errorf("shareLocations() = %v, want %v", got, m.Shares)
+	}
+}
+
+func TestManifestMACOrigin(t *testing.T) {
+	m := testManifest(xor2x2Scheme{})
+	want := manifestOrigin{Bucket: "bucket", Key: "dir/a.txt"}
+	if got := m.macOrigin("bucket", "dir/a.txt"); got != want {
+		t.Fatalf("origin of an uncopied object = %+v, want %+v", got, want)
+	}
+
+	// A copy keeps the MACs of its source and must name it in its manifest
+	mac, err := manifestMAC(testMACKey, "other", "copy.txt", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Origin = &want
+	if got := m.macOrigin("other", "copy.txt"); got != want {
+		t.Fatalf("origin of a copy = %+v, want %+v", got, want)
+	}
+	withOrigin, err := manifestMAC(testMACKey, "other", "copy.txt", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mac == withOrigin {
+		t.Fatal("manifest MAC does not cover the origin")
+	}
+}
+
+func TestManifestHeaders(t *testing.T) {
+	m := testManifest(xor2x2Scheme{})
+
+	// Manifests written before the headers were recorded keep their MACs
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"size":42,"contentType":"text/plain","metadata":`) {
+		t.Errorf("unexpected field order: %s", data)
+	}
+
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600))
+	m.objectHeaders = newObjectHeaders(aws.String("text/html"), aws.String("max-age=60"),
+		aws.String(`attachment; filename="a.html"`), aws.String("gzip"), aws.String("de"), &expires)
+	var decoded objectManifest
+	if data, err = json.Marshal(m); err == nil {
+		err = json.Unmarshal(data, &decoded)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := decoded.headOutput("")
+	if aws.ToString(head.ContentType) != "text/html" || aws.ToString(head.CacheControl) != "max-age=60" ||
+		aws.ToString(head.ContentDisposition) != `attachment; filename="a.html"` ||
+		aws.ToString(head.ContentEncoding) != "gzip" || aws.ToString(head.ContentLanguage) != "de" ||
+		!aws.ToTime(head.Expires).Equal(expires) {
+		t.Errorf("unexpected headers: %+v", head)
+	}
+
+	// Headers that were not given are not returned
+	head = testManifest(xor2x2Scheme{}).headOutput("")
+	if head.CacheControl != nil || head.ContentEncoding != nil || head.Expires != nil {
+		t.Errorf("unexpected headers: %+v", head)
+	}
+	if h := newObjectHeaders(nil, nil, nil, nil, nil, &time.Time{}); h != (objectHeaders{}) {
+		t.Errorf("zero expiry recorded: %+v", h)
+	}
+}
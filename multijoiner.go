@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrShareLengthMismatch = errors.New("shares have different lengths")
+)
+
+// JoinerFunc is the counterpart of SplitterFunc: it takes one chunk from
+// each of the p input readers, all of the same length, and combines them
+// into a chunk of the output.
+type JoinerFunc func(parts [][]byte) []byte
+
+// MultiJoiner creates a single reader from p source readers.
+// It reads n bytes at a time from every source in lockstep, applies the
+// joiner function and serves the result. At most one chunk per source is
+// held in memory.
+//
+// Errors are sticky: once a source fails, all data joined before the
+// failing chunk is served and every following Read returns the error.
+// A source that ends before the others results in ErrShareLengthMismatch.
+type MultiJoiner struct {
+	sources   []io.Reader // The source readers
+	chunkSize int         // Size n of each chunk to read from every source
+	joiner    JoinerFunc
+	buffer    []byte // Joined data not yet served
+	bufferPos int
+	err       error // Error to return once the buffer is drained
+}
+
+// NewMultiJoiner creates a new MultiJoiner with the given parameters:
+// - sources: the readers to read from
+// - chunkSize: the size n of each chunk to read from every source
+// - joiner: the function to combine p chunks into one
+func NewMultiJoiner(sources []io.Reader, chunkSize int, joiner JoinerFunc) (*MultiJoiner, error) {
+	if chunkSize <= 0 {
+		return nil, errors.New("chunk size must be positive")
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("number of sources must be positive")
+	}
+	for _, source := range sources {
+		if source == nil {
+			return nil, errors.New("source reader cannot be nil")
+		}
+	}
+	if joiner == nil {
+		return nil, errors.New("joiner function cannot be nil")
+	}
+
+	return &MultiJoiner{
+		sources:   sources,
+		chunkSize: chunkSize,
+		joiner:    joiner,
+	}, nil
+}
+
+// fill reads the next chunk from every source and joins them into the buffer
+func (mj *MultiJoiner) fill() error {
+	parts := make([][]byte, len(mj.sources))
+	n := 0
+	eof := false
+	for i, source := range mj.sources {
+		buf := make([]byte, mj.chunkSize)
+		k, err := io.ReadFull(source, buf)
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			eof = true
+		default:
+			return fmt.Errorf("reading share %d: %w", i, err)
+		}
+		if i > 0 && k != n {
+			return fmt.Errorf("%w: share %d has %d bytes left in chunk, share 0 has %d",
+				ErrShareLengthMismatch, i, k, n)
+		}
+		n = k
+		parts[i] = buf[:k]
+	}
+
+	if n > 0 {
+		mj.buffer = mj.joiner(parts)
+		mj.bufferPos = 0
+	}
+	if eof {
+		return io.EOF
+	}
+	return nil
+}
+
+// Read implements the io.Reader interface for the joined output
+func (mj *MultiJoiner) Read(p []byte) (int, error) {
+	for mj.bufferPos >= len(mj.buffer) {
+		if mj.err != nil {
+			return 0, mj.err
+		}
+		mj.buffer = nil
+		mj.bufferPos = 0
+		mj.err = mj.fill()
+	}
+	n := copy(p, mj.buffer[mj.bufferPos:])
+	mj.bufferPos += n
+	return n, nil
+}
+
+// Close closes all sources that implement io.Closer
+func (mj *MultiJoiner) Close() error {
+	var errs []error
+	for _, source := range mj.sources {
+		if c, ok := source.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
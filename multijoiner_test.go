@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// concatJoiner joins the parts by concatenation
+func concatJoiner(parts [][]byte) []byte {
+	var out []byte
+	for _, part := range parts {
+		out = append(out, part...)
+	}
+	return out
+}
+
+// failingReader serves data and then fails with err instead of io.EOF
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, f.err
+	}
+	return n, err
+}
+
+// closeRecorder records whether Close was called
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestMultiJoiner(t *testing.T) {
+	for _, size := range []int{0, 1, 5, 97} {
+		for chunkSize := 1; chunkSize < 10; chunkSize++ {
+			t.Run(fmt.Sprintf("size=%d, chunkSize=%d", size, chunkSize), func(t *testing.T) {
+				a := randomString(size)
+				b := randomString(size)
+
+				// Expected output: chunk-wise concatenation of a and b
+				var expected strings.Builder
+				for i := 0; i < size; i += chunkSize {
+					end := min(i+chunkSize, size)
+					expected.WriteString(a[i:end])
+					expected.WriteString(b[i:end])
+				}
+
+				mj, err := NewMultiJoiner([]io.Reader{
+					iotest.HalfReader(strings.NewReader(a)),
+					iotest.OneByteReader(strings.NewReader(b)),
+				}, chunkSize, concatJoiner)
+				if err != nil {
+					t.Fatalf("Failed to create MultiJoiner: %v", err)
+				}
+				got, err := io.ReadAll(mj)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if string(got) != expected.String() {
+					t.Errorf("got %q, want %q", got, expected.String())
+				}
+			})
+		}
+	}
+}
+
+func TestMultiJoinerXorRoundTrip(t *testing.T) {
+	data := []byte(randomString(1000))
+	shares := splitXor(t, data, 7)
+
+	cypher := io.MultiReader(bytes.NewReader(shares[xorCypherFirst]), bytes.NewReader(shares[xorCypherSecond]))
+	pad := io.MultiReader(bytes.NewReader(shares[xorRandFirst]), bytes.NewReader(shares[xorRandSecond]))
+	mj, err := NewMultiJoiner([]io.Reader{cypher, pad}, 13, xorJoiner)
+	if err != nil {
+		t.Fatalf("Failed to create MultiJoiner: %v", err)
+	}
+	got, err := io.ReadAll(mj)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %q, want %q", got, data)
+	}
+}
+
+func TestMultiJoinerErrors(t *testing.T) {
+	t.Run("source fails mid-stream", func(t *testing.T) {
+		errBroken := errors.New("connection reset")
+		mj, err := NewMultiJoiner([]io.Reader{
+			strings.NewReader("abcdefghij"),
+			&failingReader{r: strings.NewReader("ABCDE"), err: errBroken},
+		}, 2, concatJoiner)
+		if err != nil {
+			t.Fatalf("Failed to create MultiJoiner: %v", err)
+		}
+
+		got, err := io.ReadAll(mj)
+		if !errors.Is(err, errBroken) {
+			t.Errorf("expected %v, got %v", errBroken, err)
+		}
+		// The chunks before the failing one are served
+		if string(got) != "abABcdCD" {
+			t.Errorf("got %q before the error, want %q", got, "abABcdCD")
+		}
+
+		// The error is sticky
+		n, err := mj.Read(make([]byte, 10))
+		if n != 0 || !errors.Is(err, errBroken) {
+			t.Errorf("expected (0, %v) after failure, got (%d, %v)", errBroken, n, err)
+		}
+	})
+
+	t.Run("source shorter at chunk boundary", func(t *testing.T) {
+		mj, err := NewMultiJoiner([]io.Reader{
+			strings.NewReader("abcd"),
+			strings.NewReader("ABCDEF"),
+		}, 2, concatJoiner)
+		if err != nil {
+			t.Fatalf("Failed to create MultiJoiner: %v", err)
+		}
+		got, err := io.ReadAll(mj)
+		if !errors.Is(err, ErrShareLengthMismatch) {
+			t.Errorf("expected %v, got %v", ErrShareLengthMismatch, err)
+		}
+		if string(got) != "abABcdCD" {
+			t.Errorf("got %q before the error, want %q", got, "abABcdCD")
+		}
+	})
+
+	t.Run("source shorter within chunk", func(t *testing.T) {
+		mj, err := NewMultiJoiner([]io.Reader{
+			strings.NewReader("abcde"),
+			strings.NewReader("ABCD"),
+		}, 3, concatJoiner)
+		if err != nil {
+			t.Fatalf("Failed to create MultiJoiner: %v", err)
+		}
+		_, err = io.ReadAll(mj)
+		if !errors.Is(err, ErrShareLengthMismatch) {
+			t.Errorf("expected %v, got %v", ErrShareLengthMismatch, err)
+		}
+	})
+
+	t.Run("close closes sources", func(t *testing.T) {
+		a := &closeRecorder{Reader: strings.NewReader("a")}
+		b := &closeRecorder{Reader: strings.NewReader("b")}
+		mj, err := NewMultiJoiner([]io.Reader{a, b}, 1, concatJoiner)
+		if err != nil {
+			t.Fatalf("Failed to create MultiJoiner: %v", err)
+		}
+		if err := mj.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !a.closed || !b.closed {
+			t.Errorf("expected all sources to be closed")
+		}
+	})
+}
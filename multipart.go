@@ -0,0 +1,1174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"github.com/versity/versitygw/s3err"
+	"github.com/versity/versitygw/s3response"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// Limits of multipart uploads, as for S3
+const (
+	minPartSize   = 5 << 20 // Of all parts but the last one
+	maxPartNumber = 10000
+)
+
+// Suffixes of the records of a multipart upload, the upload record is
+// named <key>.upload.<id>, the record of every uploaded part
+// <key>.upload.<id>.part.<number>
+const (
+	suffixUpload = ".upload."
+	suffixPart   = ".part."
+)
+
+// Prefixes under which the records of multipart uploads are stored, so that
+// listing the uploads lists neither objects nor parts. Gateways before these
+// stored the records under their names alone, which are still read.
+const (
+	uploadRecordPrefix = "pcs-uploads/"
+	partRecordPrefix   = "pcs-parts/"
+)
+
+// uploadVersion is the format version of the upload records written
+const uploadVersion = 1
+
+// uploadRecord maps a multipart upload of the gateway to the uploads of
+// its shares on the providers. It is written to every provider like a
+// manifest, the gateway keeps no state of its own.
+//
+// The shares of an upload are stored under keys unique to the upload, so
+// that completing it does not touch the shares of an object published
+// under the same key until the new manifest replaces the old one.
+type uploadRecord struct {
+	Version   int             `json:"version"`
+	Scheme    string          `json:"scheme"`    // ShareScheme.name()
+	Shares    []manifestShare `json:"shares"`    // In the order of ShareScheme.shares(), without sizes
+	UploadIDs []string        `json:"uploadIds"` // Upload of every share on its provider
+	objectHeaders
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Created  time.Time         `json:"created"`
+	// Encryption of uploadSecrets, which are then left empty, as stored on
+	// the providers, see MyBackend.seal
+	Sealed string `json:"sealed,omitempty"`
+	MAC    string `json:"mac,omitempty"` // See recordMAC
+}
+
+// uploadSecrets are the fields of an upload record that are sealed, the
+// headers and metadata of the object uploaded
+type uploadSecrets struct {
+	objectHeaders
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func (u *uploadRecord) macField() *string {
+	return &u.MAC
+}
+
+// partRecord describes an uploaded part of a multipart upload
+type partRecord struct {
+	Size  int64    `json:"size"`
+	ETag  string   `json:"etag"`           // MD5 of the part as returned to the client
+	ETags []string `json:"etags"`          // Of the shares of the part, as returned by the providers
+	MACs  []string `json:"macs,omitempty"` // Hex encoded per share, see newPartMAC
+	// Base64 encoded chunk MACs per share, see newChunkMAC
+	Chunks []string `json:"chunks,omitempty"`
+	// When the part was uploaded, nil in records of older gateways
+	Created *time.Time `json:"created,omitempty"`
+	// Encryption of the ETag, which is then left empty, as stored on the
+	// providers, see MyBackend.seal
+	Sealed string `json:"sealed,omitempty"`
+	MAC    string `json:"mac,omitempty"` // See recordMAC
+}
+
+func (p *partRecord) macField() *string {
+	return &p.MAC
+}
+
+// uploadKey returns the key of the upload record of upload id of key
+func uploadKey(key, id string) string {
+	return key + suffixUpload + id
+}
+
+// partKey returns the key of the record of part number of upload id of key
+func partKey(key, id string, number int) string {
+	return fmt.Sprintf("%s%s%05d", uploadKey(key, id), suffixPart, number)
+}
+
+// uploadRecordKey returns the key under which the upload record of upload
+// id of key is stored
+func uploadRecordKey(key, id string) string {
+	return uploadRecordPrefix + uploadKey(key, id)
+}
+
+// partRecordKey returns the key under which the record of part number of
+// upload id of key is stored
+func partRecordKey(key, id string, number int) string {
+	return partRecordPrefix + partKey(key, id, number)
+}
+
+// newUploadID returns a random upload ID
+func newUploadID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// validUploadID reports whether id is an upload ID of the gateway, other
+// IDs must not end up in record keys
+func validUploadID(id string) bool {
+	decoded, err := hex.DecodeString(id)
+	return err == nil && len(decoded) == 16 && id == strings.ToLower(id)
+}
+
+// storedPartLength returns the length of a share of a part of the given
+// size as uploaded to the provider. Providers require all parts but the
+// last one to have at least minPartSize bytes, which the shares of a part
+// of that size may not have. They are padded with zeros then. The padding
+// of the last part is not needed but keeps the layout independent of the
+// position of the part.
+func storedPartLength(scheme ShareScheme, share shareSpec, size int64) int64 {
+	_, length := scheme.segment(share.part, size)
+	n := shareLength(scheme, length)
+	if size >= minPartSize {
+		n = max(n, minPartSize)
+	}
+	return n
+}
+
+// zeroReader reads zeros, use with io.LimitReader
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// isNoSuchUpload reports whether err means that an upload does not exist
+func isNoSuchUpload(err error) bool {
+	var ae smithy.APIError
+	return errors.As(err, &ae) && ae.ErrorCode() == "NoSuchUpload"
+}
+
+// readUpload returns the upload record of upload id of key and its scheme
+func (self *MyBackend) readUpload(ctx context.Context, bucket, key, id string) (*uploadRecord, ShareScheme, error) {
+	if !validUploadID(id) {
+		return nil, nil, s3err.GetAPIError(s3err.ErrNoSuchUpload)
+	}
+	var scheme ShareScheme
+	check := func(u *uploadRecord) error {
+		if u.Sealed != "" {
+			var secrets uploadSecrets
+			if err := self.unseal("upload", bucket, uploadKey(key, id), u.Sealed, &secrets); err != nil {
+				return err
+			}
+			u.objectHeaders, u.Metadata, u.Sealed = secrets.objectHeaders, secrets.Metadata, ""
+		}
+		if err := self.verifyRecord(macDomainUpload, "upload", bucket, uploadKey(key, id), u); err != nil {
+			return err
+		}
+		if u.Version != uploadVersion {
+			return fmt.Errorf("unsupported upload version %d", u.Version)
+		}
+		var err error
+		if scheme, err = parseScheme(u.Scheme, len(self.clients)); err != nil {
+			return err
+		}
+		if err := checkProviders(scheme, len(self.clients)); err != nil {
+			return err
+		}
+		if len(u.Shares) != len(scheme.shares()) || len(u.UploadIDs) != len(u.Shares) {
+			return fmt.Errorf("upload lists %d shares, scheme %s has %d",
+				len(u.Shares), u.Scheme, len(scheme.shares()))
+		}
+		for i, share := range u.Shares {
+			if share.Provider < 0 || share.Provider >= len(self.clients) {
+				return fmt.Errorf("share %d is stored on unknown provider %d", i, share.Provider)
+			}
+		}
+		return nil
+	}
+	record, err := readReplicated(ctx, self, bucket, uploadRecordKey(key, id), key, check)
+	if errors.Is(err, errNoRecord) {
+		record, err = readReplicated(ctx, self, bucket, uploadKey(key, id), key, check)
+	}
+	if errors.Is(err, errNoRecord) {
+		return nil, nil, s3err.GetAPIError(s3err.ErrNoSuchUpload)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return record, scheme, nil
+}
+
+// readPart returns the record of part number of upload id of key, which
+// has the given number of shares
+func (self *MyBackend) readPart(ctx context.Context, bucket, key, id string, number, shares int) (*partRecord, error) {
+	check := func(p *partRecord) error {
+		if p.Sealed != "" {
+			if err := self.unseal("part", bucket, partKey(key, id, number), p.Sealed, &p.ETag); err != nil {
+				return err
+			}
+			p.Sealed = ""
+		}
+		if err := self.verifyRecord(macDomainPart, "part", bucket, partKey(key, id, number), p); err != nil {
+			return err
+		}
+		if p.Size < 0 || len(p.ETags) != shares || (len(p.MACs) != 0 && len(p.MACs) != shares) ||
+			(len(p.Chunks) != 0 && len(p.Chunks) != shares) {
+			return fmt.Errorf("invalid record of part %d", number)
+		}
+		return nil
+	}
+	record, err := readReplicated(ctx, self, bucket, partRecordKey(key, id, number), key, check)
+	if errors.Is(err, errNoRecord) {
+		record, err = readReplicated(ctx, self, bucket, partKey(key, id, number), key, check)
+	}
+	if errors.Is(err, errNoRecord) {
+		return nil, s3err.GetAPIError(s3err.ErrInvalidPart)
+	}
+	return record, err
+}
+
+// deleteUploadRecords removes the upload record of upload id of key and
+// the records of its parts from all providers, including records stored
+// by older gateways under their names alone
+func (self *MyBackend) deleteUploadRecords(ctx context.Context, bucket, key, id string) {
+	prefixes := []string{
+		uploadRecordKey(key, id),
+		partRecordPrefix + uploadKey(key, id) + suffixPart,
+		uploadKey(key, id),
+	}
+	for i, client := range self.clients {
+		for _, prefix := range prefixes {
+			paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+				Bucket: aws.String(bucket),
+				Prefix: aws.String(prefix),
+			})
+			for paginator.HasMorePages() {
+				page, err := paginator.NextPage(ctx)
+				if err != nil {
+					log.Printf("Failed to list the records of upload %s of %s on client%d: %v", id, key, i+1, err)
+					break
+				}
+				for _, obj := range page.Contents {
+					_, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+						Bucket: aws.String(bucket),
+						Key:    obj.Key,
+					})
+					if err != nil && !isNotFound(err) {
+						log.Printf("Failed to delete %s from client%d: %v", *obj.Key, i+1, err)
+					}
+				}
+			}
+		}
+	}
+}
+
+// abortShareUploads aborts the uploads of the shares of an upload on the
+// providers, uploads that no longer exist are skipped
+func (self *MyBackend) abortShareUploads(ctx context.Context, bucket string, shares []manifestShare, uploadIDs []string) error {
+	errs := make([]error, len(shares))
+	var wg sync.WaitGroup
+	for i, share := range shares {
+		if uploadIDs[i] == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, share manifestShare) {
+			defer wg.Done()
+			_, err := self.clients[share.Provider].AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(bucket),
+				Key:      aws.String(share.Key),
+				UploadId: aws.String(uploadIDs[i]),
+			})
+			if err != nil && !isNoSuchUpload(err) {
+				log.Printf("Failed to abort upload of %s on client%d: %v", share.Key, share.Provider+1, err)
+				errs[i] = err
+			}
+		}(i, share)
+	}
+	wg.Wait()
+	return firstError(errs)
+}
+
+func (self *MyBackend) CreateMultipartUpload(ctx context.Context, input *s3.CreateMultipartUploadInput) (s3response.InitiateMultipartUploadResult, error) {
+	log.Printf("MyBackend.CreateMultipartUpload(%v, %v)", ctx, input)
+	if err := self.checkBucketAccess(ctx, *input.Bucket); err != nil {
+		return s3response.InitiateMultipartUploadResult{}, handleError(err)
+	}
+
+	settings, err := self.settings(ctx, *input.Bucket)
+	if err != nil {
+		return s3response.InitiateMultipartUploadResult{}, err
+	}
+	scheme := settings.scheme
+	stored, err := settings.names.hide(*input.Key)
+	if err != nil {
+		return s3response.InitiateMultipartUploadResult{}, err
+	}
+	id, err := newUploadID()
+	if err != nil {
+		return s3response.InitiateMultipartUploadResult{}, err
+	}
+
+	shares := scheme.shares()
+	record := &uploadRecord{
+		Version:   uploadVersion,
+		Scheme:    scheme.name(),
+		Shares:    make([]manifestShare, len(shares)),
+		UploadIDs: make([]string, len(shares)),
+		objectHeaders: newObjectHeaders(input.ContentType, input.CacheControl, input.ContentDisposition,
+			input.ContentEncoding, input.ContentLanguage, input.Expires),
+		Metadata: input.Metadata,
+		Created:  time.Now().UTC(),
+	}
+
+	// Start an upload for every share, headers and user metadata are only
+	// kept in the manifest
+	errs := make([]error, len(shares))
+	var wg sync.WaitGroup
+	for i, share := range shares {
+		record.Shares[i] = manifestShare{
+			Key:      stored + share.suffix + "." + id,
+			Provider: share.provider,
+		}
+		wg.Add(1)
+		go func(i int, share manifestShare) {
+			defer wg.Done()
+			output, err := self.clients[share.Provider].CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+				Bucket: input.Bucket,
+				Key:    aws.String(share.Key),
+				Metadata: map[string]string{
+					metaScheme: scheme.name(),
+					metaShare:  strconv.Itoa(i),
+				},
+			})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			record.UploadIDs[i] = aws.ToString(output.UploadId)
+		}(i, record.Shares[i])
+	}
+	wg.Wait()
+
+	err = firstError(errs)
+	if err == nil {
+		err = self.signRecord(macDomainUpload, *input.Bucket, uploadKey(stored, id), record)
+	}
+	sealed := *record
+	if err == nil {
+		sealed.Sealed, err = self.seal(*input.Bucket, uploadKey(stored, id), uploadSecrets{record.objectHeaders, record.Metadata})
+	}
+	if err == nil && sealed.Sealed != "" {
+		sealed.objectHeaders, sealed.Metadata = objectHeaders{}, nil
+	}
+	if err == nil {
+		err = self.writeReplicated(ctx, *input.Bucket, uploadRecordKey(stored, id), &sealed)
+	}
+	if err != nil {
+		log.Printf("Failed to create upload of %s: %v", *input.Key, err)
+		self.abortShareUploads(ctx, *input.Bucket, record.Shares, record.UploadIDs)
+		self.deleteUploadRecords(ctx, *input.Bucket, stored, id)
+		return s3response.InitiateMultipartUploadResult{}, handleError(err)
+	}
+
+	return s3response.InitiateMultipartUploadResult{
+		Bucket:   *input.Bucket,
+		Key:      *input.Key,
+		UploadId: id,
+	}, nil
+}
+
+func (self *MyBackend) UploadPart(ctx context.Context, input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	log.Printf("MyBackend.UploadPart(%v, %v)", ctx, input)
+	part, err := self.uploadPart(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.UploadPartOutput{ETag: aws.String(part.ETag)}, nil
+}
+
+// uploadPart splits a part into shares, uploads them as parts of the
+// uploads of the shares and returns the record of the part
+func (self *MyBackend) uploadPart(ctx context.Context, input *s3.UploadPartInput) (*partRecord, error) {
+	if err := self.checkBucketAccess(ctx, *input.Bucket); err != nil {
+		return nil, handleError(err)
+	}
+
+	settings, err := self.settings(ctx, *input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := settings.names.hide(*input.Key)
+	if err != nil {
+		return nil, err
+	}
+	number := int(aws.ToInt32(input.PartNumber))
+	if number < 1 || number > maxPartNumber {
+		return nil, s3err.GetAPIError(s3err.ErrInvalidPartNumber)
+	}
+	if input.ContentLength == nil {
+		return nil, s3err.GetAPIError(s3err.ErrInvalidRequest)
+	}
+	id := aws.ToString(input.UploadId)
+	upload, scheme, err := self.readUpload(ctx, *input.Bucket, stored, id)
+	if err != nil {
+		return nil, handleError(err)
+	}
+	contentMD5, err := requestContentMD5(ctx, input.ContentMD5)
+	if err != nil {
+		return nil, err
+	}
+	size := *input.ContentLength
+	shares := scheme.shares()
+
+	// Split the part into shares while streaming like PutObject, every
+	// share of the part is uploaded as part of the upload of the share
+	hasher := md5.New()
+	source := io.TeeReader(input.Body, hasher)
+	ms, readers, err := NewMultiSplitter(source, shareChunkSize, len(shares), scheme.splitter(size))
+	if err != nil {
+		return nil, handleError(err)
+	}
+	defer ms.Close()
+
+	// A failed share cancels the others and stops the splitter like in
+	// PutObject
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	etags := make([]string, len(shares))
+	macs := make([]hash.Hash, len(shares))
+	chunks := make([]*chunkMACWriter, len(shares))
+	errs := make([]error, len(shares))
+	var wg sync.WaitGroup
+	for i, share := range shares {
+		_, length := scheme.segment(share.part, size)
+		length = shareLength(scheme, length)
+		var body io.Reader = readers[i]
+		if len(self.macKey) > 0 {
+			macs[i] = newPartMAC(self.macKey, *input.Bucket, stored, i, number, length)
+			chunks[i] = newChunkMACWriter(func(chunk int64) hash.Hash {
+				return newChunkMAC(self.macKey, *input.Bucket, stored, i, number, length, chunk)
+			})
+			body = io.TeeReader(body, io.MultiWriter(macs[i], chunks[i]))
+		}
+		padded := storedPartLength(scheme, share, size)
+		if padded > length {
+			body = io.MultiReader(body, io.LimitReader(zeroReader{}, padded-length))
+		}
+
+		wg.Add(1)
+		go func(i int, location manifestShare, body io.Reader) {
+			defer wg.Done()
+			output, err := self.clients[location.Provider].UploadPart(uploadCtx, &s3.UploadPartInput{
+				Bucket:        input.Bucket,
+				Key:           aws.String(location.Key),
+				UploadId:      aws.String(upload.UploadIDs[i]),
+				PartNumber:    aws.Int32(int32(number)),
+				Body:          body,
+				ContentLength: aws.Int64(padded),
+			}, s3.WithAPIOptions(
+				v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware,
+			))
+			if err != nil {
+				log.Printf("S3 server returned error for UploadPart[%v]: %v", i, err)
+				errs[i] = err
+				cancel()
+				ms.Close()
+				return
+			}
+			etags[i] = aws.ToString(output.ETag)
+		}(i, upload.Shares[i], body)
+	}
+	wg.Wait()
+	if err := firstError(errs); err != nil {
+		return nil, handleError(err)
+	}
+	sum := hasher.Sum(nil)
+	if contentMD5 != nil && !bytes.Equal(contentMD5, sum) {
+		log.Printf("Rejected part %d of %s: %v", number, *input.Key, errBadDigest)
+		return nil, errBadDigest
+	}
+
+	created := time.Now().UTC()
+	part := &partRecord{
+		Size:    size,
+		ETag:    `"` + hex.EncodeToString(sum) + `"`,
+		ETags:   etags,
+		Created: &created,
+	}
+	if len(self.macKey) > 0 {
+		part.MACs = make([]string, len(shares))
+		part.Chunks = make([]string, len(shares))
+		for i := range macs {
+			part.MACs[i] = hex.EncodeToString(macs[i].Sum(nil))
+			part.Chunks[i] = chunks[i].encode()
+		}
+	}
+	if err := self.signRecord(macDomainPart, *input.Bucket, partKey(stored, id, number), part); err != nil {
+		return nil, handleError(err)
+	}
+	// The ETag is the MD5 of the part, which the providers must not learn
+	record := *part
+	record.Sealed, err = self.seal(*input.Bucket, partKey(stored, id, number), part.ETag)
+	if err != nil {
+		return nil, handleError(err)
+	}
+	if record.Sealed != "" {
+		record.ETag = ""
+	}
+	if err := self.writeReplicated(ctx, *input.Bucket, partRecordKey(stored, id, number), &record); err != nil {
+		log.Printf("Failed to record part %d of %s: %v", number, *input.Key, err)
+		return nil, handleError(err)
+	}
+	return part, nil
+}
+
+func (self *MyBackend) CompleteMultipartUpload(ctx context.Context, input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	log.Printf("MyBackend.CompleteMultipartUpload(%v, %v)", ctx, input)
+	if err := self.checkBucketAccess(ctx, *input.Bucket); err != nil {
+		return nil, handleError(err)
+	}
+
+	settings, err := self.settings(ctx, *input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := settings.names.hide(*input.Key)
+	if err != nil {
+		return nil, err
+	}
+	id := aws.ToString(input.UploadId)
+	upload, scheme, err := self.readUpload(ctx, *input.Bucket, stored, id)
+	if err != nil {
+		return nil, handleError(err)
+	}
+	if input.MultipartUpload == nil || len(input.MultipartUpload.Parts) == 0 {
+		return nil, s3err.GetAPIError(s3err.ErrMalformedXML)
+	}
+	completed := input.MultipartUpload.Parts
+	for i, part := range completed {
+		if i > 0 && aws.ToInt32(part.PartNumber) <= aws.ToInt32(completed[i-1].PartNumber) {
+			return nil, s3err.GetAPIError(s3err.ErrInvalidPartOrder)
+		}
+	}
+
+	// Like for PutObject, conditions are evaluated on the logical object
+	// before and again right before it is replaced. The upload stays if
+	// they do not hold.
+	conds := requestConditions(ctx)
+	conditional := conds.conditionalWrite()
+	if conditional {
+		head, err := self.currentHead(ctx, settings.scheme, *input.Bucket, stored)
+		if err != nil {
+			return nil, err
+		}
+		if err := conds.checkWrite(head); err != nil {
+			return nil, err
+		}
+	}
+	shares := scheme.shares()
+
+	// The records of the parts hold the ETags of their shares
+	records := make([]*partRecord, len(completed))
+	errs := make([]error, len(completed))
+	limit := make(chan struct{}, 16) // Concurrent reads
+	var wg sync.WaitGroup
+	for j, part := range completed {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(j, number int) {
+			defer func() { <-limit; wg.Done() }()
+			records[j], errs[j] = self.readPart(ctx, *input.Bucket, stored, id, number, len(shares))
+		}(j, int(aws.ToInt32(part.PartNumber)))
+	}
+	wg.Wait()
+	if err := firstError(errs); err != nil {
+		return nil, handleError(err)
+	}
+
+	manifest := &objectManifest{
+		Version:       manifestVersion,
+		Scheme:        scheme.name(),
+		Shares:        make([]manifestShare, len(shares)),
+		objectHeaders: upload.objectHeaders,
+		Metadata:      upload.Metadata,
+		Created:       time.Now().UTC(),
+		Parts:         make([]manifestPart, len(completed)),
+	}
+	copy(manifest.Shares, upload.Shares)
+	sharesParts := make([][]types.CompletedPart, len(shares))
+	etags := md5.New()
+	for j, part := range completed {
+		record := records[j]
+		if strings.Trim(aws.ToString(part.ETag), `"`) != strings.Trim(record.ETag, `"`) {
+			return nil, s3err.GetAPIError(s3err.ErrInvalidPart)
+		}
+		if j < len(completed)-1 && record.Size < minPartSize {
+			return nil, s3err.GetAPIError(s3err.ErrEntityTooSmall)
+		}
+		sum, _ := hex.DecodeString(strings.Trim(record.ETag, `"`))
+		etags.Write(sum)
+
+		manifest.Size += record.Size
+		manifest.Parts[j] = manifestPart{
+			Number: int(aws.ToInt32(part.PartNumber)),
+			Size:   record.Size,
+			MACs:   record.MACs,
+			Chunks: record.Chunks,
+		}
+		for i, share := range shares {
+			manifest.Shares[i].Size += storedPartLength(scheme, share, record.Size)
+			sharesParts[i] = append(sharesParts[i], types.CompletedPart{
+				PartNumber: part.PartNumber,
+				ETag:       aws.String(record.ETags[i]),
+			})
+		}
+	}
+	// Like S3 the ETag of the object is the MD5 of the MD5s of its parts
+	manifest.ETag = fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(etags.Sum(nil)), len(completed))
+
+	// Complete the uploads of all shares. A share completed by an earlier
+	// attempt no longer has an upload, it is accepted if its size matches.
+	errs = make([]error, len(shares))
+	for i := range shares {
+		wg.Add(1)
+		go func(i int, location manifestShare) {
+			defer wg.Done()
+			client := self.clients[location.Provider]
+			output, err := client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+				Bucket:          input.Bucket,
+				Key:             aws.String(location.Key),
+				UploadId:        aws.String(upload.UploadIDs[i]),
+				MultipartUpload: &types.CompletedMultipartUpload{Parts: sharesParts[i]},
+			})
+			if err == nil {
+				manifest.Shares[i].ETag = aws.ToString(output.ETag)
+				return
+			}
+			if isNoSuchUpload(err) {
+				head, herr := client.HeadObject(ctx, &s3.HeadObjectInput{
+					Bucket: input.Bucket,
+					Key:    aws.String(location.Key),
+				})
+				if herr == nil && aws.ToInt64(head.ContentLength) == location.Size {
+					manifest.Shares[i].ETag = aws.ToString(head.ETag)
+					return
+				}
+			}
+			log.Printf("Failed to complete upload of %s on client%d: %v", location.Key, location.Provider+1, err)
+			errs[i] = err
+		}(i, manifest.Shares[i])
+	}
+	wg.Wait()
+	if err := firstError(errs); err != nil {
+		// The object is not published, completing can be retried or the
+		// upload aborted
+		return nil, handleError(err)
+	}
+
+	// Publish the object, replacing the one stored under its key. If the
+	// gateway stops meanwhile, the object is published at startup if its
+	// manifest was written anywhere.
+	if err := self.signManifest(*input.Bucket, stored, manifest); err != nil {
+		return nil, handleError(err)
+	}
+	intent, err := self.journal.begin(journalEntry{
+		Op:     intentCompleteUpload,
+		Bucket: *input.Bucket,
+		Key:    stored,
+		Shares: manifest.Shares,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if conds.createOnly() {
+		if err := self.createManifest(ctx, *input.Bucket, stored, manifest); err != nil {
+			log.Printf("Failed to create manifest of %s: %v", *input.Key, err)
+			return nil, handleError(err)
+		}
+	} else if conditional {
+		// The object the manifest replaces must not change until it is
+		// written, see replaceManifestIf
+		written := false
+		err := self.replaceManifestIf(ctx, *input.Bucket, stored, settings.scheme, manifest, func() error {
+			head, err := self.currentHead(ctx, settings.scheme, *input.Bucket, stored)
+			if err == nil {
+				err = conds.checkWrite(head)
+			}
+			written = err == nil
+			return err
+		})
+		if err != nil {
+			log.Printf("Failed to replace manifest of %s: %v", *input.Key, err)
+			if !written {
+				self.journal.end(intent)
+			}
+			return nil, handleError(err)
+		}
+	} else {
+		if err := self.replaceManifest(ctx, *input.Bucket, stored, settings.scheme, manifest); err != nil {
+			log.Printf("Failed to write manifest of %s: %v", *input.Key, err)
+			return nil, handleError(err)
+		}
+	}
+	self.journal.end(intent)
+	self.deleteUploadRecords(ctx, *input.Bucket, stored, id)
+
+	return &s3.CompleteMultipartUploadOutput{
+		Bucket: input.Bucket,
+		Key:    input.Key,
+		ETag:   aws.String(manifest.ETag),
+	}, nil
+}
+
+func (self *MyBackend) AbortMultipartUpload(ctx context.Context, input *s3.AbortMultipartUploadInput) error {
+	log.Printf("MyBackend.AbortMultipartUpload(%v, %v)", ctx, input)
+	if err := self.checkBucketAccess(ctx, *input.Bucket); err != nil {
+		return handleError(err)
+	}
+
+	settings, err := self.settings(ctx, *input.Bucket)
+	if err != nil {
+		return err
+	}
+	stored, err := settings.names.hide(*input.Key)
+	if err != nil {
+		return err
+	}
+	id := aws.ToString(input.UploadId)
+	upload, _, err := self.readUpload(ctx, *input.Bucket, stored, id)
+	if err != nil {
+		return handleError(err)
+	}
+
+	if err := self.abortShareUploads(ctx, *input.Bucket, upload.Shares, upload.UploadIDs); err != nil {
+		return handleError(err)
+	}
+
+	// Shares completed by a failed attempt to complete the upload are
+	// removed, unless the upload was published after all
+	manifest, err := self.readManifest(ctx, *input.Bucket, stored)
+	if err != nil && !errors.Is(err, errNoManifest) {
+		return handleError(err)
+	}
+	published := make(map[string]bool)
+	if manifest != nil {
+		for _, share := range manifest.Shares {
+			published[share.Key] = true
+		}
+	}
+	for _, share := range upload.Shares {
+		if published[share.Key] {
+			continue
+		}
+		_, err := self.clients[share.Provider].DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: input.Bucket,
+			Key:    aws.String(share.Key),
+		})
+		if err != nil && !isNotFound(err) {
+			log.Printf("Failed to delete %s from client%d: %v", share.Key, share.Provider+1, err)
+		}
+	}
+
+	self.deleteUploadRecords(ctx, *input.Bucket, stored, id)
+	return nil
+}
+
+// maxListedUploads is the default and maximum number of uploads or parts
+// returned by one listing, as for S3
+const maxListedUploads = 1000
+
+// parseUploadKey returns the stored key and the upload ID of the key of an
+// upload record. ok is false for other keys, including part records.
+func parseUploadKey(key string) (stored, id string, ok bool) {
+	i := strings.LastIndex(key, suffixUpload)
+	if i < 0 || !validUploadID(key[i+len(suffixUpload):]) {
+		return "", "", false
+	}
+	return key[:i], key[i+len(suffixUpload):], true
+}
+
+// listReplicated returns the records with the given key prefix that are
+// listed on every provider, as listed on the first one. Records missing on
+// some providers were not written completely or not removed completely,
+// they are left out.
+func (self *MyBackend) listReplicated(ctx context.Context, bucket, prefix string) (map[string]types.Object, error) {
+	found := make(map[string]int)
+	records := make(map[string]types.Object)
+	for i, client := range self.clients {
+		paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(prefix),
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for _, obj := range page.Contents {
+				found[*obj.Key]++
+				if i == 0 {
+					records[*obj.Key] = obj
+				}
+			}
+		}
+	}
+	for key := range records {
+		if found[key] != len(self.clients) {
+			log.Printf("Skipping %s in bucket %s, it is only stored on %d of %d storages",
+				key, bucket, found[key], len(self.clients))
+			delete(records, key)
+		}
+	}
+	return records, nil
+}
+
+// shareUploads returns the uploads in progress on every provider of which
+// the key starts with prefix, as keys followed by a NUL and the upload ID
+func (self *MyBackend) shareUploads(ctx context.Context, bucket, prefix string) ([]map[string]bool, error) {
+	uploads := make([]map[string]bool, len(self.clients))
+	for i, client := range self.clients {
+		uploads[i] = make(map[string]bool)
+		input := &s3.ListMultipartUploadsInput{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(prefix),
+		}
+		for {
+			output, err := client.ListMultipartUploads(ctx, input)
+			if err != nil {
+				return nil, err
+			}
+			for _, upload := range output.Uploads {
+				uploads[i][aws.ToString(upload.Key)+"\x00"+aws.ToString(upload.UploadId)] = true
+			}
+			if !aws.ToBool(output.IsTruncated) {
+				break
+			}
+			input.KeyMarker = output.NextKeyMarker
+			input.UploadIdMarker = output.NextUploadIdMarker
+		}
+	}
+	return uploads, nil
+}
+
+func (self *MyBackend) ListMultipartUploads(ctx context.Context, input *s3.ListMultipartUploadsInput) (s3response.ListMultipartUploadsResult, error) {
+	log.Printf("MyBackend.ListMultipartUploads(%v, %v)", ctx, input)
+	if err := self.checkBucketAccess(ctx, *input.Bucket); err != nil {
+		return s3response.ListMultipartUploadsResult{}, handleError(err)
+	}
+
+	settings, err := self.settings(ctx, *input.Bucket)
+	if err != nil {
+		return s3response.ListMultipartUploadsResult{}, err
+	}
+	prefix := aws.ToString(input.Prefix)
+	delimiter := aws.ToString(input.Delimiter)
+	keyMarker := aws.ToString(input.KeyMarker)
+	uploadIDMarker := aws.ToString(input.UploadIdMarker)
+	maxUploads := int(aws.ToInt32(input.MaxUploads))
+	if maxUploads <= 0 || maxUploads > maxListedUploads {
+		maxUploads = maxListedUploads
+	}
+
+	// The providers cannot filter hidden keys by prefix
+	storedPrefix := prefix
+	if settings.names.hidden() {
+		storedPrefix = ""
+	}
+	records, err := self.listReplicated(ctx, *input.Bucket, uploadRecordPrefix+storedPrefix)
+	if err != nil {
+		return s3response.ListMultipartUploadsResult{}, handleError(err)
+	}
+	pending, err := self.shareUploads(ctx, *input.Bucket, storedPrefix)
+	if err != nil {
+		return s3response.ListMultipartUploadsResult{}, handleError(err)
+	}
+
+	// An upload is listed if its record is stored on every provider and
+	// the uploads of all its shares are in progress. Uploads of which only
+	// some shares are in progress were created or aborted partially, or
+	// completed partially, which can still be retried with their ID.
+	type candidate struct {
+		key, stored, id string
+	}
+	var candidates []candidate
+	for recordKey := range records {
+		stored, id, ok := parseUploadKey(strings.TrimPrefix(recordKey, uploadRecordPrefix))
+		if !ok {
+			continue
+		}
+		key, err := settings.names.reveal(stored)
+		if err != nil || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		candidates = append(candidates, candidate{key, stored, id})
+	}
+	uploads := make([]*s3response.Upload, len(candidates))
+	errs := make([]error, len(candidates))
+	limit := make(chan struct{}, 16) // Concurrent reads
+	var wg sync.WaitGroup
+	for j, c := range candidates {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(j int, c candidate) {
+			defer func() { <-limit; wg.Done() }()
+			record, _, err := self.readUpload(ctx, *input.Bucket, c.stored, c.id)
+			if err != nil {
+				// The upload may have been completed since it was listed
+				if !errors.Is(err, s3err.GetAPIError(s3err.ErrNoSuchUpload)) {
+					errs[j] = err
+				}
+				return
+			}
+			for i, share := range record.Shares {
+				if !pending[share.Provider][share.Key+"\x00"+record.UploadIDs[i]] {
+					log.Printf("Skipping upload %s of %s, share %d has no upload on client%d",
+						c.id, c.key, i, share.Provider+1)
+					return
+				}
+			}
+			uploads[j] = &s3response.Upload{
+				Key:          c.key,
+				UploadID:     c.id,
+				StorageClass: types.StorageClassStandard,
+				Initiated:    record.Created,
+			}
+		}(j, c)
+	}
+	wg.Wait()
+	if err := firstError(errs); err != nil {
+		return s3response.ListMultipartUploadsResult{}, handleError(err)
+	}
+
+	var listed []s3response.Upload
+	for _, upload := range uploads {
+		if upload != nil {
+			listed = append(listed, *upload)
+		}
+	}
+	sort.Slice(listed, func(i, j int) bool {
+		if listed[i].Key != listed[j].Key {
+			return listed[i].Key < listed[j].Key
+		}
+		return listed[i].UploadID < listed[j].UploadID
+	})
+
+	result := s3response.ListMultipartUploadsResult{
+		Bucket:         *input.Bucket,
+		KeyMarker:      keyMarker,
+		UploadIDMarker: uploadIDMarker,
+		Delimiter:      delimiter,
+		Prefix:         prefix,
+		EncodingType:   string(input.EncodingType),
+		MaxUploads:     maxUploads,
+	}
+	pageUploads(&result, listed)
+	return result, nil
+}
+
+func (self *MyBackend) ListParts(ctx context.Context, input *s3.ListPartsInput) (s3response.ListPartsResult, error) {
+	log.Printf("MyBackend.ListParts(%v, %v)", ctx, input)
+	if err := self.checkBucketAccess(ctx, *input.Bucket); err != nil {
+		return s3response.ListPartsResult{}, handleError(err)
+	}
+
+	settings, err := self.settings(ctx, *input.Bucket)
+	if err != nil {
+		return s3response.ListPartsResult{}, err
+	}
+	stored, err := settings.names.hide(*input.Key)
+	if err != nil {
+		return s3response.ListPartsResult{}, err
+	}
+	id := aws.ToString(input.UploadId)
+	upload, _, err := self.readUpload(ctx, *input.Bucket, stored, id)
+	if err != nil {
+		return s3response.ListPartsResult{}, handleError(err)
+	}
+	marker := 0
+	if input.PartNumberMarker != nil && *input.PartNumberMarker != "" {
+		marker, err = strconv.Atoi(*input.PartNumberMarker)
+		if err != nil || marker < 0 {
+			return s3response.ListPartsResult{}, s3err.GetAPIError(s3err.ErrInvalidPartNumberMarker)
+		}
+	}
+	maxParts := int(aws.ToInt32(input.MaxParts))
+	if maxParts <= 0 || maxParts > maxListedUploads {
+		maxParts = maxListedUploads
+	}
+
+	// A part is listed if its record is stored on every provider and the
+	// uploads of all its shares hold it. Uploads started by older gateways
+	// may have records under their names alone, keyed the same here.
+	records, err := self.listReplicated(ctx, *input.Bucket, uploadKey(stored, id)+suffixPart)
+	if err != nil {
+		return s3response.ListPartsResult{}, handleError(err)
+	}
+	prefixed, err := self.listReplicated(ctx, *input.Bucket, partRecordPrefix+uploadKey(stored, id)+suffixPart)
+	if err != nil {
+		return s3response.ListPartsResult{}, handleError(err)
+	}
+	for recordKey, obj := range prefixed {
+		records[strings.TrimPrefix(recordKey, partRecordPrefix)] = obj
+	}
+	uploaded, err := self.shareParts(ctx, *input.Bucket, upload)
+	if err != nil {
+		return s3response.ListPartsResult{}, handleError(err)
+	}
+	var numbers []int
+	for recordKey := range records {
+		number, err := strconv.Atoi(strings.TrimPrefix(recordKey, uploadKey(stored, id)+suffixPart))
+		if err != nil || number <= marker || number > maxPartNumber {
+			continue
+		}
+		complete := true
+		for i := range upload.Shares {
+			complete = complete && uploaded[i][number]
+		}
+		if !complete {
+			log.Printf("Skipping part %d of upload %s of %s, not all its shares are uploaded", number, id, *input.Key)
+			continue
+		}
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	result := s3response.ListPartsResult{
+		Bucket:           *input.Bucket,
+		Key:              *input.Key,
+		UploadID:         id,
+		StorageClass:     types.StorageClassStandard,
+		PartNumberMarker: marker,
+		MaxParts:         maxParts,
+	}
+	if len(numbers) > maxParts {
+		numbers = numbers[:maxParts]
+		result.IsTruncated = true
+		result.NextPartNumberMarker = numbers[maxParts-1]
+	}
+
+	// The records hold the logical sizes and ETags of the parts
+	parts := make([]*partRecord, len(numbers))
+	errs := make([]error, len(numbers))
+	limit := make(chan struct{}, 16) // Concurrent reads
+	var wg sync.WaitGroup
+	for j, number := range numbers {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(j, number int) {
+			defer func() { <-limit; wg.Done() }()
+			parts[j], errs[j] = self.readPart(ctx, *input.Bucket, stored, id, number, len(upload.Shares))
+		}(j, number)
+	}
+	wg.Wait()
+	if err := firstError(errs); err != nil {
+		return s3response.ListPartsResult{}, handleError(err)
+	}
+	for j, number := range numbers {
+		modified := aws.ToTime(records[partKey(stored, id, number)].LastModified)
+		if parts[j].Created != nil {
+			modified = *parts[j].Created
+		}
+		result.Parts = append(result.Parts, s3response.Part{
+			PartNumber:   number,
+			LastModified: modified,
+			ETag:         parts[j].ETag,
+			Size:         parts[j].Size,
+		})
+	}
+	return result, nil
+}
+
+// pageUploads fills result with the page of the sorted uploads given by
+// the prefix, delimiter, markers and maximum number of uploads of result
+func pageUploads(result *s3response.ListMultipartUploadsResult, uploads []s3response.Upload) {
+	for _, upload := range uploads {
+		// Uploads up to the markers were returned before, with an upload
+		// ID marker only those of the key marker after it are left
+		if upload.Key < result.KeyMarker || (upload.Key == result.KeyMarker &&
+			(result.UploadIDMarker == "" || upload.UploadID <= result.UploadIDMarker)) {
+			continue
+		}
+		if result.Delimiter != "" {
+			if i := strings.Index(upload.Key[len(result.Prefix):], result.Delimiter); i >= 0 {
+				common := upload.Key[:len(result.Prefix)+i+len(result.Delimiter)]
+				n := len(result.CommonPrefixes)
+				if common <= result.KeyMarker || (n > 0 && result.CommonPrefixes[n-1].Prefix == common) {
+					continue
+				}
+				if len(result.Uploads)+n == result.MaxUploads {
+					result.IsTruncated = true
+					break
+				}
+				result.CommonPrefixes = append(result.CommonPrefixes, s3response.CommonPrefix{Prefix: common})
+				result.NextKeyMarker, result.NextUploadIDMarker = common, ""
+				continue
+			}
+		}
+		if len(result.Uploads)+len(result.CommonPrefixes) == result.MaxUploads {
+			result.IsTruncated = true
+			break
+		}
+		result.Uploads = append(result.Uploads, upload)
+		result.NextKeyMarker, result.NextUploadIDMarker = upload.Key, upload.UploadID
+	}
+	if !result.IsTruncated {
+		result.NextKeyMarker, result.NextUploadIDMarker = "", ""
+	}
+}
+
+// shareParts returns the numbers of the parts uploaded to the upload of
+// every share of an upload
+func (self *MyBackend) shareParts(ctx context.Context, bucket string, upload *uploadRecord) ([]map[int]bool, error) {
+	parts := make([]map[int]bool, len(upload.Shares))
+	errs := make([]error, len(upload.Shares))
+	var wg sync.WaitGroup
+	for i, share := range upload.Shares {
+		parts[i] = make(map[int]bool)
+		wg.Add(1)
+		go func(i int, share manifestShare) {
+			defer wg.Done()
+			paginator := s3.NewListPartsPaginator(self.clients[share.Provider], &s3.ListPartsInput{
+				Bucket:   aws.String(bucket),
+				Key:      aws.String(share.Key),
+				UploadId: aws.String(upload.UploadIDs[i]),
+			})
+			for paginator.HasMorePages() {
+				page, err := paginator.NextPage(ctx)
+				if err != nil {
+					errs[i] = err
+					return
+				}
+				for _, part := range page.Parts {
+					parts[i][int(aws.ToInt32(part.PartNumber))] = true
+				}
+			}
+		}(i, share)
+	}
+	wg.Wait()
+	return parts, firstError(errs)
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/valyala/fasthttp"
+	"github.com/versity/versitygw/s3response"
+)
+
+// testMultipartManifest returns the manifest of an object uploaded in the
+// given parts with the given scheme
+func testMultipartManifest(scheme ShareScheme, sizes ...int64) *objectManifest {
+	m := testManifest(scheme)
+	m.Size = 0
+	for i := range m.Shares {
+		m.Shares[i].Size = 0
+	}
+	for j, size := range sizes {
+		m.Parts = append(m.Parts, manifestPart{Number: 2 * (j + 1), Size: size})
+		m.Size += size
+		for i, share := range scheme.shares() {
+			m.Shares[i].Size += storedPartLength(scheme, share, size)
+		}
+	}
+	return m
+}
+
+func TestStoredPartLength(t *testing.T) {
+	for _, tt := range []struct {
+		scheme ShareScheme
+		size   int64
+		want   []int64
+	}{
+		// Shares of small parts, which can only be the last ones, are
+		// not padded
+		{xor2x2Scheme{}, 1001, []int64{501, 500, 501, 500}},
+		{rsScheme{providers: 3, k: 2, m: 1}, 1001, []int64{501, 501, 501}},
+		// Shares of large parts are padded to the minimum part size
+		{xor2x2Scheme{}, minPartSize, []int64{minPartSize, minPartSize, minPartSize, minPartSize}},
+		{xorScheme{providers: 2}, minPartSize + 1, []int64{minPartSize + 1, minPartSize + 1}},
+		{rsScheme{providers: 3, k: 2, m: 1}, 3 * minPartSize, []int64{3 * minPartSize / 2, 3 * minPartSize / 2, 3 * minPartSize / 2}},
+	} {
+		for i, share := range tt.scheme.shares() {
+			if got := storedPartLength(tt.scheme, share, tt.size); got != tt.want[i] {
+				t.Errorf("%s: share %d of a %d byte part has %d bytes, want %d",
+					tt.scheme.name(), i, tt.size, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestManifestLayout(t *testing.T) {
+	scheme := xor2x2Scheme{}
+	m := testMultipartManifest(scheme, minPartSize+2, minPartSize, 10)
+	if _, err := m.scheme(2); err != nil {
+		t.Fatalf("scheme() = %v", err)
+	}
+
+	layout := m.layout(scheme)
+	if len(layout) != 3 {
+		t.Fatalf("got %d parts, want 3", len(layout))
+	}
+	want := []partLayout{
+		{number: 2, offset: 0, size: minPartSize + 2, shares: []int64{0, 0, 0, 0}},
+		{number: 4, offset: minPartSize + 2, size: minPartSize, shares: []int64{minPartSize, minPartSize, minPartSize, minPartSize}},
+		{number: 6, offset: 2*minPartSize + 2, size: 10, shares: []int64{2 * minPartSize, 2 * minPartSize, 2 * minPartSize, 2 * minPartSize}},
+	}
+	if !reflect.DeepEqual(layout, want) {
+		t.Errorf("layout() = %+v, want %+v", layout, want)
+	}
+
+	// Objects not uploaded in parts consist of one part
+	plain := testManifest(scheme)
+	plain.Shares[1].MAC = "ab"
+	if got := plain.layout(scheme); len(got) != 1 || got[0].number != 0 || got[0].size != 42 || got[0].macs[1] != "ab" {
+		t.Errorf("layout() of a plain object = %+v", got)
+	}
+}
+
+func TestManifestParts(t *testing.T) {
+	scheme := shamirScheme{providers: 3, k: 2}
+	for name, modify := range map[string]func(m *objectManifest){
+		"size":       func(m *objectManifest) { m.Size++ },
+		"share size": func(m *objectManifest) { m.Shares[2].Size-- },
+		"part size":  func(m *objectManifest) { m.Parts[1].Size = -1 },
+		"macs":       func(m *objectManifest) { m.Parts[0].MACs = []string{"00"} },
+	} {
+		m := testMultipartManifest(scheme, minPartSize, 100)
+		modify(m)
+		if got, err := m.scheme(3); err == nil {
+			t.Errorf("%s: scheme() = %v, want an error", name, got)
+		}
+	}
+}
+
+func TestUploadRecordMAC(t *testing.T) {
+	backend := &MyBackend{macKey: testMACKey}
+	key := uploadKey("dir/a.txt", "00112233445566778899aabbccddeeff")
+	record := &uploadRecord{
+		Version:   uploadVersion,
+		Scheme:    schemeXor,
+		Shares:    []manifestShare{{Key: "dir/a.txt.share.0.x", Provider: 0}, {Key: "dir/a.txt.share.1.x", Provider: 1}},
+		UploadIDs: []string{"first", "second"},
+	}
+	if err := backend.signRecord(macDomainUpload, "bucket", key, record); err != nil || record.MAC == "" {
+		t.Fatalf("signRecord = %v, MAC %q", err, record.MAC)
+	}
+	data, _ := json.Marshal(record)
+	var decoded uploadRecord
+	json.Unmarshal(data, &decoded)
+	if err := backend.verifyRecord(macDomainUpload, "upload", "bucket", key, &decoded); err != nil {
+		t.Errorf("valid upload record failed verification: %v", err)
+	}
+
+	// Records of one kind are not valid as another
+	decoded.UploadIDs[1] = "other"
+	if err := backend.verifyRecord(macDomainUpload, "upload", "bucket", key, &decoded); !isIntegrityError(err) {
+		t.Errorf("tampered upload record: got %v, want an integrity error", err)
+	}
+	part := &partRecord{Size: 5, ETag: `"etag"`, ETags: []string{"a", "b"}, MAC: record.MAC}
+	if err := backend.verifyRecord(macDomainPart, "part", "bucket", key, part); !isIntegrityError(err) {
+		t.Errorf("part record with the MAC of an upload record: got %v, want an integrity error", err)
+	}
+}
+
+func TestUploadKeys(t *testing.T) {
+	id, err := newUploadID()
+	if err != nil || !validUploadID(id) {
+		t.Fatalf("newUploadID() = %q, %v", id, err)
+	}
+	for _, id := range []string{"", "../x", "00112233445566778899AABBCCDDEEFF", "0011"} {
+		if validUploadID(id) {
+			t.Errorf("validUploadID(%q) = true", id)
+		}
+	}
+	if got := partKey("a.txt", id, 7); got != "a.txt.upload."+id+".part.00007" {
+		t.Errorf("partKey() = %q", got)
+	}
+	if got := uploadRecordKey("a.txt", id); got != "pcs-uploads/a.txt.upload."+id {
+		t.Errorf("uploadRecordKey() = %q", got)
+	}
+	if got := partRecordKey("a.txt", id, 7); got != "pcs-parts/a.txt.upload."+id+".part.00007" {
+		t.Errorf("partRecordKey() = %q", got)
+	}
+	if stored, got, ok := parseUploadKey(uploadKey("dir/a.upload.txt", id)); !ok || stored != "dir/a.upload.txt" || got != id {
+		t.Errorf("parseUploadKey() = %q, %q, %v", stored, got, ok)
+	}
+	if _, _, ok := parseUploadKey(partKey("a.txt", id, 7)); ok {
+		t.Errorf("parseUploadKey() accepted the key of a part record")
+	}
+	// Share objects of uploads are not taken for shares of the bucket scheme
+	if _, _, ok := parseShareKey(xorScheme{providers: 2}, "a.txt.share.0."+id); ok {
+		t.Errorf("share of an upload parsed as share key")
+	}
+}
+
+func TestPageUploads(t *testing.T) {
+	var uploads []s3response.Upload
+	for _, upload := range [][2]string{{"a.txt", "1"}, {"dir/b.txt", "1"}, {"dir/b.txt", "2"}, {"dir/sub/c.txt", "1"}, {"z.txt", "1"}} {
+		uploads = append(uploads, s3response.Upload{Key: upload[0], UploadID: upload[1]})
+	}
+
+	for _, tt := range []struct {
+		prefix, delimiter, keyMarker, idMarker string
+		max                                    int
+		want, prefixes                         []string
+		nextKey, nextID                        string
+	}{
+		{"", "", "", "", 1000, []string{"a.txt/1", "dir/b.txt/1", "dir/b.txt/2", "dir/sub/c.txt/1", "z.txt/1"}, nil, "", ""},
+		{"", "", "", "", 2, []string{"a.txt/1", "dir/b.txt/1"}, nil, "dir/b.txt", "1"},
+		{"", "", "dir/b.txt", "1", 2, []string{"dir/b.txt/2", "dir/sub/c.txt/1"}, nil, "dir/sub/c.txt", "1"},
+		{"", "", "dir/b.txt", "", 1000, []string{"dir/sub/c.txt/1", "z.txt/1"}, nil, "", ""},
+		{"", "/", "", "", 1000, []string{"a.txt/1", "z.txt/1"}, []string{"dir/"}, "", ""},
+		{"", "/", "", "", 2, []string{"a.txt/1"}, []string{"dir/"}, "dir/", ""},
+		{"", "/", "dir/", "", 2, []string{"z.txt/1"}, nil, "", ""},
+		{"dir/", "/", "", "", 1000, []string{"dir/b.txt/1", "dir/b.txt/2"}, []string{"dir/sub/"}, "", ""},
+	} {
+		result := s3response.ListMultipartUploadsResult{
+			Prefix:         tt.prefix,
+			Delimiter:      tt.delimiter,
+			KeyMarker:      tt.keyMarker,
+			UploadIDMarker: tt.idMarker,
+			MaxUploads:     tt.max,
+		}
+		var filtered []s3response.Upload
+		for _, upload := range uploads {
+			if len(upload.Key) >= len(tt.prefix) && upload.Key[:len(tt.prefix)] == tt.prefix {
+				filtered = append(filtered, upload)
+			}
+		}
+		pageUploads(&result, filtered)
+
+		var got, prefixes []string
+		for _, upload := range result.Uploads {
+			got = append(got, upload.Key+"/"+upload.UploadID)
+		}
+		for _, p := range result.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+		if !reflect.DeepEqual(got, tt.want) || !reflect.DeepEqual(prefixes, tt.prefixes) ||
+			result.NextKeyMarker != tt.nextKey || result.NextUploadIDMarker != tt.nextID ||
+			result.IsTruncated != (tt.nextKey != "") {
+			t.Errorf("pageUploads(%q, %q, %q, %q, %d) = %v, %v, next %q %q, truncated %v",
+				tt.prefix, tt.delimiter, tt.keyMarker, tt.idMarker, tt.max,
+				got, prefixes, result.NextKeyMarker, result.NextUploadIDMarker, result.IsTruncated)
+		}
+	}
+}
+
+func TestCompleteMultipartUploadConditions(t *testing.T) {
+	backend, _ := newStubBackend(t, 2, &bucketSettings{scheme: xor2x2Scheme{}})
+	existing := putTestObject(t, backend, "a.txt", "existing", nil)
+
+	// conditional returns a request context carrying the given header
+	conditional := func(header, value string) context.Context {
+		var req fasthttp.Request
+		req.Header.Set(header, value)
+		var ctx fasthttp.RequestCtx
+		ctx.Init(&req, nil, nil)
+		return &ctx
+	}
+	upload, err := backend.CreateMultipartUpload(context.Background(), &s3.CreateMultipartUploadInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("a.txt"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	part, err := backend.UploadPart(context.Background(), &s3.UploadPartInput{
+		Bucket:        aws.String("bucket"),
+		Key:           aws.String("a.txt"),
+		UploadId:      aws.String(upload.UploadId),
+		PartNumber:    aws.Int32(1),
+		Body:          strings.NewReader("uploaded"),
+		ContentLength: aws.Int64(8),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	complete := func(ctx context.Context) error {
+		_, err := backend.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:   aws.String("bucket"),
+			Key:      aws.String("a.txt"),
+			UploadId: aws.String(upload.UploadId),
+			MultipartUpload: &types.CompletedMultipartUpload{
+				Parts: []types.CompletedPart{{PartNumber: aws.Int32(1), ETag: part.ETag}},
+			},
+		})
+		return err
+	}
+
+	for _, tt := range []struct{ header, value string }{
+		{"If-None-Match", "*"},
+		{"If-Match", `"0123456789abcdef0123456789abcdef"`},
+	} {
+		if err := complete(conditional(tt.header, tt.value)); errorCode(err) != "PreconditionFailed" {
+			t.Errorf("CompleteMultipartUpload() with %s: %s = %v, want PreconditionFailed", tt.header, tt.value, err)
+		}
+		if got := getTestObject(t, backend, "a.txt"); got != "existing" {
+			t.Errorf("object is %q after a failed condition, want it unchanged", got)
+		}
+	}
+
+	// The upload stays and can be completed once the conditions hold
+	if err := complete(conditional("If-Match", existing.ETag)); err != nil {
+		t.Fatalf("CompleteMultipartUpload() with a matching ETag failed: %v", err)
+	}
+	if got := getTestObject(t, backend, "a.txt"); got != "uploaded" {
+		t.Errorf("object is %q after the upload was completed, want %q", got, "uploaded")
+	}
+}
+
+func TestListMultipartUploads(t *testing.T) {
+	ctx := context.Background()
+	backend, stubs := newStubBackend(t, 2, &bucketSettings{scheme: xor2x2Scheme{}})
+	putTestObject(t, backend, "a.txt", "existing", nil)
+	upload, err := backend.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String("bucket"),
+		Key:      aws.String("a.txt"),
+		Metadata: map[string]string{"owner": "alice"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	part, err := backend.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String("bucket"),
+		Key:           aws.String("a.txt"),
+		UploadId:      aws.String(upload.UploadId),
+		PartNumber:    aws.Int32(1),
+		Body:          strings.NewReader("uploaded"),
+		ContentLength: aws.Int64(8),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := func() []string {
+		result, err := backend.ListMultipartUploads(ctx, &s3.ListMultipartUploadsInput{Bucket: aws.String("bucket")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, u := range result.Uploads {
+			ids = append(ids, u.Key+" "+u.UploadID)
+		}
+		return ids
+	}
+	if got, want := list(), []string{"a.txt " + upload.UploadId}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListMultipartUploads() = %v, want %v", got, want)
+	}
+	for _, stub := range stubs {
+		for _, key := range []string{uploadRecordKey("a.txt", upload.UploadId), partRecordKey("a.txt", upload.UploadId, 1)} {
+			if _, ok := stub.objects["bucket/"+key]; !ok {
+				t.Errorf("record %s is not stored", key)
+			}
+		}
+		// The metadata of the upload and the ETag of a part, its MD5, are sealed
+		record := stub.objects["bucket/"+uploadRecordKey("a.txt", upload.UploadId)]
+		if record != nil && bytes.Contains(record.data, []byte("alice")) {
+			t.Errorf("upload record %s shows the metadata", record.data)
+		}
+		record = stub.objects["bucket/"+partRecordKey("a.txt", upload.UploadId, 1)]
+		if record != nil && bytes.Contains(record.data, []byte(strings.Trim(*part.ETag, `"`))) {
+			t.Errorf("part record %s shows the ETag %s", record.data, *part.ETag)
+		}
+	}
+
+	// Records of older gateways are stored under their names alone, such
+	// uploads are not listed but can still be completed
+	for _, stub := range stubs {
+		for old, key := range map[string]string{
+			uploadRecordKey("a.txt", upload.UploadId):  uploadKey("a.txt", upload.UploadId),
+			partRecordKey("a.txt", upload.UploadId, 1): partKey("a.txt", upload.UploadId, 1),
+		} {
+			stub.objects["bucket/"+key] = stub.objects["bucket/"+old]
+			delete(stub.objects, "bucket/"+old)
+		}
+	}
+	if got := list(); len(got) != 0 {
+		t.Errorf("ListMultipartUploads() = %v for an upload of an older gateway, want none", got)
+	}
+	parts, err := backend.ListParts(ctx, &s3.ListPartsInput{
+		Bucket:   aws.String("bucket"),
+		Key:      aws.String("a.txt"),
+		UploadId: aws.String(upload.UploadId),
+	})
+	if err != nil || len(parts.Parts) != 1 || parts.Parts[0].ETag != *part.ETag {
+		t.Fatalf("ListParts() = %+v, %v, want the uploaded part", parts.Parts, err)
+	}
+	_, err = backend.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String("bucket"),
+		Key:      aws.String("a.txt"),
+		UploadId: aws.String(upload.UploadId),
+		MultipartUpload: &types.CompletedMultipartUpload{
+			Parts: []types.CompletedPart{{PartNumber: aws.Int32(1), ETag: part.ETag}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := getTestObject(t, backend, "a.txt"); got != "uploaded" {
+		t.Errorf("object is %q after the upload was completed, want %q", got, "uploaded")
+	}
+	head, err := backend.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("a.txt")})
+	if err != nil || head.Metadata["owner"] != "alice" {
+		t.Errorf("HeadObject() = %+v, %v, want the metadata of the upload", head, err)
+	}
+	for _, stub := range stubs {
+		for _, key := range stub.keys() {
+			if _, _, ok := parseRecordKey(strings.TrimPrefix(key, "bucket/")); ok {
+				t.Errorf("record %s is left after the upload was completed", key)
+			}
+		}
+	}
+}
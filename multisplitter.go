@@ -42,6 +42,8 @@ type MultiSplitter struct {
 	outputChans []chan splitterChanItem // Channels to deliver data to each output reader
 	state       MultiSplitterState
 	stateMutex  sync.Mutex
+	closed      chan struct{} // Closed by Close to stop the read loop and the readers
+	closeOnce   sync.Once
 }
 
 // NewMultiSplitter creates a new MultiSplitter with the given parameters:
@@ -69,6 +71,7 @@ func NewMultiSplitter(source io.Reader, chunkSize, outputs int, splitter Splitte
 		splitter:    splitter,
 		outputChans: make([]chan splitterChanItem, outputs),
 		state:       Started,
+		closed:      make(chan struct{}),
 	}
 
 	// Create channels for each output
@@ -130,9 +133,12 @@ func (ms *MultiSplitter) read() error {
 		return err
 	}
 
-	// Send data to each output reader
+	// Send data to each output reader, skipping outputs that received
+	// nothing for this chunk so their readers do not spin on empty reads
 	for i, data := range outputs {
-		ms.outputChans[i] <- splitterChanItem{data: data}
+		if len(data) > 0 && !ms.send(i, splitterChanItem{data: data}) {
+			return ErrSplitterClosed
+		}
 	}
 
 	// Handle errors
@@ -162,7 +168,19 @@ func (ms *MultiSplitter) readLoop() {
 	}
 }
 
-// close closes all channels and marks the splitter as closed
+// send delivers an item to output reader i, it returns false if the
+// splitter was closed before the reader took it
+func (ms *MultiSplitter) send(i int, item splitterChanItem) bool {
+	select {
+	case ms.outputChans[i] <- item:
+		return true
+	case <-ms.closed:
+		return false
+	}
+}
+
+// close closes all channels and marks the splitter as closed, it is only
+// called by the read loop, which is the only sender on the channels
 func (ms *MultiSplitter) close(err error) {
 	if withMutex(&ms.stateMutex, func() bool {
 		needClose := (ms.state != Done)
@@ -172,15 +190,24 @@ func (ms *MultiSplitter) close(err error) {
 		logrus.Debugf("closing MultiSplitter")
 		// Notify all output readers of the error or EOF
 		for i := 0; i < len(ms.outputChans); i++ {
-			ms.outputChans[i] <- splitterChanItem{err: err}
+			ms.send(i, splitterChanItem{err: err})
 			close(ms.outputChans[i])
 		}
 	}
 }
 
-// Close closes the MultiSplitter
+// Close closes the MultiSplitter. A read loop waiting for a reader that
+// no longer reads, e.g. because its upload failed, stops, and readers
+// that have not reached the end fail with ErrSplitterClosed.
 func (ms *MultiSplitter) Close() error {
-	ms.close(io.EOF)
+	ms.closeOnce.Do(func() {
+		ms.stateMutex.Lock()
+		if ms.state == Started {
+			ms.state = Done
+		}
+		ms.stateMutex.Unlock()
+		close(ms.closed)
+	})
 	return nil
 }
 
@@ -207,15 +234,21 @@ func (sr *splitterReader) readFromBuffer(p []byte) (int, error) {
 // Read implements the io.Reader interface for a splitter output
 func (sr *splitterReader) Read(p []byte) (int, error) {
 	logrus.Debugf("splitterReader[%v].Read()", sr.index)
-	if sr.index == 0 {
-		sr.parent.readLoop()
-	}
+	// Any reader may be the first one to be consumed (e.g. when the
+	// consumer of reader 0 never reads because its share is empty)
+	sr.parent.readLoop()
 	// Use any remaining buffered data first
 	if sr.bufferPos < len(sr.buffer) {
 		return sr.readFromBuffer(p)
 	} else {
 		// Get the data
-		item, ok := <-sr.parent.outputChans[sr.index]
+		var item splitterChanItem
+		var ok bool
+		select {
+		case item, ok = <-sr.parent.outputChans[sr.index]:
+		case <-sr.parent.closed:
+			return 0, ErrSplitterClosed
+		}
 		if !ok {
 			return 0, io.EOF
 		}
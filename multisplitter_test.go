@@ -122,3 +122,34 @@ func TestMultiSplitter(t *testing.T) {
 	}
 
 }
+
+func TestMultiSplitterClose(t *testing.T) {
+	// Reader 0 stops reading like the upload of a failed share, which
+	// blocks the read loop until the splitter is closed
+	source := bytes.NewReader(make([]byte, 1<<20))
+	ms, readers, err := NewMultiSplitter(source, 16, 2, func(chunk []byte) [][]byte {
+		return [][]byte{chunk, chunk}
+	})
+	if err != nil {
+		t.Fatalf("Failed to create MultiSplitter: %v", err)
+	}
+	if _, err := readers[0].Read(make([]byte, 16)); err != nil {
+		t.Fatalf("Reader 0 error: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, readers[1])
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	ms.Close()
+	select {
+	case err := <-done:
+		if err != ErrSplitterClosed {
+			t.Errorf("Reader 1 error = %v, want %v", err, ErrSplitterClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reader 1 still blocked after Close")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/versity/versitygw/s3err"
+	"github.com/versity/versitygw/s3response"
+)
+
+// maxHiddenKeyLength is the maximum length of a hidden key, leaving room
+// for the share and manifest suffixes within the 1024 bytes of an S3 key
+const maxHiddenKeyLength = 1000
+
+// Domains of the keys derived for hiding key names
+const (
+	namesDomainCipher = "pcs-names-cipher-v1"
+	namesDomainIV     = "pcs-names-iv-v1"
+)
+
+// hiddenKeyEncoding encodes hidden keys with lowercase letters and digits
+// only, so they never contain the separators of share suffixes
+var hiddenKeyEncoding = base32.NewEncoding("0123456789abcdefghijklmnopqrstuv").WithPadding(base32.NoPadding)
+
+var errNotHidden = errors.New("not a hidden key")
+
+// hiddenKeysChecked is the number of stored keys of every bucket with
+// hidden keys checked by checkHiddenBuckets
+const hiddenKeysChecked = 100
+
+// keyNames maps the logical keys of a bucket to the keys stored on the
+// providers. A nil *keyNames stores the logical keys as they are.
+//
+// Hidden keys are the deterministic encryption of the logical key with a
+// synthetic IV: the padded key is encrypted with AES-256-CTR using its
+// truncated HMAC-SHA256 as IV, which also authenticates it. Equal keys
+// map to equal hidden keys, so objects can still be addressed by key, but
+// providers learn neither the names nor the directory structure, only the
+// length of the names rounded up to 16 bytes. The keys are derived from
+// the key encryption key, by default the MAC key, and the bucket name.
+type keyNames struct {
+	block cipher.Block
+	ivKey []byte
+}
+
+// newKeyNames returns the hidden key names of bucket derived from key
+func newKeyNames(key []byte, bucket string) *keyNames {
+	block, err := aes.NewCipher(newMAC(key, namesDomainCipher, bucket).Sum(nil))
+	if err != nil {
+		// The key of a SHA-256 sum is always valid for AES-256
+		panic(err)
+	}
+	return &keyNames{
+		block: block,
+		ivKey: newMAC(key, namesDomainIV, bucket).Sum(nil),
+	}
+}
+
+// hidden reports whether keys are hidden from the providers
+func (n *keyNames) hidden() bool {
+	return n != nil
+}
+
+// iv returns the synthetic IV of a padded key
+func (n *keyNames) iv(padded []byte) []byte {
+	mac := hmac.New(sha256.New, n.ivKey)
+	mac.Write(padded)
+	return mac.Sum(nil)[:aes.BlockSize]
+}
+
+// hide returns the key stored on the providers for a logical key
+func (n *keyNames) hide(key string) (string, error) {
+	if n == nil {
+		return key, nil
+	}
+
+	// Pad with 0x80 and zeros to a multiple of the block size
+	padded := make([]byte, (len(key)/aes.BlockSize+1)*aes.BlockSize)
+	copy(padded, key)
+	padded[len(key)] = 0x80
+
+	out := make([]byte, aes.BlockSize+len(padded))
+	iv := n.iv(padded)
+	copy(out, iv)
+	cipher.NewCTR(n.block, iv).XORKeyStream(out[aes.BlockSize:], padded)
+
+	hidden := hiddenKeyEncoding.EncodeToString(out)
+	if len(hidden) > maxHiddenKeyLength {
+		return "", s3err.GetAPIError(s3err.ErrKeyTooLong)
+	}
+	return hidden, nil
+}
+
+// reveal returns the logical key of a key stored on the providers
+func (n *keyNames) reveal(hidden string) (string, error) {
+	if n == nil {
+		return hidden, nil
+	}
+
+	data, err := hiddenKeyEncoding.DecodeString(hidden)
+	if err != nil || len(data) < 2*aes.BlockSize || len(data)%aes.BlockSize != 0 {
+		return "", errNotHidden
+	}
+	iv, padded := data[:aes.BlockSize], data[aes.BlockSize:]
+	cipher.NewCTR(n.block, iv).XORKeyStream(padded, padded)
+	if !hmac.Equal(iv, n.iv(padded)) {
+		return "", errNotHidden
+	}
+
+	end := strings.LastIndexByte(string(padded), 0x80)
+	if end < 0 {
+		return "", errNotHidden
+	}
+	for _, b := range padded[end+1:] {
+		if b != 0 {
+			return "", errNotHidden
+		}
+	}
+	return string(padded[:end]), nil
+}
+
+// hideShareKey returns the stored key of a share or manifest key, that is
+// a logical key followed by a suffix
+func (n *keyNames) hideShareKey(base, suffix string) (string, error) {
+	hidden, err := n.hide(base)
+	if err != nil {
+		return "", err
+	}
+	return hidden + suffix, nil
+}
+
+// revealShareKey returns the logical key of a stored share or manifest key.
+// ok is false if the key was not written by the gateway.
+func (n *keyNames) revealShareKey(stored string) (string, bool) {
+	if n == nil {
+		return stored, true
+	}
+	hidden, suffix, _ := strings.Cut(stored, ".")
+	key, err := n.reveal(hidden)
+	if err != nil {
+		return "", false
+	}
+	if suffix != "" {
+		key += "." + suffix
+	}
+	return key, true
+}
+
+// checkHiddenBuckets returns an error if the keys of a bucket with hidden
+// keys were hidden with another key than the configured one, which cannot
+// reveal any of the first keys stored on the first provider. Buckets that
+// cannot be checked are logged and skipped.
+func (self *MyBackend) checkHiddenBuckets(ctx context.Context) error {
+	buckets, err := self.ListBuckets(ctx, s3response.ListBucketsInput{})
+	if err != nil {
+		log.Printf("Warning: failed to list the buckets to check their hidden keys: %v", err)
+		return nil
+	}
+	for _, b := range buckets.Buckets.Bucket {
+		tags, err := self.bucketTags(ctx, b.Name)
+		if err != nil {
+			log.Printf("Warning: failed to read the tags of bucket '%s': %v", b.Name, err)
+			continue
+		}
+		if hide, _ := strconv.ParseBool(tags[hideKeysKey]); !hide {
+			continue
+		}
+		if len(self.namesKey) == 0 {
+			return fmt.Errorf("bucket '%s' has hidden keys, which cannot be read without --key-encryption-key or --mac-key", b.Name)
+		}
+		settings, err := self.settings(ctx, b.Name)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		output, err := self.clients[0].ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:  aws.String(b.Name),
+			MaxKeys: aws.Int32(hiddenKeysChecked),
+		})
+		if err != nil {
+			log.Printf("Warning: failed to list bucket '%s' on client1: %v", b.Name, err)
+			continue
+		}
+		stored, revealed := 0, 0
+		for _, obj := range output.Contents {
+			base, ok := storedBase(settings.scheme, *obj.Key)
+			if !ok {
+				continue
+			}
+			stored++
+			if _, err := settings.names.reveal(base); err == nil {
+				revealed++
+			}
+		}
+		if stored > 0 && revealed == 0 {
+			return fmt.Errorf("none of the keys of bucket '%s' can be revealed, they were hidden with another --key-encryption-key or --mac-key", b.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestKeyNamesRoundTrip(t *testing.T) {
+	names := newKeyNames(testMACKey, "bucket")
+	stored := regexp.MustCompile(`^[0-9a-v]+$`)
+
+	seen := make(map[string]string)
+	for _, key := range []string{
+		"a",
+		"customers/ACME Corp/contract.pdf",
+		"exactly16bytes!!",
+		strings.Repeat("x", 15),
+		strings.Repeat("x", 17),
+		"Kunden/Müller/Rechnung €.txt",
+		"trailing\x80\x00",
+		"a.txt.share.0",
+	} {
+		hidden, err := names.hide(key)
+		if err != nil {
+			t.Fatalf("hide(%q): %v", key, err)
+		}
+		if !stored.MatchString(hidden) {
+			t.Errorf("hide(%q) = %q contains other characters than [0-9a-v]", key, hidden)
+		}
+		if again, _ := names.hide(key); again != hidden {
+			t.Errorf("hide(%q) is not deterministic", key)
+		}
+		if other, ok := seen[hidden]; ok {
+			t.Errorf("%q and %q hide to the same key", key, other)
+		}
+		seen[hidden] = key
+
+		if got, err := names.reveal(hidden); err != nil || got != key {
+			t.Errorf("reveal(hide(%q)) = %q, %v", key, got, err)
+		}
+	}
+}
+
+func TestKeyNamesReveal(t *testing.T) {
+	names := newKeyNames(testMACKey, "bucket")
+	hidden, _ := names.hide("customers/ACME Corp/contract.pdf")
+
+	// Keys of other buckets, keys not hidden by the gateway and modified
+	// keys are rejected
+	flipped := []byte(hidden)
+	flipped[len(flipped)-1] ^= 1
+	for _, key := range []string{
+		"customers/ACME Corp/contract.pdf",
+		"",
+		string(flipped),
+		hidden[:len(hidden)-8],
+	} {
+		if got, err := names.reveal(key); err == nil {
+			t.Errorf("reveal(%q) = %q, want an error", key, got)
+		}
+	}
+	if got, err := newKeyNames(testMACKey, "other").reveal(hidden); err == nil {
+		t.Errorf("key of bucket revealed in other bucket as %q", got)
+	}
+
+	if _, err := names.hide(strings.Repeat("x", 700)); err == nil {
+		t.Errorf("hide accepted a key too long for S3")
+	}
+}
+
+func TestKeyNamesShareKeys(t *testing.T) {
+	names := newKeyNames(testMACKey, "bucket")
+	scheme := xor2x2Scheme{}
+	hidden, _ := names.hide("dir/a.txt")
+
+	stored, err := names.hideShareKey("dir/a.txt", suffixCypherFirst)
+	if err != nil || stored != hidden+suffixCypherFirst {
+		t.Fatalf("hideShareKey = %q, %v", stored, err)
+	}
+	if base, index, ok := parseShareKey(scheme, stored); !ok || base != hidden || index != xorCypherFirst {
+		t.Errorf("parseShareKey(%q) = %q, %d, %v", stored, base, index, ok)
+	}
+	if got, ok := names.revealShareKey(stored); !ok || got != "dir/a.txt"+suffixCypherFirst {
+		t.Errorf("revealShareKey(%q) = %q, %v", stored, got, ok)
+	}
+	if got, ok := names.revealShareKey(hidden + suffixManifest); !ok || got != "dir/a.txt"+suffixManifest {
+		t.Errorf("revealShareKey of the manifest = %q, %v", got, ok)
+	}
+
+	// Without hidden keys the keys are stored as they are
+	var plain *keyNames
+	if got, _ := plain.hideShareKey("dir/a.txt", suffixCypherFirst); got != "dir/a.txt"+suffixCypherFirst {
+		t.Errorf("plain hideShareKey = %q", got)
+	}
+	if got, ok := plain.revealShareKey("dir/a.txt.cypher.first"); !ok || got != "dir/a.txt.cypher.first" {
+		t.Errorf("plain revealShareKey = %q, %v", got, ok)
+	}
+}
+
+func TestListPageFilter(t *testing.T) {
+	var objects []types.Object
+	for _, key := range []string{"a.txt", "dir/b.txt", "dir/sub/c.txt", "dir/sub/d.txt", "dir2/e.txt", "z.txt"} {
+		objects = append(objects, types.Object{Key: aws.String(key)})
+	}
+
+	for _, tt := range []struct {
+		prefix, delimiter, after string
+		keys, prefixes           []string
+	}{
+		{"", "", "", []string{"a.txt", "dir/b.txt", "dir/sub/c.txt", "dir/sub/d.txt", "dir2/e.txt", "z.txt"}, nil},
+		{"", "/", "", []string{"a.txt", "z.txt"}, []string{"dir/", "dir2/"}},
+		{"dir/", "/", "", []string{"dir/b.txt"}, []string{"dir/sub/"}},
+		{"dir", "", "", []string{"dir/b.txt", "dir/sub/c.txt", "dir/sub/d.txt", "dir2/e.txt"}, nil},
+		{"dir/sub/", "/", "dir/sub/c.txt", []string{"dir/sub/d.txt"}, nil},
+		{"", "/", "dir/", []string{"z.txt"}, []string{"dir2/"}},
+		{"x", "/", "", nil, nil},
+	} {
+		it := sliceIterator(objects)
+		contents, prefixes, _, _, err := listPage(context.Background(), &it, tt.prefix, tt.delimiter, tt.after, maxListKeys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var keys, common []string
+		for _, obj := range contents {
+			keys = append(keys, *obj.Key)
+		}
+		for _, p := range prefixes {
+			common = append(common, *p.Prefix)
+		}
+		if !slices.Equal(keys, tt.keys) || !slices.Equal(common, tt.prefixes) {
+			t.Errorf("listPage(%q, %q, %q) = %v, %v, want %v, %v",
+				tt.prefix, tt.delimiter, tt.after, keys, common, tt.keys, tt.prefixes)
+		}
+	}
+}
+
+func TestParseBucketSettings(t *testing.T) {
+	backend := &MyBackend{clients: make([]*s3.Client, 3), scheme: xorScheme{providers: 3}, namesKey: testMACKey}
+
+	settings, err := backend.parseBucketSettings("bucket", map[string]string{
+		schemeKey:   "shamir:2",
+		hideKeysKey: "true",
+	})
+	if err != nil || settings.scheme != (shamirScheme{providers: 3, k: 2}) || !settings.names.hidden() {
+		t.Errorf("parseBucketSettings = %+v, %v", settings, err)
+	}
+	if settings, err := backend.parseBucketSettings("bucket", nil); err != nil ||
+		settings.scheme != backend.scheme || settings.names.hidden() {
+		t.Errorf("parseBucketSettings without tags = %+v, %v", settings, err)
+	}
+
+	for _, tags := range []map[string]string{
+		{schemeKey: "rot13"},
+		{hideKeysKey: "maybe"},
+	} {
+		if settings, err := backend.parseBucketSettings("bucket", tags); err == nil {
+			t.Errorf("parseBucketSettings(%v) = %+v, want an error", tags, settings)
+		}
+	}
+
+	// Hiding keys needs a key to derive the hidden names from
+	backend.namesKey = nil
+	if _, err := backend.parseBucketSettings("bucket", map[string]string{hideKeysKey: "true"}); err == nil {
+		t.Errorf("hiding keys without a key succeeded")
+	}
+}
+
+func TestCheckHiddenBuckets(t *testing.T) {
+	backend, stubs := newStubBackend(t, 2, &bucketSettings{scheme: xor2x2Scheme{}, names: newKeyNames(testMACKey, "bucket")})
+	putTestObject(t, backend, "a.txt", "content", nil)
+	for _, stub := range stubs {
+		stub.buckets = map[string]map[string]string{"bucket": {hideKeysKey: "true"}, "plain": {}}
+	}
+
+	for _, tt := range []struct {
+		name  string
+		key   []byte
+		valid bool
+	}{
+		{"same key", testMACKey, true},
+		{"other key", []byte("another key of 16 bytes"), false},
+		{"no key", nil, false},
+	} {
+		backend.buckets = &sync.Map{}
+		backend.namesKey = tt.key
+		if err := backend.checkHiddenBuckets(context.Background()); (err == nil) != tt.valid {
+			t.Errorf("%s: checkHiddenBuckets() = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
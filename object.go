@@ -4,10 +4,15 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
+	"net/http"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -19,8 +24,6 @@ import (
 	"github.com/versity/versitygw/s3err"
 	"github.com/versity/versitygw/s3response"
 	"github.com/versity/versitygw/s3select"
-
-	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 )
 
 func (self *MyBackend) HeadObject(ctx context.Context, input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
@@ -34,27 +37,145 @@ func (self *MyBackend) HeadObject(ctx context.Context, input *s3.HeadObjectInput
 		return nil, err
 	}
 
-	// Try to get object from first storage system
-	output, err := self.client1.HeadObject(ctx, input)
-	if err == nil {
+	// The bucket determines how its objects are split into shares and
+	// under which keys they are stored
+	settings, err := self.settings(ctx, *input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	scheme := settings.scheme
+	storedInput := *input
+
+	// Requests for a single share go to the provider storing it
+	if client, stored, ok := self.shareClient(scheme, settings.names, *input.Key); ok {
+		storedInput.Key = aws.String(stored)
+		output, err := client.HeadObject(ctx, &storedInput)
+		if err != nil {
+			return nil, handleError(err)
+		}
 		return output, nil
 	}
 
-	// If not found in first storage, try second storage
-	output, err = self.client2.HeadObject(ctx, input)
+	stored, err := settings.names.hide(*input.Key)
+	if err != nil {
+		return nil, err
+	}
+	storedInput.Key = aws.String(stored)
+	output, err := self.headOriginal(ctx, scheme, &storedInput)
 	if err != nil {
+		return nil, err
+	}
+	if err := requestConditions(ctx).check(aws.ToString(output.ETag), aws.ToTime(output.LastModified), true); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// headOriginal returns the HeadObject response for the original file
+// stored as input.Key. The manifest describes the original file, objects
+// without one are inferred from their shares. With a MAC key such objects
+// cannot be checked and are refused.
+func (self *MyBackend) headOriginal(ctx context.Context, scheme ShareScheme, input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	manifest, err := self.readManifest(ctx, *input.Bucket, *input.Key)
+	if err == nil {
+		return manifest.headOutput(input.ChecksumMode), nil
+	}
+	if !errors.Is(err, errNoManifest) {
 		return nil, handleError(err)
 	}
 
+	// Head all shares of the original file, it exists if enough streams
+	// are complete
+	outputs, errs := self.headShares(ctx, scheme, input)
+	streams := availableStreams(scheme, func(i int) bool { return errs[i] == nil })
+	if len(streams) < scheme.threshold() {
+		return nil, handleError(firstError(errs))
+	}
+	if len(self.macKey) > 0 {
+		return nil, integrityError("%s has no manifest, its shares cannot be checked", *input.Key)
+	}
+
+	size, err := logicalSize(scheme, streams[0], func(i int) int64 {
+		return aws.ToInt64(outputs[i].ContentLength)
+	}, func(i int) map[string]string {
+		return outputs[i].Metadata
+	})
+	if err != nil {
+		return nil, handleError(err)
+	}
+	output := outputs[streamShares(scheme, streams[0])[0]]
+	output.ContentLength = aws.Int64(size)
+	output.Metadata = stripShareMetadata(output.Metadata)
 	return output, nil
 }
 
+// currentHead returns the HeadObject response for the original file stored
+// as key, which conditional writes are evaluated on, or nil if there is none
+func (self *MyBackend) currentHead(ctx context.Context, scheme ShareScheme, bucket, key string) (*s3.HeadObjectOutput, error) {
+	output, err := self.headOriginal(ctx, scheme, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	var apiErr s3err.APIError
+	if errors.As(err, &apiErr) && apiErr.HTTPStatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	return output, err
+}
+
+// headShares heads all shares of the original file input.Key concurrently.
+// The results are indexed like the shares of the scheme.
+func (self *MyBackend) headShares(ctx context.Context, scheme ShareScheme, input *s3.HeadObjectInput) ([]*s3.HeadObjectOutput, []error) {
+	shares := scheme.shares()
+	outputs := make([]*s3.HeadObjectOutput, len(shares))
+	errs := make([]error, len(shares))
+	var wg sync.WaitGroup
+	wg.Add(len(shares))
+	for i, share := range shares {
+		go func(i int, share shareSpec) {
+			defer wg.Done()
+			shareInput := *input
+			shareInput.Key = aws.String(*input.Key + share.suffix)
+			outputs[i], errs[i] = self.clients[share.provider].HeadObject(ctx, &shareInput)
+		}(i, share)
+	}
+	wg.Wait()
+	return outputs, errs
+}
+
+// firstError returns the first non-nil error. Cancellations are only
+// returned if there is no other error, they are usually caused by it.
+func firstError(errs []error) error {
+	var cancelled error
+	for _, err := range errs {
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return err
+		}
+		if cancelled == nil {
+			cancelled = err
+		}
+	}
+	return cancelled
+}
+
 func (self *MyBackend) GetObject(ctx context.Context, input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return self.getObject(ctx, input, requestConditions(ctx))
+}
+
+// getObject returns the object of a GetObject request if the conditions
+// hold for the original file
+func (self *MyBackend) getObject(ctx context.Context, input *s3.GetObjectInput, conds objectConditions) (*s3.GetObjectOutput, error) {
 	// Check bucket access first
 	if err := self.checkBucketAccess(ctx, *input.Bucket); err != nil {
 		return nil, handleError(err)
 	}
 
+	settings, err := self.settings(ctx, *input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	scheme := settings.scheme
+
 	log.Printf("MyBackend.GetObject(%v, %v)", ctx, input)
 	if input.ExpectedBucketOwner != nil && *input.ExpectedBucketOwner == "" {
 		input.ExpectedBucketOwner = nil
@@ -108,108 +229,482 @@ func (self *MyBackend) GetObject(ctx context.Context, input *s3.GetObjectInput)
 		input.VersionId = nil
 	}
 
-	// Check if this is a request for the original file
+	// Requests for a single share go to the provider storing it
 	key := *input.Key
-	if !strings.HasSuffix(key, ".cypher.first") &&
-		!strings.HasSuffix(key, ".cypher.second") &&
-		!strings.HasSuffix(key, ".rand.first") &&
-		!strings.HasSuffix(key, ".rand.second") {
-		// This is a request for the original file, we need to reconstruct it
-		// from its four parts across both storage engines
-
-		// Define the related files and their corresponding clients
-		type fileInfo struct {
-			key    string
-			client *s3.Client
+	if client, stored, ok := self.shareClient(scheme, settings.names, key); ok {
+		shareInput := *input
+		shareInput.Key = aws.String(stored)
+		output, err := client.GetObject(ctx, &shareInput)
+		if err != nil {
+			return nil, handleError(err)
+		}
+		return output, nil
+	}
+
+	// This is a request for the original file, we need to reconstruct it
+	// from its shares across all storage engines. Its manifest records the
+	// scheme and placement of the shares, objects without one are inferred
+	// from the shares of the bucket scheme.
+	stored, err := settings.names.hide(key)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := self.readManifest(ctx, *input.Bucket, stored)
+	if err == nil {
+		head := manifest.headOutput("")
+		if err := conds.check(aws.ToString(head.ETag), aws.ToTime(head.LastModified), true); err != nil {
+			return nil, err
 		}
-		files := []fileInfo{
-			{key + ".cypher.first", self.client1},  // client1
-			{key + ".cypher.second", self.client2}, // client2
-			{key + ".rand.first", self.client2},    // client2
-			{key + ".rand.second", self.client1},   // client1
+		return self.getPublished(ctx, input, stored, manifest)
+	}
+	if !errors.Is(err, errNoManifest) {
+		return nil, handleError(err)
+	}
+	// Shares without a manifest have no MACs to be checked against
+	if len(self.macKey) > 0 {
+		_, err := self.headOriginal(ctx, scheme, &s3.HeadObjectInput{
+			Bucket: input.Bucket,
+			Key:    aws.String(stored),
+		})
+		var apiErr s3err.APIError
+		if errors.As(err, &apiErr) && apiErr.HTTPStatusCode == http.StatusNotFound {
+			return nil, s3err.GetAPIError(s3err.ErrNoSuchKey)
 		}
+		return nil, err
+	}
+	shares := scheme.shares()
 
-		// Download all four parts concurrently
-		var parts [4][]byte
-		var errs [4]error
-		var wg sync.WaitGroup
-		wg.Add(4)
-
-		for i, file := range files {
-			go func(i int, file fileInfo) {
-				defer wg.Done()
-				// Create a new input for the related file
-				relatedInput := &s3.GetObjectInput{
-					Bucket: input.Bucket,
-					Key:    aws.String(file.key),
-				}
+	// A byte range of the original file maps to a range in each share,
+	// which needs the object size to be known upfront
+	var size int64
+	var rng byteRange
+	partial := false
+	if input.Range != nil {
+		size, err = self.objectSize(ctx, scheme, *input.Bucket, stored)
+		if err != nil {
+			return nil, handleError(err)
+		}
+		rng, partial, err = parseRange(*input.Range, size)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-				// Get the related file using the appropriate client
-				output, err := file.client.GetObject(ctx, relatedInput)
-				if err != nil {
-					errs[i] = err
-					return
-				}
+	// Open all shares concurrently, the bodies are consumed while
+	// streaming the response
+	bodies := make([]io.ReadCloser, len(shares))
+	outputs := make([]*s3.GetObjectOutput, len(shares))
+	errs := make([]error, len(shares))
+	var wg sync.WaitGroup
 
-				// Read the data
-				data, err := io.ReadAll(output.Body)
-				if err != nil {
-					errs[i] = err
-					return
-				}
-				parts[i] = data
-			}(i, file)
+	for i, share := range shares {
+		shareInput := &s3.GetObjectInput{
+			Bucket: input.Bucket,
+			Key:    aws.String(stored + share.suffix),
+		}
+		if partial {
+			offset, length := scheme.segment(share.part, size)
+			r, ok := shareByteRange(scheme, rng, offset, length)
+			if !ok {
+				// This share is not part of the requested range
+				outputs[i] = &s3.GetObjectOutput{ContentLength: aws.Int64(0)}
+				bodies[i] = io.NopCloser(strings.NewReader(""))
+				continue
+			}
+			shareInput.Range = aws.String(r.Header())
 		}
-		wg.Wait()
 
-		// Check for errors
-		for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int, client *s3.Client) {
+			defer wg.Done()
+			outputs[i], errs[i] = client.GetObject(ctx, shareInput)
 			if errs[i] != nil {
-				log.Printf("Error downloading part %d: %v", i, errs[i])
-				return nil, handleError(errs[i])
+				log.Printf("Error downloading share %d: %v", i, errs[i])
+				return
 			}
-		}
+			bodies[i] = outputs[i].Body
+		}(i, self.clients[share.provider])
+	}
+	wg.Wait()
 
-		// Define a joiner function that combines two parts
-		joiner := func(part1, part2 []byte) []byte {
-			return append(part1, part2...)
+	// The scheme recorded with the shares selects the decoder
+	decoder := scheme
+	for i := range outputs {
+		if errs[i] != nil {
+			continue
 		}
-
-		// Join the parts
-		cypherData := joiner(parts[0], parts[1]) // .cypher.first + .cypher.second
-		randData := joiner(parts[2], parts[3])   // .rand.first + .rand.second
-
-		// XOR the joined data to reconstruct the original
-		secretData := make([]byte, len(cypherData))
-		for i := range cypherData {
-			secretData[i] = cypherData[i] ^ randData[i]
+		if recorded, ok := schemeFromMetadata(outputs[i].Metadata, len(self.clients)); ok {
+			if slices.Equal(recorded.shares(), shares) && recorded.width() == scheme.width() {
+				decoder = recorded
+			}
+			break
 		}
+	}
 
-		// Create a new output with the reconstructed data
-		return &s3.GetObjectOutput{
-			Body:          io.NopCloser(bytes.NewReader(secretData)),
-			ContentLength: aws.Int64(int64(len(secretData))),
-			LastModified:  aws.Time(time.Now()),
-		}, nil
+	joiner, streams, err := joinShares(decoder, bodies, errs)
+	if err != nil {
+		return nil, handleError(err)
 	}
 
-	// This is a request for a related file, determine which client to use
-	var client *s3.Client
-	if strings.HasSuffix(key, ".cypher.first") || strings.HasSuffix(key, ".rand.second") {
-		client = self.client1
+	// Objects without a manifest carry their headers on the shares
+	output := &s3.GetObjectOutput{AcceptRanges: aws.String("bytes")}
+	for i := range outputs {
+		if errs[i] == nil && outputs[i].LastModified != nil {
+			output.CacheControl = outputs[i].CacheControl
+			output.ContentDisposition = outputs[i].ContentDisposition
+			output.ContentEncoding = outputs[i].ContentEncoding
+			output.ContentLanguage = outputs[i].ContentLanguage
+			output.ContentType = outputs[i].ContentType
+			output.ETag = outputs[i].ETag
+			output.Expires = outputs[i].Expires
+			output.LastModified = outputs[i].LastModified
+			output.Metadata = stripShareMetadata(outputs[i].Metadata)
+			break
+		}
+	}
+	if err := conds.check(aws.ToString(output.ETag), aws.ToTime(output.LastModified), true); err != nil {
+		joiner.Close()
+		return nil, err
+	}
+	if partial {
+		output.ContentLength = aws.Int64(rng.Length())
+		output.ContentRange = aws.String(rng.ContentRange(size))
+		// Striped shares start at the row holding rng.Start
+		if skip := rng.Start % int64(decoder.width()); skip > 0 {
+			if _, err := io.CopyN(io.Discard, joiner, skip); err != nil {
+				joiner.Close()
+				return nil, handleError(err)
+			}
+		}
 	} else {
-		client = self.client2
+		size, err = logicalSize(decoder, streams[0], func(i int) int64 {
+			return aws.ToInt64(outputs[i].ContentLength)
+		}, func(i int) map[string]string {
+			return outputs[i].Metadata
+		})
+		if err != nil {
+			joiner.Close()
+			return nil, handleError(err)
+		}
+		output.ContentLength = aws.Int64(size)
 	}
+	// Drop the padding of striped shares
+	output.Body = NewLimitReadCloser(joiner, *output.ContentLength)
+	return output, nil
+}
 
-	// Get the object using the appropriate client
-	output, err := client.GetObject(ctx, input)
+// getPublished returns the GetObject response for the original file stored
+// as stored and published with manifest m. The parts of the file are
+// opened one after another while the response is streamed.
+func (self *MyBackend) getPublished(ctx context.Context, input *s3.GetObjectInput, stored string, m *objectManifest) (*s3.GetObjectOutput, error) {
+	scheme, err := m.scheme(len(self.clients))
 	if err != nil {
 		return nil, handleError(err)
 	}
+	rng := byteRange{Start: 0, End: m.Size - 1}
+	partial := false
+	if input.Range != nil {
+		r, ok, err := parseRange(*input.Range, m.Size)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			rng, partial = r, true
+		}
+	}
 
+	// Every part overlapping the range is read from its shares
+	var opens []func() (io.ReadCloser, error)
+	for _, part := range m.layout(scheme) {
+		r, ok := shareRange(rng, part.offset, part.size)
+		if !ok {
+			continue
+		}
+		opens = append(opens, func() (io.ReadCloser, error) {
+			return self.openPart(ctx, *input.Bucket, *input.Key, m.macOrigin(*input.Bucket, stored), scheme, m.Shares, part, r)
+		})
+	}
+	// The first part is opened before responding, so that missing shares
+	// are reported as errors
+	var body io.ReadCloser = io.NopCloser(strings.NewReader(""))
+	if len(opens) > 0 {
+		first, err := opens[0]()
+		if err != nil {
+			var apiErr s3err.APIError
+			if errors.As(err, &apiErr) {
+				return nil, apiErr
+			}
+			return nil, handleError(err)
+		}
+		body = NewLazyConcatReadCloser(first, opens[1:]...)
+	}
+
+	// The checksum covers the whole object only
+	mode := input.ChecksumMode
+	if partial {
+		mode = ""
+	}
+	head := m.headOutput(mode)
+	output := &s3.GetObjectOutput{
+		AcceptRanges:       aws.String("bytes"),
+		Body:               body,
+		CacheControl:       head.CacheControl,
+		ChecksumCRC32:      head.ChecksumCRC32,
+		ChecksumCRC32C:     head.ChecksumCRC32C,
+		ChecksumCRC64NVME:  head.ChecksumCRC64NVME,
+		ChecksumSHA1:       head.ChecksumSHA1,
+		ChecksumSHA256:     head.ChecksumSHA256,
+		ChecksumType:       head.ChecksumType,
+		ContentDisposition: head.ContentDisposition,
+		ContentEncoding:    head.ContentEncoding,
+		ContentLanguage:    head.ContentLanguage,
+		ContentLength:      aws.Int64(rng.Length()),
+		ContentType:        head.ContentType,
+		ETag:               head.ETag,
+		Expires:            head.Expires,
+		LastModified:       head.LastModified,
+		Metadata:           head.Metadata,
+	}
+	if partial {
+		output.ContentRange = aws.String(rng.ContentRange(m.Size))
+	}
+
+	// A MAC mismatch can only be reported as an S3 error before the
+	// response is sent, so small responses are verified upfront. Larger
+	// ones are aborted at the first chunk not matching its MAC, the client
+	// only received checked data then.
+	if len(self.macKey) > 0 && rng.Length() <= maxVerifiedUpfront {
+		data, err := io.ReadAll(output.Body)
+		output.Body.Close()
+		if err != nil {
+			var apiErr s3err.APIError
+			if errors.As(err, &apiErr) {
+				return nil, apiErr
+			}
+			return nil, handleError(err)
+		}
+		output.Body = io.NopCloser(bytes.NewReader(data))
+	}
 	return output, nil
 }
 
+// openPart opens the bytes rng of a part of the original file key from the
+// share objects at locations. Shares of the wrong length are treated as
+// missing. With a MAC key the shares are checked against their MACs, which
+// are bound to origin, while streaming: every chunk of a share is checked
+// before any of its bytes are passed on, see newChunkMAC. Shares written
+// by older gateways only have a MAC over the whole share, which is checked
+// at its end, ranges within them cannot be checked and are refused.
+func (self *MyBackend) openPart(ctx context.Context, bucket, key string, origin manifestOrigin, scheme ShareScheme,
+	locations []manifestShare, part partLayout, rng byteRange,
+) (io.ReadCloser, error) {
+	shares := scheme.shares()
+	whole := rng.Start == 0 && rng.End == part.size-1
+	bodies := make([]io.ReadCloser, len(shares))
+	errs := make([]error, len(shares))
+	var refused error
+	var wg sync.WaitGroup
+
+	for i, share := range shares {
+		offset, length := scheme.segment(share.part, part.size)
+		r, ok := shareByteRange(scheme, rng, offset, length)
+		if !ok {
+			// This share is not part of the requested range
+			bodies[i] = io.NopCloser(strings.NewReader(""))
+			continue
+		}
+		size := shareLength(scheme, length)
+		var mac hash.Hash
+		var want, sums []byte
+		chunked := false
+		if len(self.macKey) > 0 {
+			if i < len(part.chunks) && part.chunks[i] != "" {
+				if sums, chunked = decodeChunkMACs(part.chunks[i], size); !chunked {
+					refused = integrityError("share %d of %s has invalid chunk MACs", i, key)
+					break
+				}
+			} else {
+				if i < len(part.macs) {
+					want, _ = hex.DecodeString(part.macs[i])
+				}
+				if len(want) > 0 && !whole {
+					refused = integrityError("range of %s cannot be checked against its MACs", key)
+					break
+				}
+				if len(want) > 0 {
+					mac = part.shareMAC(self.macKey, origin, i, size)
+				}
+			}
+		}
+		// Chunks are checked as a whole, so the share is read from the
+		// start of the first chunk of the range to the end of the last
+		read := r
+		if chunked {
+			read = chunkAlign(r, size)
+		}
+		// Objects not uploaded in parts are read as a whole, so that data
+		// appended to the shares is noticed
+		var header *string
+		if part.number != 0 || read.Length() != size {
+			header = aws.String(byteRange{Start: part.shares[i] + read.Start, End: part.shares[i] + read.End}.Header())
+		}
+
+		wg.Add(1)
+		go func(i int, location manifestShare) {
+			defer wg.Done()
+			output, err := self.clients[location.Provider].GetObject(ctx, &s3.GetObjectInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(location.Key),
+				Range:  header,
+			})
+			if err != nil {
+				log.Printf("Error downloading share %d: %v", i, err)
+				errs[i] = err
+				return
+			}
+			if got := aws.ToInt64(output.ContentLength); got != read.Length() {
+				output.Body.Close()
+				errs[i] = self.shareTampered(bucket, key, location,
+					fmt.Sprintf("share has %d bytes at %d, manifest records %d", got, part.shares[i]+read.Start, read.Length()))
+				return
+			}
+			bodies[i] = output.Body
+			if chunked {
+				newMAC := func(chunk int64) hash.Hash { return part.chunkMAC(self.macKey, origin, i, size, chunk) }
+				bodies[i] = newChunkMACReader(output.Body, newMAC, sums, size, r, func() error {
+					return self.shareTampered(bucket, key, location, "share does not match its chunk MACs")
+				})
+			} else if mac != nil {
+				bodies[i] = newMACReader(output.Body, mac, want, func() error {
+					return self.shareTampered(bucket, key, location, "share does not match its MAC")
+				})
+			}
+		}(i, locations[i])
+	}
+	wg.Wait()
+	if refused != nil {
+		for _, body := range bodies {
+			if body != nil {
+				body.Close()
+			}
+		}
+		return nil, refused
+	}
+
+	joiner, _, err := joinShares(scheme, bodies, errs)
+	if err != nil {
+		return nil, err
+	}
+	// Striped shares start at the row holding rng.Start
+	if skip := rng.Start % int64(scheme.width()); skip > 0 {
+		if _, err := io.CopyN(io.Discard, joiner, skip); err != nil {
+			joiner.Close()
+			return nil, err
+		}
+	}
+	// Drop the padding of striped shares
+	return NewLimitReadCloser(joiner, rng.Length()), nil
+}
+
+// shareByteRange returns the range of a share holding the segment
+// [offset, offset+length) of an object that holds the logical bytes rng.
+// It returns ok=false if the share does not overlap the range at all.
+func shareByteRange(scheme ShareScheme, rng byteRange, offset, length int64) (byteRange, bool) {
+	// Share byte i encodes the logical bytes [i*w, (i+1)*w)
+	w := int64(scheme.width())
+	rows := byteRange{Start: rng.Start / w, End: rng.End / w}
+	return shareRange(rows, offset/w, shareLength(scheme, length))
+}
+
+// joinShares joins the opened shares of an object, bodies and errs being
+// indexed like the shares of the scheme. Shares may be missing as long as
+// enough streams are complete, bodies not needed are closed. It returns
+// the joined streams.
+func joinShares(scheme ShareScheme, bodies []io.ReadCloser, errs []error) (*MultiJoiner, []int, error) {
+	closeBodies := func(skip func(i int) bool) {
+		for i, body := range bodies {
+			if body != nil && !skip(i) {
+				body.Close()
+			}
+		}
+	}
+
+	streams := availableStreams(scheme, func(i int) bool { return errs[i] == nil })
+	if len(streams) < scheme.threshold() {
+		closeBodies(func(int) bool { return false })
+		return nil, nil, firstError(errs)
+	}
+	streams = streams[:scheme.threshold()]
+
+	// Concatenate the shares of every stream in part order and join the
+	// streams while reading
+	readers := make([]io.Reader, len(streams))
+	used := make([]bool, len(bodies))
+	for j, stream := range streams {
+		var parts []io.ReadCloser
+		for _, i := range streamShares(scheme, stream) {
+			parts = append(parts, bodies[i])
+			used[i] = true
+		}
+		readers[j] = NewConcatReadCloser(parts...)
+	}
+	closeBodies(func(i int) bool { return used[i] })
+	joiner, err := NewMultiJoiner(readers, shareChunkSize, scheme.joiner(streams))
+	if err != nil {
+		closeBodies(func(int) bool { return false })
+		return nil, nil, err
+	}
+	return joiner, streams, nil
+}
+
+// shareTampered records a share failing its integrity check in the audit
+// log and returns the error reported for it
+func (self *MyBackend) shareTampered(bucket, key string, share manifestShare, reason string) error {
+	self.audit.record(auditEvent{
+		Event:    auditShareTampered,
+		Bucket:   bucket,
+		Key:      key,
+		Share:    share.Key,
+		Provider: share.Provider + 1,
+		Reason:   reason,
+	})
+	return integrityError("Share %s of %s on storage %d failed its integrity check: %s",
+		share.Key, key, share.Provider+1, reason)
+}
+
+// shareClient returns the client storing the share with the given key and
+// the key it is stored as. ok is false if key is not the key of a share.
+func (self *MyBackend) shareClient(scheme ShareScheme, names *keyNames, key string) (*s3.Client, string, bool) {
+	base, index, ok := parseShareKey(scheme, key)
+	if !ok {
+		return nil, "", false
+	}
+	share := scheme.shares()[index]
+	stored, err := names.hideShareKey(base, share.suffix)
+	if err != nil {
+		return nil, "", false
+	}
+	return self.clients[share.provider], stored, true
+}
+
+// objectSize returns the size of the original file from the shares of a
+// complete stream.
+func (self *MyBackend) objectSize(ctx context.Context, scheme ShareScheme, bucket, key string) (int64, error) {
+	outputs, errs := self.headShares(ctx, scheme, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	streams := availableStreams(scheme, func(i int) bool { return errs[i] == nil })
+	if len(streams) < scheme.threshold() {
+		return 0, firstError(errs)
+	}
+	return logicalSize(scheme, streams[0], func(i int) int64 {
+		return aws.ToInt64(outputs[i].ContentLength)
+	}, func(i int) map[string]string {
+		return outputs[i].Metadata
+	})
+}
+
 func (MyBackend) GetObjectAcl(ctx context.Context, input *s3.GetObjectAclInput) (*s3.GetObjectAclOutput, error) {
 	log.Printf("MyBackend.GetObjectAcl(%v, %v)", ctx, input)
 	return nil, s3err.GetAPIError(s3err.ErrNotImplemented)
@@ -218,9 +713,46 @@ func (MyBackend) GetObjectAcl(ctx context.Context, input *s3.GetObjectAclInput)
 func (self *MyBackend) PutObject(
 	ctx context.Context, input *s3.PutObjectInput,
 ) (s3response.PutObjectOutput, error) {
+	digests, err := putObjectDigests(ctx, input)
+	if err != nil {
+		return s3response.PutObjectOutput{}, err
+	}
+	manifest, err := self.putObject(ctx, input, digests, requestConditions(ctx))
+	if err != nil {
+		return s3response.PutObjectOutput{}, err
+	}
+	// The ETag and checksums are the ones of the original file, not of
+	// the shares
+	return s3response.PutObjectOutput{
+		ETag:              manifest.Checksums.etag(),
+		ChecksumCRC32:     manifest.Checksums.value(types.ChecksumAlgorithmCrc32),
+		ChecksumCRC32C:    manifest.Checksums.value(types.ChecksumAlgorithmCrc32c),
+		ChecksumCRC64NVME: manifest.Checksums.value(types.ChecksumAlgorithmCrc64nvme),
+		ChecksumSHA1:      manifest.Checksums.value(types.ChecksumAlgorithmSha1),
+		ChecksumSHA256:    manifest.Checksums.value(types.ChecksumAlgorithmSha256),
+		ChecksumType:      manifest.Checksums.checksumType(),
+	}, nil
+}
+
+// putObject splits the body of a PutObject request into shares and
+// publishes the original file if it matches the digests and the conditions
+// hold for the object it replaces. It returns the manifest of the object.
+func (self *MyBackend) putObject(
+	ctx context.Context, input *s3.PutObjectInput, digests uploadDigests, conds objectConditions,
+) (*objectManifest, error) {
 	// Check bucket access first
 	if err := self.checkBucketAccess(ctx, *input.Bucket); err != nil {
-		return s3response.PutObjectOutput{}, handleError(err)
+		return nil, handleError(err)
+	}
+
+	settings, err := self.settings(ctx, *input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	scheme := settings.scheme
+	stored, err := settings.names.hide(*input.Key)
+	if err != nil {
+		return nil, err
 	}
 
 	// Clean up empty optional fields
@@ -310,124 +842,209 @@ func (self *MyBackend) PutObject(
 
 	log.Printf("MyBackend.PutObject(%v, %+v)", ctx, input)
 
-	// Create pipes for the data streams
-	pr1, pw1 := io.Pipe()
-	pr2, pw2 := io.Pipe()
-	pr3, pw3 := io.Pipe()
-	pr4, pw4 := io.Pipe()
-
-	// Create a multi-writer to write to all pipes
-	mw := io.MultiWriter(pw1, pw2, pw3, pw4)
-
-	// Start a goroutine to copy the input data to all pipes
-	go func() {
-		defer pw1.Close()
-		defer pw2.Close()
-		defer pw3.Close()
-		defer pw4.Close()
-		if _, err := io.Copy(mw, input.Body); err != nil {
-			log.Printf("Error copying data: %v", err)
+	if input.ContentLength == nil {
+		return nil, s3err.GetAPIError(s3err.ErrInvalidRequest)
+	}
+	size := *input.ContentLength
+	shares := scheme.shares()
+
+	// Conditions are evaluated on the logical object
+	conditional := conds.conditionalWrite()
+	if conditional {
+		head, err := self.currentHead(ctx, scheme, *input.Bucket, stored)
+		if err != nil {
+			return nil, err
+		}
+		if err := conds.checkWrite(head); err != nil {
+			return nil, err
+		}
+	}
+
+	// The upload is committed in two phases: the shares are staged under
+	// keys unique to the upload, so that neither the object stored before
+	// nor a concurrent upload of the key is touched, and the manifest then
+	// publishes them. Until the manifest is written the previous object
+	// remains readable, if anything fails the staged shares are removed
+	// again, also if the request was cancelled. A create publishes the
+	// manifest on all providers or none.
+	id, err := newUploadID()
+	if err != nil {
+		return nil, err
+	}
+	locations := shareLocations(stored, scheme, nil)
+	for i := range locations {
+		locations[i].Key += "." + id
+	}
+	// If the gateway stops before the upload is published or rolled back,
+	// it is completed at startup if its manifest was written anywhere and
+	// rolled back otherwise
+	intent, err := self.journal.begin(journalEntry{
+		Op:     intentPutObject,
+		Bucket: *input.Bucket,
+		Key:    stored,
+		Shares: locations,
+	})
+	if err != nil {
+		return nil, err
+	}
+	rollback := func() {
+		if self.deleteShares(context.WithoutCancel(ctx), *input.Bucket, locations) == nil {
+			self.journal.end(intent)
 		}
-	}()
-
-	// Prepare the S3 objects
-	keyFirst := *input.Key + ".cypher.first"
-	keySecond := *input.Key + ".cypher.second"
-	keyRandFirst := *input.Key + ".rand.first"
-	keyRandSecond := *input.Key + ".rand.second"
-
-	inputFirst := *input
-	inputSecond := *input
-	randFirst := *input
-	randSecond := *input
-
-	inputFirst.Key = &keyFirst
-	inputSecond.Key = &keySecond
-	randFirst.Key = &keyRandFirst
-	randSecond.Key = &keyRandSecond
-
-	inputFirst.Body = pr1
-	inputSecond.Body = pr2
-	randFirst.Body = pr3
-	randSecond.Body = pr4
-
-	// Perform the PutObject operations concurrently using both clients
+	}
+
+	// Split the body into shares while streaming, the checksums of the
+	// original file and the MACs of the shares go into its manifest
+	hasher := newObjectHasher(digests)
+	source := io.TeeReader(input.Body, hasher)
+	ms, readers, err := NewMultiSplitter(source, shareChunkSize, len(shares), scheme.splitter(size))
+	if err != nil {
+		self.journal.end(intent)
+		return nil, handleError(err)
+	}
+	defer ms.Close()
+
+	// Perform the PutObject operations concurrently using all clients. The
+	// first failure cancels the other uploads and stops the splitter, which
+	// would otherwise wait for the failed share to be read.
+	uploadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var failOnce sync.Once
+	var failure error
+	fail := func(err error) {
+		failOnce.Do(func() {
+			failure = err
+			cancel()
+			ms.Close()
+		})
+	}
 	var wg sync.WaitGroup
-	wg.Add(4)
-
-	// Channel to collect results
-	type result struct {
-		output *s3.PutObjectOutput
-		err    error
-		index  int
-	}
-	results := make(chan result, 4)
-
-	// Store .cypher.first and .rand.second in client1
-	go func() {
-		defer wg.Done()
-		output, err := self.client1.PutObject(ctx, &inputFirst, s3.WithAPIOptions(
-			v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware,
-		))
-		results <- result{output: output, err: err, index: 0}
-	}()
-
-	go func() {
-		defer wg.Done()
-		output, err := self.client1.PutObject(ctx, &randSecond, s3.WithAPIOptions(
-			v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware,
-		))
-		results <- result{output: output, err: err, index: 3}
-	}()
-
-	// Store .cypher.second and .rand.first in client2
-	go func() {
-		defer wg.Done()
-		output, err := self.client2.PutObject(ctx, &inputSecond, s3.WithAPIOptions(
-			v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware,
-		))
-		results <- result{output: output, err: err, index: 1}
-	}()
-
-	go func() {
-		defer wg.Done()
-		output, err := self.client2.PutObject(ctx, &randFirst, s3.WithAPIOptions(
-			v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware,
-		))
-		results <- result{output: output, err: err, index: 2}
-	}()
+	wg.Add(len(shares))
+	etags := make([]string, len(shares))
+	macs := make([]hash.Hash, len(shares))
+	chunks := make([]*chunkMACWriter, len(shares))
+
+	for i, share := range shares {
+		_, length := scheme.segment(share.part, size)
+		shareInput := *input
+		shareInput.Key = aws.String(locations[i].Key)
+		shareInput.IfMatch = nil
+		shareInput.IfNoneMatch = nil
+		shareInput.Body = readers[i]
+		shareInput.ContentLength = aws.Int64(shareLength(scheme, length))
+		if len(self.macKey) > 0 {
+			length := *shareInput.ContentLength
+			macs[i] = newShareMAC(self.macKey, *input.Bucket, stored, i, length)
+			chunks[i] = newChunkMACWriter(func(chunk int64) hash.Hash {
+				return newChunkMAC(self.macKey, *input.Bucket, stored, i, 0, length, chunk)
+			})
+			shareInput.Body = io.TeeReader(readers[i], io.MultiWriter(macs[i], chunks[i]))
+		}
+		// Headers and user metadata are only kept in the manifest
+		shareInput.ContentType = nil
+		shareInput.CacheControl = nil
+		shareInput.ContentDisposition = nil
+		shareInput.ContentEncoding = nil
+		shareInput.ContentLanguage = nil
+		shareInput.Expires = nil
+		shareInput.Metadata = shareMetadata(scheme, nil, i, size)
+		// Digests sent by the client were computed over the plaintext
+		// and do not match the share
+		shareInput.ContentMD5 = nil
+		shareInput.ChecksumAlgorithm = ""
+		shareInput.ChecksumCRC32 = nil
+		shareInput.ChecksumCRC32C = nil
+		shareInput.ChecksumCRC64NVME = nil
+		shareInput.ChecksumSHA1 = nil
+		shareInput.ChecksumSHA256 = nil
+
+		go func(i int, client *s3.Client, shareInput *s3.PutObjectInput) {
+			defer wg.Done()
+			etag, err := self.putShare(uploadCtx, client, shareInput)
+			if err != nil {
+				log.Printf("S3 server returned error for PutObject[%v]: %v", i, err)
+				fail(err)
+				return
+			}
+			etags[i] = etag
+		}(i, self.clients[share.provider], &shareInput)
+	}
 
 	// Wait for all operations to complete
 	wg.Wait()
-	close(results)
-
-	// Check for errors
-	var outputs [4]*s3.PutObjectOutput
-	for r := range results {
-		if r.err != nil {
-			log.Printf("S3 server returned error for PutObject[%v]: %v", r.index, r.err)
-			return s3response.PutObjectOutput{}, handleError(r.err)
-		}
-		outputs[r.index] = r.output
+	if failure != nil {
+		rollback()
+		return nil, handleError(failure)
+	}
+	if err := hasher.verify(); err != nil {
+		log.Printf("Rejected upload of %s: %v", *input.Key, err)
+		rollback()
+		return nil, err
 	}
 
-	// Return a success response
-	var etag, versionId string
-	if outputs[0].ETag != nil {
-		etag = *outputs[0].ETag
+	// Publish the object by writing its manifest, which replaces the object
+	// stored under its key before
+	manifest := &objectManifest{
+		Version: manifestVersion,
+		Scheme:  scheme.name(),
+		Shares:  make([]manifestShare, len(shares)),
+		Size:    size,
+		objectHeaders: newObjectHeaders(input.ContentType, input.CacheControl, input.ContentDisposition,
+			input.ContentEncoding, input.ContentLanguage, input.Expires),
+		Metadata:  input.Metadata,
+		Checksums: hasher.checksums(),
+		Created:   time.Now().UTC(),
+		ETag:      digests.etag,
+	}
+	for i, share := range shares {
+		_, length := scheme.segment(share.part, size)
+		manifest.Shares[i] = manifestShare{
+			Key:      locations[i].Key,
+			Provider: share.provider,
+			Size:     shareLength(scheme, length),
+			ETag:     etags[i],
+		}
+		if macs[i] != nil {
+			manifest.Shares[i].MAC = hex.EncodeToString(macs[i].Sum(nil))
+			manifest.Shares[i].Chunks = chunks[i].encode()
+		}
 	}
-	if outputs[0].VersionId != nil {
-		versionId = *outputs[0].VersionId
+	if err := self.signManifest(*input.Bucket, stored, manifest); err != nil {
+		rollback()
+		return nil, handleError(err)
 	}
-	return s3response.PutObjectOutput{
-		ETag:              etag,
-		VersionID:         versionId,
-		ChecksumCRC32:     outputs[0].ChecksumCRC32,
-		ChecksumCRC32C:    outputs[0].ChecksumCRC32C,
-		ChecksumCRC64NVME: outputs[0].ChecksumCRC64NVME,
-		ChecksumSHA1:      outputs[0].ChecksumSHA1,
-		ChecksumSHA256:    outputs[0].ChecksumSHA256,
-	}, nil
+	if conds.createOnly() {
+		if err := self.createManifest(ctx, *input.Bucket, stored, manifest); err != nil {
+			log.Printf("Failed to create manifest of %s: %v", *input.Key, err)
+			rollback()
+			return nil, handleError(err)
+		}
+	} else if conditional {
+		// Other conditions are evaluated again on the object the manifest
+		// replaces, which must not change until it is written
+		err := self.replaceManifestIf(ctx, *input.Bucket, stored, scheme, manifest, func() error {
+			head, err := self.currentHead(ctx, scheme, *input.Bucket, stored)
+			if err != nil {
+				return err
+			}
+			return conds.checkWrite(head)
+		})
+		if err != nil {
+			log.Printf("Failed to replace manifest of %s: %v", *input.Key, err)
+			rollback()
+			return nil, handleError(err)
+		}
+	} else {
+		if err := self.replaceManifest(ctx, *input.Bucket, stored, scheme, manifest); err != nil {
+			log.Printf("Failed to write manifest of %s: %v", *input.Key, err)
+			rollback()
+			return nil, handleError(err)
+		}
+	}
+
+	self.journal.end(intent)
+
+	return manifest, nil
 }
 
 func (MyBackend) GetObjectAttributes(ctx context.Context, input *s3.GetObjectAttributesInput) (s3response.GetObjectAttributesResponse, error) {
@@ -435,11 +1052,6 @@ func (MyBackend) GetObjectAttributes(ctx context.Context, input *s3.GetObjectAtt
 	return s3response.GetObjectAttributesResponse{}, s3err.GetAPIError(s3err.ErrNotImplemented)
 }
 
-func (MyBackend) CopyObject(ctx context.Context, input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
-	log.Printf("MyBackend.CopyObject(%v, %v)", ctx, input)
-	return nil, s3err.GetAPIError(s3err.ErrNotImplemented)
-}
-
 func (self *MyBackend) ListObjects(
 	ctx context.Context,
 	input *s3.ListObjectsInput,
@@ -449,106 +1061,57 @@ func (self *MyBackend) ListObjects(
 		return s3response.ListObjectsResult{}, handleError(err)
 	}
 
-	log.Printf("MyBackend.ListObjects(%v, %v)", ctx, input)
-
-	// Get objects from both storage systems
-	out1, err := self.client1.ListObjects(ctx, input)
+	settings, err := self.settings(ctx, *input.Bucket)
 	if err != nil {
-		return s3response.ListObjectsResult{}, handleError(err)
+		return s3response.ListObjectsResult{}, err
 	}
+	scheme := settings.scheme
 
-	out2, err := self.client2.ListObjects(ctx, input)
+	log.Printf("MyBackend.ListObjects(%v, %v)", ctx, input)
+
+	encoding, err := listEncoding(ctx, input.EncodingType)
 	if err != nil {
-		return s3response.ListObjectsResult{}, handleError(err)
+		return s3response.ListObjectsResult{}, err
 	}
-
-	// Create maps to track objects in each system
-	objects1 := make(map[string]types.Object)
-	objects2 := make(map[string]types.Object)
-
-	// Populate maps with objects from each system
-	for _, obj := range out1.Contents {
-		key := *obj.Key
-		// Only track objects with correct postfixes for client1
-		if strings.HasSuffix(key, ".cypher.first") || strings.HasSuffix(key, ".rand.second") {
-			objects1[key] = obj
-		}
+	maxKeys := aws.ToInt32(input.MaxKeys)
+	if input.MaxKeys == nil || maxKeys > maxListKeys {
+		maxKeys = maxListKeys
 	}
+	prefix, marker := aws.ToString(input.Prefix), aws.ToString(input.Marker)
 
-	for _, obj := range out2.Contents {
-		key := *obj.Key
-		// Only track objects with correct postfixes for client2
-		if strings.HasSuffix(key, ".cypher.second") || strings.HasSuffix(key, ".rand.first") {
-			objects2[key] = obj
+	// The providers cannot filter hidden keys by prefix or sort them
+	var next objectIterator
+	if settings.names.hidden() {
+		if next, err = self.newHiddenLister(ctx, scheme, settings.names, *input.Bucket, prefix, marker); err != nil {
+			return s3response.ListObjectsResult{}, handleError(err)
 		}
+	} else {
+		next = self.newLogicalLister(scheme, *input.Bucket, prefix, marker)
 	}
 
-	// Create a map to track which base files have all four parts
-	completeFiles := make(map[string]bool)
-
-	// Check for complete sets across both storage systems
-	for key1 := range objects1 {
-		// Extract base name from client1 objects
-		baseName := strings.TrimSuffix(key1, ".cypher.first")
-		baseName = strings.TrimSuffix(baseName, ".rand.second")
-
-		// Check if all required parts exist
-		requiredParts := []string{
-			baseName + ".cypher.first",  // client1
-			baseName + ".cypher.second", // client2
-			baseName + ".rand.first",    // client2
-			baseName + ".rand.second",   // client1
-		}
-
-		// Verify all parts exist in the correct storage systems
-		allPartsExist := true
-		for _, part := range requiredParts {
-			if strings.HasSuffix(part, ".cypher.first") || strings.HasSuffix(part, ".rand.second") {
-				if _, exists := objects1[part]; !exists {
-					allPartsExist = false
-					break
-				}
-			} else {
-				if _, exists := objects2[part]; !exists {
-					allPartsExist = false
-					break
-				}
-			}
-		}
-
-		if allPartsExist {
-			completeFiles[baseName] = true
-		}
+	contents, prefixes, last, truncated, err := listPage(ctx, next, prefix, aws.ToString(input.Delimiter), marker, maxKeys)
+	if err != nil {
+		return s3response.ListObjectsResult{}, handleError(err)
 	}
-
-	// Create a new list of objects containing only complete sets
-	var filteredContents []types.Object
-	for baseName := range completeFiles {
-		// Use the .cypher.first object as the base object
-		if obj, exists := objects1[baseName+".cypher.first"]; exists {
-			// Create a new object with the base name
-			newObj := obj
-			newObj.Key = aws.String(baseName)
-			filteredContents = append(filteredContents, newObj)
-		}
+	encodeListEntries(encoding, contents, prefixes)
+	result := s3response.ListObjectsResult{
+		CommonPrefixes: prefixes,
+		Contents:       ConvertObjects(contents),
+		Delimiter:      encodeListValue(encoding, input.Delimiter),
+		EncodingType:   encoding,
+		IsTruncated:    aws.Bool(truncated),
+		Marker:         encodeListValue(encoding, input.Marker),
+		MaxKeys:        aws.Int32(maxKeys),
+		Name:           input.Bucket,
+		Prefix:         encodeListValue(encoding, input.Prefix),
+	}
+	// The marker of the next page is a logical key or common prefix
+	if truncated {
+		result.NextMarker = encodeListValue(encoding, aws.String(last))
 	}
 
-	// Update the output with filtered contents
-	out1.Contents = filteredContents
-
-	contents := ConvertObjects(out1.Contents)
-
-	return s3response.ListObjectsResult{
-		CommonPrefixes: out1.CommonPrefixes,
-		Contents:       contents,
-		Delimiter:      out1.Delimiter,
-		IsTruncated:    out1.IsTruncated,
-		Marker:         out1.Marker,
-		MaxKeys:        out1.MaxKeys,
-		Name:           out1.Name,
-		NextMarker:     out1.NextMarker,
-		Prefix:         out1.Prefix,
-	}, nil
+	log.Printf("Returning %d objects in result", len(result.Contents))
+	return result, nil
 }
 
 func (self *MyBackend) ListObjectsV2(
@@ -560,212 +1123,188 @@ func (self *MyBackend) ListObjectsV2(
 		return s3response.ListObjectsV2Result{}, handleError(err)
 	}
 
-	log.Printf("MyBackend.ListObjectsV2(%v, %v)", ctx, input)
-
-	// If we have a prefix that doesn't end with a delimiter and is not empty, we should check if it's a file
-	if input.Prefix != nil && *input.Prefix != "" && !strings.HasSuffix(*input.Prefix, "/") {
-		// Check if the file exists in either storage system
-		key := *input.Prefix
-		relatedFiles := []string{
-			key + ".cypher.first",
-			key + ".cypher.second",
-			key + ".rand.first",
-			key + ".rand.second",
-		}
-
-		log.Printf("Checking for complete file set: %s", key)
+	settings, err := self.settings(ctx, *input.Bucket)
+	if err != nil {
+		return s3response.ListObjectsV2Result{}, err
+	}
+	scheme := settings.scheme
 
-		// Check if all parts exist
-		allPartsExist := true
-		for _, part := range relatedFiles {
-			var client *s3.Client
-			if strings.HasSuffix(part, ".cypher.first") || strings.HasSuffix(part, ".rand.second") {
-				client = self.client1
-			} else {
-				client = self.client2
-			}
+	log.Printf("MyBackend.ListObjectsV2(%v, %v)", ctx, input)
 
-			_, err := client.HeadObject(ctx, &s3.HeadObjectInput{
-				Bucket: input.Bucket,
-				Key:    aws.String(part),
-			})
-			if err != nil {
-				log.Printf("Missing part: %s", part)
-				allPartsExist = false
-				break
-			}
-			log.Printf("Found part: %s", part)
+	// A continuation token replaces the key to start after
+	after := aws.ToString(input.StartAfter)
+	if token := aws.ToString(input.ContinuationToken); token != "" {
+		if after, err = decodeListToken(token); err != nil {
+			return s3response.ListObjectsV2Result{}, err
 		}
+	}
+	maxKeys := aws.ToInt32(input.MaxKeys)
+	if input.MaxKeys == nil || maxKeys > maxListKeys {
+		maxKeys = maxListKeys
+	}
+	prefix := aws.ToString(input.Prefix)
+	encoding, err := listEncoding(ctx, input.EncodingType)
+	if err != nil {
+		return s3response.ListObjectsV2Result{}, err
+	}
 
-		if allPartsExist {
-			// If all parts exist, return a single object
-			obj, err := self.client1.HeadObject(ctx, &s3.HeadObjectInput{
-				Bucket: input.Bucket,
-				Key:    aws.String(key + ".cypher.first"),
-			})
-			if err != nil {
-				return s3response.ListObjectsV2Result{}, handleError(err)
-			}
-
-			// Create a single object entry
-			entry := s3response.Object{
-				Key:          aws.String(key),
-				LastModified: obj.LastModified,
-				ETag:         obj.ETag,
-				Size:         obj.ContentLength,
-				StorageClass: types.ObjectStorageClassStandard,
-			}
-
-			log.Printf("Returning single object: %s", key)
-			return s3response.ListObjectsV2Result{
-				Contents:              []s3response.Object{entry},
-				KeyCount:              aws.Int32(1),
-				MaxKeys:               input.MaxKeys,
-				Name:                  input.Bucket,
-				Prefix:                input.Prefix,
-				IsTruncated:           aws.Bool(false),
-				NextContinuationToken: nil,
-			}, nil
-		} else {
-			// If not all parts exist, return an empty result
-			log.Printf("File not found: %s", key)
-			return s3response.ListObjectsV2Result{
-				Contents:              []s3response.Object{},
-				KeyCount:              aws.Int32(0),
-				MaxKeys:               input.MaxKeys,
-				Name:                  input.Bucket,
-				Prefix:                input.Prefix,
-				IsTruncated:           aws.Bool(false),
-				NextContinuationToken: nil,
-			}, nil
+	// The providers cannot filter hidden keys by prefix or sort them
+	var next objectIterator
+	if settings.names.hidden() {
+		if next, err = self.newHiddenLister(ctx, scheme, settings.names, *input.Bucket, prefix, after); err != nil {
+			return s3response.ListObjectsV2Result{}, handleError(err)
 		}
+	} else {
+		next = self.newLogicalLister(scheme, *input.Bucket, prefix, after)
 	}
 
-	// Create a copy of the input for client1 and client2
-	input1 := *input
-	input2 := *input
-
-	// Clear continuation token for both inputs
-	input1.ContinuationToken = nil
-	input2.ContinuationToken = nil
-
-	// Get objects from client1
-	out1, err := self.client1.ListObjectsV2(ctx, &input1)
+	contents, prefixes, last, truncated, err := listPage(ctx, next, prefix, aws.ToString(input.Delimiter), after, maxKeys)
 	if err != nil {
 		return s3response.ListObjectsV2Result{}, handleError(err)
 	}
-
-	// Get objects from client2
-	out2, err := self.client2.ListObjectsV2(ctx, &input2)
-	if err != nil {
-		return s3response.ListObjectsV2Result{}, handleError(err)
+	encodeListEntries(encoding, contents, prefixes)
+	result := s3response.ListObjectsV2Result{
+		CommonPrefixes:    prefixes,
+		Contents:          ConvertObjects(contents),
+		ContinuationToken: input.ContinuationToken,
+		Delimiter:         encodeListValue(encoding, input.Delimiter),
+		EncodingType:      encoding,
+		IsTruncated:       aws.Bool(truncated),
+		KeyCount:          aws.Int32(int32(len(contents) + len(prefixes))),
+		MaxKeys:           aws.Int32(maxKeys),
+		Name:              input.Bucket,
+		Prefix:            encodeListValue(encoding, input.Prefix),
+		StartAfter:        encodeListValue(encoding, input.StartAfter),
+	}
+	if truncated {
+		result.NextContinuationToken = aws.String(encodeListToken(last))
 	}
 
-	log.Printf("Found %d objects in client1 and %d objects in client2", len(out1.Contents), len(out2.Contents))
-
-	// Create maps to track objects in each system
-	objects1 := make(map[string]types.Object)
-	objects2 := make(map[string]types.Object)
+	log.Printf("Returning %d objects in result", len(result.Contents))
+	return result, nil
+}
 
-	// Populate maps with objects from each system
-	for _, obj := range out1.Contents {
-		key := *obj.Key
-		// Only track objects with correct postfixes for client1
-		if strings.HasSuffix(key, ".cypher.first") || strings.HasSuffix(key, ".rand.second") {
-			objects1[key] = obj
-			log.Printf("Found object in client1: %s", key)
-		}
+// logicalObjects returns the original files in a listing sorted by key:
+// those with a manifest as recorded in it, the others if enough of their
+// shares are listed. listed[i] holds the objects listed on client i.
+func (self *MyBackend) logicalObjects(ctx context.Context, scheme ShareScheme, bucket string, listed [][]types.Object) ([]types.Object, error) {
+	objects, err := self.manifestObjects(ctx, bucket, listed)
+	if err != nil {
+		return nil, err
 	}
-
-	for _, obj := range out2.Contents {
-		key := *obj.Key
-		// Only track objects with correct postfixes for client2
-		if strings.HasSuffix(key, ".cypher.second") || strings.HasSuffix(key, ".rand.first") {
-			objects2[key] = obj
-			log.Printf("Found object in client2: %s", key)
-		}
+	published := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		published[*obj.Key] = true
 	}
 
-	// Create a map to track which base files have all four parts
-	completeFiles := make(map[string]bool)
-
-	// Check for complete sets across both storage systems
-	for key1 := range objects1 {
-		// Extract base name from client1 objects
-		baseName := strings.TrimSuffix(key1, ".cypher.first")
-		baseName = strings.TrimSuffix(baseName, ".rand.second")
-
-		// Skip if this is not a base name (i.e., it still has a postfix)
-		if baseName == key1 {
-			continue
+	var inferred []types.Object
+	for _, obj := range self.completeObjects(scheme, listed) {
+		if !published[*obj.Key] {
+			inferred = append(inferred, obj)
 		}
+	}
+	if err := self.headSizes(ctx, scheme, bucket, inferred); err != nil {
+		return nil, err
+	}
 
-		log.Printf("Checking complete set for base name: %s", baseName)
+	objects = append(objects, inferred...)
+	sort.Slice(objects, func(i, j int) bool {
+		return *objects[i].Key < *objects[j].Key
+	})
+	return objects, nil
+}
 
-		// Check if all required parts exist
-		requiredParts := []string{
-			baseName + ".cypher.first",  // client1
-			baseName + ".cypher.second", // client2
-			baseName + ".rand.first",    // client2
-			baseName + ".rand.second",   // client1
+// listStored lists all objects stored in a bucket on every provider
+func (self *MyBackend) listStored(ctx context.Context, bucket string) ([][]types.Object, error) {
+	listed := make([][]types.Object, len(self.clients))
+	for i, client := range self.clients {
+		paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+			listed[i] = append(listed[i], page.Contents...)
 		}
+		log.Printf("Found %d objects in client%d", len(listed[i]), i+1)
+	}
+	return listed, nil
+}
 
-		// Verify all parts exist in the correct storage systems
-		allPartsExist := true
-		for _, part := range requiredParts {
-			if strings.HasSuffix(part, ".cypher.first") || strings.HasSuffix(part, ".rand.second") {
-				if _, exists := objects1[part]; !exists {
-					log.Printf("Missing part in client1: %s", part)
-					allPartsExist = false
-					break
-				}
-			} else {
-				if _, exists := objects2[part]; !exists {
-					log.Printf("Missing part in client2: %s", part)
-					allPartsExist = false
-					break
-				}
+// completeObjects returns the original files of which enough shares are
+// present on the right storage systems to reconstruct them. listed[i]
+// holds the objects listed on client i. The returned entries are based on
+// the first share of an available stream, with the key and size of the
+// original file, and are sorted by key.
+func (self *MyBackend) completeObjects(scheme ShareScheme, listed [][]types.Object) []types.Object {
+	shares := scheme.shares()
+
+	// Collect the share objects of every original file, only tracking
+	// shares placed on the system they were listed on
+	found := make(map[string][]*types.Object)
+	for i, contents := range listed {
+		for j, obj := range contents {
+			baseName, index, ok := parseShareKey(scheme, *obj.Key)
+			if !ok || shares[index].provider != i {
+				continue
 			}
+			if found[baseName] == nil {
+				found[baseName] = make([]*types.Object, len(shares))
+			}
+			found[baseName][index] = &contents[j]
 		}
+	}
 
-		if allPartsExist {
-			log.Printf("Found complete set for: %s", baseName)
-			completeFiles[baseName] = true
-		}
+	baseNames := make([]string, 0, len(found))
+	for baseName := range found {
+		baseNames = append(baseNames, baseName)
 	}
+	sort.Strings(baseNames)
 
-	// Create a new list of objects containing only complete sets
-	var filteredContents []types.Object
-	for baseName := range completeFiles {
-		// Use the .cypher.first object as the base object
-		if obj, exists := objects1[baseName+".cypher.first"]; exists {
-			// Create a new object with the base name
-			newObj := obj
-			newObj.Key = aws.String(baseName)
-			filteredContents = append(filteredContents, newObj)
-			log.Printf("Added complete file to results: %s", baseName)
+	var complete []types.Object
+	for _, baseName := range baseNames {
+		parts := found[baseName]
+		streams := availableStreams(scheme, func(i int) bool { return parts[i] != nil })
+		if len(streams) < scheme.threshold() {
+			log.Printf("Not enough shares for %s: %d of %d streams", baseName, len(streams), scheme.threshold())
+			continue
 		}
-	}
 
-	// Calculate the new key count based on filtered contents
-	keyCount := int32(len(filteredContents))
+		// Create a new object with the base name
+		newObj := *parts[streamShares(scheme, streams[0])[0]]
+		newObj.Key = aws.String(baseName)
+		newObj.Size = aws.Int64(streamSize(scheme, streams[0], func(i int) int64 {
+			return aws.ToInt64(parts[i].Size)
+		}))
+		complete = append(complete, newObj)
+	}
+	return complete
+}
 
-	// Create the response
-	result := s3response.ListObjectsV2Result{
-		CommonPrefixes:        out1.CommonPrefixes,
-		Contents:              ConvertObjects(filteredContents),
-		Delimiter:             out1.Delimiter,
-		IsTruncated:           aws.Bool(false),
-		KeyCount:              &keyCount,
-		MaxKeys:               out1.MaxKeys,
-		Name:                  out1.Name,
-		NextContinuationToken: nil,
-		Prefix:                out1.Prefix,
-		StartAfter:            out1.StartAfter,
+// headSizes replaces the sizes of the listed original files by the sizes
+// recorded with their shares if the scheme pads the shares, so that their
+// lengths do not add up to the size of the original file.
+func (self *MyBackend) headSizes(ctx context.Context, scheme ShareScheme, bucket string, objects []types.Object) error {
+	if scheme.width() == 1 {
+		return nil
 	}
 
-	log.Printf("Returning %d objects in result", len(result.Contents))
-	return result, nil
+	errs := make([]error, len(objects))
+	limit := make(chan struct{}, 16) // Concurrent objects
+	var wg sync.WaitGroup
+	for i := range objects {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func(i int) {
+			defer func() { <-limit; wg.Done() }()
+			size, err := self.objectSize(ctx, scheme, bucket, *objects[i].Key)
+			objects[i].Size, errs[i] = aws.Int64(size), err
+		}(i)
+	}
+	wg.Wait()
+	return firstError(errs)
 }
 
 func (self *MyBackend) DeleteObjects(ctx context.Context, input *s3.DeleteObjectsInput) (s3response.DeleteResult, error) {
@@ -781,46 +1320,101 @@ func (self *MyBackend) DeleteObjects(ctx context.Context, input *s3.DeleteObject
 		client *s3.Client
 		keys   []string
 	}
-	deleteRequests := []deleteRequest{
-		{client: self.client1, keys: make([]string, 0)},
-		{client: self.client2, keys: make([]string, 0)},
+	settings, err := self.settings(ctx, *input.Bucket)
+	if err != nil {
+		return s3response.DeleteResult{}, err
+	}
+	scheme := settings.scheme
+	deleteRequests := make([]deleteRequest, len(self.clients))
+	for i, client := range self.clients {
+		deleteRequests[i] = deleteRequest{client: client, keys: make([]string, 0)}
+	}
+	shares := scheme.shares()
+
+	var allDeleted []types.DeletedObject
+	var allErrors []types.Error
+
+	// Deletions of whole objects recorded in the journal, they are
+	// completed once none of their shares failed to be deleted
+	type objectDeletion struct {
+		intent string
+		shares []manifestShare
+	}
+	var deletions []objectDeletion
+	failed := make(map[manifestShare]bool)
+
+	// Results name the deleted files by their logical keys
+	logicalKey := func(key string) *string {
+		if logical, ok := settings.names.revealShareKey(key); ok {
+			return aws.String(logical)
+		}
+		return aws.String(key)
 	}
 
 	// Distribute objects to their respective storage systems
 	for _, obj := range input.Delete.Objects {
 		key := *obj.Key
 		// Check if this is one of our special files
-		if strings.HasSuffix(key, ".cypher.first") || strings.HasSuffix(key, ".rand.second") {
-			// These go to client1
-			log.Printf("Adding %s to client1 deletion list", key)
-			deleteRequests[0].keys = append(deleteRequests[0].keys, key)
-		} else if strings.HasSuffix(key, ".cypher.second") || strings.HasSuffix(key, ".rand.first") {
-			// These go to client2
-			log.Printf("Adding %s to client2 deletion list", key)
-			deleteRequests[1].keys = append(deleteRequests[1].keys, key)
+		if _, index, ok := parseShareKey(scheme, key); ok {
+			provider := shares[index].provider
+			if _, stored, ok := self.shareClient(scheme, settings.names, key); ok {
+				key = stored
+			}
+			log.Printf("Adding %s to client%d deletion list", key, provider+1)
+			deleteRequests[provider].keys = append(deleteRequests[provider].keys, key)
 		} else {
-			// This is the original file, add its related files to both storage systems
+			// This is the original file, unpublish it by deleting its manifest
+			// and add its related files to all storage systems
 			log.Printf("Original file %s detected, adding all related files", key)
-			relatedFiles := []struct {
-				key    string
-				client int
-			}{
-				{key + ".cypher.first", 0},  // client1
-				{key + ".cypher.second", 1}, // client2
-				{key + ".rand.first", 1},    // client2
-				{key + ".rand.second", 0},   // client1
+			stored, err := settings.names.hide(key)
+			if err != nil {
+				allErrors = append(allErrors, types.Error{
+					Key:     aws.String(key),
+					Code:    aws.String("KeyTooLongError"),
+					Message: aws.String(err.Error()),
+				})
+				continue
 			}
-
-			for _, file := range relatedFiles {
-				log.Printf("Adding %s to client%d deletion list", file.key, file.client+1)
-				deleteRequests[file.client].keys = append(deleteRequests[file.client].keys, file.key)
+			manifest, err := self.readManifest(ctx, *input.Bucket, stored)
+			if err != nil && !errors.Is(err, errNoManifest) {
+				log.Printf("Failed to read manifest of %s, deleting the shares of the bucket scheme: %v", key, err)
+			}
+			locations := shareLocations(stored, scheme, manifest)
+			intent, err := self.journal.begin(journalEntry{
+				Op:     intentDeleteObject,
+				Bucket: *input.Bucket,
+				Key:    stored,
+				Shares: locations,
+			})
+			if err != nil {
+				allErrors = append(allErrors, types.Error{
+					Key:     aws.String(key),
+					Code:    aws.String("InternalError"),
+					Message: aws.String(err.Error()),
+				})
+				continue
+			}
+			if err := self.deleteManifest(ctx, *input.Bucket, stored); err != nil {
+				// The manifest may already be gone from some providers, the
+				// intent stays open so that the next start completes the
+				// deletion, and the shares are kept until then
+				log.Printf("Error deleting manifest of %s: %v", key, err)
+				allErrors = append(allErrors, types.Error{
+					Key:     aws.String(key),
+					Code:    aws.String("InternalError"),
+					Message: aws.String(err.Error()),
+				})
+				continue
+			}
+			deletions = append(deletions, objectDeletion{intent: intent, shares: locations})
+			for _, share := range locations {
+				log.Printf("Adding %s to client%d deletion list", share.Key, share.Provider+1)
+				deleteRequests[share.Provider].keys = append(deleteRequests[share.Provider].keys, share.Key)
 			}
 		}
 	}
 
 	// Perform deletions for each storage system
-	var allDeleted []types.DeletedObject
-	var allErrors []types.Error
 
 	for i, req := range deleteRequests {
 		if len(req.keys) == 0 {
@@ -858,17 +1452,18 @@ func (self *MyBackend) DeleteObjects(ctx context.Context, input *s3.DeleteObject
 			output, err := req.client.DeleteObject(ctx, deleteInput)
 			if err != nil {
 				log.Printf("Error deleting %s from client%d: %v", key, i+1, err)
+				failed[manifestShare{Key: key, Provider: i}] = true
 				var ae smithy.APIError
 				if errors.As(err, &ae) {
 					log.Printf("API Error details - Code: %s, Message: %s", ae.ErrorCode(), ae.ErrorMessage())
 					allErrors = append(allErrors, types.Error{
-						Key:     aws.String(key),
+						Key:     logicalKey(key),
 						Code:    aws.String(ae.ErrorCode()),
 						Message: aws.String(ae.ErrorMessage()),
 					})
 				} else {
 					allErrors = append(allErrors, types.Error{
-						Key:     aws.String(key),
+						Key:     logicalKey(key),
 						Code:    aws.String("InternalError"),
 						Message: aws.String(err.Error()),
 					})
@@ -889,21 +1484,23 @@ func (self *MyBackend) DeleteObjects(ctx context.Context, input *s3.DeleteObject
 				if errors.As(err, &ae) && ae.ErrorCode() == "NotFound" {
 					log.Printf("Successfully deleted %s from client%d (verified)", key, i+1)
 					allDeleted = append(allDeleted, types.DeletedObject{
-						Key:       aws.String(key),
+						Key:       logicalKey(key),
 						VersionId: output.VersionId,
 					})
 				} else {
 					log.Printf("Warning: Unexpected error verifying deletion of %s from client%d: %v", key, i+1, err)
+					failed[manifestShare{Key: key, Provider: i}] = true
 					allErrors = append(allErrors, types.Error{
-						Key:     aws.String(key),
+						Key:     logicalKey(key),
 						Code:    aws.String("DeletionVerificationFailed"),
 						Message: aws.String(fmt.Sprintf("Unexpected error verifying deletion: %v", err)),
 					})
 				}
 			} else {
 				log.Printf("Warning: %s still exists in client%d after deletion attempt", key, i+1)
+				failed[manifestShare{Key: key, Provider: i}] = true
 				allErrors = append(allErrors, types.Error{
-					Key:     aws.String(key),
+					Key:     logicalKey(key),
 					Code:    aws.String("DeletionVerificationFailed"),
 					Message: aws.String("Object still exists after deletion"),
 				})
@@ -911,6 +1508,14 @@ func (self *MyBackend) DeleteObjects(ctx context.Context, input *s3.DeleteObject
 		}
 	}
 
+	for _, deletion := range deletions {
+		if !slices.ContainsFunc(deletion.shares, func(share manifestShare) bool {
+			return failed[manifestShare{Key: share.Key, Provider: share.Provider}]
+		}) {
+			self.journal.end(deletion.intent)
+		}
+	}
+
 	// Create the final result
 	result := s3response.DeleteResult{
 		Deleted: allDeleted,
@@ -996,6 +1601,12 @@ func (self *MyBackend) DeleteObject(ctx context.Context, input *s3.DeleteObjectI
 		return nil, handleError(err)
 	}
 
+	settings, err := self.settings(ctx, *input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	scheme := settings.scheme
+
 	// Log all input fields
 	log.Printf("DeleteObject Input Details:")
 	log.Printf("  Bucket: %s", *input.Bucket)
@@ -1030,66 +1641,76 @@ func (self *MyBackend) DeleteObject(ctx context.Context, input *s3.DeleteObjectI
 
 	key := *input.Key
 	// Check if this is one of our special files
-	if strings.HasSuffix(key, ".cypher.first") || strings.HasSuffix(key, ".rand.second") {
-		// These go to client1
-		log.Printf("Deleting %s from client1", key)
+	if client, stored, ok := self.shareClient(scheme, settings.names, key); ok {
+		log.Printf("Deleting %s from its storage system", key)
 		deleteInput := &s3.DeleteObjectInput{
 			Bucket: input.Bucket,
-			Key:    input.Key,
+			Key:    aws.String(stored),
 		}
 		if input.VersionId != nil {
 			deleteInput.VersionId = input.VersionId
 		}
-		output, err := self.client1.DeleteObject(ctx, deleteInput)
+		output, err := client.DeleteObject(ctx, deleteInput)
 		if err != nil {
-			log.Printf("Error deleting %s from client1: %v", key, err)
+			log.Printf("Error deleting %s: %v", key, err)
 			return nil, handleError(err)
 		}
 		return output, nil
-	} else if strings.HasSuffix(key, ".cypher.second") || strings.HasSuffix(key, ".rand.first") {
-		// These go to client2
-		log.Printf("Deleting %s from client2", key)
-		deleteInput := &s3.DeleteObjectInput{
-			Bucket: input.Bucket,
-			Key:    input.Key,
+	} else {
+		// This is the original file, delete its manifest first so that it
+		// disappears at once, then all related files
+		log.Printf("Original file %s detected, deleting all related files", key)
+		stored, err := settings.names.hide(key)
+		if err != nil {
+			return nil, err
 		}
-		if input.VersionId != nil {
-			deleteInput.VersionId = input.VersionId
+		if conds := requestConditions(ctx); conds.conditionalWrite() {
+			head, err := self.currentHead(ctx, scheme, *input.Bucket, stored)
+			if err == nil {
+				err = conds.checkWrite(head)
+			}
+			if err != nil {
+				return nil, err
+			}
 		}
-		output, err := self.client2.DeleteObject(ctx, deleteInput)
-		if err != nil {
-			log.Printf("Error deleting %s from client2: %v", key, err)
+		manifest, err := self.readManifest(ctx, *input.Bucket, stored)
+		if err != nil && !errors.Is(err, errNoManifest) {
 			return nil, handleError(err)
 		}
-		return output, nil
-	} else {
-		// This is the original file, delete all related files
-		log.Printf("Original file %s detected, deleting all related files", key)
-		relatedFiles := []struct {
-			key    string
-			client *s3.Client
-		}{
-			{key + ".cypher.first", self.client1},  // client1
-			{key + ".cypher.second", self.client2}, // client2
-			{key + ".rand.first", self.client2},    // client2
-			{key + ".rand.second", self.client1},   // client1
+		// Once the manifest is deleted on any storage system, the deletion is
+		// completed at startup if the gateway stops before it is done
+		locations := shareLocations(stored, scheme, manifest)
+		intent, err := self.journal.begin(journalEntry{
+			Op:     intentDeleteObject,
+			Bucket: *input.Bucket,
+			Key:    stored,
+			Shares: locations,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := self.deleteManifest(ctx, *input.Bucket, stored); err != nil {
+			// The intent stays open, the manifest may already be gone from
+			// some providers and the next start completes the deletion
+			log.Printf("Error deleting manifest of %s: %v", key, err)
+			return nil, handleError(err)
 		}
 
 		var lastOutput *s3.DeleteObjectOutput
 		var lastErr error
 
-		for _, file := range relatedFiles {
-			log.Printf("Deleting %s", file.key)
+		for _, share := range locations {
+			log.Printf("Deleting %s from client%d", share.Key, share.Provider+1)
 			deleteInput := &s3.DeleteObjectInput{
 				Bucket: input.Bucket,
-				Key:    aws.String(file.key),
+				Key:    aws.String(share.Key),
 			}
 			if input.VersionId != nil {
 				deleteInput.VersionId = input.VersionId
 			}
-			output, err := file.client.DeleteObject(ctx, deleteInput)
+			output, err := self.clients[share.Provider].DeleteObject(ctx, deleteInput)
 			if err != nil {
-				log.Printf("Error deleting %s: %v", file.key, err)
+				log.Printf("Error deleting %s: %v", share.Key, err)
 				lastErr = err
 			} else {
 				lastOutput = output
@@ -1099,6 +1720,7 @@ func (self *MyBackend) DeleteObject(ctx context.Context, input *s3.DeleteObjectI
 		if lastErr != nil {
 			return nil, handleError(lastErr)
 		}
+		self.journal.end(intent)
 		return lastOutput, nil
 	}
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/versity/versitygw/s3err"
+)
+
+// byteRange is an inclusive range of byte offsets [Start, End]
+type byteRange struct {
+	Start int64
+	End   int64
+}
+
+// Length returns the number of bytes in the range
+func (r byteRange) Length() int64 {
+	return r.End - r.Start + 1
+}
+
+// ContentRange returns the Content-Range header value for the range
+// within an object of the given size
+func (r byteRange) ContentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.Start, r.End, size)
+}
+
+// Header returns the range as HTTP Range header value
+func (r byteRange) Header() string {
+	return fmt.Sprintf("bytes=%d-%d", r.Start, r.End)
+}
+
+// parseRange parses an HTTP Range header against an object of the given
+// size. Supported are the forms "bytes=a-b", "bytes=a-" (open-ended) and
+// "bytes=-n" (suffix, the last n bytes). The end is clamped to the object
+// size.
+//
+// Like S3, a header that cannot be parsed or that asks for several ranges
+// is ignored, parseRange then returns ok=false and the whole object should
+// be served. A well-formed range that does not overlap the object results
+// in ErrInvalidRange.
+func parseRange(header string, size int64) (r byteRange, ok bool, err error) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return byteRange{}, false, nil
+	}
+	first, last, found := strings.Cut(spec, "-")
+	if !found {
+		return byteRange{}, false, nil
+	}
+
+	if first == "" {
+		// Suffix range
+		n, perr := strconv.ParseInt(last, 10, 64)
+		if perr != nil || n < 0 {
+			return byteRange{}, false, nil
+		}
+		if n == 0 || size == 0 {
+			return byteRange{}, false, s3err.GetAPIError(s3err.ErrInvalidRange)
+		}
+		return byteRange{Start: max(size-n, 0), End: size - 1}, true, nil
+	}
+
+	start, perr := strconv.ParseInt(first, 10, 64)
+	if perr != nil || start < 0 {
+		return byteRange{}, false, nil
+	}
+	end := size - 1
+	if last != "" {
+		end, perr = strconv.ParseInt(last, 10, 64)
+		if perr != nil || end < start {
+			return byteRange{}, false, nil
+		}
+	}
+	if start >= size {
+		return byteRange{}, false, s3err.GetAPIError(s3err.ErrInvalidRange)
+	}
+	return byteRange{Start: start, End: min(end, size-1)}, true, nil
+}
+
+// shareRange translates the logical range r to the bytes of a share that
+// holds the logical bytes [offset, offset+length). It returns ok=false if
+// the share does not overlap the range at all.
+func shareRange(r byteRange, offset, length int64) (byteRange, bool) {
+	start := max(r.Start, offset)
+	end := min(r.End, offset+length-1)
+	if start > end {
+		return byteRange{}, false
+	}
+	return byteRange{Start: start - offset, End: end - offset}, true
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/versity/versitygw/s3err"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		size    int64
+		want    byteRange
+		ok      bool
+		invalid bool
+	}{
+		{name: "closed range", header: "bytes=0-9", size: 100, want: byteRange{0, 9}, ok: true},
+		{name: "single byte", header: "bytes=5-5", size: 100, want: byteRange{5, 5}, ok: true},
+		{name: "end beyond size", header: "bytes=90-200", size: 100, want: byteRange{90, 99}, ok: true},
+		{name: "open-ended", header: "bytes=40-", size: 100, want: byteRange{40, 99}, ok: true},
+		{name: "suffix", header: "bytes=-10", size: 100, want: byteRange{90, 99}, ok: true},
+		{name: "suffix longer than object", header: "bytes=-500", size: 100, want: byteRange{0, 99}, ok: true},
+		{name: "start beyond size", header: "bytes=100-", size: 100, invalid: true},
+		{name: "zero suffix", header: "bytes=-0", size: 100, invalid: true},
+		{name: "suffix of empty object", header: "bytes=-5", size: 0, invalid: true},
+		{name: "wrong unit", header: "items=0-9", size: 100},
+		{name: "multiple ranges", header: "bytes=0-1,5-6", size: 100},
+		{name: "end before start", header: "bytes=9-0", size: 100},
+		{name: "garbage", header: "bytes=a-b", size: 100},
+		{name: "missing dash", header: "bytes=5", size: 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := parseRange(tt.header, tt.size)
+			if tt.invalid {
+				if !errors.Is(err, s3err.GetAPIError(s3err.ErrInvalidRange)) {
+					t.Fatalf("expected InvalidRange, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("got (%v, %v), want (%v, %v)", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestShareRange(t *testing.T) {
+	// An object of 10 bytes, split into halves [0, 5) and [5, 10)
+	tests := []struct {
+		name     string
+		r        byteRange
+		first    byteRange
+		firstOk  bool
+		second   byteRange
+		secondOk bool
+	}{
+		{name: "whole object", r: byteRange{0, 9},
+			first: byteRange{0, 4}, firstOk: true, second: byteRange{0, 4}, secondOk: true},
+		{name: "first half only", r: byteRange{1, 3},
+			first: byteRange{1, 3}, firstOk: true},
+		{name: "second half only", r: byteRange{6, 9},
+			second: byteRange{1, 4}, secondOk: true},
+		{name: "across boundary", r: byteRange{4, 5},
+			first: byteRange{4, 4}, firstOk: true, second: byteRange{0, 0}, secondOk: true},
+		{name: "starts at boundary", r: byteRange{5, 5},
+			second: byteRange{0, 0}, secondOk: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, ok := shareRange(tt.r, 0, 5)
+			if ok != tt.firstOk || first != tt.first {
+				t.Errorf("first half: got (%v, %v), want (%v, %v)", first, ok, tt.first, tt.firstOk)
+			}
+			second, ok := shareRange(tt.r, 5, 5)
+			if ok != tt.secondOk || second != tt.second {
+				t.Errorf("second half: got (%v, %v), want (%v, %v)", second, ok, tt.second, tt.secondOk)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// Ways buckets that exist on some providers only are reconciled
+const (
+	reconcileReport   = "report"   // Only list them
+	reconcileComplete = "complete" // Create them on the providers missing them
+	reconcileRemove   = "remove"   // Delete them from the providers that have them if they are empty
+)
+
+// Actions taken on an asymmetric bucket
+const (
+	reconcileCreated = "created"
+	reconcileRemoved = "removed"
+)
+
+// asymmetricBucket is a bucket that exists on some providers but not on
+// all of them, e.g. because its creation or deletion was interrupted. Such
+// buckets are neither listed nor usable.
+type asymmetricBucket struct {
+	Bucket  string `json:"bucket"`
+	Present []int  `json:"present"` // Providers starting at 1 like client1
+	Missing []int  `json:"missing"`
+	Empty   bool   `json:"empty"` // Whether no provider stores objects or uploads in it
+	Action  string `json:"action,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// listProviderBuckets returns the buckets listed on every provider
+func (self *MyBackend) listProviderBuckets(ctx context.Context) ([][]types.Bucket, error) {
+	listed := make([][]types.Bucket, len(self.clients))
+	for i, client := range self.clients {
+		output, err := client.ListBuckets(ctx, &s3.ListBucketsInput{})
+		if err != nil {
+			return nil, err
+		}
+		listed[i] = output.Buckets
+	}
+	return listed, nil
+}
+
+// asymmetricBuckets returns the buckets that are listed on some providers
+// but not on all of them, sorted by name. listed[i] holds the buckets
+// listed on client i.
+func asymmetricBuckets(listed [][]types.Bucket) []asymmetricBucket {
+	present := make(map[string][]int)
+	for i, buckets := range listed {
+		for _, b := range buckets {
+			present[*b.Name] = append(present[*b.Name], i+1)
+		}
+	}
+	var result []asymmetricBucket
+	for name, providers := range present {
+		if len(providers) == len(listed) {
+			continue
+		}
+		b := asymmetricBucket{Bucket: name, Present: providers}
+		for i := range listed {
+			if !slices.Contains(providers, i+1) {
+				b.Missing = append(b.Missing, i+1)
+			}
+		}
+		result = append(result, b)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Bucket < result[j].Bucket })
+	return result
+}
+
+// bucketEmpty reports whether a provider stores neither objects nor
+// multipart uploads in a bucket
+func bucketEmpty(ctx context.Context, client *s3.Client, bucket string) (bool, error) {
+	objects, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucket),
+		MaxKeys: aws.Int32(1),
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(objects.Contents) > 0 {
+		return false, nil
+	}
+	uploads, err := client.ListMultipartUploads(ctx, &s3.ListMultipartUploadsInput{
+		Bucket:     aws.String(bucket),
+		MaxUploads: aws.Int32(1),
+	})
+	if err != nil {
+		var ae smithy.APIError
+		if errors.As(err, &ae) && strings.Contains(ae.ErrorCode(), "NotImplemented") {
+			return true, nil
+		}
+		return false, err
+	}
+	return len(uploads.Uploads) == 0, nil
+}
+
+// completeBucket creates bucket on the missing providers with the tags
+// of the bucket on the first provider that has it, which select how its
+// objects are stored
+func (self *MyBackend) completeBucket(ctx context.Context, b asymmetricBucket) error {
+	source := self.clients[b.Present[0]-1]
+	output, err := source.GetBucketTagging(ctx, &s3.GetBucketTaggingInput{Bucket: aws.String(b.Bucket)})
+	var tagSet []types.Tag
+	if err == nil {
+		tagSet = output.TagSet
+	} else {
+		var ae smithy.APIError
+		if !errors.As(err, &ae) || !(strings.Contains(ae.ErrorCode(), "NoSuchTagSet") ||
+			strings.Contains(ae.ErrorCode(), "NotImplemented")) {
+			return fmt.Errorf("failed to read the tags of bucket '%s' in storage system %d: %v", b.Bucket, b.Present[0], err)
+		}
+	}
+
+	for _, p := range b.Missing {
+		client := self.clients[p-1]
+		if _, err := client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(b.Bucket)}); err != nil {
+			return fmt.Errorf("failed to create bucket '%s' in storage system %d: %v", b.Bucket, p, err)
+		}
+		if len(tagSet) == 0 {
+			continue
+		}
+		_, err := client.PutBucketTagging(ctx, &s3.PutBucketTaggingInput{
+			Bucket:  aws.String(b.Bucket),
+			Tagging: &types.Tagging{TagSet: tagSet},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to tag bucket '%s' in storage system %d: %v", b.Bucket, p, err)
+		}
+	}
+	return nil
+}
+
+// removeBucket deletes an empty bucket from the providers that have it
+func (self *MyBackend) removeBucket(ctx context.Context, b asymmetricBucket) error {
+	for _, p := range b.Present {
+		_, err := self.clients[p-1].DeleteBucket(ctx, &s3.DeleteBucketInput{Bucket: aws.String(b.Bucket)})
+		var ae smithy.APIError
+		if err != nil && !(errors.As(err, &ae) && ae.ErrorCode() == "NoSuchBucket") {
+			return fmt.Errorf("failed to delete bucket '%s' from storage system %d: %v", b.Bucket, p, err)
+		}
+	}
+	return nil
+}
+
+// reconcileBuckets finds the buckets that exist on some providers only and
+// completes or removes them according to mode. Buckets that are not empty
+// are never removed.
+func (self *MyBackend) reconcileBuckets(ctx context.Context, mode string) ([]asymmetricBucket, error) {
+	listed, err := self.listProviderBuckets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	buckets := asymmetricBuckets(listed)
+	for i := range buckets {
+		b := &buckets[i]
+		b.Empty = true
+		for _, p := range b.Present {
+			empty, err := bucketEmpty(ctx, self.clients[p-1], b.Bucket)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list bucket '%s' in storage system %d: %v", b.Bucket, p, err)
+			}
+			b.Empty = b.Empty && empty
+		}
+
+		switch {
+		case mode == reconcileComplete:
+			if err := self.completeBucket(ctx, *b); err != nil {
+				b.Error = err.Error()
+			} else {
+				b.Action = reconcileCreated
+			}
+		case mode == reconcileRemove && b.Empty:
+			if err := self.removeBucket(ctx, *b); err != nil {
+				b.Error = err.Error()
+			} else {
+				b.Action = reconcileRemoved
+			}
+		case mode == reconcileRemove:
+			b.Error = "bucket is not empty, complete it instead"
+		}
+		self.buckets.Delete(b.Bucket)
+	}
+	return buckets, nil
+}
+
+// runReconcile reconciles the asymmetric buckets according to mode and
+// writes them to w as JSON lines. It returns the number of buckets that
+// remain asymmetric.
+func (self *MyBackend) runReconcile(ctx context.Context, mode string, w io.Writer) (int, error) {
+	buckets, err := self.reconcileBuckets(ctx, mode)
+	if err != nil {
+		return 0, err
+	}
+	enc := json.NewEncoder(w)
+	remaining := 0
+	for _, b := range buckets {
+		if err := enc.Encode(b); err != nil {
+			return 0, err
+		}
+		if b.Action == "" {
+			remaining++
+		}
+	}
+	log.Printf("Reconciled buckets: %d found on some storage systems only, %d remaining", len(buckets), remaining)
+	return remaining, nil
+}
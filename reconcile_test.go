@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestAsymmetricBuckets(t *testing.T) {
+	buckets := func(names ...string) []types.Bucket {
+		result := make([]types.Bucket, len(names))
+		for i, name := range names {
+			result[i] = types.Bucket{Name: aws.String(name)}
+		}
+		return result
+	}
+	listed := [][]types.Bucket{
+		buckets("all", "first", "two"),
+		buckets("all", "three", "two"),
+		buckets("all"),
+	}
+	want := []asymmetricBucket{
+		{Bucket: "first", Present: []int{1}, Missing: []int{2, 3}},
+		{Bucket: "three", Present: []int{2}, Missing: []int{1, 3}},
+		{Bucket: "two", Present: []int{1, 2}, Missing: []int{3}},
+	}
+	if got := asymmetricBuckets(listed); !reflect.DeepEqual(got, want) {
+		t.Errorf("asymmetricBuckets() = %+v, want %+v", got, want)
+	}
+	if got := asymmetricBuckets(listed[2:]); got != nil {
+		t.Errorf("asymmetricBuckets() = %+v for a single provider, want none", got)
+	}
+}
+
+func TestReconcileComplete(t *testing.T) {
+	backend, stubs := newStubBackend(t, 2, &bucketSettings{scheme: xor2x2Scheme{}})
+	stubs[0].buckets = map[string]map[string]string{"half": {"pcsScheme": "replication"}, "broken": {}}
+	stubs[1].buckets = map[string]map[string]string{}
+	stubs[1].fail = func(r *http.Request) bool {
+		return r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/broken")
+	}
+
+	var out bytes.Buffer
+	remaining, err := backend.runReconcile(context.Background(), reconcileComplete, &out)
+	if err != nil {
+		t.Fatalf("runReconcile() failed: %v", err)
+	}
+	if remaining != 1 {
+		t.Errorf("runReconcile() = %d remaining, want 1:\n%s", remaining, &out)
+	}
+	if tags, ok := stubs[1].buckets["half"]; !ok || tags["pcsScheme"] != "replication" {
+		t.Errorf("completed bucket has tags %v, %v, want those of the other half", tags, ok)
+	}
+	var results []asymmetricBucket
+	for dec := json.NewDecoder(&out); dec.More(); {
+		var b asymmetricBucket
+		if err := dec.Decode(&b); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, b)
+	}
+	if len(results) != 2 || results[0].Bucket != "broken" || results[0].Action != "" || results[0].Error == "" ||
+		results[1].Bucket != "half" || results[1].Action != reconcileCreated || results[1].Error != "" {
+		t.Errorf("runReconcile() reported %+v, want broken failed and half created", results)
+	}
+}
+
+func TestReconcileRemove(t *testing.T) {
+	backend, stubs := newStubBackend(t, 2, &bucketSettings{scheme: xor2x2Scheme{}})
+	stubs[0].buckets = map[string]map[string]string{"empty": {}, "data": {}}
+	stubs[1].buckets = map[string]map[string]string{}
+	stubs[0].objects["data/a.txt.manifest"] = &stubObject{data: []byte("{}")}
+
+	buckets, err := backend.reconcileBuckets(context.Background(), reconcileRemove)
+	if err != nil {
+		t.Fatalf("reconcileBuckets() failed: %v", err)
+	}
+	want := []asymmetricBucket{
+		{Bucket: "data", Present: []int{1}, Missing: []int{2}, Error: "bucket is not empty, complete it instead"},
+		{Bucket: "empty", Present: []int{1}, Missing: []int{2}, Empty: true, Action: reconcileRemoved},
+	}
+	if !reflect.DeepEqual(buckets, want) {
+		t.Errorf("reconcileBuckets() = %+v, want %+v", buckets, want)
+	}
+	if _, ok := stubs[0].buckets["empty"]; ok {
+		t.Errorf("empty bucket was not removed")
+	}
+	if _, ok := stubs[0].buckets["data"]; !ok {
+		t.Errorf("bucket with objects was removed")
+	}
+}
+
+func TestReconcileCreateBucketAdopts(t *testing.T) {
+	ctx := context.Background()
+	backend, stubs := newStubBackend(t, 2, &bucketSettings{scheme: xor2x2Scheme{}})
+	stubs[0].buckets = map[string]map[string]string{"half": {"pcsScheme": "replication"}, "data": {}}
+	stubs[1].buckets = map[string]map[string]string{}
+	stubs[0].objects["data/a.txt.manifest"] = &stubObject{data: []byte("{}")}
+
+	if err := backend.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String("half")}, nil); err != nil {
+		t.Fatalf("CreateBucket() failed to adopt an empty half: %v", err)
+	}
+	if _, ok := stubs[1].buckets["half"]; !ok {
+		t.Errorf("missing half was not created")
+	}
+	if tags := stubs[0].buckets["half"]; len(tags) != 0 {
+		t.Errorf("adopted half kept its tags %v", tags)
+	}
+
+	if err := backend.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String("data")}, nil); err == nil {
+		t.Errorf("CreateBucket() adopted a half storing objects")
+	}
+	if _, ok := stubs[1].buckets["data"]; ok {
+		t.Errorf("bucket was created next to a half storing objects")
+	}
+}
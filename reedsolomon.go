@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// maxShards limits the number of data plus parity shards of rsScheme
+const maxShards = 64
+
+// rsScheme implements systematic Reed-Solomon erasure coding over GF(256)
+// with k data and m parity shards. The data is striped over the data
+// shards, byte p of the object is byte p/k of data shard p%k. Every parity
+// shard holds a different linear combination of the data bytes of a row,
+// any k of the k+m shards reconstruct the data.
+//
+// The data shards hold the plaintext, so the scheme is meant for buckets
+// that need resilience but no confidentiality. It stores (k+m)/k times the
+// data instead of n times for the XOR schemes.
+//
+// Shard i is stored as <key>.share.<i> on provider i modulo the number of
+// providers, checkPlacement rejects layouts that do not survive the loss
+// of any one provider. All shards are padded to the same number of rows, the size of
+// the object is recorded in the metaSize share metadata.
+type rsScheme struct {
+	providers int
+	k         int // Number of data shards
+	m         int // Number of parity shards
+}
+
+func (s rsScheme) name() string {
+	return withProviders(schemeReedSolomon+":"+strconv.Itoa(s.k)+"+"+strconv.Itoa(s.m), s.providers)
+}
+
+func (s rsScheme) shares() []shareSpec {
+	shares := make([]shareSpec, s.k+s.m)
+	for i := range shares {
+		shares[i] = shareSpec{suffixShare + strconv.Itoa(i), i % s.providers, i, 0}
+	}
+	return shares
+}
+
+func (s rsScheme) streams() int {
+	return s.k + s.m
+}
+
+// segment returns the whole object, every shard holds a stripe of it
+func (s rsScheme) segment(part int, size int64) (offset, length int64) {
+	return 0, size
+}
+
+func (s rsScheme) width() int {
+	return s.k
+}
+
+func (s rsScheme) splitter(size int64) SplitterFunc {
+	return newRSSplitter(s.k, s.parityMatrix(), size)
+}
+
+func (s rsScheme) threshold() int {
+	return s.k
+}
+
+// joiner returns a JoinerFunc decoding the data from the given shards. If
+// all data shards are given it only interleaves them again.
+func (s rsScheme) joiner(streams []int) JoinerFunc {
+	parity := s.parityMatrix()
+	rows := make([][]byte, len(streams))
+	for i, stream := range streams {
+		if stream < s.k {
+			rows[i] = make([]byte, s.k)
+			rows[i][stream] = 1
+		} else {
+			rows[i] = parity[stream-s.k]
+		}
+	}
+	decode, err := gfInvertMatrix(rows)
+	if err != nil {
+		// Any k rows of a systematic Cauchy matrix are independent
+		panic(fmt.Sprintf("cannot decode from shards %v: %v", streams, err))
+	}
+	return newRSJoiner(decode)
+}
+
+// parityMatrix returns the m x k Cauchy matrix computing the parity shards,
+// entry (i, j) is 1 / (x_i + y_j) with x_i = k+i and y_j = j. Stacked
+// below the identity matrix every k x k submatrix is invertible.
+func (s rsScheme) parityMatrix() [][]byte {
+	parity := make([][]byte, s.m)
+	for i := range parity {
+		parity[i] = make([]byte, s.k)
+		for j := range parity[i] {
+			parity[i][j] = gfInv(byte(s.k+i) ^ byte(j))
+		}
+	}
+	return parity
+}
+
+// newRSSplitter returns a SplitterFunc for an object of the given size.
+// Bytes that do not fill a row of k bytes are carried over to the next
+// chunk, the last row is padded with zeros. Outputs 0 to k-1 are the data
+// shards, the following ones the parity shards.
+func newRSSplitter(k int, parity [][]byte, size int64) SplitterFunc {
+	var carry []byte
+	var offset int64
+	return func(data []byte) [][]byte {
+		offset += int64(len(data))
+		buf := append(carry, data...)
+		if offset >= size && len(buf)%k != 0 {
+			buf = append(buf, make([]byte, k-len(buf)%k)...)
+		}
+		rows := len(buf) / k
+		carry = append([]byte(nil), buf[rows*k:]...)
+
+		out := make([][]byte, k+len(parity))
+		for j := 0; j < k; j++ {
+			out[j] = make([]byte, rows)
+			for r := range out[j] {
+				out[j][r] = buf[r*k+j]
+			}
+		}
+		for i, coeffs := range parity {
+			shard := make([]byte, rows)
+			for j, c := range coeffs {
+				gfMulAddSlice(shard, c, out[j])
+			}
+			out[k+i] = shard
+		}
+		return out
+	}
+}
+
+// newRSJoiner returns a JoinerFunc computing data shard j as the linear
+// combination decode[j] of the given shards and interleaving the data
+// shards into rows.
+func newRSJoiner(decode [][]byte) JoinerFunc {
+	k := len(decode)
+	return func(parts [][]byte) []byte {
+		rows := len(parts[0])
+		out := make([]byte, rows*k)
+		shard := make([]byte, rows)
+		for j, coeffs := range decode {
+			clear(shard)
+			for i, part := range parts {
+				gfMulAddSlice(shard, coeffs[i], part)
+			}
+			for r, b := range shard {
+				out[r*k+j] = b
+			}
+		}
+		return out
+	}
+}
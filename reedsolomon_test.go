@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestGFInvertMatrix(t *testing.T) {
+	s := rsScheme{providers: 6, k: 4, m: 3}
+	parity := s.parityMatrix()
+	// Every 4 rows of the identity stacked on the parity matrix
+	for _, rows := range subsets(s.k+s.m, s.k) {
+		m := make([][]byte, len(rows))
+		for i, row := range rows {
+			if row < s.k {
+				m[i] = make([]byte, s.k)
+				m[i][row] = 1
+			} else {
+				m[i] = parity[row-s.k]
+			}
+		}
+		inv, err := gfInvertMatrix(m)
+		if err != nil {
+			t.Fatalf("rows %v: %v", rows, err)
+		}
+		for i := range m {
+			for j := range m {
+				var sum byte
+				for l := range m {
+					sum ^= gfMul(m[i][l], inv[l][j])
+				}
+				want := byte(0)
+				if i == j {
+					want = 1
+				}
+				if sum != want {
+					t.Fatalf("rows %v: (m * inv)[%d][%d] = %d", rows, i, j, sum)
+				}
+			}
+		}
+	}
+
+	if _, err := gfInvertMatrix([][]byte{{1, 2}, {2, 4}}); err == nil {
+		t.Errorf("inverted a singular matrix")
+	}
+}
+
+func TestReedSolomonDegradedReads(t *testing.T) {
+	for _, size := range []int{0, 1, 5, 1000, 4099} {
+		for _, params := range [][2]int{{4, 2}, {3, 3}, {1, 2}} {
+			k, m := params[0], params[1]
+			t.Run(fmt.Sprintf("size=%d, rs:%d+%d", size, k, m), func(t *testing.T) {
+				scheme := rsScheme{providers: 3, k: k, m: m}
+				data := []byte(randomString(size))
+				stored := splitScheme(t, scheme, data, 7)
+				for i := range stored {
+					if int64(len(stored[i])) != shareLength(scheme, int64(size)) {
+						t.Fatalf("shard %d has %d bytes, want %d", i, len(stored[i]), shareLength(scheme, int64(size)))
+					}
+				}
+
+				// Any k shards reconstruct the data followed by the padding
+				for _, streams := range subsets(k+m, k) {
+					got := joinScheme(t, scheme, stored, streams)
+					if !bytes.Equal(got[:size], data) || !bytes.Equal(got[size:], make([]byte, len(got)-size)) {
+						t.Errorf("shards %v: reconstructed data differs from the original", streams)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestLogicalSize(t *testing.T) {
+	scheme := rsScheme{providers: 3, k: 4, m: 2}
+	lengths := func(int) int64 { return 3 }
+	for _, tt := range []struct {
+		meta string
+		size int64
+		ok   bool
+	}{
+		{"9", 9, true},
+		{"12", 12, true},
+		{"8", 0, false}, // needs only 2 rows
+		{"13", 0, false},
+		{"", 0, false},
+	} {
+		size, err := logicalSize(scheme, 5, lengths, func(int) map[string]string {
+			return map[string]string{metaSize: tt.meta}
+		})
+		if (err == nil) != tt.ok || size != tt.size {
+			t.Errorf("logicalSize with %s=%q = %d, %v", metaSize, tt.meta, size, err)
+		}
+	}
+
+	// Unstriped schemes add up the share lengths
+	size, err := logicalSize(xor2x2Scheme{}, 1, lengths, nil)
+	if err != nil || size != 6 {
+		t.Errorf("logicalSize(xor2x2) = %d, %v, want 6", size, err)
+	}
+}
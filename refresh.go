@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/versity/versitygw/s3err"
+	"github.com/versity/versitygw/s3response"
+)
+
+// Outcomes of refreshing the shares of an object
+const (
+	refreshDone    = "refreshed"
+	refreshSkipped = "skipped"
+	refreshFailed  = "failed"
+)
+
+// refreshProgressInterval is how often a running refresh logs its progress
+const refreshProgressInterval = time.Minute
+
+// refreshOptions configure a refresh of the shares of the objects of a
+// bucket
+type refreshOptions struct {
+	prefix string    // Only objects whose keys start with it
+	before time.Time // Only objects last modified before, all if zero
+	rate   int64     // Maximum bytes per second read and written, unlimited if 0
+}
+
+// refreshResult is the outcome of refreshing the shares of an object
+type refreshResult struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// refreshProgress counts the objects of a refresh by their outcome
+type refreshProgress struct {
+	Refreshed, Skipped, Failed int
+	Bytes                      int64 // Of the refreshed objects
+}
+
+// add counts the result of an object
+func (p *refreshProgress) add(r refreshResult) {
+	switch r.Status {
+	case refreshDone:
+		p.Refreshed++
+		p.Bytes += r.Size
+	case refreshSkipped:
+		p.Skipped++
+	default:
+		p.Failed++
+	}
+}
+
+func (p refreshProgress) String() string {
+	return fmt.Sprintf("%d objects refreshed (%d bytes), %d skipped, %d failed", p.Refreshed, p.Bytes, p.Skipped, p.Failed)
+}
+
+// rateLimiter spaces out work so that on average at most rate bytes are
+// processed per second. A rate of 0 does not limit.
+type rateLimiter struct {
+	rate  int64
+	start time.Time
+	total int64
+}
+
+// delay returns how long to wait at time now after n more bytes were
+// processed to keep to the rate
+func (l *rateLimiter) delay(now time.Time, n int64) time.Duration {
+	if l.rate <= 0 {
+		return 0
+	}
+	if l.start.IsZero() {
+		l.start = now
+	}
+	l.total += n
+	due := l.start.Add(time.Duration(float64(l.total) / float64(l.rate) * float64(time.Second)))
+	return max(due.Sub(now), 0)
+}
+
+// wait blocks after n more bytes were processed until the rate allows
+// more work, or until ctx is done
+func (l *rateLimiter) wait(ctx context.Context, n int64) error {
+	d := l.delay(time.Now(), n)
+	if d == 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// refreshObject splits the object bucket/key again with fresh randomness
+// and replaces its shares, so that shares of it obtained before cannot be
+// combined with the new ones. The providers only see the new shares. The
+// object is written like an upload and only replaced if it did not change
+// in the meantime. Its data, metadata and ETag stay the same, also the
+// ETag of an object uploaded in parts, it is last modified at the time of
+// the refresh.
+func (self *MyBackend) refreshObject(ctx context.Context, bucket, key string) refreshResult {
+	result := refreshResult{Bucket: bucket, Key: key, Status: refreshDone}
+	fail := func(err error) refreshResult {
+		result.Status, result.Detail = refreshFailed, err.Error()
+		return result
+	}
+
+	src, err := self.openSource(ctx, bucket, key)
+	if err != nil {
+		return fail(err)
+	}
+	result.Size = aws.ToInt64(src.head.ContentLength)
+	if !randomized(src.settings.scheme) {
+		result.Status = refreshSkipped
+		result.Detail = fmt.Sprintf("scheme %s uses no randomness", src.settings.scheme.name())
+		return result
+	}
+
+	var checksums manifestChecksums
+	if src.manifest != nil {
+		checksums = src.manifest.Checksums
+	}
+	metadata := stripShareMetadata(src.head.Metadata)
+	if len(metadata) == 0 {
+		metadata = nil
+	}
+	conds := objectConditions{
+		ifMatch:             aws.ToString(src.head.ETag),
+		ifMatchLastModified: src.head.LastModified,
+	}
+	digests := uploadDigests{algorithm: checksums.Algorithm}
+	if src.manifest != nil {
+		digests.etag = src.manifest.ETag
+	}
+	_, err = self.splitAgain(ctx, src, bucket, key, headObjectHeaders(src.head), metadata, digests, conds)
+	var apiErr s3err.APIError
+	if errors.As(err, &apiErr) && apiErr.Code == "PreconditionFailed" {
+		result.Status, result.Detail = refreshSkipped, "object changed during the refresh"
+		return result
+	}
+	if err != nil {
+		return fail(err)
+	}
+	return result
+}
+
+// refreshObjects refreshes the shares of the objects of a bucket selected
+// by opts, see refreshObject, and passes the result of every object to
+// report. Objects are refreshed one after the other, the progress is
+// logged regularly.
+func (self *MyBackend) refreshObjects(ctx context.Context, bucket string, opts refreshOptions,
+	report func(refreshResult),
+) (refreshProgress, error) {
+	var progress refreshProgress
+	limiter := rateLimiter{rate: opts.rate}
+	logged := time.Now()
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(bucket)}
+	if opts.prefix != "" {
+		input.Prefix = aws.String(opts.prefix)
+	}
+	for {
+		page, err := self.ListObjectsV2(ctx, input)
+		if err != nil {
+			return progress, err
+		}
+		for _, obj := range page.Contents {
+			if !opts.before.IsZero() && !aws.ToTime(obj.LastModified).Before(opts.before) {
+				continue
+			}
+			result := self.refreshObject(ctx, bucket, aws.ToString(obj.Key))
+			progress.add(result)
+			report(result)
+			if time.Since(logged) >= refreshProgressInterval {
+				log.Printf("Refreshing bucket %s: %v so far", bucket, progress)
+				logged = time.Now()
+			}
+			if result.Status == refreshDone {
+				// Every byte is read and written once
+				if err := limiter.wait(ctx, 2*result.Size); err != nil {
+					return progress, err
+				}
+			} else if err := ctx.Err(); err != nil {
+				return progress, err
+			}
+		}
+		if !aws.ToBool(page.IsTruncated) {
+			break
+		}
+		input.ContinuationToken = page.NextContinuationToken
+	}
+	log.Printf("Refreshed bucket %s: %v", bucket, progress)
+	return progress, nil
+}
+
+// runRefresh refreshes the shares of the objects of a bucket and writes
+// the result of every object to w as a JSON line. It returns the number of
+// objects that failed.
+func (self *MyBackend) runRefresh(ctx context.Context, bucket string, opts refreshOptions, w io.Writer) (int, error) {
+	enc := json.NewEncoder(w)
+	var encErr error
+	progress, err := self.refreshObjects(ctx, bucket, opts, func(r refreshResult) {
+		if encErr == nil {
+			encErr = enc.Encode(r)
+		}
+	})
+	if err == nil {
+		err = encErr
+	}
+	return progress.Failed, err
+}
+
+// refreshPeriodically refreshes the shares of all buckets every interval,
+// each time those of the objects last modified more than interval ago,
+// until ctx is done. Failures are logged.
+func (self *MyBackend) refreshPeriodically(ctx context.Context, interval time.Duration, rate int64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		buckets, err := self.ListBuckets(ctx, s3response.ListBucketsInput{})
+		if err != nil {
+			log.Printf("Failed to list the buckets to refresh: %v", err)
+			continue
+		}
+		opts := refreshOptions{before: time.Now().Add(-interval), rate: rate}
+		for _, b := range buckets.Buckets.Bucket {
+			_, err := self.refreshObjects(ctx, b.Name, opts, func(r refreshResult) {
+				if r.Status == refreshFailed {
+					log.Printf("Failed to refresh the shares of %s/%s: %s", r.Bucket, r.Key, r.Detail)
+				}
+			})
+			if err != nil {
+				log.Printf("Failed to refresh bucket %s: %v", b.Name, err)
+			}
+		}
+	}
+}
+
+// parseRefreshTarget splits the argument of --refresh, a bucket optionally
+// followed by "/" and a key prefix
+func parseRefreshTarget(target string) (bucket, prefix string) {
+	bucket, prefix, _ = strings.Cut(target, "/")
+	return bucket, prefix
+}
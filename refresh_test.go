@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	l := rateLimiter{rate: 1000}
+	if d := l.delay(start, 500); d != 500*time.Millisecond {
+		t.Errorf("delay() = %v after 500 bytes, want 500ms", d)
+	}
+	// Time spent on the work counts towards the delay
+	if d := l.delay(start.Add(2*time.Second), 1000); d != 0 {
+		t.Errorf("delay() = %v when behind the rate, want 0", d)
+	}
+	if d := l.delay(start.Add(2*time.Second), 1500); d != time.Second {
+		t.Errorf("delay() = %v after 3000 bytes in 2s, want 1s", d)
+	}
+
+	unlimited := rateLimiter{}
+	if d := unlimited.delay(start, 1<<40); d != 0 {
+		t.Errorf("delay() = %v without a rate, want 0", d)
+	}
+}
+
+func TestRefreshProgress(t *testing.T) {
+	var p refreshProgress
+	for _, r := range []refreshResult{
+		{Size: 10, Status: refreshDone},
+		{Size: 5, Status: refreshDone},
+		{Size: 7, Status: refreshSkipped},
+		{Size: 3, Status: refreshFailed},
+	} {
+		p.add(r)
+	}
+	want := refreshProgress{Refreshed: 2, Skipped: 1, Failed: 1, Bytes: 15}
+	if p != want {
+		t.Errorf("progress = %+v, want %+v", p, want)
+	}
+}
+
+func TestRandomized(t *testing.T) {
+	for _, name := range []string{schemeXor2x2, schemeXor, "shamir:2"} {
+		scheme, err := parseScheme(name, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !randomized(scheme) {
+			t.Errorf("randomized(%s) = false", name)
+		}
+	}
+	for _, name := range []string{schemeReplication, "rs:2+1"} {
+		scheme, err := parseScheme(name, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if randomized(scheme) {
+			t.Errorf("randomized(%s) = true", name)
+		}
+	}
+}
+
+func TestParseRefreshTarget(t *testing.T) {
+	for _, tt := range []struct{ target, bucket, prefix string }{
+		{"bucket", "bucket", ""},
+		{"bucket/dir/sub", "bucket", "dir/sub"},
+		{"/dir", "", "dir"},
+	} {
+		if bucket, prefix := parseRefreshTarget(tt.target); bucket != tt.bucket || prefix != tt.prefix {
+			t.Errorf("parseRefreshTarget(%q) = %q, %q, want %q, %q", tt.target, bucket, prefix, tt.bucket, tt.prefix)
+		}
+	}
+}
+
+func TestRefreshObject(t *testing.T) {
+	ctx := context.Background()
+	backend, stubs := newStubBackend(t, 2, &bucketSettings{scheme: xor2x2Scheme{}})
+	j, err := openIntentJournal(filepath.Join(t.TempDir(), "intents.journal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.journal = j
+	putTestObject(t, backend, "a.txt", "content", map[string]string{"color": "red"})
+
+	// An object uploaded in parts keeps its ETag
+	upload, err := backend.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("parts.txt"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	part, err := backend.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String("bucket"),
+		Key:           aws.String("parts.txt"),
+		UploadId:      aws.String(upload.UploadId),
+		PartNumber:    aws.Int32(1),
+		Body:          strings.NewReader("in parts"),
+		ContentLength: aws.Int64(8),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = backend.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String("bucket"),
+		Key:      aws.String("parts.txt"),
+		UploadId: aws.String(upload.UploadId),
+		MultipartUpload: &types.CompletedMultipartUpload{
+			Parts: []types.CompletedPart{{PartNumber: aws.Int32(1), ETag: part.ETag}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct{ key, content string }{
+		{"a.txt", "content"},
+		{"parts.txt", "in parts"},
+	} {
+		head := func() *s3.HeadObjectOutput {
+			head, err := backend.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String(tt.key)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return head
+		}
+		before := head()
+		old, err := backend.readManifest(ctx, "bucket", tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result := backend.refreshObject(ctx, "bucket", tt.key); result.Status != refreshDone {
+			t.Fatalf("refreshObject(%s) = %+v, want it refreshed", tt.key, result)
+		}
+		after := head()
+		if aws.ToString(after.ETag) != aws.ToString(before.ETag) {
+			t.Errorf("%s has ETag %s after the refresh, want %s", tt.key, aws.ToString(after.ETag), aws.ToString(before.ETag))
+		}
+		if !reflect.DeepEqual(after.Metadata, before.Metadata) {
+			t.Errorf("%s has metadata %v after the refresh, want %v", tt.key, after.Metadata, before.Metadata)
+		}
+		if got := getTestObject(t, backend, tt.key); got != tt.content {
+			t.Errorf("%s is %q after the refresh, want %q", tt.key, got, tt.content)
+		}
+		// The old shares are replaced by new ones
+		for _, share := range old.Shares {
+			if _, ok := stubs[share.Provider].objects["bucket/"+share.Key]; ok {
+				t.Errorf("old share %s of %s is still stored", share.Key, tt.key)
+			}
+		}
+	}
+	if pending := j.pending(); len(pending) != 0 {
+		t.Errorf("journal has open intents %+v after the refresh", pending)
+	}
+
+	// Schemes without randomness are skipped
+	backend.buckets.Store("replicated", &bucketSettings{scheme: replicationScheme{providers: 2}})
+	_, err = backend.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String("replicated"),
+		Key:           aws.String("a.txt"),
+		Body:          strings.NewReader("plain"),
+		ContentLength: aws.Int64(5),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := backend.refreshObject(ctx, "replicated", "a.txt"); result.Status != refreshSkipped {
+		t.Errorf("refreshObject() = %+v for a replicated object, want it skipped", result)
+	}
+}
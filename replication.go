@@ -0,0 +1,52 @@
+package main
+
+// replicationScheme stores a full plaintext copy of every object on each
+// provider as <key>.share.<i>. It offers no confidentiality, but any single
+// provider suffices to read the object.
+type replicationScheme struct {
+	providers int
+}
+
+func (s replicationScheme) name() string {
+	return withProviders(schemeReplication, s.providers)
+}
+
+func (s replicationScheme) shares() []shareSpec {
+	return indexedShares(s.providers)
+}
+
+func (s replicationScheme) streams() int {
+	return s.providers
+}
+
+// segment returns the whole object, every share is a copy
+func (s replicationScheme) segment(part int, size int64) (offset, length int64) {
+	return 0, size
+}
+
+func (s replicationScheme) width() int {
+	return 1
+}
+
+// splitter returns a SplitterFunc handing the data to every output, the
+// outputs only read it
+func (s replicationScheme) splitter(size int64) SplitterFunc {
+	return func(data []byte) [][]byte {
+		out := make([][]byte, s.providers)
+		for i := range out {
+			out[i] = data
+		}
+		return out
+	}
+}
+
+func (s replicationScheme) threshold() int {
+	return 1
+}
+
+// joiner returns the single stream it is given
+func (s replicationScheme) joiner(streams []int) JoinerFunc {
+	return func(parts [][]byte) []byte {
+		return parts[0]
+	}
+}
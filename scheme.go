@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// shareChunkSize is the number of bytes read from the source per splitter call
+const shareChunkSize = 64 * 1024
+
+// suffixShare is the suffix of the shares of schemes storing one share per
+// provider, it is followed by the share index
+const suffixShare = ".share."
+
+// User metadata stored with every share, recording how the object was split
+const (
+	metaScheme = "pcs-scheme" // ShareScheme.name() of the scheme
+	metaShare  = "pcs-share"  // Index of the share
+	metaSize   = "pcs-size"   // Size of the original file
+)
+
+// Names of the share schemes as used in the bucket tag schemeKey, the
+// --scheme flag and metaScheme. Shamir sharing is followed by the
+// threshold, e.g. "shamir:2", Reed-Solomon by the number of data and
+// parity shards, e.g. "rs:4+2". The names recorded for objects end with
+// the number of providers the shares are placed on, e.g. "shamir:2/3",
+// except for xor2x2, which always uses two.
+const (
+	schemeReplication = "replication"
+	schemeXor2x2      = "xor2x2"
+	schemeXor         = "xor"
+	schemeShamir      = "shamir"
+	schemeReedSolomon = "rs"
+)
+
+// shareSpec describes one share of a logical object
+type shareSpec struct {
+	suffix   string // Appended to the logical key to get the share key
+	provider int    // Index of the client storing the share
+	stream   int    // Shares of the same stream are concatenated before joining
+	part     int    // Position within the stream, see ShareScheme.segment
+}
+
+// ShareScheme describes how a logical object is split into shares, how
+// the shares are named and placed on the providers and how they are
+// joined again. Schemes differ in how many providers they need to read
+// an object and how many may collude without learning anything about it.
+type ShareScheme interface {
+	// name returns the name of the scheme including its parameters, it
+	// is accepted by parseScheme
+	name() string
+	// shares returns the shares of a logical object, in the order of the
+	// outputs of splitter. The shares of a stream are listed in part order.
+	shares() []shareSpec
+	// streams returns the number of streams the object is split into
+	streams() int
+	// segment returns the offset and length of the bytes of an object of
+	// the given size that the shares with the given part number hold
+	segment(part int, size int64) (offset, length int64)
+	// width returns the number of bytes of a segment every byte of a share
+	// encodes. It is 1 unless the segment is striped over the streams.
+	width() int
+	// splitter returns the SplitterFunc for an object of the given size
+	splitter(size int64) SplitterFunc
+	// threshold returns the number of streams needed to join the object
+	threshold() int
+	// joiner returns the JoinerFunc combining the given streams, of which
+	// there are threshold()
+	joiner(streams []int) JoinerFunc
+}
+
+// parseScheme returns the scheme with the given name. The shares are
+// placed on the number of providers the name ends with, or on the given
+// number of providers if it has none, which checkProviders checks against
+// the configured ones.
+func parseScheme(name string, providers int) (ShareScheme, error) {
+	if base, count, found := strings.Cut(name, "/"); found {
+		n, err := strconv.Atoi(count)
+		if err != nil || n < 2 || n > maxShards || base == schemeXor2x2 {
+			return nil, fmt.Errorf("invalid number of providers in share scheme %q", name)
+		}
+		name, providers = base, n
+	}
+	switch name {
+	case schemeReplication:
+		return replicationScheme{providers: providers}, nil
+	case schemeXor2x2:
+		return xor2x2Scheme{}, nil
+	case schemeXor:
+		return xorScheme{providers: providers}, nil
+	}
+	if threshold, found := strings.CutPrefix(name, schemeShamir+":"); found {
+		k, err := strconv.Atoi(threshold)
+		if err != nil || k < 2 || k > providers {
+			return nil, fmt.Errorf("shamir threshold must be between 2 and %d, got %q", providers, threshold)
+		}
+		return shamirScheme{providers: providers, k: k}, nil
+	}
+	if shards, found := strings.CutPrefix(name, schemeReedSolomon+":"); found {
+		data, parity, _ := strings.Cut(shards, "+")
+		k, errK := strconv.Atoi(data)
+		m, errM := strconv.Atoi(parity)
+		if errK != nil || errM != nil || k < 1 || m < 1 || k+m > maxShards {
+			return nil, fmt.Errorf("reed-solomon shards must be <data>+<parity> with at most %d in total, got %q",
+				maxShards, shards)
+		}
+		return rsScheme{providers: providers, k: k, m: m}, nil
+	}
+	return nil, fmt.Errorf("unknown share scheme %q", name)
+}
+
+// withProviders returns the name of a scheme with the given parameters
+// followed by the number of providers its shares are placed on
+func withProviders(name string, providers int) string {
+	return name + "/" + strconv.Itoa(providers)
+}
+
+// schemeProviders returns the number of providers a scheme places shares on
+func schemeProviders(scheme ShareScheme) int {
+	n := 0
+	for _, share := range scheme.shares() {
+		n = max(n, share.provider+1)
+	}
+	return n
+}
+
+// checkProviders checks that the given number of configured providers
+// includes every provider a scheme places shares on. Objects keep the
+// placement recorded in their name when providers are added.
+func checkProviders(scheme ShareScheme, providers int) error {
+	if n := schemeProviders(scheme); n > providers {
+		return fmt.Errorf("share scheme %s places shares on %d providers, %d are configured",
+			scheme.name(), n, providers)
+	}
+	return nil
+}
+
+// checkPlacement checks that a scheme configured for new objects survives
+// the loss of any one provider if it is meant to. Losing a provider loses
+// all shards placed on it, which the parity shards of rs must be able to
+// replace. Existing objects are still read with such a scheme.
+func checkPlacement(scheme ShareScheme) error {
+	rs, ok := scheme.(rsScheme)
+	if !ok {
+		return nil
+	}
+	if perProvider := (rs.k + rs.m + rs.providers - 1) / rs.providers; perProvider > rs.m {
+		return fmt.Errorf("%s places up to %d shards on one of %d providers, more than its %d parity shards",
+			rs.name(), perProvider, rs.providers, rs.m)
+	}
+	return nil
+}
+
+// defaultScheme returns the scheme used when none is configured: the XOR
+// 2x2 layout for two providers and n-of-n XOR for more
+func defaultScheme(providers int) ShareScheme {
+	if providers == 2 {
+		return xor2x2Scheme{}
+	}
+	return xorScheme{providers: providers}
+}
+
+// indexedShares returns n shares <key>.share.<i>, share i being stream i
+// and stored on provider i
+func indexedShares(n int) []shareSpec {
+	shares := make([]shareSpec, n)
+	for i := range shares {
+		shares[i] = shareSpec{suffixShare + strconv.Itoa(i), i, i, 0}
+	}
+	return shares
+}
+
+// parseShareKey returns the logical key and the share index of a share
+// key. ok is false if the key does not belong to the scheme.
+func parseShareKey(scheme ShareScheme, key string) (base string, index int, ok bool) {
+	for i, share := range scheme.shares() {
+		if base, found := strings.CutSuffix(key, share.suffix); found {
+			return base, i, true
+		}
+	}
+	return "", 0, false
+}
+
+// availableStreams returns the streams of which all shares are present,
+// present is called with share indices
+func availableStreams(scheme ShareScheme, present func(index int) bool) []int {
+	missing := make([]bool, scheme.streams())
+	for i, share := range scheme.shares() {
+		if !present(i) {
+			missing[share.stream] = true
+		}
+	}
+	var streams []int
+	for stream, m := range missing {
+		if !m {
+			streams = append(streams, stream)
+		}
+	}
+	return streams
+}
+
+// streamShares returns the indices of the shares of a stream in part order
+func streamShares(scheme ShareScheme, stream int) []int {
+	var indices []int
+	for i, share := range scheme.shares() {
+		if share.stream == stream {
+			indices = append(indices, i)
+		}
+	}
+	return indices
+}
+
+// streamSize returns the total length of the shares of the given stream,
+// length is called with share indices
+func streamSize(scheme ShareScheme, stream int, length func(index int) int64) int64 {
+	var size int64
+	for _, i := range streamShares(scheme, stream) {
+		size += length(i)
+	}
+	return size
+}
+
+// shareLength returns the length of a share holding a segment of the
+// given length
+func shareLength(scheme ShareScheme, length int64) int64 {
+	w := int64(scheme.width())
+	return (length + w - 1) / w
+}
+
+// logicalSize returns the size of the original file from the shares of an
+// available stream. Striped schemes pad their shares, their size is taken
+// from the metaSize metadata of the first share of the stream.
+func logicalSize(scheme ShareScheme, stream int, length func(index int) int64,
+	metadata func(index int) map[string]string,
+) (int64, error) {
+	if scheme.width() == 1 {
+		return streamSize(scheme, stream, length), nil
+	}
+	index := streamShares(scheme, stream)[0]
+	size, err := strconv.ParseInt(metadata(index)[metaSize], 10, 64)
+	if err != nil || size < 0 || shareLength(scheme, size) != streamSize(scheme, stream, length) {
+		return 0, fmt.Errorf("share %d has no valid %s metadata", index, metaSize)
+	}
+	return size, nil
+}
+
+// schemeFromMetadata returns the scheme recorded in the metadata of a
+// share. ok is false if the metadata does not name a valid scheme.
+func schemeFromMetadata(metadata map[string]string, providers int) (ShareScheme, bool) {
+	name, found := metadata[metaScheme]
+	if !found {
+		return nil, false
+	}
+	scheme, err := parseScheme(name, providers)
+	if err == nil {
+		err = checkProviders(scheme, providers)
+	}
+	return scheme, err == nil
+}
+
+// shareMetadata returns the user metadata of share index: the metadata of
+// the original file of the given size plus the scheme parameters
+func shareMetadata(scheme ShareScheme, metadata map[string]string, index int, size int64) map[string]string {
+	result := make(map[string]string, len(metadata)+3)
+	for k, v := range metadata {
+		result[k] = v
+	}
+	result[metaScheme] = scheme.name()
+	result[metaShare] = strconv.Itoa(index)
+	result[metaSize] = strconv.FormatInt(size, 10)
+	return result
+}
+
+// stripShareMetadata removes the scheme parameters from share metadata
+func stripShareMetadata(metadata map[string]string) map[string]string {
+	result := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		if !strings.HasPrefix(k, "pcs-") {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// randomized reports whether the shares of the scheme hide the object
+// behind randomness, so that splitting it again yields unrelated shares.
+// Replicas and Reed-Solomon shards are determined by the object.
+func randomized(scheme ShareScheme) bool {
+	switch scheme.(type) {
+	case replicationScheme, rsScheme:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// splitScheme runs data through a MultiSplitter with the splitter of the
+// scheme and returns the shares in scheme order.
+func splitScheme(t *testing.T, scheme ShareScheme, data []byte, chunkSize int) [][]byte {
+	shares := scheme.shares()
+	ms, readers, err := NewMultiSplitter(bytes.NewReader(data), chunkSize, len(shares),
+		scheme.splitter(int64(len(data))))
+	if err != nil {
+		t.Fatalf("Failed to create MultiSplitter: %v", err)
+	}
+	defer ms.Close()
+
+	stored := make([][]byte, len(shares))
+	var wg sync.WaitGroup
+	for i := range readers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var buf bytes.Buffer
+			if _, err := io.Copy(&buf, readers[i]); err != nil {
+				t.Errorf("Reader %d error: %v", i, err)
+			}
+			stored[i] = buf.Bytes()
+		}()
+	}
+	wg.Wait()
+	return stored
+}
+
+// joinScheme joins the shares of the given streams like GetObject does
+func joinScheme(t *testing.T, scheme ShareScheme, stored [][]byte, streams []int) []byte {
+	readers := make([]io.Reader, len(streams))
+	for j, stream := range streams {
+		var parts []io.Reader
+		for _, i := range streamShares(scheme, stream) {
+			parts = append(parts, bytes.NewReader(stored[i]))
+		}
+		readers[j] = io.MultiReader(parts...)
+	}
+	mj, err := NewMultiJoiner(readers, 64, scheme.joiner(streams))
+	if err != nil {
+		t.Fatalf("Failed to create MultiJoiner: %v", err)
+	}
+	got, err := io.ReadAll(mj)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return got
+}
+
+func TestSchemeRoundTrip(t *testing.T) {
+	secret := "TOP-SECRET customer record"
+	data := []byte(strings.Repeat(secret+"\n", 300))
+	size := int64(len(data))
+
+	for _, tt := range []struct {
+		scheme       ShareScheme
+		providers    int
+		confidential bool
+	}{
+		{replicationScheme{providers: 3}, 3, false},
+		{xor2x2Scheme{}, 2, true},
+		{xor2x2Scheme{}, 3, true},
+		{xorScheme{providers: 2}, 2, true},
+		{xorScheme{providers: 5}, 5, true},
+		{shamirScheme{providers: 3, k: 2}, 3, true},
+		{rsScheme{providers: 3, k: 4, m: 2}, 3, false},
+	} {
+		t.Run(tt.scheme.name(), func(t *testing.T) {
+			shares := tt.scheme.shares()
+			stored := splitScheme(t, tt.scheme, data, 100)
+
+			for i, share := range shares {
+				if share.provider >= tt.providers {
+					t.Errorf("share %d is placed on provider %d of %d", i, share.provider, tt.providers)
+				}
+				if _, length := tt.scheme.segment(share.part, size); int64(len(stored[i])) != shareLength(tt.scheme, length) {
+					t.Errorf("share %d has %d bytes, want %d", i, len(stored[i]), length)
+				}
+				if tt.confidential && bytes.Contains(stored[i], []byte(secret)) {
+					t.Errorf("share %d on provider %d contains the plaintext", i, share.provider)
+				}
+			}
+
+			// Join the last threshold streams
+			streams := availableStreams(tt.scheme, func(int) bool { return true })
+			streams = streams[len(streams)-tt.scheme.threshold():]
+			if got := joinScheme(t, tt.scheme, stored, streams); !bytes.Equal(got[:min(len(got), len(data))], data) {
+				t.Errorf("reconstructed data differs from the original")
+			}
+		})
+	}
+}
+
+func TestCheckPlacement(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		providers int
+		valid     bool
+	}{
+		{"rs:4+2", 2, false}, // 3 shards on each provider
+		{"rs:3+1", 2, false},
+		{"rs:2+2", 2, true},
+		{"rs:4+2", 3, true},
+		{"rs:4+2", 6, true},
+		{"rs:5+2", 3, false},
+		{"xor2x2", 2, true},
+		{"shamir:2", 3, true},
+	} {
+		scheme, err := parseScheme(tt.name, tt.providers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkPlacement(scheme)
+		if valid := err == nil; valid != tt.valid {
+			t.Errorf("checkPlacement(%s with %d providers) = %v, want valid %v", tt.name, tt.providers, err, tt.valid)
+		}
+	}
+}
+
+func TestParseScheme(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		want ShareScheme
+	}{
+		{"replication", replicationScheme{providers: 3}},
+		{"xor2x2", xor2x2Scheme{}},
+		{"xor", xorScheme{providers: 3}},
+		{"shamir:2", shamirScheme{providers: 3, k: 2}},
+		{"shamir:3", shamirScheme{providers: 3, k: 3}},
+		{"rs:4+2", rsScheme{providers: 3, k: 4, m: 2}},
+		{"rs:1+1", rsScheme{providers: 3, k: 1, m: 1}},
+		{"shamir:2/4", shamirScheme{providers: 4, k: 2}},
+		{"rs:4+2/6", rsScheme{providers: 6, k: 4, m: 2}},
+		{"xor/2", xorScheme{providers: 2}},
+		{"shamir:3/2", nil},
+		{"xor/1", nil},
+		{"xor/", nil},
+		{"xor2x2/2", nil},
+		{"rs:4+0", nil},
+		{"rs:4", nil},
+		{"rs:60+5", nil},
+		{"shamir:1", nil},
+		{"shamir:4", nil},
+		{"shamir:", nil},
+		{"shamir", nil},
+		{"rot13", nil},
+	} {
+		got, err := parseScheme(tt.name, 3)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseScheme(%q) = %v, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseScheme(%q) = %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+		// The recorded name keeps the number of providers
+		if again, err := parseScheme(got.name(), 7); err != nil || again != got {
+			t.Errorf("%v has name %q, which parses to %v, %v", got, got.name(), again, err)
+		}
+	}
+}
+
+func TestSchemeFromMetadata(t *testing.T) {
+	for _, scheme := range []ShareScheme{
+		replicationScheme{providers: 4},
+		xor2x2Scheme{},
+		xorScheme{providers: 4},
+		shamirScheme{providers: 4, k: 3},
+		rsScheme{providers: 4, k: 4, m: 2},
+	} {
+		meta := shareMetadata(scheme, map[string]string{"owner": "alice"}, 1, 42)
+		got, ok := schemeFromMetadata(meta, 4)
+		if !ok || got != scheme {
+			t.Errorf("schemeFromMetadata(%v) = %v, %v, want %v", meta, got, ok, scheme)
+		}
+		if stripped := stripShareMetadata(meta); len(stripped) != 1 || stripped["owner"] != "alice" {
+			t.Errorf("stripShareMetadata(%v) = %v", meta, stripped)
+		}
+	}
+
+	for _, meta := range []map[string]string{
+		nil,
+		{"owner": "alice"},
+		{metaScheme: "rot13"},
+		{metaScheme: "shamir:9"},
+		{metaScheme: "shamir:2/5"},
+		{metaScheme: "shamir:1"},
+		{metaScheme: "shamir:"},
+	} {
+		if got, ok := schemeFromMetadata(meta, 4); ok {
+			t.Errorf("schemeFromMetadata(%v) = %v, want not ok", meta, got)
+		}
+	}
+}
+
+func TestParseShareKey(t *testing.T) {
+	tests := []struct {
+		scheme ShareScheme
+		key    string
+		base   string
+		index  int
+		ok     bool
+	}{
+		{xor2x2Scheme{}, "dir/a.txt.cypher.first", "dir/a.txt", xorCypherFirst, true},
+		{xor2x2Scheme{}, "a.txt.rand.second", "a.txt", xorRandSecond, true},
+		{xor2x2Scheme{}, "a.txt", "", 0, false},
+		{xor2x2Scheme{}, "a.txt.share.1", "", 0, false},
+		{xorScheme{providers: 3}, "a.txt.share.2", "a.txt", 2, true},
+		{xorScheme{providers: 3}, "a.txt.share.3", "", 0, false},
+		{xorScheme{providers: 3}, "a.txt.cypher.first", "", 0, false},
+		{xorScheme{providers: 12}, "a.txt.share.11", "a.txt", 11, true},
+		{xorScheme{providers: 12}, "a.txt.share.1", "a.txt", 1, true},
+		{replicationScheme{providers: 2}, "a.txt.share.1", "a.txt", 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scheme.name()+"/"+tt.key, func(t *testing.T) {
+			base, index, ok := parseShareKey(tt.scheme, tt.key)
+			if base != tt.base || index != tt.index || ok != tt.ok {
+				t.Errorf("got (%q, %d, %v), want (%q, %d, %v)", base, index, ok, tt.base, tt.index, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSchemeProvidersChange(t *testing.T) {
+	for _, scheme := range []ShareScheme{
+		xorScheme{providers: 3},
+		shamirScheme{providers: 3, k: 2},
+		rsScheme{providers: 3, k: 2, m: 2},
+	} {
+		t.Run(scheme.name(), func(t *testing.T) {
+			backend, stubs := newStubBackend(t, 3, &bucketSettings{scheme: scheme})
+			putTestObject(t, backend, "a.txt", "content", nil)
+
+			// A gateway with another provider reads the object as it was
+			// split
+			grown, grownStubs := newStubBackend(t, 4, &bucketSettings{scheme: scheme})
+			for i, stub := range stubs {
+				grownStubs[i].objects = stub.objects
+			}
+			if got := getTestObject(t, grown, "a.txt"); got != "content" {
+				t.Errorf("object is %q with four providers, want %q", got, "content")
+			}
+
+			// One without all of its providers refuses to
+			shrunk, shrunkStubs := newStubBackend(t, 2, &bucketSettings{scheme: defaultScheme(2)})
+			for i := range shrunkStubs {
+				shrunkStubs[i].objects = stubs[i].objects
+			}
+			if _, err := shrunk.readManifest(context.Background(), "bucket", "a.txt"); err == nil {
+				t.Error("manifest placing shares on three providers read with two")
+			}
+		})
+	}
+}
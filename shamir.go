@@ -0,0 +1,107 @@
+package main
+
+import "strconv"
+
+// shamirScheme implements k-of-n Shamir secret sharing over GF(256). Every
+// byte of the data is the constant term of a random polynomial of degree
+// k-1, share i holds the values of the polynomials at x = i+1. Any k
+// shares determine the data, fewer than k reveal nothing about it.
+//
+// Share i is stored as <key>.share.<i> on provider i, so reads succeed as
+// long as k providers are healthy.
+type shamirScheme struct {
+	providers int // n
+	k         int // threshold
+}
+
+func (s shamirScheme) name() string {
+	return withProviders(schemeShamir+":"+strconv.Itoa(s.k), s.providers)
+}
+
+func (s shamirScheme) shares() []shareSpec {
+	return indexedShares(s.providers)
+}
+
+func (s shamirScheme) streams() int {
+	return s.providers
+}
+
+// segment returns the whole object, every share is as long as the data
+func (s shamirScheme) segment(part int, size int64) (offset, length int64) {
+	return 0, size
+}
+
+func (s shamirScheme) width() int {
+	return 1
+}
+
+func (s shamirScheme) splitter(size int64) SplitterFunc {
+	return newShamirSplitter(s.k, s.providers)
+}
+
+func (s shamirScheme) threshold() int {
+	return s.k
+}
+
+func (s shamirScheme) joiner(streams []int) JoinerFunc {
+	xs := make([]byte, len(streams))
+	for i, stream := range streams {
+		xs[i] = byte(stream + 1)
+	}
+	return newShamirJoiner(xs)
+}
+
+// newShamirSplitter returns a SplitterFunc producing n shares of which k
+// are needed to reconstruct the data. Output i holds the evaluations at
+// x = i+1.
+func newShamirSplitter(k, n int) SplitterFunc {
+	return func(data []byte) [][]byte {
+		// Random coefficients c_1 ... c_{k-1} for every byte, c_0 is the data
+		coeffs := make([][]byte, k-1)
+		for j := range coeffs {
+			coeffs[j] = randomPad(len(data))
+		}
+
+		out := make([][]byte, n)
+		for s := range out {
+			x := byte(s + 1)
+			y := make([]byte, len(data))
+			// Horner's scheme: y = ((c_{k-1} x + c_{k-2}) x + ... + c_1) x + c_0
+			for j := k - 2; j >= 0; j-- {
+				for i := range y {
+					y[i] = gfMul(y[i], x) ^ coeffs[j][i]
+				}
+			}
+			for i := range y {
+				y[i] = gfMul(y[i], x) ^ data[i]
+			}
+			out[s] = y
+		}
+		return out
+	}
+}
+
+// newShamirJoiner returns a JoinerFunc interpolating the data from the
+// shares at the given x coordinates, which must be distinct and non-zero.
+func newShamirJoiner(xs []byte) JoinerFunc {
+	// Lagrange basis polynomials evaluated at 0:
+	// l_j(0) = prod_{m != j} x_m / (x_m - x_j)
+	basis := make([]byte, len(xs))
+	for j := range xs {
+		l := byte(1)
+		for m := range xs {
+			if m != j {
+				l = gfMul(l, gfDiv(xs[m], xs[m]^xs[j]))
+			}
+		}
+		basis[j] = l
+	}
+
+	return func(parts [][]byte) []byte {
+		out := make([]byte, len(parts[0]))
+		for j, part := range parts {
+			gfMulAddSlice(out, basis[j], part)
+		}
+		return out
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// joinShamir interpolates the data from the given shares with a
+// MultiJoiner
+func joinShamir(t *testing.T, stored [][]byte, streams []int) []byte {
+	readers := make([]io.Reader, len(streams))
+	for i, stream := range streams {
+		readers[i] = bytes.NewReader(stored[stream])
+	}
+	xs := make([]byte, len(streams))
+	for i, stream := range streams {
+		xs[i] = byte(stream + 1)
+	}
+	mj, err := NewMultiJoiner(readers, 50, newShamirJoiner(xs))
+	if err != nil {
+		t.Fatalf("Failed to create MultiJoiner: %v", err)
+	}
+	got, err := io.ReadAll(mj)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return got
+}
+
+// subsets returns all subsets of {0, ..., n-1} with k elements in
+// ascending order
+func subsets(n, k int) [][]int {
+	if k == 0 {
+		return [][]int{{}}
+	}
+	var result [][]int
+	for last := k - 1; last < n; last++ {
+		for _, s := range subsets(last, k-1) {
+			result = append(result, append(s, last))
+		}
+	}
+	return result
+}
+
+func TestGF256(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if got := gfMul(byte(a), gfInv(byte(a))); got != 1 {
+			t.Fatalf("%d * 1/%d = %d, want 1", a, a, got)
+		}
+		for b := 1; b < 256; b += 7 {
+			if got := gfDiv(gfMul(byte(a), byte(b)), byte(b)); got != byte(a) {
+				t.Fatalf("%d * %d / %d = %d", a, b, b, got)
+			}
+		}
+	}
+	// 0x53 * 0xca = 0x01 in the AES field
+	if got := gfMul(0x53, 0xca); got != 0x01 {
+		t.Errorf("0x53 * 0xca = %#x, want 0x01", got)
+	}
+}
+
+func TestShamirRoundTrip(t *testing.T) {
+	secret := "TOP-SECRET customer record"
+	data := []byte(strings.Repeat(secret+"\n", 300))
+
+	for _, params := range [][2]int{{2, 2}, {2, 3}, {3, 5}, {4, 4}} {
+		k, n := params[0], params[1]
+		t.Run(fmt.Sprintf("k=%d, n=%d", k, n), func(t *testing.T) {
+			stored := splitScheme(t, shamirScheme{providers: n, k: k}, data, 100)
+			for i := range stored {
+				if len(stored[i]) != len(data) {
+					t.Errorf("share %d has %d bytes, want %d", i, len(stored[i]), len(data))
+				}
+				if bytes.Contains(stored[i], []byte(secret)) {
+					t.Errorf("share %d contains the plaintext", i)
+				}
+			}
+
+			// Any k shares reconstruct the data
+			for _, streams := range subsets(n, k) {
+				if got := joinShamir(t, stored, streams); !bytes.Equal(got, data) {
+					t.Errorf("shares %v: reconstructed data differs from the original", streams)
+				}
+			}
+
+			// k-1 shares do not
+			for _, streams := range subsets(n, k-1) {
+				if got := joinShamir(t, stored, streams); bytes.Equal(got, data) {
+					t.Errorf("shares %v: reconstructed the data below the threshold", streams)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/versity/versitygw/s3err"
+	"github.com/versity/versitygw/s3response"
+)
+
+// stubObject is an object stored by a stubS3
+type stubObject struct {
+	data     []byte
+	metadata map[string]string
+}
+
+// stubUpload is a multipart upload in progress on a stubS3
+type stubUpload struct {
+	bucket, key string
+	parts       map[int][]byte
+}
+
+// stubS3 is an in-memory S3 provider serving the requests the backend
+// sends to its clients. Objects are stored under "<bucket>/<key>".
+type stubS3 struct {
+	mu      sync.Mutex
+	objects map[string]*stubObject
+	uploads map[string]*stubUpload
+	buckets map[string]map[string]string // Tags of the existing buckets, every bucket exists if nil
+	fail    func(r *http.Request) bool   // Requests answered with an InternalError
+}
+
+// newStubBackend returns a backend on n stub providers, whose bucket
+// "bucket" is configured with settings
+func newStubBackend(t *testing.T, n int, settings *bucketSettings) (*MyBackend, []*stubS3) {
+	var stubs []*stubS3
+	var clients []*s3.Client
+	for range n {
+		stub := &stubS3{objects: map[string]*stubObject{}, uploads: map[string]*stubUpload{}}
+		server := httptest.NewServer(stub)
+		t.Cleanup(server.Close)
+		stubs = append(stubs, stub)
+		clients = append(clients, s3.New(s3.Options{
+			BaseEndpoint:               aws.String(server.URL),
+			UsePathStyle:               true,
+			Region:                     "us-east-1",
+			Credentials:                credentials.NewStaticCredentialsProvider("key", "secret", ""),
+			RequestChecksumCalculation: aws.RequestChecksumCalculationWhenRequired,
+			ResponseChecksumValidation: aws.ResponseChecksumValidationWhenRequired,
+			RetryMaxAttempts:           1, // Failures are injected
+		}))
+	}
+	backend := &MyBackend{clients: clients, scheme: settings.scheme, buckets: &sync.Map{}, macKey: testMACKey, namesKey: testMACKey}
+	backend.buckets.Store("bucket", settings)
+	return backend, stubs
+}
+
+// putTestObject uploads body as bucket/key through the backend
+func putTestObject(t *testing.T, backend *MyBackend, key, body string, metadata map[string]string) s3response.PutObjectOutput {
+	t.Helper()
+	output, err := backend.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:        aws.String("bucket"),
+		Key:           aws.String(key),
+		Body:          strings.NewReader(body),
+		ContentLength: aws.Int64(int64(len(body))),
+		Metadata:      metadata,
+	})
+	if err != nil {
+		t.Fatalf("Failed to put %s: %v", key, err)
+	}
+	return output
+}
+
+// getTestObject returns the content of bucket/key read through the backend
+func getTestObject(t *testing.T, backend *MyBackend, key string) string {
+	t.Helper()
+	output, err := backend.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		t.Fatalf("Failed to get %s: %v", key, err)
+	}
+	defer output.Body.Close()
+	data, err := io.ReadAll(output.Body)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", key, err)
+	}
+	return string(data)
+}
+
+// errorCode returns the S3 error code of err, "" if it is nil
+func errorCode(err error) string {
+	var apiErr s3err.APIError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &apiErr):
+		return apiErr.Code
+	default:
+		return err.Error()
+	}
+}
+
+// keys returns the sorted keys of the objects of the stub
+func (s *stubS3) keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// stubETag returns the ETag of data as S3 computes it for an upload
+func stubETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func stubError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// stubBody returns the body of a request, decoding the aws-chunked
+// encoding of streamed uploads
+func stubBody(r *http.Request) []byte {
+	data, _ := io.ReadAll(r.Body)
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING") &&
+		!strings.Contains(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		return data
+	}
+	var decoded []byte
+	chunks := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := chunks.ReadString('\n')
+		if err != nil {
+			return decoded
+		}
+		hexSize, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(hexSize, 16, 64)
+		if err != nil || size == 0 {
+			return decoded
+		}
+		chunk := make([]byte, size)
+		io.ReadFull(chunks, chunk)
+		decoded = append(decoded, chunk...)
+		chunks.ReadString('\n')
+	}
+}
+
+func (s *stubS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail != nil && s.fail(r) {
+		stubError(w, http.StatusInternalServerError, "InternalError")
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	switch {
+	case key == "":
+		s.serveBucket(w, r, bucket, query)
+	case query.Has("uploads") || query.Has("uploadId"):
+		s.serveUpload(w, r, bucket, key, query)
+	default:
+		s.serveObject(w, r, bucket+"/"+key)
+	}
+}
+
+func (s *stubS3) serveBucket(w http.ResponseWriter, r *http.Request, bucket string, query url.Values) {
+	tags, exists := s.buckets[bucket]
+	if s.buckets == nil {
+		exists = true
+	}
+	switch {
+	case bucket == "":
+		var names []string
+		for name := range s.buckets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprint(w, "<ListAllMyBucketsResult><Buckets>")
+		for _, name := range names {
+			fmt.Fprintf(w, "<Bucket><Name>%s</Name><CreationDate>2024-01-01T00:00:00.000Z</CreationDate></Bucket>", name)
+		}
+		fmt.Fprint(w, "</Buckets></ListAllMyBucketsResult>")
+	case r.Method == http.MethodPut && !exists && !query.Has("tagging"):
+		s.buckets[bucket] = map[string]string{}
+	case r.Method == http.MethodHead && !exists:
+		w.WriteHeader(http.StatusNotFound)
+	case !exists:
+		stubError(w, http.StatusNotFound, "NoSuchBucket")
+	case r.Method == http.MethodHead:
+	case s.buckets == nil && r.Method != http.MethodGet:
+		stubError(w, http.StatusNotImplemented, "NotImplemented")
+	case r.Method == http.MethodPut && query.Has("tagging"):
+		var tagging struct {
+			Tags []struct{ Key, Value string } `xml:"TagSet>Tag"`
+		}
+		xml.Unmarshal(stubBody(r), &tagging)
+		tags = map[string]string{}
+		for _, tag := range tagging.Tags {
+			tags[tag.Key] = tag.Value
+		}
+		s.buckets[bucket] = tags
+	case r.Method == http.MethodGet && query.Has("tagging"):
+		if len(tags) == 0 {
+			stubError(w, http.StatusNotFound, "NoSuchTagSet")
+			return
+		}
+		fmt.Fprint(w, "<Tagging><TagSet>")
+		for k, v := range tags {
+			fmt.Fprintf(w, "<Tag><Key>%s</Key><Value>%s</Value></Tag>", k, v)
+		}
+		fmt.Fprint(w, "</TagSet></Tagging>")
+	case r.Method == http.MethodDelete && query.Has("tagging"):
+		s.buckets[bucket] = map[string]string{}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		stubError(w, http.StatusConflict, "BucketAlreadyOwnedByYou")
+	case r.Method == http.MethodDelete:
+		for id := range s.objects {
+			if strings.HasPrefix(id, bucket+"/") {
+				stubError(w, http.StatusConflict, "BucketNotEmpty")
+				return
+			}
+		}
+		delete(s.buckets, bucket)
+		w.WriteHeader(http.StatusNoContent)
+	case query.Has("uploads"):
+		s.listUploads(w, bucket)
+	default:
+		s.listObjects(w, bucket, query)
+	}
+}
+
+func (s *stubS3) listObjects(w http.ResponseWriter, bucket string, query url.Values) {
+	prefix := query.Get("prefix")
+	var keys []string
+	for id := range s.objects {
+		b, key, _ := strings.Cut(id, "/")
+		if b == bucket && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	after := query.Get("start-after")
+	if token := query.Get("continuation-token"); token != "" {
+		after = token
+	}
+	for len(keys) > 0 && keys[0] <= after {
+		keys = keys[1:]
+	}
+	limit := 1000
+	if n, err := strconv.Atoi(query.Get("max-keys")); err == nil && n > 0 {
+		limit = n
+	}
+	truncated := len(keys) > limit
+	if truncated {
+		keys = keys[:limit]
+	}
+	fmt.Fprintf(w, "<ListBucketResult><Name>%s</Name><IsTruncated>%v</IsTruncated><KeyCount>%d</KeyCount>", bucket, truncated, len(keys))
+	if truncated {
+		fmt.Fprintf(w, "<NextContinuationToken>%s</NextContinuationToken>", url.QueryEscape(keys[len(keys)-1]))
+	}
+	for _, key := range keys {
+		object := s.objects[bucket+"/"+key]
+		var escaped bytes.Buffer
+		xml.EscapeText(&escaped, []byte(key))
+		fmt.Fprintf(w, "<Contents><Key>%s</Key><Size>%d</Size><ETag>%s</ETag><LastModified>2024-01-01T00:00:00.000Z</LastModified></Contents>",
+			escaped.String(), len(object.data), stubETag(object.data))
+	}
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+func (s *stubS3) listUploads(w http.ResponseWriter, bucket string) {
+	var ids []string
+	for id, upload := range s.uploads {
+		if upload.bucket == bucket {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	fmt.Fprintf(w, "<ListMultipartUploadsResult><Bucket>%s</Bucket><IsTruncated>false</IsTruncated>", bucket)
+	for _, id := range ids {
+		fmt.Fprintf(w, "<Upload><Key>%s</Key><UploadId>%s</UploadId><Initiated>2024-01-01T00:00:00.000Z</Initiated></Upload>", s.uploads[id].key, id)
+	}
+	fmt.Fprint(w, "</ListMultipartUploadsResult>")
+}
+
+func (s *stubS3) serveUpload(w http.ResponseWriter, r *http.Request, bucket, key string, query url.Values) {
+	if query.Has("uploads") {
+		id := fmt.Sprintf("upload%d", len(s.uploads)+1)
+		s.uploads[id] = &stubUpload{bucket: bucket, key: key, parts: map[int][]byte{}}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", bucket, key, id)
+		return
+	}
+	id := query.Get("uploadId")
+	upload, ok := s.uploads[id]
+	if !ok {
+		stubError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		data := stubBody(r)
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			source, _ = url.PathUnescape(strings.TrimPrefix(source, "/"))
+			object, ok := s.objects[source]
+			if !ok {
+				stubError(w, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			data = object.data
+			if byteRange := r.Header.Get("X-Amz-Copy-Source-Range"); byteRange != "" {
+				var first, last int
+				fmt.Sscanf(byteRange, "bytes=%d-%d", &first, &last)
+				data = data[first : last+1]
+			}
+			upload.parts[number] = bytes.Clone(data)
+			fmt.Fprintf(w, "<CopyPartResult><ETag>%s</ETag></CopyPartResult>", stubETag(data))
+			return
+		}
+		upload.parts[number] = data
+		w.Header().Set("ETag", stubETag(data))
+	case http.MethodPost:
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		xml.Unmarshal(stubBody(r), &complete)
+		var data []byte
+		for _, part := range complete.Parts {
+			partData, ok := upload.parts[part.PartNumber]
+			if !ok || stubETag(partData) != part.ETag {
+				stubError(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			data = append(data, partData...)
+		}
+		s.objects[bucket+"/"+key] = &stubObject{data: data}
+		delete(s.uploads, id)
+		fmt.Fprintf(w, "<CompleteMultipartUploadResult><Bucket>%s</Bucket><Key>%s</Key><ETag>%s</ETag></CompleteMultipartUploadResult>",
+			bucket, key, xmlETag(stubETag(data)))
+	case http.MethodGet:
+		numbers := make([]int, 0, len(upload.parts))
+		for number := range upload.parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		fmt.Fprintf(w, "<ListPartsResult><Bucket>%s</Bucket><Key>%s</Key><UploadId>%s</UploadId><IsTruncated>false</IsTruncated>",
+			bucket, key, id)
+		for _, number := range numbers {
+			data := upload.parts[number]
+			fmt.Fprintf(w, "<Part><PartNumber>%d</PartNumber><ETag>%s</ETag><Size>%d</Size></Part>",
+				number, xmlETag(stubETag(data)), len(data))
+		}
+		fmt.Fprint(w, "</ListPartsResult>")
+	case http.MethodDelete:
+		delete(s.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		stubError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *stubS3) serveObject(w http.ResponseWriter, r *http.Request, id string) {
+	object, exists := s.objects[id]
+	switch r.Method {
+	case http.MethodPut:
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			source, _ = url.PathUnescape(strings.TrimPrefix(source, "/"))
+			object, ok := s.objects[source]
+			if !ok {
+				stubError(w, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			s.objects[id] = &stubObject{data: bytes.Clone(object.data), metadata: object.metadata}
+			fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>", xmlETag(stubETag(object.data)))
+			return
+		}
+		data := stubBody(r)
+		if exists && r.Header.Get("If-None-Match") == "*" {
+			stubError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+			if !exists {
+				stubError(w, http.StatusNotFound, "NoSuchKey")
+				return
+			}
+			if ifMatch != stubETag(object.data) {
+				stubError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+				return
+			}
+		}
+		metadata := map[string]string{}
+		for name, values := range r.Header {
+			if meta, ok := strings.CutPrefix(strings.ToLower(name), "x-amz-meta-"); ok {
+				metadata[meta] = values[0]
+			}
+		}
+		s.objects[id] = &stubObject{data: data, metadata: metadata}
+		w.Header().Set("ETag", stubETag(data))
+	case http.MethodGet, http.MethodHead:
+		if !exists {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			stubError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		for name, value := range object.metadata {
+			w.Header().Set("X-Amz-Meta-"+name, value)
+		}
+		w.Header().Set("ETag", stubETag(object.data))
+		w.Header().Set("Last-Modified", "Mon, 01 Jan 2024 00:00:00 GMT")
+		data, status := object.data, http.StatusOK
+		if byteRange := r.Header.Get("Range"); byteRange != "" && r.Method == http.MethodGet {
+			var first, last int64
+			fmt.Sscanf(byteRange, "bytes=%d-%d", &first, &last)
+			size := int64(len(data))
+			if first >= size {
+				stubError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+				return
+			}
+			last = min(last, size-1)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, size))
+			data, status = data[first:last+1], http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			// Objects are read while others are written, e.g. by copies
+			s.mu.Unlock()
+			w.Write(data)
+			s.mu.Lock()
+		}
+	case http.MethodDelete:
+		delete(s.objects, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		stubError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// xmlETag escapes the quotes of an ETag for an XML document
+func xmlETag(etag string) string {
+	return strings.ReplaceAll(etag, `"`, "&quot;")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Limits of the providers and defaults for uploading large shares
+const (
+	maxSinglePutSize       = 5 << 30 // Largest object a provider accepts in one PUT
+	defaultUploadThreshold = 64 << 20
+	defaultUploadPartSize  = 16 << 20
+	uploadConcurrency      = 2 // Parts of a share uploaded at the same time
+)
+
+// uploadLimits decides how shares are uploaded to the providers. Shares up
+// to the threshold are streamed in a single PUT, larger ones are uploaded
+// in parts, which buffers up to uploadConcurrency+1 parts per share.
+type uploadLimits struct {
+	threshold int64 // 0 uploads only shares too large for a single PUT in parts
+	partSize  int64 // 0 for defaultUploadPartSize
+}
+
+// multipart reports whether a share of the given size is uploaded in parts
+func (l uploadLimits) multipart(size int64) bool {
+	return size > maxSinglePutSize || (l.threshold > 0 && size > l.threshold)
+}
+
+// partLength returns the size of the parts of a share of the given size,
+// large enough for the share to fit into the maximum number of parts
+func (l uploadLimits) partLength(size int64) int64 {
+	n := l.partSize
+	if n == 0 {
+		n = defaultUploadPartSize
+	}
+	n = max(n, minPartSize)
+	return max(n, (size+maxPartNumber-1)/maxPartNumber)
+}
+
+// putShare uploads the share object of the given input, whose body is read
+// once and whose ContentLength must be set, and returns its ETag. Large
+// shares are uploaded in parts so that neither the request timeout nor the
+// single PUT limit of the provider applies to the whole share.
+func (self *MyBackend) putShare(ctx context.Context, client *s3.Client, input *s3.PutObjectInput) (string, error) {
+	size := aws.ToInt64(input.ContentLength)
+	if !self.upload.multipart(size) {
+		output, err := client.PutObject(ctx, input, s3.WithAPIOptions(
+			v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware,
+		))
+		if err != nil {
+			return "", err
+		}
+		return aws.ToString(output.ETag), nil
+	}
+
+	// The uploader buffers the parts and aborts the upload on errors
+	uploader := manager.NewUploader(client, func(u *manager.Uploader) {
+		u.PartSize = self.upload.partLength(size)
+		u.Concurrency = uploadConcurrency
+		u.MaxUploadParts = maxPartNumber
+	})
+	output, err := uploader.Upload(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(output.ETag), nil
+}
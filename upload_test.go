@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestUploadLimits(t *testing.T) {
+	limits := uploadLimits{threshold: 64 << 20, partSize: 16 << 20}
+	tests := []struct {
+		limits    uploadLimits
+		size      int64
+		multipart bool
+		part      int64
+	}{
+		{limits: limits, size: 64 << 20, part: 16 << 20},
+		{limits: limits, size: 64<<20 + 1, multipart: true, part: 16 << 20},
+		{limits: limits, size: 1 << 40, multipart: true, part: (1<<40 + maxPartNumber - 1) / maxPartNumber},
+		{limits: uploadLimits{partSize: 1 << 20}, size: 1 << 30, part: minPartSize},
+		{limits: uploadLimits{}, size: maxSinglePutSize, part: defaultUploadPartSize},
+		{limits: uploadLimits{}, size: maxSinglePutSize + 1, multipart: true, part: defaultUploadPartSize},
+	}
+	for _, tt := range tests {
+		if got := tt.limits.multipart(tt.size); got != tt.multipart {
+			t.Errorf("%+v.multipart(%d) = %v, want %v", tt.limits, tt.size, got, tt.multipart)
+		}
+		part := tt.limits.partLength(tt.size)
+		if part != tt.part {
+			t.Errorf("%+v.partLength(%d) = %d, want %d", tt.limits, tt.size, part, tt.part)
+		}
+		if (tt.size+part-1)/part > maxPartNumber {
+			t.Errorf("%+v: %d bytes need more than %d parts of %d bytes", tt.limits, tt.size, maxPartNumber, part)
+		}
+	}
+}
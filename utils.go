@@ -2,8 +2,10 @@ package main
 
 import (
 	"encoding/base64"
+	"errors"
 	"io"
 	"math"
+	"strings"
 )
 
 func Base64Encode(input []byte) string {
@@ -65,3 +67,110 @@ func (u PrependReader) Read(p []byte) (int, error) {
 		return u.r.Read(p)
 	}
 }
+
+// ConcatReadCloser reads from its readers one after another, like
+// io.MultiReader, and closes all of them on Close.
+type ConcatReadCloser struct {
+	r  io.Reader
+	rs []io.ReadCloser
+}
+
+func NewConcatReadCloser(rs ...io.ReadCloser) *ConcatReadCloser {
+	readers := make([]io.Reader, len(rs))
+	for i, r := range rs {
+		readers[i] = r
+	}
+	return &ConcatReadCloser{r: io.MultiReader(readers...), rs: rs}
+}
+
+func (c *ConcatReadCloser) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *ConcatReadCloser) Close() error {
+	var errs []error
+	for _, r := range c.rs {
+		errs = append(errs, r.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// LazyConcatReadCloser reads from its first reader and then from the
+// readers returned by opens, each opened once the previous reader is
+// exhausted, so that only one of them is open at a time. Close closes the
+// current reader.
+type LazyConcatReadCloser struct {
+	current io.ReadCloser
+	opens   []func() (io.ReadCloser, error)
+	err     error
+}
+
+func NewLazyConcatReadCloser(first io.ReadCloser, opens ...func() (io.ReadCloser, error)) *LazyConcatReadCloser {
+	return &LazyConcatReadCloser{current: first, opens: opens}
+}
+
+func (c *LazyConcatReadCloser) Read(p []byte) (int, error) {
+	for c.err == nil {
+		n, err := c.current.Read(p)
+		if err != io.EOF {
+			if err != nil {
+				c.err = err
+			}
+			return n, err
+		}
+		if len(c.opens) == 0 {
+			c.err = io.EOF
+			return n, io.EOF
+		}
+
+		c.current.Close()
+		next, err := c.opens[0]()
+		c.opens = c.opens[1:]
+		if err != nil {
+			c.current = io.NopCloser(strings.NewReader(""))
+			c.err = err
+			return n, err
+		}
+		c.current = next
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return 0, c.err
+}
+
+func (c *LazyConcatReadCloser) Close() error {
+	return c.current.Close()
+}
+
+// LimitReadCloser reads at most n bytes from its reader, like
+// io.LimitReader, and closes the reader on Close. Once n bytes are read the
+// rest of the reader is drained, so that errors detected at its end, like a
+// failed integrity check, are not lost.
+type LimitReadCloser struct {
+	rc io.ReadCloser
+	n  int64 // Bytes left to serve
+}
+
+func NewLimitReadCloser(rc io.ReadCloser, n int64) *LimitReadCloser {
+	return &LimitReadCloser{rc: rc, n: n}
+}
+
+func (l *LimitReadCloser) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		if _, err := io.Copy(io.Discard, l.rc); err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.rc.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+func (l *LimitReadCloser) Close() error {
+	return l.rc.Close()
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"strings"
 	"testing"
@@ -157,3 +158,35 @@ func TestPrependReaderEdgeCases(t *testing.T) {
 		}
 	})
 }
+
+func TestLazyConcatReadCloser(t *testing.T) {
+	opened := 0
+	open := func(s string) func() (io.ReadCloser, error) {
+		return func() (io.ReadCloser, error) {
+			opened++
+			return io.NopCloser(strings.NewReader(s)), nil
+		}
+	}
+	r := NewLazyConcatReadCloser(io.NopCloser(strings.NewReader("first ")), open(""), open("second "), open("third"))
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(r, buf); err != nil || opened != 0 {
+		t.Errorf("read %q, %v with %d readers opened, want none", buf, err, opened)
+	}
+	rest, err := io.ReadAll(r)
+	if err != nil || string(rest) != "second third" || opened != 3 {
+		t.Errorf("got %q, %v with %d readers opened", rest, err, opened)
+	}
+
+	// Errors opening a reader end the stream
+	failing := errors.New("share missing")
+	r = NewLazyConcatReadCloser(io.NopCloser(strings.NewReader("first")), func() (io.ReadCloser, error) {
+		return nil, failing
+	})
+	if got, err := io.ReadAll(r); string(got) != "first" || !errors.Is(err, failing) {
+		t.Errorf("got %q, %v, want %v", got, err, failing)
+	}
+	if _, err := r.Read(buf); !errors.Is(err, failing) {
+		t.Errorf("error is not sticky: %v", err)
+	}
+	r.Close()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// Suffixes of the four shares a logical object is split into by the XOR
+// 2x2 scheme. The cypher is data XOR pad, both cypher and pad are
+// cut in two halves:
+//
+//	client1: .cypher.first  .rand.second
+//	client2: .cypher.second .rand.first
+//
+// so neither provider holds a cypher byte together with its pad byte.
+const (
+	suffixCypherFirst  = ".cypher.first"
+	suffixCypherSecond = ".cypher.second"
+	suffixRandFirst    = ".rand.first"
+	suffixRandSecond   = ".rand.second"
+)
+
+// Order of the outputs produced by newXorSplitter
+const (
+	xorCypherFirst = iota
+	xorCypherSecond
+	xorRandFirst
+	xorRandSecond
+	xorShareCount
+)
+
+// xor2x2Scheme stores the four shares above on the first two providers.
+// Both providers are needed to read an object.
+type xor2x2Scheme struct{}
+
+func (s xor2x2Scheme) name() string {
+	return schemeXor2x2
+}
+
+// shares returns the shares in the order of the outputs of newXorSplitter,
+// stream 0 is the cypher and stream 1 the pad
+func (s xor2x2Scheme) shares() []shareSpec {
+	return []shareSpec{
+		xorCypherFirst:  {suffixCypherFirst, 0, 0, 0},
+		xorCypherSecond: {suffixCypherSecond, 1, 0, 1},
+		xorRandFirst:    {suffixRandFirst, 1, 1, 0},
+		xorRandSecond:   {suffixRandSecond, 0, 1, 1},
+	}
+}
+
+func (s xor2x2Scheme) streams() int {
+	return 2
+}
+
+// segment returns the first half for part 0 and the second one for part 1
+func (s xor2x2Scheme) segment(part int, size int64) (offset, length int64) {
+	half := splitPoint(size)
+	if part == 0 {
+		return 0, half
+	}
+	return half, size - half
+}
+
+func (s xor2x2Scheme) width() int {
+	return 1
+}
+
+func (s xor2x2Scheme) splitter(size int64) SplitterFunc {
+	return newXorSplitter(size)
+}
+
+func (s xor2x2Scheme) threshold() int {
+	return 2
+}
+
+func (s xor2x2Scheme) joiner(streams []int) JoinerFunc {
+	return xorJoiner
+}
+
+// xorScheme implements n-of-n XOR sharing: share 0 is the cypher, data XOR
+// pad1 XOR ... XOR pad(n-1), and share i > 0 is pad i. Share i is stored
+// as <key>.share.<i> on provider i, so all n providers are needed to
+// reconstruct the data.
+type xorScheme struct {
+	providers int
+}
+
+func (s xorScheme) name() string {
+	return withProviders(schemeXor, s.providers)
+}
+
+func (s xorScheme) shares() []shareSpec {
+	return indexedShares(s.providers)
+}
+
+func (s xorScheme) streams() int {
+	return s.providers
+}
+
+// segment returns the whole object, every share is as long as the data
+func (s xorScheme) segment(part int, size int64) (offset, length int64) {
+	return 0, size
+}
+
+func (s xorScheme) width() int {
+	return 1
+}
+
+func (s xorScheme) splitter(size int64) SplitterFunc {
+	return newXorNSplitter(s.providers)
+}
+
+func (s xorScheme) threshold() int {
+	return s.providers
+}
+
+func (s xorScheme) joiner(streams []int) JoinerFunc {
+	return xorJoiner
+}
+
+// splitPoint returns the length of the first half of an object of the given
+// size. The first half is never shorter than the second one.
+func splitPoint(size int64) int64 {
+	return size - size/2
+}
+
+// randomPad returns n bytes from crypto/rand
+func randomPad(n int) []byte {
+	pad := make([]byte, n)
+	if _, err := rand.Read(pad); err != nil {
+		// Never hand out data with a predictable pad
+		panic(fmt.Sprintf("failed to read random pad: %v", err))
+	}
+	return pad
+}
+
+// newXorSplitter returns a SplitterFunc for an object of the given size.
+// For every chunk it draws a fresh pad from crypto/rand, computes
+// cypher = data XOR pad and routes the bytes to the first or second half
+// depending on their offset in the object. The outputs are ordered as
+// xorCypherFirst, xorCypherSecond, xorRandFirst, xorRandSecond.
+func newXorSplitter(size int64) SplitterFunc {
+	half := splitPoint(size)
+	var offset int64
+	return func(data []byte) [][]byte {
+		pad := randomPad(len(data))
+		cypher := make([]byte, len(data))
+		for i := range data {
+			cypher[i] = data[i] ^ pad[i]
+		}
+
+		// Number of bytes of this chunk that belong to the first half
+		n := int64(len(data))
+		if offset+n > half {
+			n = max(half-offset, 0)
+		}
+		offset += int64(len(data))
+
+		out := make([][]byte, xorShareCount)
+		out[xorCypherFirst] = cypher[:n]
+		out[xorCypherSecond] = cypher[n:]
+		out[xorRandFirst] = pad[:n]
+		out[xorRandSecond] = pad[n:]
+		return out
+	}
+}
+
+// newXorNSplitter returns a SplitterFunc for n-of-n sharing: output 0 is
+// the data XORed with n-1 fresh pads, outputs 1 to n-1 are the pads.
+func newXorNSplitter(n int) SplitterFunc {
+	return func(data []byte) [][]byte {
+		out := make([][]byte, n)
+		cypher := make([]byte, len(data))
+		copy(cypher, data)
+		for i := 1; i < n; i++ {
+			out[i] = randomPad(len(data))
+			for j := range cypher {
+				cypher[j] ^= out[i][j]
+			}
+		}
+		out[0] = cypher
+		return out
+	}
+}
+
+// xorJoiner is the JoinerFunc counterpart of the XOR splitters: it XORs
+// all parts together, i.e. the cypher with its pads.
+func xorJoiner(parts [][]byte) []byte {
+	out := make([]byte, len(parts[0]))
+	for _, part := range parts {
+		for i := range part {
+			out[i] ^= part[i]
+		}
+	}
+	return out
+}
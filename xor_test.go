@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// splitXor runs data through a MultiSplitter with the XOR splitter and
+// returns the four shares in xorCypherFirst ... xorRandSecond order.
+func splitXor(t *testing.T, data []byte, chunkSize int) [][]byte {
+	ms, readers, err := NewMultiSplitter(bytes.NewReader(data), chunkSize, xorShareCount,
+		newXorSplitter(int64(len(data))))
+	if err != nil {
+		t.Fatalf("Failed to create MultiSplitter: %v", err)
+	}
+	defer ms.Close()
+
+	shares := make([][]byte, xorShareCount)
+	var wg sync.WaitGroup
+	for i := range readers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var buf bytes.Buffer
+			if _, err := io.Copy(&buf, readers[i]); err != nil {
+				t.Errorf("Reader %d error: %v", i, err)
+			}
+			shares[i] = buf.Bytes()
+		}()
+	}
+	wg.Wait()
+	return shares
+}
+
+func TestXorSplitRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, 2, 3, 97, 1000} {
+		for _, chunkSize := range []int{1, 7, 64, 4096} {
+			t.Run(fmt.Sprintf("size=%d, chunkSize=%d", size, chunkSize), func(t *testing.T) {
+				data := []byte(randomString(size))
+				shares := splitXor(t, data, chunkSize)
+
+				half := int(splitPoint(int64(size)))
+				if len(shares[xorCypherFirst]) != half || len(shares[xorRandFirst]) != half {
+					t.Fatalf("first halves have lengths %d and %d, want %d",
+						len(shares[xorCypherFirst]), len(shares[xorRandFirst]), half)
+				}
+				if len(shares[xorCypherSecond]) != size-half || len(shares[xorRandSecond]) != size-half {
+					t.Fatalf("second halves have lengths %d and %d, want %d",
+						len(shares[xorCypherSecond]), len(shares[xorRandSecond]), size-half)
+				}
+
+				cypher := append(append([]byte{}, shares[xorCypherFirst]...), shares[xorCypherSecond]...)
+				pad := append(append([]byte{}, shares[xorRandFirst]...), shares[xorRandSecond]...)
+				for i := range cypher {
+					cypher[i] ^= pad[i]
+				}
+				if !bytes.Equal(cypher, data) {
+					t.Errorf("reconstructed %q, want %q", cypher, data)
+				}
+			})
+		}
+	}
+}
+
+func TestXorSplitHidesPlaintextFromProviders(t *testing.T) {
+	secret := "TOP-SECRET customer record"
+	data := []byte(strings.Repeat(secret+"\n", 500))
+	shares := splitXor(t, data, shareChunkSize)
+
+	half := splitPoint(int64(len(data)))
+	type stored struct {
+		share     []byte
+		plaintext []byte // plaintext at the same offsets as the share
+	}
+	providers := map[string][]stored{
+		"client1": {
+			{shares[xorCypherFirst], data[:half]},
+			{shares[xorRandSecond], data[half:]},
+		},
+		"client2": {
+			{shares[xorCypherSecond], data[half:]},
+			{shares[xorRandFirst], data[:half]},
+		},
+	}
+	for name, objs := range providers {
+		for _, obj := range objs {
+			if bytes.Contains(obj.share, []byte(secret)) {
+				t.Errorf("%s stores a share containing the plaintext", name)
+			}
+			// A share byte equals the plaintext byte at the same offset
+			// with probability 1/256, far below this bound
+			same := 0
+			for i := range obj.share {
+				if obj.share[i] == obj.plaintext[i] {
+					same++
+				}
+			}
+			if same > len(obj.share)/16 {
+				t.Errorf("%s stores a share matching %d of %d plaintext bytes",
+					name, same, len(obj.share))
+			}
+		}
+	}
+}
+
+func TestXorSchemeRoundTrip(t *testing.T) {
+	secret := "TOP-SECRET customer record"
+	data := []byte(strings.Repeat(secret+"\n", 300))
+	size := int64(len(data))
+
+	for providers := 2; providers <= 5; providers++ {
+		t.Run(fmt.Sprintf("providers=%d", providers), func(t *testing.T) {
+			scheme := xorScheme{providers: providers}
+			stored := splitScheme(t, scheme, data, 100)
+
+			// Every provider stores shares, none of them with plaintext
+			perProvider := make([]int, providers)
+			for i, share := range scheme.shares() {
+				perProvider[share.provider]++
+				if _, length := scheme.segment(share.part, size); int64(len(stored[i])) != length {
+					t.Errorf("share %d has %d bytes, want %d", i, len(stored[i]), length)
+				}
+				if bytes.Contains(stored[i], []byte(secret)) {
+					t.Errorf("share %d on provider %d contains the plaintext", i, share.provider)
+				}
+			}
+			for provider, n := range perProvider {
+				if n == 0 {
+					t.Errorf("provider %d stores no share", provider)
+				}
+			}
+
+			// All streams are needed, any missing one leaves noise
+			streams := availableStreams(scheme, func(int) bool { return true })
+			if got := joinScheme(t, scheme, stored, streams); !bytes.Equal(got, data) {
+				t.Errorf("reconstructed data differs from the original")
+			}
+			for missing := range streams {
+				partial := append(append([]int{}, streams[:missing]...), streams[missing+1:]...)
+				if got := joinScheme(t, scheme, stored, partial); bytes.Equal(got, data) {
+					t.Errorf("reconstructed the data without stream %d", missing)
+				}
+			}
+		})
+	}
+}